@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/processor"
+	"github.com/golang/glog"
+)
+
+// explainCommand prints why each image of a repository is kept or deleted.
+func explainCommand(args []string) {
+	repoName, tagOrDigest, asJSON := "", "", false
+
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	flags.StringVar(&repoName, "repo", repoName, "name of the repository whose images are explained; defaults to the only repository in -repos.")
+	flags.StringVar(&tagOrDigest, "image", tagOrDigest, "only explain the image with this tag or digest.")
+	flags.BoolVar(&asJSON, "json", asJSON, "print the decisions as JSON.")
+	flags.Parse(args)
+
+	if repoName == "" {
+		if len(task.EcrRepositories) != 1 {
+			glog.Fatalf("Must specify the repository to explain via -repo, exiting.")
+		}
+		repoName = *task.EcrRepositories[0]
+	}
+
+	ecrClient, kubeClient, err := processor.NewClients(task)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	store, err := processor.NewStateStore(task)
+	if err != nil {
+		glog.Fatalf("Cannot create state store: %v", err)
+	}
+
+	decisions, err := processor.ExplainImages(task, kubeClient, ecrClient, store, repoName)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	if tagOrDigest != "" {
+		matching := []*core.ImageDecision{}
+		for _, decision := range decisions {
+			if decision.Matches(tagOrDigest) {
+				matching = append(matching, decision)
+			}
+		}
+
+		if len(matching) == 0 {
+			glog.Fatalf("No image tagged '%s' or with that digest in repo '%s', exiting.", tagOrDigest, repoName)
+		}
+		decisions = matching
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(decisions); err != nil {
+			glog.Fatal(err)
+		}
+		return
+	}
+
+	for _, decision := range decisions {
+		decision.Print(os.Stdout)
+	}
+}
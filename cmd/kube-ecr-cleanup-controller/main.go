@@ -5,9 +5,11 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
 	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
 	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/processor"
 	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/utils"
@@ -20,26 +22,67 @@ var task *core.CleanupTask
 var VERSION = "UNKNOWN"
 
 func init() {
-	namespacesStr, reposStr, registryID, keepFiltersStr := "default", "", "", ""
+	namespacesStr, reposStr, registryID, keepFiltersStr := "", "", "", ""
+	kubeConfigsStr, kubeContextsStr, excludedNamespacesStr := "", "", ""
+	signatureKeysStr, signatureIdentitiesStr := "", ""
+	keepLabelsStr, retainUntilLabelsStr := "", ""
+	repoOrderingsStr, inUseSourcesStr := "", "pods"
 
 	task = core.NewCleanupTask()
 
-	flag.StringVar(&task.KubeConfig, "kubeconfig", task.KubeConfig, "path to a kubeconfig file.")
-	flag.StringVar(&namespacesStr, "namespaces", namespacesStr, "do not remove images used by pods in this comma-separated list of namespaces.")
+	flag.StringVar(&kubeConfigsStr, "kubeconfig", kubeConfigsStr, "comma-separated list of paths to kubeconfig files.")
+	flag.StringVar(&kubeContextsStr, "contexts", kubeContextsStr, "comma-separated list of kubeconfig contexts whose pods are inspected.")
+	flag.StringVar(&namespacesStr, "namespaces", namespacesStr, "do not remove images used by pods in this comma-separated list of namespaces; if empty, pods from all namespaces are considered.")
+	flag.StringVar(&excludedNamespacesStr, "exclude-namespaces", excludedNamespacesStr, "comma-separated list of namespaces whose pods are not considered.")
+	flag.StringVar(&task.KubeNamespaceSelector, "namespace-selector", task.KubeNamespaceSelector, "only consider pods from namespaces matching this label selector.")
+	flag.StringVar(&inUseSourcesStr, "in-use-sources", inUseSourcesStr, "comma-separated list of sources of images in use: pods, workloads, gitops=DIR, allowlist=FILE, endpoint=URL, ecs[=REGION[/ROLE_ARN]] or lambda[=REGION[/ROLE_ARN]].")
+	flag.BoolVar(&task.WatchPods, "watch-pods", task.WatchPods, "keep track of pods via watch events instead of listing them at every run.")
 	flag.IntVar(&task.Interval, "interval", task.Interval, "check interval, in minutes.")
 	flag.IntVar(&task.MaxImages, "max-images", task.MaxImages, "maximum number of images to keep in each repository.")
+	flag.StringVar(&task.Ordering, "ordering", task.Ordering, "order in which unused images beyond -max-images are removed: push-date, last-pull, size, semver or lexical.")
+	flag.StringVar(&repoOrderingsStr, "repo-orderings", repoOrderingsStr, "comma-separated list of 'repo=ordering' pairs that override -ordering for specific repositories.")
+	flag.IntVar(&task.MinPods, "min-pods", task.MinPods, "do not remove any images if less than this number of pods are found.")
+	flag.IntVar(&task.MinImagesPerSource, "min-images-per-source", task.MinImagesPerSource, "do not remove any images if less than this number of ECR images are found in use by any of the in-use sources other than pods.")
+	flag.IntVar(&task.MinImagesInUse, "min-images-in-use", task.MinImagesInUse, "do not remove any images if less than this number of ECR images are found in use.")
+	flag.Float64Var(&task.MaxDeleteRatio, "max-delete-ratio", task.MaxDeleteRatio, "do not remove any images from a repository if more than this fraction (0-1) of its images would be removed in a single run; 0 disables this check.")
 	flag.StringVar(&reposStr, "repos", reposStr, "comma-separated list of repository names to watch.")
 	flag.StringVar(&task.AwsRegion, "region", task.AwsRegion, "region to use when talking to AWS.")
+	flag.StringVar(&task.AwsEndpoint, "endpoint", task.AwsEndpoint, "custom ECR endpoint URL, e.g. a VPC endpoint or a local ECR emulator.")
+	flag.StringVar(&task.AwsCABundle, "ca-bundle", task.AwsCABundle, "path to a PEM-encoded CA bundle used to verify the certificates of the ECR endpoint and of layer downloads.")
+	flag.DurationVar(&task.GracePeriod, "grace-period", task.GracePeriod, "only remove images that were considered old and unused during this whole period, e.g. 72h; requires -state-file or -state-configmap.")
+	flag.DurationVar(&task.InUseLookback, "in-use-lookback", task.InUseLookback, "do not remove images seen in use during this period, e.g. 168h; requires -state-file or -state-configmap.")
+	flag.StringVar(&task.StateFile, "state-file", task.StateFile, "path to a local file used to persist state between runs.")
+	flag.StringVar(&task.StateConfigMap, "state-configmap", task.StateConfigMap, "ConfigMap used to persist state between runs, in the 'namespace/name' format.")
+	flag.StringVar(&task.StateContext, "state-context", task.StateContext, "kubeconfig context of the cluster where -state-configmap and plans waiting for approval live; defaults to the current context.")
+	flag.IntVar(&task.ApprovalThreshold, "approval-threshold", task.ApprovalThreshold, "wait for approval before removing more than this number of images from a repository in a single run; 0 disables approvals.")
+	flag.StringVar(&task.ApprovalNamespace, "approval-namespace", task.ApprovalNamespace, "namespace where plans waiting for approval are published as ConfigMaps.")
+	flag.BoolVar(&task.PruneTags, "prune-tags", task.PruneTags, "remove the tags that do not match any -keep-filters from old unused images kept by those filters.")
+	flag.DurationVar(&task.QuarantinePeriod, "quarantine-period", task.QuarantinePeriod, "instead of removing images right away, replace their tags with a quarantine tag and remove them after this period, e.g. 168h.")
+	flag.StringVar(&task.BackupLocation, "backup", task.BackupLocation, "back up the manifests of images before removing them to this local directory or 's3://bucket/prefix' URL.")
+	flag.StringVar(&task.BackupEndpoint, "backup-endpoint", task.BackupEndpoint, "custom S3 endpoint URL, e.g. of an S3-compatible object store.")
+	flag.StringVar(&task.BackupCABundle, "backup-ca-bundle", task.BackupCABundle, "path to a PEM-encoded CA bundle used to verify the S3 endpoint's certificate.")
+	flag.StringVar(&signatureKeysStr, "signature-keys", signatureKeysStr, "comma-separated list of paths to PEM-encoded public keys; images with a valid cosign signature from any of them are never removed.")
+	flag.StringVar(&signatureIdentitiesStr, "signature-identities", signatureIdentitiesStr, "comma-separated list of emails or URIs; images with a valid keyless cosign signature from any of them are never removed; requires -signature-roots.")
+	flag.StringVar(&task.SignatureRoots, "signature-roots", task.SignatureRoots, "path to a PEM file with the root certificates that issue the certificates of -signature-identities.")
+	flag.StringVar(&keepLabelsStr, "keep-labels", keepLabelsStr, "comma-separated list of image labels or manifest annotations, as 'key' or 'key=value'; images carrying any of them are never removed.")
+	flag.StringVar(&retainUntilLabelsStr, "retain-until-labels", retainUntilLabelsStr, "comma-separated list of image labels or manifest annotations holding a date, e.g. 2024-12-31, until which images are not removed.")
+	flag.StringVar(&task.VulnerableSeverity, "vulnerable-severity", task.VulnerableSeverity, "images with scan findings of this severity, or of a more severe one, are considered vulnerable: CRITICAL, HIGH, MEDIUM, LOW, INFORMATIONAL or UNDEFINED.")
+	flag.BoolVar(&task.RemoveVulnerableFirst, "remove-vulnerable-first", task.RemoveVulnerableFirst, "remove old unused vulnerable images before any others, instead of removing the oldest images first.")
+	flag.IntVar(&task.MaxVulnerableImages, "max-vulnerable-images", task.MaxVulnerableImages, "maximum number of unused vulnerable images to keep in each repository, regardless of -max-images; 0 disables this limit.")
+	flag.StringVar(&task.PolicyFile, "policy-file", task.PolicyFile, "path to a JSON file with per-repository expressions deciding whether images are kept or deleted, checked at startup.")
+	flag.StringVar(&task.VetoHook, "veto-hook", task.VetoHook, "URL of a webhook, or path to an executable, that is sent the images about to be removed from each repository and may veto their removal.")
+	flag.DurationVar(&task.VetoHookTimeout, "veto-hook-timeout", task.VetoHookTimeout, "time to wait for -veto-hook before failing, in which case no images are removed from the repository.")
+	flag.StringVar(&task.ReportFile, "report", task.ReportFile, "path to a file where a JSON report of what was deleted and kept is written after every run.")
 	flag.BoolVar(&task.DryRun, "dry-run", task.DryRun, "just log, don't delete any images.")
 	flag.StringVar(&registryID, "registry-id", registryID, "specify a registry account ID. If not specified, uses the account ID of the credentials passed.")
 	flag.StringVar(&keepFiltersStr, "keep-filters", keepFiltersStr, "comma-separated list of filters or regexes that when matched will preserve the matching images.")
 
 	flag.Parse()
 
-	if len(namespacesStr) == 0 {
-		log.Fatalf("Must specify at least one namespace, exiting.")
-	}
-	if len(reposStr) == 0 {
+	// The other commands are given their repository via -repo or in the plan
+	requiresRepos := flag.Arg(0) == "" || flag.Arg(0) == "plan"
+
+	if len(reposStr) == 0 && requiresRepos {
 		log.Fatalf("Must specify at least one ECR repository to watch, exiting.")
 	}
 
@@ -47,25 +90,88 @@ func init() {
 	repositories := utils.ParseCommaSeparatedList(reposStr)
 	keepFilters := utils.ParseCommaSeparatedList(keepFiltersStr)
 
-	if len(namespaces) == 0 {
-		glog.Fatalf("Must specify at least one namespace, exiting.")
-	}
-	if len(repositories) == 0 {
+	if len(repositories) == 0 && requiresRepos {
 		glog.Fatalf("Must specify at least one repository to watch, exiting.")
 	}
 
+	if (task.GracePeriod > 0 || task.InUseLookback > 0) && task.StateFile == "" && task.StateConfigMap == "" {
+		glog.Fatalf("Must specify either -state-file or -state-configmap when using a grace period or in-use lookback, exiting.")
+	}
+
+	task.KeepLabels = utils.ParseCommaSeparatedList(keepLabelsStr)
+	task.RetainUntilLabels = utils.ParseCommaSeparatedList(retainUntilLabelsStr)
+	task.SignatureKeys = utils.ParseCommaSeparatedList(signatureKeysStr)
+	task.SignatureIdentities = utils.ParseCommaSeparatedList(signatureIdentitiesStr)
+
+	if len(task.SignatureIdentities) > 0 && task.SignatureRoots == "" {
+		glog.Fatalf("Must specify -signature-roots when using -signature-identities, exiting.")
+	}
+
+	if !aws.ValidImageOrdering(task.Ordering) {
+		glog.Fatalf("Unknown image ordering '%s' in -ordering, exiting.", task.Ordering)
+	}
+
+	for _, pair := range utils.ParseCommaSeparatedList(repoOrderingsStr) {
+		parts := strings.SplitN(*pair, "=", 2)
+		if len(parts) != 2 || !aws.ValidImageOrdering(parts[1]) {
+			glog.Fatalf("Invalid pair '%s' in -repo-orderings, exiting.", *pair)
+		}
+		task.RepositoryOrderings[parts[0]] = parts[1]
+	}
+
+	if !aws.ValidScanSeverity(task.VulnerableSeverity) {
+		glog.Fatalf("Unknown severity '%s' in -vulnerable-severity, exiting.", task.VulnerableSeverity)
+	}
+
+	if task.VetoHookTimeout <= 0 {
+		glog.Fatalf("Must specify a positive -veto-hook-timeout, exiting.")
+	}
+
+	// Policies are compiled and type-checked before the first run
+	if _, err := processor.NewPolicies(task); err != nil {
+		glog.Fatalf("Invalid policy file '%s': %v, exiting.", task.PolicyFile, err)
+	}
+
 	if len(registryID) == 0 {
 		task.RegistryID = nil
 	} else {
 		task.RegistryID = &registryID
 	}
 
+	task.KubeConfigs = utils.ParseCommaSeparatedList(kubeConfigsStr)
+	task.KubeContexts = utils.ParseCommaSeparatedList(kubeContextsStr)
 	task.KubeNamespaces = namespaces
+	task.KubeExcludedNamespaces = utils.ParseCommaSeparatedList(excludedNamespacesStr)
+	task.InUseSources = utils.ParseCommaSeparatedList(inUseSourcesStr)
+
+	// Sources are validated before the first run, without a Kubernetes client
+	for _, spec := range task.InUseSourceSpecs() {
+		if _, err := processor.NewInUseSource(task, nil, spec); err != nil {
+			glog.Fatalf("Invalid in-use source: %v, exiting.", err)
+		}
+	}
 	task.EcrRepositories = repositories
 	task.KeepFilters = keepFilters
 }
 
 func main() {
+	switch flag.Arg(0) {
+	case "":
+		runController()
+	case "explain":
+		explainCommand(flag.Args()[1:])
+	case "plan":
+		planCommand(flag.Args()[1:])
+	case "apply":
+		applyCommand(flag.Args()[1:])
+	case "restore":
+		restoreCommand(flag.Args()[1:])
+	default:
+		glog.Fatalf("Unknown command '%s', exiting.", flag.Arg(0))
+	}
+}
+
+func runController() {
 	glog.Infof("Kubernetes ECR Image Cleanup Controller v%s started, will run every %d minute(s).", VERSION, task.Interval)
 
 	doneChan := make(chan struct{})
@@ -75,10 +181,26 @@ func main() {
 		glog.Infof("Will clean up '%s' repo in '%s' region.", *repo, task.AwsRegion)
 	}
 
+	for _, kubeContext := range task.KubeContexts {
+		glog.Infof("Will look for images in use in '%s' cluster context.", *kubeContext)
+	}
+
+	if len(task.KubeNamespaces) == 0 {
+		glog.Info("Images currently used by pods in all namespaces *will not* be removed.")
+	}
+
 	for _, namespace := range task.KubeNamespaces {
 		glog.Infof("Images currently used by pods in '%s' namespace *will not* be removed.", *namespace)
 	}
 
+	for _, namespace := range task.KubeExcludedNamespaces {
+		glog.Infof("Images currently used by pods in '%s' namespace *may* be removed.", *namespace)
+	}
+
+	if task.KubeNamespaceSelector != "" {
+		glog.Infof("Only pods in namespaces matching '%s' are considered.", task.KubeNamespaceSelector)
+	}
+
 	wg.Add(1)
 	processor.ImageCleanupLoop(task, doneChan, &wg)
 
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/processor"
+	"github.com/golang/glog"
+)
+
+// planCommand writes the images that would be removed to a plan file.
+func planCommand(args []string) {
+	out := "plan.json"
+
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	flags.StringVar(&out, "out", out, "path to the file where the plan is written.")
+	flags.Parse(args)
+
+	ecrClient, kubeClient, err := processor.NewClients(task)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	store, err := processor.NewStateStore(task)
+	if err != nil {
+		glog.Fatalf("Cannot create state store: %v", err)
+	}
+
+	plan, errors := processor.PlanRemoval(task, kubeClient, ecrClient, store)
+	for _, err := range errors {
+		glog.Error(err)
+	}
+	if plan == nil {
+		glog.Fatal("Cannot create plan, exiting.")
+	}
+
+	if err = plan.WriteFile(out); err != nil {
+		glog.Fatalf("Cannot write plan: %v", err)
+	}
+
+	for _, repo := range plan.Repositories {
+		fmt.Fprintf(os.Stdout, "Repo '%s': %d images to remove.\n", repo.Name, len(repo.Images))
+	}
+	fmt.Fprintf(os.Stdout, "Plan with %d images written to %s.\n", plan.ImagesCount(), out)
+
+	if len(errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+// applyCommand removes the images listed in a plan file.
+func applyCommand(args []string) {
+	planPath := "plan.json"
+
+	flags := flag.NewFlagSet("apply", flag.ExitOnError)
+	flags.StringVar(&planPath, "plan", planPath, "path to the plan file to apply.")
+	flags.Parse(args)
+
+	plan, err := core.ReadPlan(planPath)
+	if err != nil {
+		glog.Fatalf("Cannot read plan: %v", err)
+	}
+
+	ecrClient, kubeClient, err := processor.NewClients(task)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	store, err := processor.NewStateStore(task)
+	if err != nil {
+		glog.Fatalf("Cannot create state store: %v", err)
+	}
+
+	report, errors := processor.ApplyPlan(task, kubeClient, ecrClient, store, plan)
+	for _, err := range errors {
+		glog.Error(err)
+	}
+
+	if task.ReportFile != "" {
+		if err = report.WriteFile(task.ReportFile); err != nil {
+			glog.Errorf("Cannot write report: %v", err)
+		}
+	}
+
+	for _, repo := range report.Repositories {
+		fmt.Fprintf(os.Stdout, "Repo '%s': %d images removed, %d quarantined, %d failed.\n", repo.Name, len(repo.Deleted), len(repo.Quarantined), len(repo.Failed))
+	}
+
+	if len(errors) > 0 {
+		os.Exit(1)
+	}
+}
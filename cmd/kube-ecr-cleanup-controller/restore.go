@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/backup"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/processor"
+	"github.com/golang/glog"
+)
+
+// restoreCommand recreates removed images from their backups.
+func restoreCommand(args []string) {
+	repoName := ""
+
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.StringVar(&repoName, "repo", repoName, "name of the repository the images are restored to; defaults to the only repository in -repos.")
+	flags.Parse(args)
+
+	digests := flags.Args()
+	if len(digests) == 0 {
+		glog.Fatalf("Must specify the digests of the images to restore, exiting.")
+	}
+
+	if repoName == "" {
+		if len(task.EcrRepositories) != 1 {
+			glog.Fatalf("Must specify the repository to restore to via -repo, exiting.")
+		}
+		repoName = *task.EcrRepositories[0]
+	}
+
+	backups, err := processor.NewBackupStore(task)
+	if err != nil {
+		glog.Fatalf("Cannot create backup store: %v", err)
+	}
+	if backups == nil {
+		glog.Fatalf("Must specify where images were backed up to via -backup, exiting.")
+	}
+
+	ecrClient, err := aws.NewECRClient(task.AwsRegion, task.AwsEndpoint, task.AwsCABundle)
+	if err != nil {
+		glog.Fatalf("Cannot create ECR client: %v", err)
+	}
+
+	failed := false
+	for _, digest := range digests {
+		b, err := backup.Restore(ecrClient, backups, repoName, digest)
+		if err != nil {
+			glog.Error(err)
+			failed = true
+			continue
+		}
+
+		fmt.Fprintf(os.Stdout, "Restored image '%s' with tags %v.\n", b.Digest, b.Tags)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -1,10 +1,19 @@
 package aws
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
@@ -15,20 +24,58 @@ import (
 )
 
 const (
-	batchRemoveMaxImages = 100
+	// BatchRemoveMaxImages is the maximum number of images that can be
+	// removed in a single API call.
+	BatchRemoveMaxImages = 100
 )
 
+// Matches ECR image references, optionally pinned to a digest.
+var imageReferenceRegexp = regexp.MustCompile(`^[^/]+\.dkr\.ecr\.[^./]+\.amazonaws\.com(?:\.cn)?/([^:@]+)(?::([^@]+))?(?:@(.+))?$`)
+
+// Media types accepted when retrieving image manifests, so that they are
+// returned as they were pushed instead of being converted by ECR.
+var manifestMediaTypes = []*string{
+	aws.String("application/vnd.docker.distribution.manifest.v1+json"),
+	aws.String("application/vnd.docker.distribution.manifest.v1+prettyjws"),
+	aws.String("application/vnd.docker.distribution.manifest.v2+json"),
+	aws.String("application/vnd.docker.distribution.manifest.list.v2+json"),
+	aws.String("application/vnd.oci.image.manifest.v1+json"),
+	aws.String("application/vnd.oci.image.index.v1+json"),
+}
+
 // ECRClientImpl provides an interface for mocking.
 type ECRClientImpl struct {
 	ECRClient ecriface.ECRAPI
+
+	// Client used to download layers, which trusts the same CA bundle as the
+	// ECR client. If nil, the default client is used.
+	HTTPClient *http.Client
+
+	// Metadata of the images retrieved so far that were still listed the
+	// last time their repository was listed, by repository name and digest.
+	metadata     map[string]map[string]*ImageMetadata
+	metadataLock sync.Mutex
+
+	// Scan findings retrieved so far of the images that were still listed
+	// the last time their repository was listed, by repository name and
+	// digest.
+	scanFindings     map[string]map[string]*cachedScanFindings
+	scanFindingsLock sync.Mutex
 }
 
 // ECRClient defines the expected interface of any object capable of
-// listing and removing images from a ECR repository.
+// listing, retrieving, pushing and removing images from a ECR repository.
 type ECRClient interface {
 	ListRepositories(repositoryNames []*string, registryID *string) ([]*ecr.Repository, error)
 	ListImages(repositoryName *string, registryID *string) ([]*ecr.ImageDetail, error)
+	GetImages(images []*ecr.ImageDetail) ([]*ecr.Image, error)
+	PutImage(image *ecr.Image) error
+	GetLayer(repositoryName *string, registryID *string, digest string) ([]byte, error)
+	GetImageMetadata(images []*ecr.ImageDetail) (map[string]*ImageMetadata, error)
+	GetScanFindings(image *ecr.ImageDetail) (map[string]int64, error)
+	LastPullTime(image *ecr.ImageDetail) (time.Time, bool)
 	BatchRemoveImages(images []*ecr.ImageDetail) error
+	BatchRemoveTags(repositoryName *string, registryID *string, tags []*string) error
 }
 
 // ImagesByPushDate lets us sort ECR images by push date so that we can
@@ -52,13 +99,19 @@ func (slice ImagesByPushDate) Swap(i, j int) {
 // NewECRClient returns a new client for interacting with the ECR API. The
 // credentials are retrieved from environment variables or from the
 // `~/.aws/credentials` file.
-func NewECRClient(region string) *ECRClientImpl {
+//
+// If endpoint is not empty, it replaces the default regional ECR endpoint,
+// which is useful for talking to VPC or FIPS endpoints, or to local ECR
+// emulators such as LocalStack. If caBundle is not empty, the PEM-encoded
+// certificates in that file are used to verify the endpoint's certificate,
+// as well as the certificates of the URLs layers are downloaded from.
+func NewECRClient(region, endpoint, caBundle string) (*ECRClientImpl, error) {
 	awsConfig := aws.NewConfig()
-	awsConfig.WithRegion(region)
 
-	sess := session.Must(
-		session.NewSession(awsConfig),
-	)
+	sess, err := newSession(awsConfig, region, endpoint, caBundle)
+	if err != nil {
+		return nil, err
+	}
 
 	creds := credentials.NewChainCredentials(
 		[]credentials.Provider{
@@ -73,8 +126,39 @@ func NewECRClient(region string) *ECRClientImpl {
 	awsConfig.WithCredentials(creds)
 
 	return &ECRClientImpl{
-		ECRClient: ecr.New(sess),
+		ECRClient:  ecr.New(sess),
+		HTTPClient: sess.Config.HTTPClient,
+	}, nil
+}
+
+// newSession returns a session for the given region, using the given custom
+// endpoint and CA bundle, if not empty.
+func newSession(awsConfig *aws.Config, region, endpoint, caBundle string) (*session.Session, error) {
+	awsConfig.WithRegion(region)
+
+	if endpoint != "" {
+		awsConfig.WithEndpoint(endpoint)
 	}
+
+	opts := session.Options{}
+
+	if caBundle != "" {
+		f, err := os.Open(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot open CA bundle: %v", err)
+		}
+		defer f.Close()
+
+		opts.CustomCABundle = f
+
+		// The SDK loads the CA bundle into the session's HTTP client, which
+		// would otherwise be http.DefaultClient, shared by all sessions
+		awsConfig.WithHTTPClient(&http.Client{})
+	}
+
+	opts.Config = *awsConfig
+
+	return session.NewSessionWithOptions(opts)
 }
 
 // ListRepositories returns the data belonging to the given repository names.
@@ -145,11 +229,157 @@ func (c *ECRClientImpl) ListImages(repositoryName *string, registryID *string) (
 		return nil, err
 	}
 
+	c.pruneMetadata(*repositoryName, images)
+	c.pruneScanFindings(*repositoryName, images)
+
 	return images, nil
 }
 
+// GetImages returns the manifests of all the given images in one go. All
+// images must be stored in the same repository for this to work.
+func (c *ECRClientImpl) GetImages(images []*ecr.ImageDetail) ([]*ecr.Image, error) {
+
+	// No images to be retrieved
+	if len(images) == 0 {
+		return []*ecr.Image{}, nil
+	}
+
+	// Too many images to retrieve
+	if len(images) > BatchRemoveMaxImages {
+		return nil, fmt.Errorf("Only allows to retrieve %d images in a single call", BatchRemoveMaxImages)
+	}
+
+	repositoryName := images[0].RepositoryName
+	for i := range images {
+		if *images[i].RepositoryName != *repositoryName {
+			return nil, fmt.Errorf("All images must belong to the same ECR repo")
+		}
+	}
+
+	imageIds := make([]*ecr.ImageIdentifier, len(images))
+
+	for i := range images {
+		imageIds[i] = &ecr.ImageIdentifier{
+			ImageDigest: images[i].ImageDigest,
+		}
+	}
+
+	input := &ecr.BatchGetImageInput{
+		RegistryId:         images[0].RegistryId,
+		RepositoryName:     repositoryName,
+		ImageIds:           imageIds,
+		AcceptedMediaTypes: manifestMediaTypes,
+	}
+
+	output, err := c.ECRClient.BatchGetImage(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(output.Failures) > 0 {
+		failure := output.Failures[0]
+
+		digest := ""
+		if failure.ImageId != nil {
+			digest = aws.StringValue(failure.ImageId.ImageDigest)
+		}
+
+		return nil, fmt.Errorf("Cannot retrieve image '%s': %s", digest, aws.StringValue(failure.FailureReason))
+	}
+
+	return output.Images, nil
+}
+
+// PutImage pushes the manifest of the given image, tagging it with the
+// image's tag, if any. Pushing a manifest that already exists with the same
+// tag is not an error.
+func (c *ECRClientImpl) PutImage(image *ecr.Image) error {
+	input := &ecr.PutImageInput{
+		RegistryId:             image.RegistryId,
+		RepositoryName:         image.RepositoryName,
+		ImageManifest:          image.ImageManifest,
+		ImageManifestMediaType: image.ImageManifestMediaType,
+	}
+
+	if image.ImageId != nil {
+		input.ImageDigest = image.ImageId.ImageDigest
+		input.ImageTag = image.ImageId.ImageTag
+	}
+
+	_, err := c.ECRClient.PutImage(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeImageAlreadyExistsException {
+		return nil
+	}
+
+	return err
+}
+
+// GetLayer downloads the layer or config blob with the given digest from the
+// given repository, and makes sure its contents match the digest.
+func (c *ECRClientImpl) GetLayer(repositoryName *string, registryID *string, digest string) ([]byte, error) {
+	output, err := c.ECRClient.GetDownloadUrlForLayer(&ecr.GetDownloadUrlForLayerInput{
+		RegistryId:     registryID,
+		RepositoryName: repositoryName,
+		LayerDigest:    &digest,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Get(aws.StringValue(output.DownloadUrl))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Cannot download layer '%s': %s", digest, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if actual := fmt.Sprintf("sha256:%x", sha256.Sum256(data)); actual != digest {
+		return nil, fmt.Errorf("Layer '%s' does not match its digest, got '%s'", digest, actual)
+	}
+
+	return data, nil
+}
+
+// BatchRemoveError is returned when ECR refuses to remove some of the images
+// of a batch, such as images referenced by an image index. The other images
+// of the batch were removed.
+type BatchRemoveError struct {
+
+	// Reason each image was not removed, by digest.
+	Failures map[string]string
+}
+
+func (e *BatchRemoveError) Error() string {
+	digests := []string{}
+	for digest := range e.Failures {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+
+	failures := []string{}
+	for _, digest := range digests {
+		failures = append(failures, fmt.Sprintf("'%s' (%s)", digest, e.Failures[digest]))
+	}
+
+	return fmt.Sprintf("Cannot remove images %s", strings.Join(failures, ", "))
+}
+
 // BatchRemoveImages deletes all the given images in one go. All images must
-// be stored in the same repository for this to work.
+// be stored in the same repository for this to work. If ECR refuses to remove
+// some of the images, a *BatchRemoveError lists them.
 func (c *ECRClientImpl) BatchRemoveImages(images []*ecr.ImageDetail) error {
 
 	// No images to be removed
@@ -158,8 +388,8 @@ func (c *ECRClientImpl) BatchRemoveImages(images []*ecr.ImageDetail) error {
 	}
 
 	// Too many images to delete
-	if len(images) > batchRemoveMaxImages {
-		return fmt.Errorf("Only allows to remove %d images in a single call", batchRemoveMaxImages)
+	if len(images) > BatchRemoveMaxImages {
+		return fmt.Errorf("Only allows to remove %d images in a single call", BatchRemoveMaxImages)
 	}
 
 	repositoryName := images[0].RepositoryName
@@ -182,11 +412,72 @@ func (c *ECRClientImpl) BatchRemoveImages(images []*ecr.ImageDetail) error {
 		ImageIds:       imageIds,
 	}
 
-	_, err := c.ECRClient.BatchDeleteImage(input)
+	output, err := c.ECRClient.BatchDeleteImage(input)
+	if err != nil {
+		return err
+	}
+
+	if output != nil && len(output.Failures) > 0 {
+		failures := map[string]string{}
+		for _, failure := range output.Failures {
+			digest := ""
+			if failure.ImageId != nil {
+				digest = aws.StringValue(failure.ImageId.ImageDigest)
+			}
+			failures[digest] = fmt.Sprintf("%s: %s", aws.StringValue(failure.FailureCode), aws.StringValue(failure.FailureReason))
+		}
+
+		return &BatchRemoveError{Failures: failures}
+	}
+
+	return nil
+}
+
+// BatchRemoveTags removes all the given tags from the repository identified
+// by the given repository name in one go. Images left without any tags are
+// deleted by ECR.
+func (c *ECRClientImpl) BatchRemoveTags(repositoryName *string, registryID *string, tags []*string) error {
+
+	// No tags to be removed
+	if len(tags) == 0 {
+		return nil
+	}
+
+	// Too many tags to remove
+	if len(tags) > BatchRemoveMaxImages {
+		return fmt.Errorf("Only allows to remove %d tags in a single call", BatchRemoveMaxImages)
+	}
+
+	imageIds := make([]*ecr.ImageIdentifier, len(tags))
+
+	for i := range tags {
+		imageIds[i] = &ecr.ImageIdentifier{
+			ImageTag: tags[i],
+		}
+	}
+
+	input := &ecr.BatchDeleteImageInput{
+		RegistryId:     registryID,
+		RepositoryName: repositoryName,
+		ImageIds:       imageIds,
+	}
+
+	output, err := c.ECRClient.BatchDeleteImage(input)
 	if err != nil {
 		return err
 	}
 
+	if output != nil && len(output.Failures) > 0 {
+		failure := output.Failures[0]
+
+		tag := ""
+		if failure.ImageId != nil {
+			tag = aws.StringValue(failure.ImageId.ImageTag)
+		}
+
+		return fmt.Errorf("Cannot remove tag '%s': %s", tag, aws.StringValue(failure.FailureReason))
+	}
+
 	return nil
 }
 
@@ -204,6 +495,14 @@ func SortImagesByPushDate(images []*ecr.ImageDetail) {
 // This list will contain at most 100 images, which is the maximum number of
 // images we are allowed to delete in a single API call to AWS.
 func FilterOldUnusedImages(keepMax int, repoImages []*ecr.ImageDetail, tagsInUse []string) []*ecr.ImageDetail {
+	return FilterOldUnusedImagesBy(keepMax, repoImages, tagsInUse, SortImagesByPushDate)
+}
+
+// FilterOldUnusedImagesBy works like FilterOldUnusedImages, except the unused
+// images are ordered with the given sort function, so that the first ones are
+// the first to go. Images whose digests are among the given tags in use are
+// also considered in use.
+func FilterOldUnusedImagesBy(keepMax int, repoImages []*ecr.ImageDetail, tagsInUse []string, sortImages func([]*ecr.ImageDetail)) []*ecr.ImageDetail {
 	usedImagesFound := 0
 	unusedImages := []*ecr.ImageDetail{}
 
@@ -214,6 +513,13 @@ func FilterOldUnusedImages(keepMax int, repoImages []*ecr.ImageDetail, tagsInUse
 
 repoImagesLoop:
 	for _, repoImage := range repoImages {
+		for _, tagInUse := range tagsInUse {
+			if tagInUse == aws.StringValue(repoImage.ImageDigest) {
+				usedImagesFound++
+				continue repoImagesLoop
+			}
+		}
+
 		for _, tag := range repoImage.ImageTags {
 			if *tag == "latest" {
 				continue repoImagesLoop
@@ -230,7 +536,7 @@ repoImagesLoop:
 		unusedImages = append(unusedImages, repoImage)
 	}
 
-	SortImagesByPushDate(unusedImages)
+	sortImages(unusedImages)
 
 	lastImageIdx := len(unusedImages) - keepMax + usedImagesFound
 	if lastImageIdx > len(unusedImages) {
@@ -239,9 +545,22 @@ repoImagesLoop:
 
 	// Only returns the 100 oldest unused images, which is the number of
 	// images we are allowed to delete in a single API call
-	if lastImageIdx > batchRemoveMaxImages {
-		lastImageIdx = batchRemoveMaxImages
+	if lastImageIdx > BatchRemoveMaxImages {
+		lastImageIdx = BatchRemoveMaxImages
 	}
 
 	return unusedImages[:lastImageIdx]
 }
+
+// ParseImageReference returns the repository name, tag and digest of the
+// given ECR image reference, and whether it is an ECR image reference at all.
+// The tag is empty if the image is only referenced by digest, and the digest
+// is empty if the image is not pinned to one.
+func ParseImageReference(image string) (string, string, string, bool) {
+	match := imageReferenceRegexp.FindStringSubmatch(image)
+	if match == nil {
+		return "", "", "", false
+	}
+
+	return match[1], match[2], match[3], true
+}
@@ -1,10 +1,19 @@
 package aws
 
 import (
+	"crypto/sha256"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
 )
@@ -18,8 +27,16 @@ type mockAWSECRClient struct {
 
 	expectedRepositoryNames []string
 	expectedImageDigests    []string
+	expectedImageTags       []string
 	expectedRegistryID      *string
 
+	batchGetImageOutput    *ecr.BatchGetImageOutput
+	batchDeleteImageOutput *ecr.BatchDeleteImageOutput
+	expectedLayerDigest    string
+	downloadURL            string
+	scanFindings           *ecr.ImageScanFindings
+	scanFindingsCalls      int
+
 	outputError error
 }
 
@@ -108,8 +125,41 @@ func (m *mockAWSECRClient) BatchDeleteImage(input *ecr.BatchDeleteImageInput) (*
 		m.t.Errorf("Expected repository name to be %s, but was %s", m.expectedRepositoryNames[0], *input.RepositoryName)
 	}
 
+	if len(input.ImageIds) != len(m.expectedImageDigests)+len(m.expectedImageTags) {
+		m.t.Errorf("Expected delete with %d images, but got %d", len(m.expectedImageDigests)+len(m.expectedImageTags), len(input.ImageIds))
+	}
+
+	for i := range input.ImageIds {
+		if input.ImageIds[i].ImageTag != nil {
+			if *input.ImageIds[i].ImageTag != m.expectedImageTags[i] {
+				m.t.Errorf("Expected image tag of image in idx %d to be %v, but was %v", i, m.expectedImageTags, *input.ImageIds[i].ImageTag)
+			}
+			continue
+		}
+
+		if *input.ImageIds[i].ImageDigest != m.expectedImageDigests[i] {
+			m.t.Errorf("Expected image digest of image in idx %d to be %v, but was %v", i, m.expectedImageDigests, *input.ImageIds[i].ImageDigest)
+		}
+	}
+
+	return m.batchDeleteImageOutput, m.outputError
+}
+
+func (m *mockAWSECRClient) BatchGetImage(input *ecr.BatchGetImageInput) (*ecr.BatchGetImageOutput, error) {
+	if input == nil {
+		m.t.Errorf("Unexpected nil input")
+	}
+
+	if *input.RepositoryName != m.expectedRepositoryNames[0] {
+		m.t.Errorf("Expected repository name to be %s, but was %s", m.expectedRepositoryNames[0], *input.RepositoryName)
+	}
+
+	if len(input.AcceptedMediaTypes) == 0 {
+		m.t.Errorf("Expected accepted media types not to be empty")
+	}
+
 	if len(input.ImageIds) != len(m.expectedImageDigests) {
-		m.t.Errorf("Expected delete with %d images, but got %d", len(m.expectedImageDigests), len(input.ImageIds))
+		m.t.Errorf("Expected get with %d images, but got %d", len(m.expectedImageDigests), len(input.ImageIds))
 	}
 
 	for i := range input.ImageIds {
@@ -118,6 +168,61 @@ func (m *mockAWSECRClient) BatchDeleteImage(input *ecr.BatchDeleteImageInput) (*
 		}
 	}
 
+	return m.batchGetImageOutput, m.outputError
+}
+
+func (m *mockAWSECRClient) GetDownloadUrlForLayer(input *ecr.GetDownloadUrlForLayerInput) (*ecr.GetDownloadUrlForLayerOutput, error) {
+	if input == nil {
+		m.t.Errorf("Unexpected nil input")
+	}
+
+	if *input.RepositoryName != m.expectedRepositoryNames[0] {
+		m.t.Errorf("Expected repository name to be %s, but was %s", m.expectedRepositoryNames[0], *input.RepositoryName)
+	}
+
+	if *input.LayerDigest != m.expectedLayerDigest {
+		m.t.Errorf("Expected layer digest to be %s, but was %s", m.expectedLayerDigest, *input.LayerDigest)
+	}
+
+	return &ecr.GetDownloadUrlForLayerOutput{
+		DownloadUrl: &m.downloadURL,
+		LayerDigest: input.LayerDigest,
+	}, m.outputError
+}
+
+func (m *mockAWSECRClient) DescribeImageScanFindings(input *ecr.DescribeImageScanFindingsInput) (*ecr.DescribeImageScanFindingsOutput, error) {
+	m.scanFindingsCalls++
+
+	if input == nil {
+		m.t.Errorf("Unexpected nil input")
+	}
+
+	if *input.RepositoryName != m.expectedRepositoryNames[0] {
+		m.t.Errorf("Expected repository name to be %s, but was %s", m.expectedRepositoryNames[0], *input.RepositoryName)
+	}
+
+	if *input.ImageId.ImageDigest != m.expectedImageDigests[0] {
+		m.t.Errorf("Expected image digest to be %s, but was %s", m.expectedImageDigests[0], *input.ImageId.ImageDigest)
+	}
+
+	return &ecr.DescribeImageScanFindingsOutput{
+		ImageScanFindings: m.scanFindings,
+	}, m.outputError
+}
+
+func (m *mockAWSECRClient) PutImage(input *ecr.PutImageInput) (*ecr.PutImageOutput, error) {
+	if input == nil {
+		m.t.Errorf("Unexpected nil input")
+	}
+
+	if *input.RepositoryName != m.expectedRepositoryNames[0] {
+		m.t.Errorf("Expected repository name to be %s, but was %s", m.expectedRepositoryNames[0], *input.RepositoryName)
+	}
+
+	if *input.ImageDigest != m.expectedImageDigests[0] {
+		m.t.Errorf("Expected image digest to be %s, but was %s", m.expectedImageDigests[0], *input.ImageDigest)
+	}
+
 	return nil, m.outputError
 }
 
@@ -156,6 +261,79 @@ func TestSortImagesByPushDate(t *testing.T) {
 	}
 }
 
+func TestNewECRClient(t *testing.T) {
+	client, err := NewECRClient("us-west-2", "", "")
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+
+	endpoint := client.ECRClient.(*ecr.ECR).Endpoint
+	if endpoint != "https://api.ecr.us-west-2.amazonaws.com" {
+		t.Errorf("Expected endpoint to be the default regional endpoint, but was %s", endpoint)
+	}
+}
+
+func TestNewECRClientWithEndpoint(t *testing.T) {
+	client, err := NewECRClient("us-east-1", "http://localhost:4566", "")
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+
+	endpoint := client.ECRClient.(*ecr.ECR).Endpoint
+	if endpoint != "http://localhost:4566" {
+		t.Errorf("Expected endpoint to be http://localhost:4566, but was %s", endpoint)
+	}
+}
+
+func TestNewECRClientWithMissingCABundle(t *testing.T) {
+	client, err := NewECRClient("us-east-1", "", "/does/not/exist.pem")
+
+	if client != nil {
+		t.Errorf("Expected client to be nil, but was %v", client)
+	}
+
+	if err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestNewECRClientWithCABundle(t *testing.T) {
+	repoName, layer := "repo-1", []byte(`{"critical": {}}`)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(layer)
+	}))
+	defer server.Close()
+
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caBundle, cert, 0644); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	client, err := NewECRClient("us-east-1", server.URL, caBundle)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	client.ECRClient = &mockAWSECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		expectedLayerDigest:     digest,
+
+		downloadURL: server.URL,
+	}
+
+	// Layers are downloaded trusting the CA bundle
+	if _, err = client.GetLayer(&repoName, nil, digest); err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+}
+
 func TestListRepositoriesWithEmptyRepos(t *testing.T) {
 	client := ECRClientImpl{
 		ECRClient: nil, // Should not interact with the ECR client
@@ -343,6 +521,193 @@ func TestListImagesWithRegistryId(t *testing.T) {
 	}
 }
 
+func TestGetImagesWithEmptyImages(t *testing.T) {
+	client := ECRClientImpl{
+		ECRClient: nil, // Should not interact with the ECR client
+	}
+
+	images, err := client.GetImages([]*ecr.ImageDetail{})
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+
+	if len(images) != 0 {
+		t.Errorf("Expected images to be empty, but was %q", images)
+	}
+}
+
+func TestGetImagesWithTooManyImages(t *testing.T) {
+	client := ECRClientImpl{
+		ECRClient: nil, // Should not interact with the ECR client
+	}
+
+	_, err := client.GetImages(make([]*ecr.ImageDetail, 101))
+
+	if err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestGetImages(t *testing.T) {
+	repoName, digest, manifest, reason := "repo-1", "digest-1", "{}", "ImageNotFound"
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest:    &digest,
+			RepositoryName: &repoName,
+		},
+	}
+
+	testCases := []struct {
+		output        *ecr.BatchGetImageOutput
+		outputError   error
+		expectedError bool
+	}{
+		{
+			output: &ecr.BatchGetImageOutput{
+				Images: []*ecr.Image{
+					{
+						ImageId:       &ecr.ImageIdentifier{ImageDigest: &digest},
+						ImageManifest: &manifest,
+					},
+				},
+			},
+		},
+		{
+			output: &ecr.BatchGetImageOutput{
+				Failures: []*ecr.ImageFailure{
+					{
+						ImageId:       &ecr.ImageIdentifier{ImageDigest: &digest},
+						FailureReason: &reason,
+					},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			outputError:   fmt.Errorf(""),
+			expectedError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		client := ECRClientImpl{
+			ECRClient: &mockAWSECRClient{
+				t: t,
+
+				expectedRepositoryNames: []string{repoName},
+				expectedImageDigests:    []string{digest},
+
+				batchGetImageOutput: testCase.output,
+				outputError:         testCase.outputError,
+			},
+		}
+
+		result, err := client.GetImages(images)
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned: %v, but was %v", testCase.expectedError, err)
+		}
+
+		if err == nil && (len(result) != 1 || *result[0].ImageManifest != manifest) {
+			t.Errorf("Expected images to contain the manifest, but was %q", result)
+		}
+	}
+}
+
+func TestPutImage(t *testing.T) {
+	repoName, digest, tag, manifest := "repo-1", "digest-1", "tag-1", "{}"
+
+	testCases := []struct {
+		outputError   error
+		expectedError bool
+	}{
+		{nil, false},
+		{awserr.New(ecr.ErrCodeImageAlreadyExistsException, "", nil), false},
+		{fmt.Errorf(""), true},
+	}
+
+	for _, testCase := range testCases {
+		client := ECRClientImpl{
+			ECRClient: &mockAWSECRClient{
+				t: t,
+
+				expectedRepositoryNames: []string{repoName},
+				expectedImageDigests:    []string{digest},
+
+				outputError: testCase.outputError,
+			},
+		}
+
+		err := client.PutImage(&ecr.Image{
+			RepositoryName: &repoName,
+			ImageId: &ecr.ImageIdentifier{
+				ImageDigest: &digest,
+				ImageTag:    &tag,
+			},
+			ImageManifest: &manifest,
+		})
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned: %v, but was %v", testCase.expectedError, err)
+		}
+	}
+}
+
+func TestGetLayer(t *testing.T) {
+	repoName, layer := "repo-1", []byte(`{"critical": {}}`)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write(layer)
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		digest        string
+		downloadURL   string
+		outputError   error
+		expectedError bool
+	}{
+		{digest, server.URL + "/ok", nil, false},
+		{digest, server.URL + "/forbidden", nil, true},
+		{digest, "", fmt.Errorf(""), true},
+
+		// Contents do not match the digest
+		{"sha256:a1", server.URL + "/ok", nil, true},
+	}
+
+	for _, testCase := range testCases {
+		client := ECRClientImpl{
+			ECRClient: &mockAWSECRClient{
+				t: t,
+
+				expectedRepositoryNames: []string{repoName},
+				expectedLayerDigest:     testCase.digest,
+
+				downloadURL: testCase.downloadURL,
+				outputError: testCase.outputError,
+			},
+			HTTPClient: server.Client(),
+		}
+
+		data, err := client.GetLayer(&repoName, nil, testCase.digest)
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned: %v, but was %v", testCase.expectedError, err)
+		}
+
+		if err == nil && string(data) != string(layer) {
+			t.Errorf("Expected layer to be %s, but was %s", layer, data)
+		}
+	}
+}
+
 func TestBatchRemoveImagesWithEmptyImages(t *testing.T) {
 	client := ECRClientImpl{
 		ECRClient: nil, // Should not interact with the ECR client
@@ -442,6 +807,52 @@ func TestBatchRemoveImages(t *testing.T) {
 	}
 }
 
+func TestBatchRemoveImagesWithFailures(t *testing.T) {
+	repoName, digests := "repo-1", []string{"digest-1", "digest-2"}
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest:    &digests[0],
+			RepositoryName: &repoName,
+		},
+		{
+			ImageDigest:    &digests[1],
+			RepositoryName: &repoName,
+		},
+	}
+
+	client := ECRClientImpl{
+		ECRClient: &mockAWSECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			expectedImageDigests:    digests,
+
+			batchDeleteImageOutput: &ecr.BatchDeleteImageOutput{
+				Failures: []*ecr.ImageFailure{
+					{
+						ImageId:       &ecr.ImageIdentifier{ImageDigest: &digests[1]},
+						FailureCode:   aws.String(ecr.ImageFailureCodeImageReferencedByManifestList),
+						FailureReason: aws.String("referenced by an image index"),
+					},
+				},
+			},
+		},
+	}
+
+	err := client.BatchRemoveImages(images)
+
+	removeErr, ok := err.(*BatchRemoveError)
+	if !ok {
+		t.Fatalf("Expected error to be a *BatchRemoveError, but was %v", err)
+	}
+
+	expected := map[string]string{"digest-2": "ImageReferencedByManifestList: referenced by an image index"}
+	if !reflect.DeepEqual(removeErr.Failures, expected) {
+		t.Errorf("Expected failures to be %v, but was %v", expected, removeErr.Failures)
+	}
+}
+
 func TestFilterOldUnusedImages(t *testing.T) {
 	latestTag := "latest"
 	tags := []string{"tag-1", "tag-2", "tag-3", "tag-4", "tag-5"}
@@ -667,3 +1078,145 @@ func TestFilterOldUnusedImages(t *testing.T) {
 		}
 	}
 }
+
+func TestFilterOldUnusedImagesBy(t *testing.T) {
+	digests := []string{"sha256:a", "sha256:b", "sha256:c"}
+	pushedAt := time.Unix(0, 0)
+
+	images := []*ecr.ImageDetail{}
+	for i := range digests {
+		images = append(images, &ecr.ImageDetail{
+			ImageDigest:   &digests[i],
+			ImagePushedAt: &pushedAt,
+		})
+	}
+
+	// Keeps the images sorted last, regardless of their push date
+	reverse := func(images []*ecr.ImageDetail) {
+		for i, j := 0, len(images)-1; i < j; i, j = i+1, j-1 {
+			images[i], images[j] = images[j], images[i]
+		}
+	}
+
+	filtered := FilterOldUnusedImagesBy(1, images, []string{}, reverse)
+
+	if len(filtered) != 2 || *filtered[0].ImageDigest != "sha256:c" || *filtered[1].ImageDigest != "sha256:b" {
+		t.Errorf("Expected old images to be 'sha256:c' and 'sha256:b', but was %+v", filtered)
+	}
+}
+
+func TestFilterOldUnusedImagesWithDigestsInUse(t *testing.T) {
+	digests := []string{"sha256:a", "sha256:b", "sha256:c"}
+	pushedAt := []time.Time{time.Unix(0, 0), time.Unix(1, 0), time.Unix(2, 0)}
+
+	// Untagged images, such as the ones left behind by moved tags
+	images := []*ecr.ImageDetail{}
+	for i := range digests {
+		images = append(images, &ecr.ImageDetail{
+			ImageDigest:   &digests[i],
+			ImagePushedAt: &pushedAt[i],
+		})
+	}
+
+	filtered := FilterOldUnusedImages(0, images, []string{"sha256:a"})
+
+	if len(filtered) != 2 || *filtered[0].ImageDigest != "sha256:b" || *filtered[1].ImageDigest != "sha256:c" {
+		t.Errorf("Expected old images to be 'sha256:b' and 'sha256:c', but was %+v", filtered)
+	}
+}
+
+func TestBatchRemoveTagsWithEmptyTags(t *testing.T) {
+	client := ECRClientImpl{
+		ECRClient: nil, // Should not interact with the ECR client
+	}
+
+	repoName := "repo-1"
+	err := client.BatchRemoveTags(&repoName, nil, []*string{})
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+}
+
+func TestBatchRemoveTagsWithTooManyTags(t *testing.T) {
+	client := ECRClientImpl{
+		ECRClient: nil, // Should not interact with the ECR client
+	}
+
+	repoName := "repo-1"
+	err := client.BatchRemoveTags(&repoName, nil, make([]*string, 101))
+
+	if err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestBatchRemoveTags(t *testing.T) {
+	repoName, reason := "repo-1", "ImageNotFound"
+	tags := []string{"tag-1", "tag-2"}
+
+	testCases := []struct {
+		output        *ecr.BatchDeleteImageOutput
+		outputError   error
+		expectedError bool
+	}{
+		{&ecr.BatchDeleteImageOutput{}, nil, false},
+		{&ecr.BatchDeleteImageOutput{
+			Failures: []*ecr.ImageFailure{
+				{
+					ImageId:       &ecr.ImageIdentifier{ImageTag: &tags[0]},
+					FailureReason: &reason,
+				},
+			},
+		}, nil, true},
+		{nil, fmt.Errorf(""), true},
+	}
+
+	for _, testCase := range testCases {
+		client := ECRClientImpl{
+			ECRClient: &mockAWSECRClient{
+				t: t,
+
+				expectedRepositoryNames: []string{repoName},
+				expectedImageTags:       tags,
+
+				batchDeleteImageOutput: testCase.output,
+				outputError:            testCase.outputError,
+			},
+		}
+
+		err := client.BatchRemoveTags(&repoName, nil, []*string{&tags[0], &tags[1]})
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned: %v, but was %v", testCase.expectedError, err)
+		}
+	}
+}
+
+func TestParseImageReference(t *testing.T) {
+	testCases := []struct {
+		image            string
+		expectedRepoName string
+		expectedTag      string
+		expectedDigest   string
+		expectedOk       bool
+	}{
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/repo:v1", "repo", "v1", "", true},
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/team/repo:v1", "team/repo", "v1", "", true},
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/repo:v1@sha256:a1", "repo", "v1", "sha256:a1", true},
+		{"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn/repo:v1", "repo", "v1", "", true},
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/repo@sha256:a1", "repo", "", "sha256:a1", true},
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/repo", "repo", "", "", true},
+		{"id.dkr.ecr.region.amazonaws.com/repo:v1", "repo", "v1", "", true},
+		{"nginx:1.21", "", "", "", false},
+		{"public.ecr.aws/team/repo:v1", "", "", "", false},
+	}
+
+	for _, testCase := range testCases {
+		repoName, tag, digest, ok := ParseImageReference(testCase.image)
+
+		if repoName != testCase.expectedRepoName || tag != testCase.expectedTag || digest != testCase.expectedDigest || ok != testCase.expectedOk {
+			t.Errorf("Expected %s to be parsed as (%s, %s, %s, %v), but was (%s, %s, %s, %v)", testCase.image, testCase.expectedRepoName, testCase.expectedTag, testCase.expectedDigest, testCase.expectedOk, repoName, tag, digest, ok)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package aws
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+)
+
+// DescribeServicesMaxServices is the maximum number of ECS services that can
+// be described in a single API call.
+const DescribeServicesMaxServices = 10
+
+// ECSClientImpl provides an interface for mocking.
+type ECSClientImpl struct {
+	ECSClient ecsiface.ECSAPI
+}
+
+// ECSClient defines the expected interface of any object capable of listing
+// the images of the task definitions used by ECS services.
+type ECSClient interface {
+	ListServiceImages() (map[string][]string, error)
+}
+
+// NewECSClient returns a new client for interacting with the ECS API in the
+// given region, using the default credentials chain.
+//
+// If roleARN is not empty, that role is assumed, which is useful for
+// inspecting the services of other accounts.
+func NewECSClient(region, roleARN, caBundle string) (*ECSClientImpl, error) {
+	sess, err := newSession(aws.NewConfig(), region, "", caBundle)
+	if err != nil {
+		return nil, err
+	}
+
+	awsConfig := aws.NewConfig()
+	if roleARN != "" {
+		awsConfig.WithCredentials(stscreds.NewCredentials(sess, roleARN))
+	}
+
+	return &ECSClientImpl{
+		ECSClient: ecs.New(sess, awsConfig),
+	}, nil
+}
+
+// ListServiceImages returns the ARNs of the services using each image, given
+// by the task definitions of the services of all clusters, including those
+// of deployments and task sets still in progress.
+func (c *ECSClientImpl) ListServiceImages() (map[string][]string, error) {
+	clusterARNs := []*string{}
+
+	err := c.ECSClient.ListClustersPages(&ecs.ListClustersInput{}, func(page *ecs.ListClustersOutput, lastPage bool) bool {
+		clusterARNs = append(clusterARNs, page.ClusterArns...)
+		return !lastPage
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Services using each task definition, by task definition ARN
+	taskDefinitionUsers := map[string][]string{}
+
+	for _, clusterARN := range clusterARNs {
+		serviceARNs := []*string{}
+
+		input := &ecs.ListServicesInput{
+			Cluster: clusterARN,
+		}
+
+		err = c.ECSClient.ListServicesPages(input, func(page *ecs.ListServicesOutput, lastPage bool) bool {
+			serviceARNs = append(serviceARNs, page.ServiceArns...)
+			return !lastPage
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 0; i < len(serviceARNs); i += DescribeServicesMaxServices {
+			j := i + DescribeServicesMaxServices
+			if j > len(serviceARNs) {
+				j = len(serviceARNs)
+			}
+
+			output, err := c.ECSClient.DescribeServices(&ecs.DescribeServicesInput{
+				Cluster:  clusterARN,
+				Services: serviceARNs[i:j],
+			})
+
+			if err != nil {
+				return nil, err
+			}
+
+			for _, service := range output.Services {
+				for _, taskDefinition := range serviceTaskDefinitions(service) {
+					taskDefinitionUsers[taskDefinition] = append(taskDefinitionUsers[taskDefinition], aws.StringValue(service.ServiceArn))
+				}
+			}
+		}
+	}
+
+	imageUsers := map[string][]string{}
+	encountered := map[string]bool{}
+
+	for taskDefinition, serviceARNs := range taskDefinitionUsers {
+		output, err := c.ECSClient.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
+			TaskDefinition: aws.String(taskDefinition),
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, container := range output.TaskDefinition.ContainerDefinitions {
+			image := aws.StringValue(container.Image)
+			if image == "" {
+				continue
+			}
+
+			for _, serviceARN := range serviceARNs {
+				if key := image + " " + serviceARN; !encountered[key] {
+					imageUsers[image] = append(imageUsers[image], serviceARN)
+					encountered[key] = true
+				}
+			}
+		}
+	}
+
+	return imageUsers, nil
+}
+
+// serviceTaskDefinitions returns the distinct ARNs of the task definitions
+// used by the given service, its deployments and its task sets.
+func serviceTaskDefinitions(service *ecs.Service) []string {
+	taskDefinitions := []string{}
+	encountered := map[string]bool{}
+
+	add := func(taskDefinition *string) {
+		if arn := aws.StringValue(taskDefinition); arn != "" && !encountered[arn] {
+			taskDefinitions = append(taskDefinitions, arn)
+			encountered[arn] = true
+		}
+	}
+
+	add(service.TaskDefinition)
+
+	for _, deployment := range service.Deployments {
+		add(deployment.TaskDefinition)
+	}
+
+	for _, taskSet := range service.TaskSets {
+		add(taskSet.TaskDefinition)
+	}
+
+	return taskDefinitions
+}
@@ -0,0 +1,171 @@
+package aws
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+)
+
+// mockAWSECSClient serves the services and task definitions of a fixed set of
+// clusters.
+type mockAWSECSClient struct {
+	t *testing.T
+	ecsiface.ECSAPI
+
+	// Services of each cluster, by cluster ARN.
+	services map[string][]*ecs.Service
+
+	// Images of each task definition, by task definition ARN.
+	taskDefinitions map[string][]string
+
+	describeServicesCalls int
+	outputError           error
+}
+
+func (m *mockAWSECSClient) ListClustersPages(input *ecs.ListClustersInput, fn func(*ecs.ListClustersOutput, bool) bool) error {
+	page := &ecs.ListClustersOutput{}
+	for clusterARN := range m.services {
+		page.ClusterArns = append(page.ClusterArns, aws.String(clusterARN))
+	}
+
+	fn(page, true)
+	return nil
+}
+
+func (m *mockAWSECSClient) ListServicesPages(input *ecs.ListServicesInput, fn func(*ecs.ListServicesOutput, bool) bool) error {
+	page := &ecs.ListServicesOutput{}
+	for _, service := range m.services[aws.StringValue(input.Cluster)] {
+		page.ServiceArns = append(page.ServiceArns, service.ServiceArn)
+	}
+
+	fn(page, true)
+	return nil
+}
+
+func (m *mockAWSECSClient) DescribeServices(input *ecs.DescribeServicesInput) (*ecs.DescribeServicesOutput, error) {
+	m.describeServicesCalls++
+
+	if len(input.Services) > DescribeServicesMaxServices {
+		m.t.Errorf("Expected at most %d services to be described at once, but was %d", DescribeServicesMaxServices, len(input.Services))
+	}
+
+	output := &ecs.DescribeServicesOutput{}
+	for _, service := range m.services[aws.StringValue(input.Cluster)] {
+		for _, serviceARN := range input.Services {
+			if aws.StringValue(service.ServiceArn) == aws.StringValue(serviceARN) {
+				output.Services = append(output.Services, service)
+			}
+		}
+	}
+
+	return output, nil
+}
+
+func (m *mockAWSECSClient) DescribeTaskDefinition(input *ecs.DescribeTaskDefinitionInput) (*ecs.DescribeTaskDefinitionOutput, error) {
+	if m.outputError != nil {
+		return nil, m.outputError
+	}
+
+	images, ok := m.taskDefinitions[aws.StringValue(input.TaskDefinition)]
+	if !ok {
+		m.t.Errorf("Unexpected task definition %s", aws.StringValue(input.TaskDefinition))
+	}
+
+	taskDefinition := &ecs.TaskDefinition{}
+	for _, image := range images {
+		taskDefinition.ContainerDefinitions = append(taskDefinition.ContainerDefinitions, &ecs.ContainerDefinition{
+			Image: aws.String(image),
+		})
+	}
+
+	return &ecs.DescribeTaskDefinitionOutput{TaskDefinition: taskDefinition}, nil
+}
+
+func TestListServiceImages(t *testing.T) {
+	services := []*ecs.Service{
+		{
+			ServiceArn:     aws.String("web"),
+			TaskDefinition: aws.String("web:2"),
+
+			// Rolling update still in progress
+			Deployments: []*ecs.Deployment{
+				{TaskDefinition: aws.String("web:2")},
+				{TaskDefinition: aws.String("web:1")},
+			},
+		},
+		{
+			ServiceArn: aws.String("worker"),
+
+			// External deployment controller
+			TaskSets: []*ecs.TaskSet{
+				{TaskDefinition: aws.String("worker:1")},
+			},
+		},
+	}
+
+	// Enough services to be described in several calls
+	for i := 0; i <= DescribeServicesMaxServices; i++ {
+		services = append(services, &ecs.Service{
+			ServiceArn:     aws.String(fmt.Sprintf("batch-%d", i)),
+			TaskDefinition: aws.String("batch:1"),
+		})
+	}
+
+	ecsClient := &mockAWSECSClient{
+		t: t,
+
+		services: map[string][]*ecs.Service{
+			"cluster-1": services[:2],
+			"cluster-2": services[2:],
+		},
+		taskDefinitions: map[string][]string{
+			"web:1":    {"repo:v1", "sidecar:v1"},
+			"web:2":    {"repo:v2", "sidecar:v1"},
+			"worker:1": {"repo:v2"},
+			"batch:1":  {"batch:v1"},
+		},
+	}
+
+	client := &ECSClientImpl{
+		ECSClient: ecsClient,
+	}
+
+	images, err := client.ListServiceImages()
+
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if ecsClient.describeServicesCalls != 3 {
+		t.Errorf("Expected services to be described in 3 calls, but was %d", ecsClient.describeServicesCalls)
+	}
+
+	testCases := []struct {
+		image    string
+		expected []string
+	}{
+		{"repo:v1", []string{"web"}},
+		{"sidecar:v1", []string{"web"}},
+		{"worker:v1", nil},
+	}
+
+	for _, testCase := range testCases {
+		if !reflect.DeepEqual(images[testCase.image], testCase.expected) {
+			t.Errorf("Expected users of %s to be %v, but was %v", testCase.image, testCase.expected, images[testCase.image])
+		}
+	}
+
+	if len(images["repo:v2"]) != 2 || len(images["batch:v1"]) != DescribeServicesMaxServices+1 {
+		t.Errorf("Expected users of all images to be returned, but was %v", images)
+	}
+
+	ecsClient.outputError = fmt.Errorf("access denied")
+
+	if _, err = client.ListServiceImages(); err == nil {
+		t.Errorf("Expected error, but was nil")
+	}
+}
@@ -0,0 +1,92 @@
+package aws
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+// LambdaClientImpl provides an interface for mocking.
+type LambdaClientImpl struct {
+	LambdaClient lambdaiface.LambdaAPI
+}
+
+// LambdaClient defines the expected interface of any object capable of
+// listing the images of container image Lambda functions.
+type LambdaClient interface {
+	ListFunctionImages() (map[string][]string, error)
+}
+
+// NewLambdaClient returns a new client for interacting with the Lambda API in
+// the given region, using the default credentials chain.
+//
+// If roleARN is not empty, that role is assumed, which is useful for
+// inspecting the functions of other accounts.
+func NewLambdaClient(region, roleARN, caBundle string) (*LambdaClientImpl, error) {
+	sess, err := newSession(aws.NewConfig(), region, "", caBundle)
+	if err != nil {
+		return nil, err
+	}
+
+	awsConfig := aws.NewConfig()
+	if roleARN != "" {
+		awsConfig.WithCredentials(stscreds.NewCredentials(sess, roleARN))
+	}
+
+	return &LambdaClientImpl{
+		LambdaClient: lambda.New(sess, awsConfig),
+	}, nil
+}
+
+// ListFunctionImages returns the qualified ARNs of the function versions using
+// each image, referenced both as configured and by the digest it resolved to.
+// All published versions are considered, since aliases may still point to
+// them.
+func (c *LambdaClientImpl) ListFunctionImages() (map[string][]string, error) {
+	functionARNs := []*string{}
+
+	input := &lambda.ListFunctionsInput{
+		FunctionVersion: aws.String(lambda.FunctionVersionAll),
+	}
+
+	err := c.LambdaClient.ListFunctionsPages(input, func(page *lambda.ListFunctionsOutput, lastPage bool) bool {
+		for _, function := range page.Functions {
+			if aws.StringValue(function.PackageType) == lambda.PackageTypeImage {
+				functionARNs = append(functionARNs, function.FunctionArn)
+			}
+		}
+		return !lastPage
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	imageUsers := map[string][]string{}
+
+	// The image of each function is only returned when getting the function
+	for _, functionARN := range functionARNs {
+		output, err := c.LambdaClient.GetFunction(&lambda.GetFunctionInput{
+			FunctionName: functionARN,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if output.Code == nil {
+			continue
+		}
+
+		// Functions run the image their tag resolved to when they were
+		// deployed, which may no longer be tagged
+		for _, image := range []*string{output.Code.ImageUri, output.Code.ResolvedImageUri} {
+			if uri := aws.StringValue(image); uri != "" {
+				imageUsers[uri] = append(imageUsers[uri], aws.StringValue(functionARN))
+			}
+		}
+	}
+
+	return imageUsers, nil
+}
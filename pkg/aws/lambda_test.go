@@ -0,0 +1,108 @@
+package aws
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+// mockAWSLambdaClient serves a fixed set of function versions.
+type mockAWSLambdaClient struct {
+	t *testing.T
+	lambdaiface.LambdaAPI
+
+	functions []*lambda.FunctionConfiguration
+
+	// Image of each function version, by qualified function ARN.
+	images map[string]string
+
+	// Digest-pinned image each image resolved to, by image.
+	digests map[string]string
+
+	getFunctionCalls int
+	outputError      error
+}
+
+func (m *mockAWSLambdaClient) ListFunctionsPages(input *lambda.ListFunctionsInput, fn func(*lambda.ListFunctionsOutput, bool) bool) error {
+	if aws.StringValue(input.FunctionVersion) != lambda.FunctionVersionAll {
+		m.t.Errorf("Expected all function versions to be listed, but was %v", input.FunctionVersion)
+	}
+
+	for i, function := range m.functions {
+		fn(&lambda.ListFunctionsOutput{
+			Functions: []*lambda.FunctionConfiguration{function},
+		}, i == len(m.functions)-1)
+	}
+
+	return m.outputError
+}
+
+func (m *mockAWSLambdaClient) GetFunction(input *lambda.GetFunctionInput) (*lambda.GetFunctionOutput, error) {
+	m.getFunctionCalls++
+
+	image := m.images[aws.StringValue(input.FunctionName)]
+
+	return &lambda.GetFunctionOutput{
+		Code: &lambda.FunctionCodeLocation{
+			ImageUri:         aws.String(image),
+			ResolvedImageUri: aws.String(m.digests[image]),
+		},
+	}, nil
+}
+
+func TestListFunctionImages(t *testing.T) {
+	lambdaClient := &mockAWSLambdaClient{
+		t: t,
+
+		functions: []*lambda.FunctionConfiguration{
+			{FunctionArn: aws.String("api:$LATEST"), PackageType: aws.String(lambda.PackageTypeImage)},
+			{FunctionArn: aws.String("api:1"), PackageType: aws.String(lambda.PackageTypeImage)},
+			{FunctionArn: aws.String("api:2"), PackageType: aws.String(lambda.PackageTypeImage)},
+			{FunctionArn: aws.String("zip:1"), PackageType: aws.String(lambda.PackageTypeZip)},
+		},
+		images: map[string]string{
+			"api:$LATEST": "repo:v2",
+			"api:1":       "repo:v1",
+			"api:2":       "repo:v2",
+		},
+		digests: map[string]string{
+			"repo:v1": "repo@sha256:a1",
+			"repo:v2": "repo@sha256:a2",
+		},
+	}
+
+	client := &LambdaClientImpl{
+		LambdaClient: lambdaClient,
+	}
+
+	images, err := client.ListFunctionImages()
+
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	expected := map[string][]string{
+		"repo:v1":        {"api:1"},
+		"repo:v2":        {"api:$LATEST", "api:2"},
+		"repo@sha256:a1": {"api:1"},
+		"repo@sha256:a2": {"api:$LATEST", "api:2"},
+	}
+
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("Expected images to be %v, but was %v", expected, images)
+	}
+
+	if lambdaClient.getFunctionCalls != 3 {
+		t.Errorf("Expected only image functions to be retrieved, but %d were", lambdaClient.getFunctionCalls)
+	}
+
+	lambdaClient.outputError = fmt.Errorf("access denied")
+
+	if _, err = client.ListFunctionImages(); err == nil {
+		t.Errorf("Expected error, but was nil")
+	}
+}
@@ -0,0 +1,349 @@
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// Media types of manifests that reference other manifests, such as the ones
+// of multi-arch images.
+var imageIndexMediaTypes = map[string]bool{
+	"application/vnd.docker.distribution.manifest.list.v2+json": true,
+	"application/vnd.oci.image.index.v1+json":                   true,
+}
+
+// Media types of the configs of regular container images. Images whose
+// artifact media type is anything else may be OCI referrers, such as SBOMs.
+var imageConfigMediaTypes = map[string]bool{
+	"application/vnd.docker.container.image.v1+json": true,
+	"application/vnd.oci.image.config.v1+json":       true,
+}
+
+// Tags under which cosign stores the signatures, attestations and SBOMs of
+// an image, named after the image digest.
+var artifactTagRegexp = regexp.MustCompile(`^sha256-([0-9a-f]+)\.(sig|att|sbom)$`)
+
+// ImageGraph relates image indexes, such as the ones of multi-arch images,
+// to the per-platform images they reference, which are often untagged. It
+// also relates artifacts, such as signatures and SBOMs, to the images they
+// describe.
+type ImageGraph struct {
+
+	// Digests of the images referenced by each image index.
+	Children map[string][]string
+
+	// Digests of the image indexes referencing each image.
+	Parents map[string][]string
+
+	// Digests of the artifacts describing each image.
+	Artifacts map[string][]string
+
+	// Digest of the image described by each artifact.
+	Subjects map[string]string
+
+	// Digests of all images in the repository.
+	present map[string]bool
+}
+
+// IsImageIndex returns whether the given image is an image index.
+func IsImageIndex(image *ecr.ImageDetail) bool {
+	return imageIndexMediaTypes[aws.StringValue(image.ImageManifestMediaType)]
+}
+
+// ArtifactSubject returns the digest of the image described by the given
+// image, if its tags are all cosign signature, attestation or SBOM tags.
+func ArtifactSubject(image *ecr.ImageDetail) (string, bool) {
+	subject := ""
+	for _, tag := range image.ImageTags {
+		match := artifactTagRegexp.FindStringSubmatch(aws.StringValue(tag))
+		if match == nil || (subject != "" && subject != match[1]) {
+			return "", false
+		}
+		subject = match[1]
+	}
+
+	if subject == "" {
+		return "", false
+	}
+
+	return "sha256:" + subject, true
+}
+
+// MayBeReferrer returns whether the given image may be an OCI referrer, that
+// is, an artifact whose manifest names the image it describes.
+func MayBeReferrer(image *ecr.ImageDetail) bool {
+	mediaType := aws.StringValue(image.ArtifactMediaType)
+	return mediaType != "" && !imageConfigMediaTypes[mediaType] && !IsImageIndex(image)
+}
+
+// ManifestChildren returns the digests of the manifests referenced by the
+// given image index manifest.
+func ManifestChildren(manifest string) ([]string, error) {
+	index := struct {
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+	}{}
+
+	if err := json.Unmarshal([]byte(manifest), &index); err != nil {
+		return nil, err
+	}
+
+	digests := []string{}
+	for _, child := range index.Manifests {
+		digests = append(digests, child.Digest)
+	}
+
+	return digests, nil
+}
+
+// ManifestSubject returns the digest of the manifest named as the subject of
+// the given manifest, if any.
+func ManifestSubject(manifest string) (string, error) {
+	referrer := struct {
+		Subject *struct {
+			Digest string `json:"digest"`
+		} `json:"subject"`
+	}{}
+
+	if err := json.Unmarshal([]byte(manifest), &referrer); err != nil {
+		return "", err
+	}
+
+	if referrer.Subject == nil {
+		return "", nil
+	}
+
+	return referrer.Subject.Digest, nil
+}
+
+// NewImageGraph retrieves the manifests of the image indexes and OCI
+// referrers among the given images, all stored in the same repository, in
+// order to find out which images they reference. Cosign artifacts are
+// related to the images they describe by their tags.
+func NewImageGraph(ecrClient ECRClient, images []*ecr.ImageDetail) (*ImageGraph, error) {
+	graph := &ImageGraph{
+		Children:  map[string][]string{},
+		Parents:   map[string][]string{},
+		Artifacts: map[string][]string{},
+		Subjects:  map[string]string{},
+		present:   digestSet(images),
+	}
+
+	toFetch := []*ecr.ImageDetail{}
+	for _, image := range images {
+		if subject, ok := ArtifactSubject(image); ok {
+			graph.addArtifact(aws.StringValue(image.ImageDigest), subject)
+		} else if IsImageIndex(image) || MayBeReferrer(image) {
+			toFetch = append(toFetch, image)
+		}
+	}
+
+	for start := 0; start < len(toFetch); start += BatchRemoveMaxImages {
+		end := start + BatchRemoveMaxImages
+		if end > len(toFetch) {
+			end = len(toFetch)
+		}
+
+		manifests, err := ecrClient.GetImages(toFetch[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, manifest := range manifests {
+			if manifest.ImageId == nil {
+				continue
+			}
+
+			parent := aws.StringValue(manifest.ImageId.ImageDigest)
+
+			children, err := ManifestChildren(aws.StringValue(manifest.ImageManifest))
+			if err != nil {
+				return nil, fmt.Errorf("Cannot parse manifest of image '%s': %v", parent, err)
+			}
+
+			for _, child := range children {
+				graph.Children[parent] = append(graph.Children[parent], child)
+				graph.Parents[child] = append(graph.Parents[child], parent)
+			}
+
+			subject, err := ManifestSubject(aws.StringValue(manifest.ImageManifest))
+			if err != nil {
+				return nil, fmt.Errorf("Cannot parse manifest of image '%s': %v", parent, err)
+			}
+
+			if subject != "" {
+				graph.addArtifact(parent, subject)
+			}
+		}
+	}
+
+	return graph, nil
+}
+
+func (g *ImageGraph) addArtifact(artifact, subject string) {
+	g.Artifacts[subject] = append(g.Artifacts[subject], artifact)
+	g.Subjects[artifact] = subject
+}
+
+// SplitChildren separates the images referenced by image indexes, along
+// with the artifacts describing other images, from the others.
+func (g *ImageGraph) SplitChildren(images []*ecr.ImageDetail) ([]*ecr.ImageDetail, []*ecr.ImageDetail) {
+	if g == nil {
+		return images, []*ecr.ImageDetail{}
+	}
+
+	regular, children := []*ecr.ImageDetail{}, []*ecr.ImageDetail{}
+
+	for _, image := range images {
+		if g.IsChild(image) {
+			children = append(children, image)
+		} else {
+			regular = append(regular, image)
+		}
+	}
+
+	return regular, children
+}
+
+// IsChild returns whether the given image is referenced by an image index,
+// or is an artifact describing another image in the repository. Artifacts
+// describing images that are not in the repository are handled as any other
+// image.
+func (g *ImageGraph) IsChild(image *ecr.ImageDetail) bool {
+	if g == nil {
+		return false
+	}
+
+	digest := aws.StringValue(image.ImageDigest)
+	subject, isArtifact := g.Subjects[digest]
+
+	return (isArtifact && g.Exists(subject)) || len(g.Parents[digest]) > 0
+}
+
+// Subject returns the digest of the image described by the given artifact.
+func (g *ImageGraph) Subject(artifact *ecr.ImageDetail) (string, bool) {
+	if g == nil {
+		return "", false
+	}
+
+	subject, ok := g.Subjects[aws.StringValue(artifact.ImageDigest)]
+	return subject, ok
+}
+
+// Exists returns whether the image with the given digest exists in the
+// repository.
+func (g *ImageGraph) Exists(digest string) bool {
+	return g != nil && g.present[digest]
+}
+
+// OrphanedChildren returns the images among the given children that can be
+// removed along with the given removed images. These are the untagged
+// images whose image indexes are all removed, and the artifacts whose
+// subject is removed, including the ones describing other orphaned children.
+func (g *ImageGraph) OrphanedChildren(removed []*ecr.ImageDetail, children []*ecr.ImageDetail) []*ecr.ImageDetail {
+	orphaned := []*ecr.ImageDetail{}
+	if g == nil {
+		return orphaned
+	}
+
+	isRemoved := digestSet(removed)
+	isOrphaned := map[*ecr.ImageDetail]bool{}
+
+	for found := true; found; {
+		found = false
+
+		for _, child := range children {
+			if isOrphaned[child] || !g.isOrphaned(child, isRemoved) {
+				continue
+			}
+
+			isOrphaned[child] = true
+			isRemoved[aws.StringValue(child.ImageDigest)] = true
+			orphaned = append(orphaned, child)
+			found = true
+		}
+	}
+
+	return orphaned
+}
+
+func (g *ImageGraph) isOrphaned(child *ecr.ImageDetail, isRemoved map[string]bool) bool {
+	digest := aws.StringValue(child.ImageDigest)
+
+	if subject, ok := g.Subjects[digest]; ok {
+		return isRemoved[subject]
+	}
+
+	parents := g.Parents[digest]
+	if len(child.ImageTags) > 0 || len(parents) == 0 {
+		return false
+	}
+
+	for _, parent := range parents {
+		if !isRemoved[parent] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WithoutKeptChildren returns the given images, except those referenced by
+// image indexes that are not among them, and the artifacts describing
+// images that still exist and are not among them.
+func (g *ImageGraph) WithoutKeptChildren(images []*ecr.ImageDetail) []*ecr.ImageDetail {
+	if g == nil {
+		return images
+	}
+
+	isRemoved := digestSet(images)
+	result := []*ecr.ImageDetail{}
+
+imagesLoop:
+	for _, image := range images {
+		digest := aws.StringValue(image.ImageDigest)
+
+		if subject, ok := g.Subjects[digest]; ok && g.Exists(subject) && !isRemoved[subject] {
+			continue
+		}
+
+		for _, parent := range g.Parents[digest] {
+			if !isRemoved[parent] {
+				continue imagesLoop
+			}
+		}
+
+		result = append(result, image)
+	}
+
+	return result
+}
+
+// SplitImageIndexes separates the image indexes from the other images, so
+// that indexes can be removed before the images they reference.
+func SplitImageIndexes(images []*ecr.ImageDetail) ([]*ecr.ImageDetail, []*ecr.ImageDetail) {
+	indexes, others := []*ecr.ImageDetail{}, []*ecr.ImageDetail{}
+
+	for _, image := range images {
+		if IsImageIndex(image) {
+			indexes = append(indexes, image)
+		} else {
+			others = append(others, image)
+		}
+	}
+
+	return indexes, others
+}
+
+func digestSet(images []*ecr.ImageDetail) map[string]bool {
+	set := map[string]bool{}
+	for _, image := range images {
+		set[aws.StringValue(image.ImageDigest)] = true
+	}
+	return set
+}
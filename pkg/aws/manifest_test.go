@@ -0,0 +1,293 @@
+package aws
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func newGraphTestImage(digest string, tags ...string) *ecr.ImageDetail {
+	repoName := "repo-1"
+
+	image := &ecr.ImageDetail{
+		RepositoryName: &repoName,
+		ImageDigest:    &digest,
+	}
+
+	for i := range tags {
+		image.ImageTags = append(image.ImageTags, &tags[i])
+	}
+
+	return image
+}
+
+func digestsOf(images []*ecr.ImageDetail) []string {
+	digests := []string{}
+	for _, image := range images {
+		digests = append(digests, *image.ImageDigest)
+	}
+	return digests
+}
+
+func TestManifestChildren(t *testing.T) {
+	testCases := []struct {
+		manifest      string
+		expected      []string
+		expectedError bool
+	}{
+		{`{"manifests": [{"digest": "sha256:b1"}, {"digest": "sha256:b2"}]}`, []string{"sha256:b1", "sha256:b2"}, false},
+		{`{"layers": []}`, []string{}, false},
+		{`not json`, nil, true},
+	}
+
+	for _, testCase := range testCases {
+		children, err := ManifestChildren(testCase.manifest)
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned: %v, but was %v", testCase.expectedError, err)
+		}
+
+		if err == nil && !reflect.DeepEqual(children, testCase.expected) {
+			t.Errorf("Expected children to be %v, but was %v", testCase.expected, children)
+		}
+	}
+}
+
+func TestNewImageGraph(t *testing.T) {
+	indexType, manifest := "application/vnd.docker.distribution.manifest.list.v2+json", `{"manifests": [{"digest": "sha256:b1"}]}`
+	repoName, digest := "repo-1", "sha256:a1"
+
+	index := newGraphTestImage(digest, "v1")
+	index.ImageManifestMediaType = &indexType
+
+	client := ECRClientImpl{
+		ECRClient: &mockAWSECRClient{
+			t: t,
+
+			// Only indexes are retrieved
+			expectedRepositoryNames: []string{repoName},
+			expectedImageDigests:    []string{digest},
+
+			batchGetImageOutput: &ecr.BatchGetImageOutput{
+				Images: []*ecr.Image{
+					{
+						ImageId:       &ecr.ImageIdentifier{ImageDigest: &digest},
+						ImageManifest: &manifest,
+					},
+				},
+			},
+		},
+	}
+
+	graph, err := NewImageGraph(&client, []*ecr.ImageDetail{index, newGraphTestImage("sha256:b1")})
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if !reflect.DeepEqual(graph.Children, map[string][]string{"sha256:a1": {"sha256:b1"}}) {
+		t.Errorf("Expected children to be mapped, but was %v", graph.Children)
+	}
+
+	if !reflect.DeepEqual(graph.Parents, map[string][]string{"sha256:b1": {"sha256:a1"}}) {
+		t.Errorf("Expected parents to be mapped, but was %v", graph.Parents)
+	}
+}
+
+func TestImageGraph(t *testing.T) {
+	graph := &ImageGraph{
+		Children: map[string][]string{
+			"sha256:a1": {"sha256:b1", "sha256:b2", "sha256:b4"},
+			"sha256:a2": {"sha256:b2", "sha256:b3"},
+		},
+		Parents: map[string][]string{
+			"sha256:b1": {"sha256:a1"},
+			"sha256:b2": {"sha256:a1", "sha256:a2"},
+			"sha256:b3": {"sha256:a2"},
+			"sha256:b4": {"sha256:a1"},
+		},
+	}
+
+	oldIndex, newIndex := newGraphTestImage("sha256:a1", "old"), newGraphTestImage("sha256:a2", "new")
+	images := []*ecr.ImageDetail{
+		oldIndex,
+		newIndex,
+		newGraphTestImage("sha256:b1"),
+		newGraphTestImage("sha256:b2"),
+		newGraphTestImage("sha256:b3"),
+		newGraphTestImage("sha256:b4", "tagged"),
+		newGraphTestImage("sha256:c1"),
+	}
+
+	regular, children := graph.SplitChildren(images)
+
+	if !reflect.DeepEqual(digestsOf(regular), []string{"sha256:a1", "sha256:a2", "sha256:c1"}) {
+		t.Errorf("Expected regular images to be the indexes and standalone images, but was %v", digestsOf(regular))
+	}
+
+	// Tagged children and children of kept indexes are not orphaned
+	orphaned := graph.OrphanedChildren([]*ecr.ImageDetail{oldIndex}, children)
+	if !reflect.DeepEqual(digestsOf(orphaned), []string{"sha256:b1"}) {
+		t.Errorf("Expected orphaned children to be [sha256:b1], but was %v", digestsOf(orphaned))
+	}
+
+	orphaned = graph.OrphanedChildren([]*ecr.ImageDetail{oldIndex, newIndex}, children)
+	if !reflect.DeepEqual(digestsOf(orphaned), []string{"sha256:b1", "sha256:b2", "sha256:b3"}) {
+		t.Errorf("Expected orphaned children to be [sha256:b1 sha256:b2 sha256:b3], but was %v", digestsOf(orphaned))
+	}
+
+	removable := graph.WithoutKeptChildren([]*ecr.ImageDetail{oldIndex, images[2], images[3]})
+	if !reflect.DeepEqual(digestsOf(removable), []string{"sha256:a1", "sha256:b1"}) {
+		t.Errorf("Expected removable images to be [sha256:a1 sha256:b1], but was %v", digestsOf(removable))
+	}
+
+	var nilGraph *ImageGraph
+	if regular, _ = nilGraph.SplitChildren(images); len(regular) != len(images) {
+		t.Errorf("Expected nil graph not to have children")
+	}
+}
+
+func TestSplitImageIndexes(t *testing.T) {
+	indexType := "application/vnd.oci.image.index.v1+json"
+
+	index := newGraphTestImage("sha256:a1")
+	index.ImageManifestMediaType = &indexType
+
+	indexes, others := SplitImageIndexes([]*ecr.ImageDetail{newGraphTestImage("sha256:b1"), index})
+
+	if !reflect.DeepEqual(digestsOf(indexes), []string{"sha256:a1"}) || !reflect.DeepEqual(digestsOf(others), []string{"sha256:b1"}) {
+		t.Errorf("Expected indexes to be split from other images, but was %v and %v", digestsOf(indexes), digestsOf(others))
+	}
+}
+
+func TestArtifactSubject(t *testing.T) {
+	testCases := []struct {
+		tags       []string
+		expected   string
+		expectedOk bool
+	}{
+		{[]string{"sha256-a1.sig"}, "sha256:a1", true},
+		{[]string{"sha256-a1.att", "sha256-a1.sbom"}, "sha256:a1", true},
+		{[]string{"sha256-a1.sig", "sha256-b1.sig"}, "", false},
+		{[]string{"sha256-a1.sig", "v1"}, "", false},
+		{[]string{"sha256-a1"}, "", false},
+		{[]string{}, "", false},
+	}
+
+	for _, testCase := range testCases {
+		subject, ok := ArtifactSubject(newGraphTestImage("sha256:c1", testCase.tags...))
+
+		if subject != testCase.expected || ok != testCase.expectedOk {
+			t.Errorf("Expected subject of %v to be '%s' (%v), but was '%s' (%v)", testCase.tags, testCase.expected, testCase.expectedOk, subject, ok)
+		}
+	}
+}
+
+func TestManifestSubject(t *testing.T) {
+	testCases := []struct {
+		manifest      string
+		expected      string
+		expectedError bool
+	}{
+		{`{"subject": {"digest": "sha256:a1"}, "layers": []}`, "sha256:a1", false},
+		{`{"layers": []}`, "", false},
+		{`not json`, "", true},
+	}
+
+	for _, testCase := range testCases {
+		subject, err := ManifestSubject(testCase.manifest)
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned: %v, but was %v", testCase.expectedError, err)
+		}
+
+		if subject != testCase.expected {
+			t.Errorf("Expected subject to be '%s', but was '%s'", testCase.expected, subject)
+		}
+	}
+}
+
+func TestNewImageGraphWithArtifacts(t *testing.T) {
+	sbomType, configType := "application/spdx+json", "application/vnd.oci.image.config.v1+json"
+	repoName, referrerDigest, manifest := "repo-1", "sha256:c2", `{"subject": {"digest": "sha256:a1"}}`
+
+	image := newGraphTestImage("sha256:a1", "v1")
+	image.ArtifactMediaType = &configType
+
+	referrer := newGraphTestImage(referrerDigest)
+	referrer.ArtifactMediaType = &sbomType
+
+	client := ECRClientImpl{
+		ECRClient: &mockAWSECRClient{
+			t: t,
+
+			// Only referrers are retrieved, signatures are found by their tags
+			expectedRepositoryNames: []string{repoName},
+			expectedImageDigests:    []string{referrerDigest},
+
+			batchGetImageOutput: &ecr.BatchGetImageOutput{
+				Images: []*ecr.Image{
+					{
+						ImageId:       &ecr.ImageIdentifier{ImageDigest: &referrerDigest},
+						ImageManifest: &manifest,
+					},
+				},
+			},
+		},
+	}
+
+	images := []*ecr.ImageDetail{
+		image,
+		newGraphTestImage("sha256:c1", "sha256-a1.sig"),
+		referrer,
+		newGraphTestImage("sha256:c3", "sha256-b1.sig"),
+	}
+
+	graph, err := NewImageGraph(&client, images)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if !reflect.DeepEqual(graph.Artifacts, map[string][]string{"sha256:a1": {"sha256:c1", "sha256:c2"}, "sha256:b1": {"sha256:c3"}}) {
+		t.Errorf("Expected artifacts to be mapped, but was %v", graph.Artifacts)
+	}
+
+	// Artifacts of missing images are handled as regular images
+	regular, children := graph.SplitChildren(images)
+	if !reflect.DeepEqual(digestsOf(regular), []string{"sha256:a1", "sha256:c3"}) {
+		t.Errorf("Expected regular images to be [sha256:a1 sha256:c3], but was %v", digestsOf(regular))
+	}
+
+	orphaned := graph.OrphanedChildren([]*ecr.ImageDetail{}, children)
+	if len(orphaned) != 0 {
+		t.Errorf("Expected orphaned artifacts to be empty, but was %v", digestsOf(orphaned))
+	}
+
+	orphaned = graph.OrphanedChildren([]*ecr.ImageDetail{image}, children)
+	if !reflect.DeepEqual(digestsOf(orphaned), []string{"sha256:c1", "sha256:c2"}) {
+		t.Errorf("Expected orphaned artifacts to be [sha256:c1 sha256:c2], but was %v", digestsOf(orphaned))
+	}
+
+	removable := graph.WithoutKeptChildren(children)
+	if len(removable) != 0 {
+		t.Errorf("Expected removable artifacts to be empty, but was %v", digestsOf(removable))
+	}
+}
+
+func TestOrphanedChildrenWithArtifactsOfChildren(t *testing.T) {
+	index, child, signature := newGraphTestImage("sha256:a1", "v1"), newGraphTestImage("sha256:b1"), newGraphTestImage("sha256:c1", "sha256-b1.sig")
+
+	graph := &ImageGraph{
+		Children:  map[string][]string{"sha256:a1": {"sha256:b1"}},
+		Parents:   map[string][]string{"sha256:b1": {"sha256:a1"}},
+		Artifacts: map[string][]string{"sha256:b1": {"sha256:c1"}},
+		Subjects:  map[string]string{"sha256:c1": "sha256:b1"},
+		present:   digestSet([]*ecr.ImageDetail{index, child, signature}),
+	}
+
+	// The signature is listed before the child it describes
+	orphaned := graph.OrphanedChildren([]*ecr.ImageDetail{index}, []*ecr.ImageDetail{signature, child})
+	if !reflect.DeepEqual(digestsOf(orphaned), []string{"sha256:b1", "sha256:c1"}) {
+		t.Errorf("Expected orphaned children to be [sha256:b1 sha256:c1], but was %v", digestsOf(orphaned))
+	}
+}
@@ -0,0 +1,201 @@
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// ImageMetadata holds the labels of an image's config and the annotations of
+// its manifest.
+type ImageMetadata struct {
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// Lookup returns the value of the annotation with the given key, or else the
+// value of the label with that key.
+func (m *ImageMetadata) Lookup(key string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+
+	if value, ok := m.Annotations[key]; ok {
+		return value, true
+	}
+
+	value, ok := m.Labels[key]
+	return value, ok
+}
+
+// WithChildLabels returns the given metadata of an image index, whose own
+// manifest references no config, along with the labels of the configs of the
+// images it references. Labels of the index itself take precedence, followed
+// by the ones of the given children, in order.
+func (m *ImageMetadata) WithChildLabels(children []*ImageMetadata) *ImageMetadata {
+	merged := &ImageMetadata{
+		Labels:      map[string]string{},
+		Annotations: map[string]string{},
+	}
+
+	if m != nil {
+		for key, value := range m.Annotations {
+			merged.Annotations[key] = value
+		}
+	}
+
+	for _, md := range append([]*ImageMetadata{m}, children...) {
+		if md == nil {
+			continue
+		}
+
+		for key, value := range md.Labels {
+			if _, ok := merged.Labels[key]; !ok {
+				merged.Labels[key] = value
+			}
+		}
+	}
+
+	return merged
+}
+
+// ParseManifestMetadata returns the annotations of the given manifest, along
+// with the digest of the config it references, if any.
+func ParseManifestMetadata(manifest string) (map[string]string, string, error) {
+	parsed := struct {
+		Config *struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		Annotations map[string]string `json:"annotations"`
+	}{}
+
+	if err := json.Unmarshal([]byte(manifest), &parsed); err != nil {
+		return nil, "", err
+	}
+
+	if parsed.Annotations == nil {
+		parsed.Annotations = map[string]string{}
+	}
+
+	if parsed.Config == nil {
+		return parsed.Annotations, "", nil
+	}
+
+	return parsed.Annotations, parsed.Config.Digest, nil
+}
+
+// ParseConfigLabels returns the labels set in the given image config. Configs
+// that are not container image configs, such as the ones of artifacts, have
+// no labels.
+func ParseConfigLabels(config []byte) map[string]string {
+	parsed := struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}{}
+
+	if err := json.Unmarshal(config, &parsed); err != nil || parsed.Config.Labels == nil {
+		return map[string]string{}
+	}
+
+	return parsed.Config.Labels
+}
+
+// GetImageMetadata returns the labels and annotations of the given images,
+// all stored in the same repository, by digest. Since images never change,
+// their metadata is cached, so it is only retrieved once for each image, for
+// as long as the image is listed in its repository.
+func (c *ECRClientImpl) GetImageMetadata(images []*ecr.ImageDetail) (map[string]*ImageMetadata, error) {
+	result := map[string]*ImageMetadata{}
+	toFetch := []*ecr.ImageDetail{}
+
+	c.metadataLock.Lock()
+	for _, image := range images {
+		digest := aws.StringValue(image.ImageDigest)
+		if md, ok := c.metadata[aws.StringValue(image.RepositoryName)][digest]; ok {
+			result[digest] = md
+		} else {
+			toFetch = append(toFetch, image)
+		}
+	}
+	c.metadataLock.Unlock()
+
+	for start := 0; start < len(toFetch); start += BatchRemoveMaxImages {
+		end := start + BatchRemoveMaxImages
+		if end > len(toFetch) {
+			end = len(toFetch)
+		}
+
+		manifests, err := c.GetImages(toFetch[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, manifest := range manifests {
+			if manifest.ImageId == nil {
+				continue
+			}
+
+			digest := aws.StringValue(manifest.ImageId.ImageDigest)
+
+			annotations, configDigest, err := ParseManifestMetadata(aws.StringValue(manifest.ImageManifest))
+			if err != nil {
+				return nil, fmt.Errorf("Cannot parse manifest of image '%s': %v", digest, err)
+			}
+
+			md := &ImageMetadata{
+				Labels:      map[string]string{},
+				Annotations: annotations,
+			}
+
+			if configDigest != "" {
+				config, err := c.GetLayer(toFetch[start].RepositoryName, toFetch[start].RegistryId, configDigest)
+				if err != nil {
+					return nil, fmt.Errorf("Cannot retrieve config of image '%s': %v", digest, err)
+				}
+				md.Labels = ParseConfigLabels(config)
+			}
+
+			result[digest] = md
+
+			repoName := aws.StringValue(toFetch[start].RepositoryName)
+
+			c.metadataLock.Lock()
+			if c.metadata == nil {
+				c.metadata = map[string]map[string]*ImageMetadata{}
+			}
+			if c.metadata[repoName] == nil {
+				c.metadata[repoName] = map[string]*ImageMetadata{}
+			}
+			c.metadata[repoName][digest] = md
+			c.metadataLock.Unlock()
+		}
+	}
+
+	return result, nil
+}
+
+// pruneMetadata drops the cached metadata of the images of the given
+// repository that are not among the given ones, which were just listed, so
+// that the cache does not grow as images are removed.
+func (c *ECRClientImpl) pruneMetadata(repoName string, images []*ecr.ImageDetail) {
+	c.metadataLock.Lock()
+	defer c.metadataLock.Unlock()
+
+	cached, ok := c.metadata[repoName]
+	if !ok {
+		return
+	}
+
+	listed := map[string]*ImageMetadata{}
+	for _, image := range images {
+		digest := aws.StringValue(image.ImageDigest)
+		if md, ok := cached[digest]; ok {
+			listed[digest] = md
+		}
+	}
+
+	c.metadata[repoName] = listed
+}
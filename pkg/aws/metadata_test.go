@@ -0,0 +1,195 @@
+package aws
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestImageMetadataLookup(t *testing.T) {
+	md := &ImageMetadata{
+		Labels:      map[string]string{"keep": "true", "team": "label"},
+		Annotations: map[string]string{"team": "annotation"},
+	}
+
+	testCases := []struct {
+		md            *ImageMetadata
+		key           string
+		expected      string
+		expectedFound bool
+	}{
+		{md, "keep", "true", true},
+		{md, "team", "annotation", true},
+		{md, "missing", "", false},
+		{nil, "keep", "", false},
+	}
+
+	for _, testCase := range testCases {
+		value, ok := testCase.md.Lookup(testCase.key)
+
+		if value != testCase.expected || ok != testCase.expectedFound {
+			t.Errorf("Expected '%s' to be '%s' (%v), but was '%s' (%v)", testCase.key, testCase.expected, testCase.expectedFound, value, ok)
+		}
+	}
+}
+
+func TestImageMetadataWithChildLabels(t *testing.T) {
+	index := &ImageMetadata{
+		Labels:      map[string]string{"team": "index"},
+		Annotations: map[string]string{"keep": "true"},
+	}
+
+	children := []*ImageMetadata{
+		{Labels: map[string]string{"team": "amd64", "retain-until": "2030-01-01"}},
+		nil,
+		{Labels: map[string]string{"retain-until": "2020-01-01", "arch": "arm64"}},
+	}
+
+	testCases := []struct {
+		md                  *ImageMetadata
+		expectedLabels      map[string]string
+		expectedAnnotations map[string]string
+	}{
+		{index, map[string]string{"team": "index", "retain-until": "2030-01-01", "arch": "arm64"}, map[string]string{"keep": "true"}},
+		{nil, map[string]string{"team": "amd64", "retain-until": "2030-01-01", "arch": "arm64"}, map[string]string{}},
+	}
+
+	for i, testCase := range testCases {
+		merged := testCase.md.WithChildLabels(children)
+
+		if !reflect.DeepEqual(merged.Labels, testCase.expectedLabels) {
+			t.Errorf("Expected labels in test case %d to be %v, but was %v", i, testCase.expectedLabels, merged.Labels)
+		}
+
+		if !reflect.DeepEqual(merged.Annotations, testCase.expectedAnnotations) {
+			t.Errorf("Expected annotations in test case %d to be %v, but was %v", i, testCase.expectedAnnotations, merged.Annotations)
+		}
+	}
+
+	if !reflect.DeepEqual(index.Labels, map[string]string{"team": "index"}) {
+		t.Errorf("Expected metadata of the index not to change, but was %v", index.Labels)
+	}
+}
+
+func TestParseManifestMetadata(t *testing.T) {
+	testCases := []struct {
+		manifest            string
+		expectedAnnotations map[string]string
+		expectedConfig      string
+		expectedError       bool
+	}{
+		{`{"config": {"digest": "sha256:c1"}, "annotations": {"keep": "true"}}`, map[string]string{"keep": "true"}, "sha256:c1", false},
+		{`{"manifests": []}`, map[string]string{}, "", false},
+		{`not json`, nil, "", true},
+	}
+
+	for _, testCase := range testCases {
+		annotations, config, err := ParseManifestMetadata(testCase.manifest)
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned: %v, but was %v", testCase.expectedError, err)
+		}
+
+		if err == nil && (!reflect.DeepEqual(annotations, testCase.expectedAnnotations) || config != testCase.expectedConfig) {
+			t.Errorf("Expected annotations %v and config '%s', but was %v and '%s'", testCase.expectedAnnotations, testCase.expectedConfig, annotations, config)
+		}
+	}
+}
+
+func TestParseConfigLabels(t *testing.T) {
+	testCases := []struct {
+		config   string
+		expected map[string]string
+	}{
+		{`{"config": {"Labels": {"keep": "true"}}}`, map[string]string{"keep": "true"}},
+		{`{"config": {}}`, map[string]string{}},
+		{`not json`, map[string]string{}},
+	}
+
+	for _, testCase := range testCases {
+		if labels := ParseConfigLabels([]byte(testCase.config)); !reflect.DeepEqual(labels, testCase.expected) {
+			t.Errorf("Expected labels to be %v, but was %v", testCase.expected, labels)
+		}
+	}
+}
+
+func TestGetImageMetadata(t *testing.T) {
+	repoName, digest := "repo-1", "sha256:a1"
+	config := []byte(`{"config": {"Labels": {"keep": "true"}}}`)
+	configDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(config))
+	manifest := fmt.Sprintf(`{"config": {"digest": "%s"}, "annotations": {"team": "a"}}`, configDigest)
+
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		w.Write(config)
+	}))
+	defer server.Close()
+
+	client := ECRClientImpl{
+		ECRClient: &mockAWSECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			expectedImageDigests:    []string{digest},
+			expectedLayerDigest:     configDigest,
+
+			batchGetImageOutput: &ecr.BatchGetImageOutput{
+				Images: []*ecr.Image{
+					{
+						ImageId:       &ecr.ImageIdentifier{ImageDigest: &digest},
+						ImageManifest: &manifest,
+					},
+				},
+			},
+			downloadURL: server.URL,
+		},
+		HTTPClient: server.Client(),
+	}
+
+	images := []*ecr.ImageDetail{newGraphTestImage(digest, "v1")}
+	expected := map[string]*ImageMetadata{
+		digest: {
+			Labels:      map[string]string{"keep": "true"},
+			Annotations: map[string]string{"team": "a"},
+		},
+	}
+
+	// Metadata is only retrieved the first time
+	for i := 0; i < 2; i++ {
+		metadata, err := client.GetImageMetadata(images)
+		if err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+
+		if !reflect.DeepEqual(metadata, expected) {
+			t.Errorf("Expected metadata to be %+v, but was %+v", expected, metadata)
+		}
+	}
+
+	if downloads != 1 {
+		t.Errorf("Expected metadata to be retrieved once, but was %d times", downloads)
+	}
+
+	// Metadata of images no longer listed is dropped from the cache
+	if _, err := client.ListImages(&repoName, nil); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if cached := len(client.metadata[repoName]); cached != 0 {
+		t.Errorf("Expected cached metadata to be empty, but holds %d images", cached)
+	}
+
+	if _, err := client.GetImageMetadata(images); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if downloads != 2 {
+		t.Errorf("Expected metadata to be retrieved again, but was retrieved %d times", downloads)
+	}
+}
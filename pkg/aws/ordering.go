@@ -0,0 +1,242 @@
+package aws
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// Names of the built-in image orderings.
+const (
+	PushDateOrderingName = "push-date"
+	LastPullOrderingName = "last-pull"
+	SizeOrderingName     = "size"
+	SemverOrderingName   = "semver"
+	LexicalOrderingName  = "lexical"
+)
+
+// ImageOrderingNames lists the names of the built-in image orderings.
+var ImageOrderingNames = []string{
+	PushDateOrderingName,
+	LastPullOrderingName,
+	SizeOrderingName,
+	SemverOrderingName,
+	LexicalOrderingName,
+}
+
+var semverRegexp = regexp.MustCompile(`^v?(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// ImageOrdering defines the order in which unused images are removed.
+type ImageOrdering interface {
+
+	// Sort sorts the given images so that the first ones are the first to
+	// be removed.
+	Sort(images []*ecr.ImageDetail)
+}
+
+// PushDateOrdering removes the least recently pushed images first.
+type PushDateOrdering struct{}
+
+// LastPullOrdering removes the least recently pulled images first. Images
+// never pulled, or whose pull time is unknown, go first, the least recently
+// pushed ones first.
+type LastPullOrdering struct {
+	LastPullTime func(image *ecr.ImageDetail) (time.Time, bool)
+}
+
+// SizeOrdering removes the largest images first, and the least recently
+// pushed ones first among images of the same size.
+type SizeOrdering struct{}
+
+// SemverOrdering removes the images with the lowest semantic version tags
+// first, according to the highest such tag of each image. Images without
+// semantic version tags go first, the least recently pushed ones first.
+type SemverOrdering struct{}
+
+// LexicalOrdering removes the images whose tags come first in lexical
+// order first, according to the last such tag of each image. Untagged
+// images go first, the least recently pushed ones first.
+type LexicalOrdering struct{}
+
+// NewImageOrdering returns the built-in image ordering with the given name,
+// or the push date ordering if the name is empty. The given client provides
+// the last pull time of images, if needed.
+func NewImageOrdering(name string, ecrClient ECRClient) (ImageOrdering, error) {
+	switch name {
+	case "", PushDateOrderingName:
+		return &PushDateOrdering{}, nil
+	case LastPullOrderingName:
+		return &LastPullOrdering{LastPullTime: ecrClient.LastPullTime}, nil
+	case SizeOrderingName:
+		return &SizeOrdering{}, nil
+	case SemverOrderingName:
+		return &SemverOrdering{}, nil
+	case LexicalOrderingName:
+		return &LexicalOrdering{}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown image ordering '%s'", name)
+}
+
+// ValidImageOrdering returns whether the given name is the name of a
+// built-in image ordering.
+func ValidImageOrdering(name string) bool {
+	for _, n := range ImageOrderingNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Sort sorts the given images by push date.
+func (o *PushDateOrdering) Sort(images []*ecr.ImageDetail) {
+	SortImagesByPushDate(images)
+}
+
+// Sort sorts the given images by last pull time.
+func (o *LastPullOrdering) Sort(images []*ecr.ImageDetail) {
+	SortImagesByPushDate(images)
+
+	sort.SliceStable(images, func(i, j int) bool {
+		ti, iok := o.LastPullTime(images[i])
+		tj, jok := o.LastPullTime(images[j])
+
+		if !iok || !jok {
+			return !iok && jok
+		}
+		return ti.Before(tj)
+	})
+}
+
+// Sort sorts the given images by size, the largest ones first.
+func (o *SizeOrdering) Sort(images []*ecr.ImageDetail) {
+	SortImagesByPushDate(images)
+
+	sort.SliceStable(images, func(i, j int) bool {
+		return aws.Int64Value(images[i].ImageSizeInBytes) > aws.Int64Value(images[j].ImageSizeInBytes)
+	})
+}
+
+// Sort sorts the given images by semantic version.
+func (o *SemverOrdering) Sort(images []*ecr.ImageDetail) {
+	SortImagesByPushDate(images)
+
+	sort.SliceStable(images, func(i, j int) bool {
+		vi, iok := highestSemver(images[i])
+		vj, jok := highestSemver(images[j])
+
+		if !iok || !jok {
+			return !iok && jok
+		}
+		return compareSemver(vi, vj) < 0
+	})
+}
+
+// Sort sorts the given images by tag, in lexical order.
+func (o *LexicalOrdering) Sort(images []*ecr.ImageDetail) {
+	SortImagesByPushDate(images)
+
+	sort.SliceStable(images, func(i, j int) bool {
+		ti, iok := lastTag(images[i])
+		tj, jok := lastTag(images[j])
+
+		if !iok || !jok {
+			return !iok && jok
+		}
+		return ti < tj
+	})
+}
+
+// highestSemver returns the highest semantic version among the tags of the
+// given image, if any.
+func highestSemver(image *ecr.ImageDetail) ([]string, bool) {
+	var highest []string
+
+	for _, tag := range image.ImageTags {
+		version := semverRegexp.FindStringSubmatch(aws.StringValue(tag))
+		if version == nil {
+			continue
+		}
+
+		if highest == nil || compareSemver(version[1:], highest) > 0 {
+			highest = version[1:]
+		}
+	}
+
+	return highest, highest != nil
+}
+
+// compareSemver compares the given semantic versions, given as their
+// major, minor, patch and pre-release parts, following the precedence rules
+// of the semver spec.
+func compareSemver(a, b []string) int {
+	for i := 0; i < 3; i++ {
+		if c := compareNumbers(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+
+	// A pre-release version has lower precedence than the normal version
+	switch {
+	case a[3] == b[3]:
+		return 0
+	case a[3] == "":
+		return 1
+	case b[3] == "":
+		return -1
+	}
+
+	ai, bi := strings.Split(a[3], "."), strings.Split(b[3], ".")
+	for i := 0; i < len(ai) && i < len(bi); i++ {
+		_, aErr := strconv.ParseUint(ai[i], 10, 64)
+		_, bErr := strconv.ParseUint(bi[i], 10, 64)
+
+		var c int
+		switch {
+		case aErr == nil && bErr == nil:
+			c = compareNumbers(ai[i], bi[i])
+		case aErr == nil:
+			c = -1
+		case bErr == nil:
+			c = 1
+		default:
+			c = strings.Compare(ai[i], bi[i])
+		}
+
+		if c != 0 {
+			return c
+		}
+	}
+
+	return len(ai) - len(bi)
+}
+
+// compareNumbers compares the given decimal numbers without leading zeros,
+// which may not fit in an integer.
+func compareNumbers(a, b string) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+// lastTag returns the last of the tags of the given image in lexical order,
+// if any.
+func lastTag(image *ecr.ImageDetail) (string, bool) {
+	last, found := "", false
+
+	for _, tag := range image.ImageTags {
+		if !found || aws.StringValue(tag) > last {
+			last, found = aws.StringValue(tag), true
+		}
+	}
+
+	return last, found
+}
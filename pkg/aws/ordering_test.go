@@ -0,0 +1,145 @@
+package aws
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// newOrderingTestImages returns images pushed in the given order, with the
+// given sizes and tags, where an empty tag stands for an untagged image.
+func newOrderingTestImages(sizes []int64, tags []string) []*ecr.ImageDetail {
+	images := []*ecr.ImageDetail{}
+
+	for i := range sizes {
+		image := &ecr.ImageDetail{
+			ImageDigest:      aws.String(string(rune('a' + i))),
+			ImagePushedAt:    aws.Time(time.Unix(int64(i), 0)),
+			ImageSizeInBytes: aws.Int64(sizes[i]),
+		}
+
+		if tags[i] != "" {
+			image.ImageTags = []*string{aws.String(tags[i])}
+		}
+
+		images = append(images, image)
+	}
+
+	return images
+}
+
+func orderedDigests(ordering ImageOrdering, images []*ecr.ImageDetail) []string {
+	sorted := append([]*ecr.ImageDetail{}, images...)
+
+	// Starts from the reverse order, so that sorting matters
+	for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+		sorted[i], sorted[j] = sorted[j], sorted[i]
+	}
+
+	ordering.Sort(sorted)
+
+	digests := []string{}
+	for _, image := range sorted {
+		digests = append(digests, *image.ImageDigest)
+	}
+	return digests
+}
+
+func TestImageOrderings(t *testing.T) {
+	images := newOrderingTestImages(
+		[]int64{10, 30, 20, 30, 5},
+		[]string{"v1.10.0", "", "v1.9.0", "v1.10.0-rc.1", "latest"})
+
+	pullTimes := map[string]time.Time{
+		"b": time.Unix(20, 0),
+		"c": time.Unix(10, 0),
+		"d": time.Unix(30, 0),
+	}
+
+	lastPullTime := func(image *ecr.ImageDetail) (time.Time, bool) {
+		pulledAt, ok := pullTimes[*image.ImageDigest]
+		return pulledAt, ok
+	}
+
+	testCases := []struct {
+		ordering ImageOrdering
+		expected []string
+	}{
+		{&PushDateOrdering{}, []string{"a", "b", "c", "d", "e"}},
+		{&LastPullOrdering{LastPullTime: lastPullTime}, []string{"a", "e", "c", "b", "d"}},
+		{&SizeOrdering{}, []string{"b", "d", "c", "a", "e"}},
+		{&SemverOrdering{}, []string{"b", "e", "c", "d", "a"}},
+		{&LexicalOrdering{}, []string{"b", "e", "a", "d", "c"}},
+	}
+
+	for _, testCase := range testCases {
+		if actual := orderedDigests(testCase.ordering, images); !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected images sorted by %T to be %v, but was %v", testCase.ordering, testCase.expected, actual)
+		}
+	}
+}
+
+func TestSemverOrderingWithSeveralTags(t *testing.T) {
+	images := newOrderingTestImages([]int64{0, 0}, []string{"2.0.0", "1.5.0"})
+	images[1].ImageTags = append(images[1].ImageTags, aws.String("3.0.0"))
+
+	if actual := orderedDigests(&SemverOrdering{}, images); !reflect.DeepEqual(actual, []string{"a", "b"}) {
+		t.Errorf("Expected images to be sorted by their highest version, but was %v", actual)
+	}
+}
+
+func TestCompareSemver(t *testing.T) {
+	testCases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.0.0", "2.0.0", -1},
+		{"1.10.0", "1.9.0", 1},
+		{"1.0.0-alpha", "1.0.0", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-rc.1", "1.0.0-beta.11", 1},
+		{"1.0.0+build.1", "1.0.0", 0},
+		{"18446744073709551616.0.0", "18446744073709551615.0.0", 1},
+	}
+
+	sign := func(n int) int {
+		switch {
+		case n < 0:
+			return -1
+		case n > 0:
+			return 1
+		}
+		return 0
+	}
+
+	for _, testCase := range testCases {
+		a := semverRegexp.FindStringSubmatch(testCase.a)[1:]
+		b := semverRegexp.FindStringSubmatch(testCase.b)[1:]
+
+		if actual := sign(compareSemver(a, b)); actual != testCase.expected {
+			t.Errorf("Expected comparison of '%s' and '%s' to be %d, but was %d", testCase.a, testCase.b, testCase.expected, actual)
+		}
+	}
+}
+
+func TestNewImageOrdering(t *testing.T) {
+	for _, name := range append([]string{""}, ImageOrderingNames...) {
+		if _, err := NewImageOrdering(name, &ECRClientImpl{}); err != nil {
+			t.Errorf("Expected error for '%s' to be nil, but was %v", name, err)
+		}
+	}
+
+	if _, err := NewImageOrdering("oldest", &ECRClientImpl{}); err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+
+	if ValidImageOrdering("oldest") || !ValidImageOrdering("semver") {
+		t.Errorf("Expected only built-in image orderings to be valid")
+	}
+}
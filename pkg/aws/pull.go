@@ -0,0 +1,17 @@
+package aws
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// LastPullTime returns the last time the given image was pulled, as
+// recorded by ECR, if known.
+func (c *ECRClientImpl) LastPullTime(image *ecr.ImageDetail) (time.Time, bool) {
+	if image.LastRecordedPullTime == nil {
+		return time.Time{}, false
+	}
+
+	return *image.LastRecordedPullTime, true
+}
@@ -0,0 +1,34 @@
+package aws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestLastPullTime(t *testing.T) {
+	pulledAt := time.Unix(1500000000, 0)
+
+	testCases := []struct {
+		image    *ecr.ImageDetail
+		expected bool
+	}{
+		{&ecr.ImageDetail{LastRecordedPullTime: &pulledAt}, true},
+		{&ecr.ImageDetail{}, false},
+	}
+
+	client := &ECRClientImpl{}
+
+	for i, testCase := range testCases {
+		actual, ok := client.LastPullTime(testCase.image)
+
+		if ok != testCase.expected {
+			t.Errorf("Expected pull time to be known in test case %d: %v, but was %v", i, testCase.expected, ok)
+		}
+
+		if ok && !actual.Equal(pulledAt) {
+			t.Errorf("Expected pull time to be %v in test case %d, but was %v", pulledAt, i, actual)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package aws
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// NewS3Client returns a new client for interacting with the S3 API, using
+// the default credentials chain.
+//
+// If endpoint is not empty, it replaces the default regional S3 endpoint,
+// which is useful for talking to S3-compatible object stores. In that case,
+// path-style addressing is used, since those stores often do not support
+// virtual-hosted-style buckets.
+func NewS3Client(region, endpoint, caBundle string) (*s3.S3, error) {
+	awsConfig := aws.NewConfig()
+	if endpoint != "" {
+		awsConfig.WithS3ForcePathStyle(true)
+	}
+
+	sess, err := newSession(awsConfig, region, endpoint, caBundle)
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.New(sess), nil
+}
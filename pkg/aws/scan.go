@@ -0,0 +1,182 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// Time for which the scan findings retrieved for an image are reused, since
+// the image may be rescanned, e.g. when its vulnerability database is updated.
+const scanFindingsTTL = time.Hour
+
+// cachedScanFindings holds the scan findings of an image, along with when
+// they were retrieved.
+type cachedScanFindings struct {
+	counts      map[string]int64
+	retrievedAt time.Time
+}
+
+// ScanSeverities lists the severities of scan findings, from the most to the
+// least severe.
+var ScanSeverities = []string{
+	ecr.FindingSeverityCritical,
+	ecr.FindingSeverityHigh,
+	ecr.FindingSeverityMedium,
+	ecr.FindingSeverityLow,
+	ecr.FindingSeverityInformational,
+	ecr.FindingSeverityUndefined,
+}
+
+// ValidScanSeverity returns whether the given severity is a known severity
+// of scan findings.
+func ValidScanSeverity(severity string) bool {
+	for _, s := range ScanSeverities {
+		if s == severity {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScanSummary returns whether the details of the given image include the
+// summary of its scan findings.
+func HasScanSummary(image *ecr.ImageDetail) bool {
+	return image.ImageScanFindingsSummary != nil
+}
+
+// HasCompletedScan returns whether the given image has been scanned.
+func HasCompletedScan(image *ecr.ImageDetail) bool {
+	return image.ImageScanStatus != nil && aws.StringValue(image.ImageScanStatus.Status) == ecr.ScanStatusComplete
+}
+
+// SeverityCounts returns the number of scan findings of each severity of the
+// given image, according to the summary included in its details.
+func SeverityCounts(image *ecr.ImageDetail) map[string]int64 {
+	if image.ImageScanFindingsSummary == nil {
+		return map[string]int64{}
+	}
+	return toSeverityCounts(image.ImageScanFindingsSummary.FindingSeverityCounts)
+}
+
+// IsVulnerable returns whether the given severity counts include findings of
+// the given severity, or of any more severe one.
+func IsVulnerable(counts map[string]int64, severity string) bool {
+	for _, s := range ScanSeverities {
+		if counts[s] > 0 {
+			return true
+		}
+		if s == severity {
+			break
+		}
+	}
+	return false
+}
+
+// DescribeSeverityCounts returns a human-readable summary of the given
+// severity counts, such as "2 CRITICAL, 5 HIGH".
+func DescribeSeverityCounts(counts map[string]int64) string {
+	parts := []string{}
+	for _, s := range ScanSeverities {
+		if counts[s] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[s], s))
+		}
+	}
+
+	if len(parts) == 0 {
+		return "no findings"
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// GetScanFindings returns the number of scan findings of each severity of the
+// given image, which is useful when its details do not include them, such as
+// with enhanced scanning. Images that have not been scanned have no findings.
+// The findings are cached for scanFindingsTTL, as long as the image is listed
+// in its repository, so that rescans are eventually taken into account.
+func (c *ECRClientImpl) GetScanFindings(image *ecr.ImageDetail) (map[string]int64, error) {
+	repoName, digest := aws.StringValue(image.RepositoryName), aws.StringValue(image.ImageDigest)
+	now := time.Now()
+
+	c.scanFindingsLock.Lock()
+	cached, ok := c.scanFindings[repoName][digest]
+	c.scanFindingsLock.Unlock()
+
+	if ok && now.Before(cached.retrievedAt.Add(scanFindingsTTL)) {
+		return cached.counts, nil
+	}
+
+	output, err := c.ECRClient.DescribeImageScanFindings(&ecr.DescribeImageScanFindingsInput{
+		RegistryId:     image.RegistryId,
+		RepositoryName: image.RepositoryName,
+		ImageId: &ecr.ImageIdentifier{
+			ImageDigest: image.ImageDigest,
+		},
+		MaxResults: aws.Int64(1),
+	})
+
+	// Not cached, since the image may be scanned later
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeScanNotFoundException {
+		return map[string]int64{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int64{}
+	if output.ImageScanFindings != nil {
+		counts = toSeverityCounts(output.ImageScanFindings.FindingSeverityCounts)
+	}
+
+	c.scanFindingsLock.Lock()
+	if c.scanFindings == nil {
+		c.scanFindings = map[string]map[string]*cachedScanFindings{}
+	}
+	if c.scanFindings[repoName] == nil {
+		c.scanFindings[repoName] = map[string]*cachedScanFindings{}
+	}
+	c.scanFindings[repoName][digest] = &cachedScanFindings{
+		counts:      counts,
+		retrievedAt: now,
+	}
+	c.scanFindingsLock.Unlock()
+
+	return counts, nil
+}
+
+// pruneScanFindings drops the cached scan findings of the images of the given
+// repository that are not among the given ones, which were just listed, so
+// that the cache does not grow as images are removed.
+func (c *ECRClientImpl) pruneScanFindings(repoName string, images []*ecr.ImageDetail) {
+	c.scanFindingsLock.Lock()
+	defer c.scanFindingsLock.Unlock()
+
+	cached, ok := c.scanFindings[repoName]
+	if !ok {
+		return
+	}
+
+	listed := map[string]*cachedScanFindings{}
+	for _, image := range images {
+		digest := aws.StringValue(image.ImageDigest)
+		if findings, ok := cached[digest]; ok {
+			listed[digest] = findings
+		}
+	}
+
+	c.scanFindings[repoName] = listed
+}
+
+func toSeverityCounts(counts map[string]*int64) map[string]int64 {
+	result := map[string]int64{}
+	for severity, count := range counts {
+		result[severity] = aws.Int64Value(count)
+	}
+	return result
+}
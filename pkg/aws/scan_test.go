@@ -0,0 +1,232 @@
+package aws
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestValidScanSeverity(t *testing.T) {
+	testCases := []struct {
+		severity string
+		expected bool
+	}{
+		{"CRITICAL", true},
+		{"INFORMATIONAL", true},
+		{"critical", false},
+		{"", false},
+	}
+
+	for _, testCase := range testCases {
+		if actual := ValidScanSeverity(testCase.severity); actual != testCase.expected {
+			t.Errorf("Expected severity '%s' to be valid: %v, but was %v", testCase.severity, testCase.expected, actual)
+		}
+	}
+}
+
+func TestSeverityCounts(t *testing.T) {
+	testCases := []struct {
+		image    *ecr.ImageDetail
+		expected map[string]int64
+	}{
+		{&ecr.ImageDetail{}, map[string]int64{}},
+		{
+			&ecr.ImageDetail{
+				ImageScanFindingsSummary: &ecr.ImageScanFindingsSummary{
+					FindingSeverityCounts: map[string]*int64{
+						"CRITICAL": aws.Int64(2),
+						"LOW":      aws.Int64(5),
+					},
+				},
+			},
+			map[string]int64{"CRITICAL": 2, "LOW": 5},
+		},
+	}
+
+	for _, testCase := range testCases {
+		if actual := SeverityCounts(testCase.image); !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected severity counts to be %v, but was %v", testCase.expected, actual)
+		}
+	}
+}
+
+func TestIsVulnerable(t *testing.T) {
+	testCases := []struct {
+		counts   map[string]int64
+		severity string
+		expected bool
+	}{
+		{map[string]int64{}, "CRITICAL", false},
+		{nil, "LOW", false},
+		{map[string]int64{"CRITICAL": 1}, "CRITICAL", true},
+		{map[string]int64{"CRITICAL": 1}, "LOW", true},
+		{map[string]int64{"HIGH": 1}, "CRITICAL", false},
+		{map[string]int64{"HIGH": 1}, "HIGH", true},
+		{map[string]int64{"HIGH": 0}, "HIGH", false},
+		{map[string]int64{"LOW": 3}, "MEDIUM", false},
+	}
+
+	for _, testCase := range testCases {
+		if actual := IsVulnerable(testCase.counts, testCase.severity); actual != testCase.expected {
+			t.Errorf("Expected %v to be vulnerable at severity '%s': %v, but was %v", testCase.counts, testCase.severity, testCase.expected, actual)
+		}
+	}
+}
+
+func TestDescribeSeverityCounts(t *testing.T) {
+	testCases := []struct {
+		counts   map[string]int64
+		expected string
+	}{
+		{map[string]int64{}, "no findings"},
+		{map[string]int64{"LOW": 5, "CRITICAL": 2}, "2 CRITICAL, 5 LOW"},
+		{map[string]int64{"HIGH": 0, "MEDIUM": 1}, "1 MEDIUM"},
+	}
+
+	for _, testCase := range testCases {
+		if actual := DescribeSeverityCounts(testCase.counts); actual != testCase.expected {
+			t.Errorf("Expected description to be '%s', but was '%s'", testCase.expected, actual)
+		}
+	}
+}
+
+func TestGetScanFindings(t *testing.T) {
+	repoName, digest := "repo-1", "sha256:digest"
+
+	image := &ecr.ImageDetail{
+		RepositoryName: &repoName,
+		ImageDigest:    &digest,
+	}
+
+	testCases := []struct {
+		scanFindings   *ecr.ImageScanFindings
+		outputError    error
+		expectedCounts map[string]int64
+		expectedError  bool
+	}{
+		{
+			&ecr.ImageScanFindings{
+				FindingSeverityCounts: map[string]*int64{"HIGH": aws.Int64(3)},
+			},
+			nil,
+			map[string]int64{"HIGH": 3},
+			false,
+		},
+		{nil, nil, map[string]int64{}, false},
+
+		// Not scanned
+		{nil, awserr.New(ecr.ErrCodeScanNotFoundException, "", nil), map[string]int64{}, false},
+
+		{nil, fmt.Errorf(""), nil, true},
+	}
+
+	for i, testCase := range testCases {
+		client := ECRClientImpl{
+			ECRClient: &mockAWSECRClient{
+				t: t,
+
+				expectedRepositoryNames: []string{repoName},
+				expectedImageDigests:    []string{digest},
+
+				scanFindings: testCase.scanFindings,
+				outputError:  testCase.outputError,
+			},
+		}
+
+		counts, err := client.GetScanFindings(image)
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned in test case %d: %v, but was %v", i, testCase.expectedError, err)
+		}
+
+		if !reflect.DeepEqual(counts, testCase.expectedCounts) {
+			t.Errorf("Expected severity counts in test case %d to be %v, but was %v", i, testCase.expectedCounts, counts)
+		}
+	}
+}
+
+func TestGetScanFindingsCache(t *testing.T) {
+	repoName, digest := "repo-1", "sha256:a1"
+
+	ecrClient := &mockAWSECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		expectedImageDigests:    []string{digest},
+
+		scanFindings: &ecr.ImageScanFindings{
+			FindingSeverityCounts: map[string]*int64{"HIGH": aws.Int64(3)},
+		},
+	}
+	client := ECRClientImpl{ECRClient: ecrClient}
+
+	images := []*ecr.ImageDetail{newGraphTestImage(digest, "v1")}
+	expected := map[string]int64{"HIGH": 3}
+
+	// Findings are only retrieved the first time
+	for i := 0; i < 2; i++ {
+		counts, err := client.GetScanFindings(images[0])
+		if err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+
+		if !reflect.DeepEqual(counts, expected) {
+			t.Errorf("Expected severity counts to be %v, but was %v", expected, counts)
+		}
+	}
+
+	if ecrClient.scanFindingsCalls != 1 {
+		t.Errorf("Expected findings to be retrieved once, but was %d times", ecrClient.scanFindingsCalls)
+	}
+
+	// Findings are retrieved again once they expire, in case of rescans
+	client.scanFindings[repoName][digest].retrievedAt = time.Now().Add(-scanFindingsTTL)
+	ecrClient.scanFindings.FindingSeverityCounts["HIGH"] = aws.Int64(1)
+
+	counts, err := client.GetScanFindings(images[0])
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if !reflect.DeepEqual(counts, map[string]int64{"HIGH": 1}) {
+		t.Errorf("Expected severity counts to be map[HIGH:1], but was %v", counts)
+	}
+
+	if ecrClient.scanFindingsCalls != 2 {
+		t.Errorf("Expected expired findings to be retrieved again, but was retrieved %d times", ecrClient.scanFindingsCalls)
+	}
+
+	// Findings of images no longer listed are dropped from the cache
+	client.pruneScanFindings(repoName, []*ecr.ImageDetail{})
+
+	if cached := len(client.scanFindings[repoName]); cached != 0 {
+		t.Errorf("Expected cached findings to be empty, but holds %d images", cached)
+	}
+
+	if _, err := client.GetScanFindings(images[0]); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if ecrClient.scanFindingsCalls != 3 {
+		t.Errorf("Expected findings to be retrieved again, but was retrieved %d times", ecrClient.scanFindingsCalls)
+	}
+
+	// Images not scanned yet are not cached
+	ecrClient.outputError = awserr.New(ecr.ErrCodeScanNotFoundException, "", nil)
+	client.pruneScanFindings(repoName, []*ecr.ImageDetail{})
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetScanFindings(images[0]); err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+	}
+
+	if ecrClient.scanFindingsCalls != 5 {
+		t.Errorf("Expected findings of images not scanned to be retrieved each time, but was retrieved %d times", ecrClient.scanFindingsCalls)
+	}
+}
@@ -0,0 +1,243 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/golang/glog"
+)
+
+// Backup holds what is needed to recreate a removed image, as long as its
+// layers still exist in the repository.
+type Backup struct {
+	RegistryID string    `json:"registryId,omitempty"`
+	Repository string    `json:"repository"`
+	Digest     string    `json:"digest"`
+	Tags       []string  `json:"tags"`
+	MediaType  string    `json:"mediaType"`
+	Manifest   string    `json:"manifest"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// Store defines the expected interface of any object capable of persisting
+// image backups.
+type Store interface {
+	Save(b *Backup) error
+	Load(repoName, digest string) (*Backup, error)
+}
+
+// DirStore persists backups as JSON files in a local directory, one
+// subdirectory per repository.
+type DirStore struct {
+	Dir string
+}
+
+// Client is an aws.ECRClient that backs up the manifests of the images
+// before removing them.
+type Client struct {
+	aws.ECRClient
+
+	Store Store
+}
+
+// NewBackup returns the backup of the given image, given its manifest.
+func NewBackup(detail *ecr.ImageDetail, image *ecr.Image, now time.Time) *Backup {
+	b := &Backup{
+		RegistryID: awssdk.StringValue(detail.RegistryId),
+		Repository: awssdk.StringValue(detail.RepositoryName),
+		Digest:     awssdk.StringValue(detail.ImageDigest),
+		Tags:       awssdk.StringValueSlice(detail.ImageTags),
+		MediaType:  awssdk.StringValue(image.ImageManifestMediaType),
+		Manifest:   awssdk.StringValue(image.ImageManifest),
+		CreatedAt:  now,
+	}
+
+	if b.MediaType == "" {
+		b.MediaType = awssdk.StringValue(detail.ImageManifestMediaType)
+	}
+
+	return b
+}
+
+// NewDirStore returns a Store backed by the given local directory.
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{
+		Dir: dir,
+	}
+}
+
+// Save writes the given backup to the directory.
+func (s *DirStore) Save(b *Backup) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := s.path(b.Repository, b.Digest)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// Load reads the backup of the given image from the directory.
+func (s *DirStore) Load(repoName, digest string) (*Backup, error) {
+	data, err := os.ReadFile(s.path(repoName, digest))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Backup{}
+	if err = json.Unmarshal(data, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (s *DirStore) path(repoName, digest string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(objectName(repoName, digest)))
+}
+
+// NewClient returns a client that backs up images to the given store before
+// removing them with the given client.
+func NewClient(ecrClient aws.ECRClient, store Store) *Client {
+	return &Client{
+		ECRClient: ecrClient,
+		Store:     store,
+	}
+}
+
+// BatchRemoveImages saves a backup of each of the given images, then removes
+// them. If any of the images cannot be backed up, none are removed.
+func (c *Client) BatchRemoveImages(images []*ecr.ImageDetail) error {
+
+	// No images to be removed
+	if len(images) == 0 {
+		return nil
+	}
+
+	if err := c.backUpImages(images); err != nil {
+		return err
+	}
+
+	return c.ECRClient.BatchRemoveImages(images)
+}
+
+// BatchRemoveBackedUpImages removes the given images, only backing up the
+// ones that were not backed up before, so that the backups saved earlier,
+// such as before their tags were replaced, are kept. If any of the images
+// cannot be backed up, none are removed.
+func (c *Client) BatchRemoveBackedUpImages(images []*ecr.ImageDetail) error {
+
+	// No images to be removed
+	if len(images) == 0 {
+		return nil
+	}
+
+	missing := []*ecr.ImageDetail{}
+	for _, image := range images {
+		if _, err := c.Store.Load(awssdk.StringValue(image.RepositoryName), awssdk.StringValue(image.ImageDigest)); err != nil {
+			missing = append(missing, image)
+		}
+	}
+
+	if len(missing) > 0 {
+		if err := c.backUpImages(missing); err != nil {
+			return err
+		}
+	}
+
+	return c.ECRClient.BatchRemoveImages(images)
+}
+
+// BackUpImages saves a backup of each of the given images, with the tags
+// they have now, given their manifests.
+func (c *Client) BackUpImages(images []*ecr.ImageDetail, manifests []*ecr.Image) error {
+	manifestsByDigest := map[string]*ecr.Image{}
+	for _, manifest := range manifests {
+		if manifest.ImageId != nil {
+			manifestsByDigest[awssdk.StringValue(manifest.ImageId.ImageDigest)] = manifest
+		}
+	}
+
+	now := time.Now()
+	for _, image := range images {
+		digest := awssdk.StringValue(image.ImageDigest)
+
+		manifest, ok := manifestsByDigest[digest]
+		if !ok {
+			return fmt.Errorf("Cannot back up image '%s': manifest not found", digest)
+		}
+
+		if err := c.Store.Save(NewBackup(image, manifest, now)); err != nil {
+			return fmt.Errorf("Cannot back up image '%s': %v", digest, err)
+		}
+	}
+
+	glog.Infof("Backed up %d images.", len(images))
+
+	return nil
+}
+
+func (c *Client) backUpImages(images []*ecr.ImageDetail) error {
+	manifests, err := c.ECRClient.GetImages(images)
+	if err != nil {
+		return fmt.Errorf("Cannot retrieve manifests to back up: %v", err)
+	}
+
+	return c.BackUpImages(images, manifests)
+}
+
+// Restore recreates the given image from its backup, along with its tags.
+// This only works while the image's layers still exist in the repository.
+func Restore(ecrClient aws.ECRClient, store Store, repoName, digest string) (*Backup, error) {
+	b, err := store.Load(repoName, digest)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load backup of image '%s' from repo '%s': %v", digest, repoName, err)
+	}
+
+	image := &ecr.Image{
+		RepositoryName: &b.Repository,
+		ImageId: &ecr.ImageIdentifier{
+			ImageDigest: &b.Digest,
+		},
+		ImageManifest: &b.Manifest,
+	}
+
+	if b.RegistryID != "" {
+		image.RegistryId = &b.RegistryID
+	}
+
+	if b.MediaType != "" {
+		image.ImageManifestMediaType = &b.MediaType
+	}
+
+	// Untagged images are put just once, without a tag
+	if len(b.Tags) == 0 {
+		return b, ecrClient.PutImage(image)
+	}
+
+	for i := range b.Tags {
+		image.ImageId.ImageTag = &b.Tags[i]
+
+		if err = ecrClient.PutImage(image); err != nil {
+			return nil, fmt.Errorf("Cannot restore tag '%s' of image '%s': %v", b.Tags[i], digest, err)
+		}
+	}
+
+	return b, nil
+}
+
+// objectName returns the slash-separated name under which the backup of the
+// given image is stored.
+func objectName(repoName, digest string) string {
+	return repoName + "/" + digest + ".json"
+}
@@ -0,0 +1,355 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+)
+
+// mockECRClient keeps track of the images removed and put, and returns the
+// configured manifests.
+type mockECRClient struct {
+	manifests []*ecr.Image
+	getError  error
+	putError  error
+
+	removed []*ecr.ImageDetail
+	put     []ecr.Image
+}
+
+func (m *mockECRClient) ListRepositories(repositoryNames []*string, registryID *string) ([]*ecr.Repository, error) {
+	return nil, nil
+}
+
+func (m *mockECRClient) ListImages(repositoryName *string, registryID *string) ([]*ecr.ImageDetail, error) {
+	return nil, nil
+}
+
+func (m *mockECRClient) GetImages(images []*ecr.ImageDetail) ([]*ecr.Image, error) {
+	return m.manifests, m.getError
+}
+
+func (m *mockECRClient) PutImage(image *ecr.Image) error {
+	put, imageID := *image, *image.ImageId
+	put.ImageId = &imageID
+
+	m.put = append(m.put, put)
+	return m.putError
+}
+
+func (m *mockECRClient) GetLayer(repositoryName *string, registryID *string, digest string) ([]byte, error) {
+	return nil, nil
+}
+
+func (m *mockECRClient) GetImageMetadata(images []*ecr.ImageDetail) (map[string]*aws.ImageMetadata, error) {
+	return nil, nil
+}
+
+func (m *mockECRClient) GetScanFindings(image *ecr.ImageDetail) (map[string]int64, error) {
+	return nil, nil
+}
+
+func (m *mockECRClient) LastPullTime(image *ecr.ImageDetail) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (m *mockECRClient) BatchRemoveTags(repositoryName *string, registryID *string, tags []*string) error {
+	return nil
+}
+
+func (m *mockECRClient) BatchRemoveImages(images []*ecr.ImageDetail) error {
+	m.removed = append(m.removed, images...)
+	return nil
+}
+
+// mockS3Client keeps objects in memory.
+type mockS3Client struct {
+	s3iface.S3API
+
+	objects map[string][]byte
+}
+
+func (m *mockS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	m.objects[*input.Bucket+"/"+*input.Key] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *mockS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	data, ok := m.objects[*input.Bucket+"/"+*input.Key]
+	if !ok {
+		return nil, fmt.Errorf("NoSuchKey")
+	}
+
+	return &s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader(data)),
+	}, nil
+}
+
+func newTestBackup() *Backup {
+	return &Backup{
+		Repository: "team/repo",
+		Digest:     "sha256:digest",
+		Tags:       []string{"tag-1", "tag-2"},
+		MediaType:  "application/vnd.docker.distribution.manifest.v2+json",
+		Manifest:   "{}",
+		CreatedAt:  time.Unix(0, 0).UTC(),
+	}
+}
+
+func TestDirStore(t *testing.T) {
+	store := NewDirStore(t.TempDir())
+	b := newTestBackup()
+
+	if err := store.Save(b); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	loaded, err := store.Load(b.Repository, b.Digest)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if !reflect.DeepEqual(loaded, b) {
+		t.Errorf("Expected loaded backup to be %+v, but was %+v", b, loaded)
+	}
+
+	if _, err = store.Load(b.Repository, "sha256:missing"); err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestNewS3Store(t *testing.T) {
+	testCases := []struct {
+		location       string
+		expectedBucket string
+		expectedPrefix string
+		expectedError  bool
+	}{
+		{"s3://bucket", "bucket", "", false},
+		{"s3://bucket/", "bucket", "", false},
+		{"s3://bucket/some/prefix/", "bucket", "some/prefix", false},
+		{"bucket/prefix", "", "", true},
+		{"s3:///prefix", "", "", true},
+	}
+
+	for _, testCase := range testCases {
+		store, err := NewS3Store(nil, testCase.location)
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error for '%s' to be returned: %v, but was %v", testCase.location, testCase.expectedError, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if store.Bucket != testCase.expectedBucket || store.Prefix != testCase.expectedPrefix {
+			t.Errorf("Expected '%s' to have bucket '%s' and prefix '%s', but was '%s' and '%s'", testCase.location, testCase.expectedBucket, testCase.expectedPrefix, store.Bucket, store.Prefix)
+		}
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	client := &mockS3Client{
+		objects: map[string][]byte{},
+	}
+
+	store, err := NewS3Store(client, "s3://bucket/backups")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	b := newTestBackup()
+	if err = store.Save(b); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if _, ok := client.objects["bucket/backups/team/repo/sha256:digest.json"]; !ok {
+		t.Errorf("Expected backup to be stored under the prefix, but objects were %v", client.objects)
+	}
+
+	loaded, err := store.Load(b.Repository, b.Digest)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if !reflect.DeepEqual(loaded, b) {
+		t.Errorf("Expected loaded backup to be %+v, but was %+v", b, loaded)
+	}
+}
+
+func TestClientBatchRemoveImages(t *testing.T) {
+	repoName, digest, tag, manifest := "repo", "sha256:digest", "tag", "{}"
+
+	images := []*ecr.ImageDetail{
+		{
+			RepositoryName: &repoName,
+			ImageDigest:    &digest,
+			ImageTags:      []*string{&tag},
+		},
+	}
+
+	testCases := []struct {
+		manifests       []*ecr.Image
+		getError        error
+		expectedRemoved int
+		expectedError   bool
+	}{
+		// Backed up, then removed
+		{[]*ecr.Image{{ImageId: &ecr.ImageIdentifier{ImageDigest: &digest}, ImageManifest: &manifest}}, nil, 1, false},
+
+		// Missing manifest
+		{[]*ecr.Image{}, nil, 0, true},
+
+		// Cannot retrieve manifests
+		{nil, fmt.Errorf(""), 0, true},
+	}
+
+	for i, testCase := range testCases {
+		ecrClient := &mockECRClient{
+			manifests: testCase.manifests,
+			getError:  testCase.getError,
+		}
+
+		store := NewDirStore(t.TempDir())
+		err := NewClient(ecrClient, store).BatchRemoveImages(images)
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned in test case %d: %v, but was %v", i, testCase.expectedError, err)
+		}
+
+		if len(ecrClient.removed) != testCase.expectedRemoved {
+			t.Errorf("Expected %d removed images in test case %d, but was %d", testCase.expectedRemoved, i, len(ecrClient.removed))
+		}
+
+		if testCase.expectedRemoved == 0 {
+			continue
+		}
+
+		b, err := store.Load(repoName, digest)
+		if err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+
+		if b.Manifest != manifest || !reflect.DeepEqual(b.Tags, []string{tag}) {
+			t.Errorf("Expected backup to hold the manifest and tags, but was %+v", b)
+		}
+	}
+}
+
+func TestClientBatchRemoveBackedUpImages(t *testing.T) {
+	repoName, manifest := "repo", "{}"
+	digests, tags := []string{"sha256:a1", "sha256:a2"}, []string{"quarantine-a1", "quarantine-a2"}
+
+	images, manifests := []*ecr.ImageDetail{}, []*ecr.Image{}
+	for i := range digests {
+		images = append(images, &ecr.ImageDetail{
+			RepositoryName: &repoName,
+			ImageDigest:    &digests[i],
+			ImageTags:      []*string{&tags[i]},
+		})
+		manifests = append(manifests, &ecr.Image{ImageId: &ecr.ImageIdentifier{ImageDigest: &digests[i]}, ImageManifest: &manifest})
+	}
+
+	store := NewDirStore(t.TempDir())
+	if err := store.Save(&Backup{Repository: repoName, Digest: digests[0], Tags: []string{"v1"}}); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	ecrClient := &mockECRClient{manifests: manifests}
+	if err := NewClient(ecrClient, store).BatchRemoveBackedUpImages(images); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if len(ecrClient.removed) != 2 {
+		t.Errorf("Expected 2 removed images, but was %d", len(ecrClient.removed))
+	}
+
+	testCases := []struct {
+		digest       string
+		expectedTags []string
+	}{
+		// Existing backup is kept
+		{digests[0], []string{"v1"}},
+
+		// Missing backup is saved
+		{digests[1], []string{"quarantine-a2"}},
+	}
+
+	for _, testCase := range testCases {
+		b, err := store.Load(repoName, testCase.digest)
+		if err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+
+		if !reflect.DeepEqual(b.Tags, testCase.expectedTags) {
+			t.Errorf("Expected backup of image '%s' to hold tags %v, but was %v", testCase.digest, testCase.expectedTags, b.Tags)
+		}
+	}
+}
+
+func TestRestore(t *testing.T) {
+	store := NewDirStore(t.TempDir())
+
+	tagged := newTestBackup()
+	untagged := newTestBackup()
+	untagged.Digest = "sha256:untagged"
+	untagged.Tags = []string{}
+
+	for _, b := range []*Backup{tagged, untagged} {
+		if err := store.Save(b); err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+	}
+
+	testCases := []struct {
+		digest       string
+		expectedTags []string
+	}{
+		{tagged.Digest, []string{"tag-1", "tag-2"}},
+		{untagged.Digest, []string{""}},
+	}
+
+	for _, testCase := range testCases {
+		ecrClient := &mockECRClient{}
+
+		if _, err := Restore(ecrClient, store, "team/repo", testCase.digest); err != nil {
+			t.Errorf("Expected error to be nil, but was %v", err)
+		}
+
+		tags := []string{}
+		for _, image := range ecrClient.put {
+			if *image.ImageId.ImageDigest != testCase.digest || *image.ImageManifest != "{}" {
+				t.Errorf("Expected put image to be '%s', but was %+v", testCase.digest, image)
+			}
+
+			tag := ""
+			if image.ImageId.ImageTag != nil {
+				tag = *image.ImageId.ImageTag
+			}
+			tags = append(tags, tag)
+		}
+
+		if !reflect.DeepEqual(tags, testCase.expectedTags) {
+			t.Errorf("Expected put tags to be %v, but was %v", testCase.expectedTags, tags)
+		}
+	}
+
+	if _, err := Restore(&mockECRClient{}, store, "team/repo", "sha256:missing"); err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// S3Store persists backups as JSON objects in an S3 or S3-compatible
+// bucket, under the given key prefix.
+type S3Store struct {
+	client s3iface.S3API
+
+	Bucket string
+	Prefix string
+}
+
+// NewS3Store returns a Store backed by the bucket and key prefix in the
+// given "s3://bucket/prefix" URL.
+func NewS3Store(client s3iface.S3API, location string) (*S3Store, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("S3 location must be in the 's3://bucket/prefix' format, but was '%s'", location)
+	}
+
+	return &S3Store{
+		client: client,
+		Bucket: u.Host,
+		Prefix: strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+// Save writes the given backup to the bucket.
+func (s *S3Store) Save(b *Backup) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObject(&s3.PutObjectInput{
+		Bucket:      &s.Bucket,
+		Key:         awssdk.String(s.key(b.Repository, b.Digest)),
+		Body:        bytes.NewReader(data),
+		ContentType: awssdk.String("application/json"),
+	})
+
+	return err
+}
+
+// Load reads the backup of the given image from the bucket.
+func (s *S3Store) Load(repoName, digest string) (*Backup, error) {
+	output, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: &s.Bucket,
+		Key:    awssdk.String(s.key(repoName, digest)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Backup{}
+	if err = json.Unmarshal(data, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (s *S3Store) key(repoName, digest string) string {
+	return path.Join(s.Prefix, objectName(repoName, digest))
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ImageDecision explains why an image is kept or deleted, by listing each
+// rule evaluated against it.
+type ImageDecision struct {
+	Image *ImageRecord  `json:"image"`
+	Rules []*RuleResult `json:"rules"`
+
+	// Whether the image is going to be deleted.
+	Delete bool `json:"delete"`
+}
+
+// RuleResult is the outcome of evaluating a rule against an image.
+type RuleResult struct {
+	Rule string `json:"rule"`
+
+	// Whether this rule protects the image from being deleted.
+	Keep bool `json:"keep"`
+
+	Detail string `json:"detail"`
+}
+
+// AddRule appends the outcome of evaluating a rule to the decision.
+func (d *ImageDecision) AddRule(rule string, keep bool, detail string, args ...interface{}) {
+	d.Rules = append(d.Rules, &RuleResult{
+		Rule:   rule,
+		Keep:   keep,
+		Detail: fmt.Sprintf(detail, args...),
+	})
+}
+
+// Verdict returns a human-readable verdict of the decision.
+func (d *ImageDecision) Verdict() string {
+	if d.Delete {
+		return "DELETE"
+	}
+	return "KEEP"
+}
+
+// Matches returns whether the image has the given tag or digest.
+func (d *ImageDecision) Matches(tagOrDigest string) bool {
+	if d.Image.Digest == tagOrDigest {
+		return true
+	}
+
+	for _, tag := range d.Image.Tags {
+		if tag == tagOrDigest {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Print writes the decision in a human-readable format to the given writer.
+func (d *ImageDecision) Print(w io.Writer) {
+	tags := "<untagged>"
+	if len(d.Image.Tags) > 0 {
+		tags = strings.Join(d.Image.Tags, ", ")
+	}
+
+	fmt.Fprintf(w, "%s %s (%s), pushed at %s\n", d.Verdict(), d.Image.Digest, tags, d.Image.PushedAt.Format("2006-01-02 15:04:05 MST"))
+
+	for _, rule := range d.Rules {
+		outcome := "-"
+		if rule.Keep {
+			outcome = "keep"
+		}
+		fmt.Fprintf(w, "  %-15s %-5s %s\n", rule.Rule, outcome, rule.Detail)
+	}
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImageDecisionMatches(t *testing.T) {
+	decision := &ImageDecision{
+		Image: &ImageRecord{
+			Digest: "digest",
+			Tags:   []string{"tag-1", "tag-2"},
+		},
+	}
+
+	for _, tagOrDigest := range []string{"digest", "tag-1", "tag-2"} {
+		if !decision.Matches(tagOrDigest) {
+			t.Errorf("Expected decision to match '%s', but it did not", tagOrDigest)
+		}
+	}
+
+	if decision.Matches("tag-3") {
+		t.Errorf("Expected decision not to match 'tag-3', but it did")
+	}
+}
+
+func TestImageDecisionPrint(t *testing.T) {
+	decision := &ImageDecision{
+		Image: &ImageRecord{
+			Digest:   "digest",
+			PushedAt: time.Unix(0, 0).UTC(),
+		},
+	}
+	decision.AddRule("in-use", true, "tag '%s' in use by pod '%s'", "tag-1", "ns/pod")
+
+	var buf bytes.Buffer
+	decision.Print(&buf)
+
+	expected := "KEEP digest (<untagged>), pushed at 1970-01-01 00:00:00 UTC\n" +
+		"  in-use          keep  tag 'tag-1' in use by pod 'ns/pod'\n"
+
+	if buf.String() != expected {
+		t.Errorf("Expected output to be:\n%s\nBut was:\n%s", expected, buf.String())
+	}
+
+	decision.Delete = true
+	buf.Reset()
+	decision.Print(&buf)
+
+	if !strings.HasPrefix(buf.String(), "DELETE") {
+		t.Errorf("Expected output to start with DELETE, but was:\n%s", buf.String())
+	}
+}
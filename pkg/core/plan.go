@@ -0,0 +1,148 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Plan lists the images a cleanup run would delete, so that they can be
+// reviewed before actually being deleted.
+type Plan struct {
+	CreatedAt time.Time `json:"createdAt"`
+
+	// Registry account ID the repositories belong to. If empty, the account
+	// ID of the credentials in use is assumed.
+	RegistryID string `json:"registryId,omitempty"`
+
+	Repositories []*RepositoryPlan `json:"repositories"`
+}
+
+// RepositoryPlan lists the images that would be deleted from a repository.
+type RepositoryPlan struct {
+	Name   string          `json:"name"`
+	Images []*PlannedImage `json:"images"`
+
+	// Images whose listed tags would be removed, which are kept along with
+	// their other tags.
+	PrunedTags []*ImageRecord `json:"prunedTags,omitempty"`
+}
+
+// Approver defines the expected interface of any object capable of holding
+// back the removal of images until a human approves it.
+type Approver interface {
+
+	// Approved publishes the given plan for review, if not published yet, and
+	// returns whether that exact plan has been approved.
+	Approved(plan *RepositoryPlan) (bool, error)
+
+	// Clear removes the published plan of the given repository, if any.
+	Clear(repoName string) error
+}
+
+// PlannedImage is an image that would be deleted, along with the reasons it
+// would be deleted.
+type PlannedImage struct {
+	ImageRecord
+	Reasons []string `json:"reasons"`
+}
+
+// NewPlan returns an empty Plan created now.
+func NewPlan(registryID *string) *Plan {
+	plan := &Plan{
+		CreatedAt:    time.Now(),
+		Repositories: []*RepositoryPlan{},
+	}
+
+	if registryID != nil {
+		plan.RegistryID = *registryID
+	}
+
+	return plan
+}
+
+// NewPlannedImage returns the planned deletion of the image explained by
+// the given decision. The reasons are the outcomes of the rules that did not
+// protect the image.
+func NewPlannedImage(decision *ImageDecision) *PlannedImage {
+	planned := &PlannedImage{
+		ImageRecord: *decision.Image,
+		Reasons:     []string{},
+	}
+
+	for _, rule := range decision.Rules {
+		if !rule.Keep {
+			planned.Reasons = append(planned.Reasons, rule.Rule+": "+rule.Detail)
+		}
+	}
+
+	return planned
+}
+
+// ReadPlan reads a JSON-encoded plan from the file in the given path.
+func ReadPlan(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+	if err = json.Unmarshal(data, plan); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// WriteFile writes the plan as JSON to the file in the given path.
+func (p *Plan) WriteFile(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// ImagesCount returns the number of images in the plan.
+func (p *Plan) ImagesCount() int {
+	count := 0
+	for _, repo := range p.Repositories {
+		count += len(repo.Images)
+	}
+	return count
+}
+
+// Hash returns a digest that identifies the set of images in the plan, and
+// of the tags it would prune, regardless of their order or the reasons they
+// would be deleted.
+func (p *RepositoryPlan) Hash() string {
+	digests := make([]string, len(p.Images))
+	for i, image := range p.Images {
+		digests[i] = image.Digest
+	}
+	sort.Strings(digests)
+
+	pruned := make([]string, len(p.PrunedTags))
+	for i, record := range p.PrunedTags {
+		tags := append([]string{}, record.Tags...)
+		sort.Strings(tags)
+		pruned[i] = record.Digest + " " + strings.Join(tags, ",")
+	}
+	sort.Strings(pruned)
+
+	h := sha256.New()
+	h.Write([]byte(p.Name))
+	for _, digest := range digests {
+		h.Write([]byte("\n" + digest))
+	}
+	for _, tags := range pruned {
+		h.Write([]byte("\ntags " + tags))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
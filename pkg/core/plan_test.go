@@ -0,0 +1,121 @@
+package core
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewPlannedImage(t *testing.T) {
+	decision := &ImageDecision{
+		Image: &ImageRecord{
+			Digest: "digest",
+		},
+		Delete: true,
+	}
+	decision.AddRule("protected-tag", false, "not tagged 'latest'")
+	decision.AddRule("keep-filter", true, "tag 'v1' matches keep filter '^v'")
+
+	planned := NewPlannedImage(decision)
+
+	if planned.Digest != "digest" {
+		t.Errorf("Expected digest to be 'digest', but was '%s'", planned.Digest)
+	}
+
+	expected := []string{"protected-tag: not tagged 'latest'"}
+	if !reflect.DeepEqual(planned.Reasons, expected) {
+		t.Errorf("Expected reasons to be %v, but was %v", expected, planned.Reasons)
+	}
+}
+
+func TestPlanReadWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.json")
+	registryID := "123456789012"
+
+	plan := NewPlan(&registryID)
+	plan.CreatedAt = time.Unix(0, 0).UTC()
+	plan.Repositories = append(plan.Repositories, &RepositoryPlan{
+		Name: "repo",
+		Images: []*PlannedImage{
+			{
+				ImageRecord: ImageRecord{
+					Digest:   "digest",
+					Tags:     []string{"tag"},
+					PushedAt: time.Unix(0, 0).UTC(),
+				},
+				Reasons: []string{"in-use: not in use"},
+			},
+		},
+	})
+
+	if err := plan.WriteFile(path); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	loaded, err := ReadPlan(path)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if !reflect.DeepEqual(loaded, plan) {
+		t.Errorf("Expected loaded plan to be %+v, but was %+v", plan, loaded)
+	}
+
+	if loaded.ImagesCount() != 1 {
+		t.Errorf("Expected plan to contain 1 image, but it contains %d", loaded.ImagesCount())
+	}
+}
+
+func TestRepositoryPlanHash(t *testing.T) {
+	newPlan := func(name string, digests ...string) *RepositoryPlan {
+		plan := &RepositoryPlan{Name: name}
+		for _, digest := range digests {
+			plan.Images = append(plan.Images, &PlannedImage{
+				ImageRecord: ImageRecord{Digest: digest},
+			})
+		}
+		return plan
+	}
+
+	withPrunedTags := func(plan *RepositoryPlan, digest string, tags ...string) *RepositoryPlan {
+		plan.PrunedTags = append(plan.PrunedTags, &ImageRecord{Digest: digest, Tags: tags})
+		return plan
+	}
+
+	hash := newPlan("repo", "digest-1", "digest-2").Hash()
+	prunedHash := withPrunedTags(newPlan("repo", "digest-1"), "digest-2", "tag-1", "tag-2").Hash()
+
+	testCases := []struct {
+		plan     *RepositoryPlan
+		expected bool
+	}{
+		{newPlan("repo", "digest-1", "digest-2"), true},
+		{newPlan("repo", "digest-2", "digest-1"), true},
+		{newPlan("repo", "digest-1"), false},
+		{newPlan("repo", "digest-1", "digest-2", "digest-3"), false},
+		{newPlan("other", "digest-1", "digest-2"), false},
+		{withPrunedTags(newPlan("repo", "digest-1"), "digest-2", "tag-1"), false},
+	}
+
+	for _, testCase := range testCases {
+		if same := testCase.plan.Hash() == hash; same != testCase.expected {
+			t.Errorf("Expected hash of %+v to match: %v, but was %v", testCase.plan, testCase.expected, same)
+		}
+	}
+
+	prunedCases := []struct {
+		plan     *RepositoryPlan
+		expected bool
+	}{
+		{withPrunedTags(newPlan("repo", "digest-1"), "digest-2", "tag-2", "tag-1"), true},
+		{withPrunedTags(newPlan("repo", "digest-1"), "digest-2", "tag-1"), false},
+		{withPrunedTags(newPlan("repo", "digest-1"), "digest-3", "tag-1", "tag-2"), false},
+	}
+
+	for _, testCase := range prunedCases {
+		if same := testCase.plan.Hash() == prunedHash; same != testCase.expected {
+			t.Errorf("Expected hash of %+v to match: %v, but was %v", testCase.plan, testCase.expected, same)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// Report describes the outcome of a cleanup run.
+type Report struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+
+	// Whether the images were actually deleted, or would have been deleted
+	// if dry-run was not set.
+	DryRun bool `json:"dryRun"`
+
+	Repositories []*RepositoryReport `json:"repositories"`
+
+	// Failures that prevented the whole run from completing.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// RepositoryReport describes what happened to the images of a repository
+// during a cleanup run.
+type RepositoryReport struct {
+	Name string `json:"name"`
+
+	// Number of images found in the repository.
+	Listed int `json:"listed"`
+
+	// Images kept because they are in use.
+	InUse []*ImageRecord `json:"inUse"`
+
+	// Images kept because they match a keep filter.
+	KeptByFilter []*ImageRecord `json:"keptByFilter"`
+
+	// Images kept for any other reason, such as the maximum number of images
+	// to keep, or the grace period.
+	KeptByPolicy []*ImageRecord `json:"keptByPolicy"`
+
+	// Images deleted from the repository.
+	Deleted []*ImageRecord `json:"deleted"`
+
+	// Images kept by a keep filter whose redundant tags, the ones that do not
+	// match any keep filter, were removed. Only the removed tags are listed.
+	PrunedTags []*ImageRecord `json:"prunedTags"`
+
+	// Images quarantined instead of deleted, which can be restored by tagging
+	// them again until they are deleted.
+	Quarantined []*ImageRecord `json:"quarantined"`
+
+	// Images that were to be deleted or quarantined, but were kept because
+	// deleting or quarantining them failed, as listed in Failures.
+	Failed []*ImageRecord `json:"failed"`
+
+	// Failures that prevented images from being deleted.
+	Failures []string `json:"failures,omitempty"`
+}
+
+// ImageRecord holds the identifying data of an image.
+type ImageRecord struct {
+	Digest    string    `json:"digest"`
+	Tags      []string  `json:"tags"`
+	PushedAt  time.Time `json:"pushedAt"`
+	SizeBytes int64     `json:"sizeBytes"`
+
+	// Names of the in-use sources that protected the image, if in use.
+	ProtectedBy []string `json:"protectedBy,omitempty"`
+}
+
+// NewReport returns an empty Report for a run started now.
+func NewReport(dryRun bool) *Report {
+	return &Report{
+		StartedAt:    time.Now(),
+		DryRun:       dryRun,
+		Repositories: []*RepositoryReport{},
+	}
+}
+
+// NewRepositoryReport returns an empty RepositoryReport for the repository
+// with the given name.
+func NewRepositoryReport(name string) *RepositoryReport {
+	return &RepositoryReport{
+		Name:         name,
+		InUse:        []*ImageRecord{},
+		KeptByFilter: []*ImageRecord{},
+		KeptByPolicy: []*ImageRecord{},
+		Deleted:      []*ImageRecord{},
+		PrunedTags:   []*ImageRecord{},
+		Quarantined:  []*ImageRecord{},
+		Failed:       []*ImageRecord{},
+	}
+}
+
+// NewImageRecord extracts the identifying data from the given ECR image.
+func NewImageRecord(image *ecr.ImageDetail) *ImageRecord {
+	return &ImageRecord{
+		Digest:    aws.StringValue(image.ImageDigest),
+		Tags:      aws.StringValueSlice(image.ImageTags),
+		PushedAt:  aws.TimeValue(image.ImagePushedAt),
+		SizeBytes: aws.Int64Value(image.ImageSizeInBytes),
+	}
+}
+
+// WriteFile writes the report as JSON to the file in the given path.
+func (r *Report) WriteFile(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
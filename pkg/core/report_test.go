@@ -0,0 +1,61 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestNewImageRecord(t *testing.T) {
+	digest, tag := "digest", "tag"
+	pushedAt := time.Unix(0, 0)
+	size := int64(1024)
+
+	record := NewImageRecord(&ecr.ImageDetail{
+		ImageDigest:      &digest,
+		ImageTags:        []*string{&tag},
+		ImagePushedAt:    &pushedAt,
+		ImageSizeInBytes: &size,
+	})
+
+	expected := &ImageRecord{
+		Digest:    digest,
+		Tags:      []string{tag},
+		PushedAt:  pushedAt,
+		SizeBytes: size,
+	}
+
+	if !reflect.DeepEqual(record, expected) {
+		t.Errorf("Expected record to be %+v, but was %+v", expected, record)
+	}
+}
+
+func TestReportWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+
+	report := NewReport(true)
+	report.Repositories = append(report.Repositories, NewRepositoryReport("repo"))
+
+	if err := report.WriteFile(path); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &Report{}
+	if err = json.Unmarshal(data, loaded); err != nil {
+		t.Fatalf("Expected report to be valid JSON, but got %v", err)
+	}
+
+	if !loaded.DryRun || len(loaded.Repositories) != 1 || loaded.Repositories[0].Name != "repo" {
+		t.Errorf("Expected loaded report to match the written one, but was %+v", loaded)
+	}
+}
@@ -1,5 +1,7 @@
 package core
 
+import "time"
+
 // CleanupTask encapsulates the input parameters for the clean-up code.
 type CleanupTask struct {
 
@@ -12,17 +14,162 @@ type CleanupTask struct {
 	// AWS region in which the repositories live.
 	AwsRegion string
 
+	// Custom ECR endpoint URL, such as a VPC endpoint or a local ECR
+	// emulator. If empty, the default regional endpoint is used.
+	AwsEndpoint string
+
+	// Path to a PEM-encoded CA bundle used to verify the ECR endpoint's
+	// TLS certificate. If empty, the system's trusted roots are used.
+	AwsCABundle string
+
 	// ECR repositories to clean up.
 	EcrRepositories []*string
 
-	// Path to the kubeconfig file used to access the Kubernetes cluster.
+	// Paths to the kubeconfig files used to access the Kubernetes clusters.
 	// This is used to find out which images are in use, so they don't get
 	// deleted by accident.
-	KubeConfig string
+	KubeConfigs []*string
+
+	// Kubeconfig contexts of the clusters whose pods are inspected. If empty,
+	// each kubeconfig file identifies a single cluster.
+	KubeContexts []*string
 
 	// Images used by pods running in these namespaces will not get deleted.
+	// If empty, pods from all namespaces are considered.
 	KubeNamespaces []*string
 
+	// Images used by pods running in these namespaces are not protected.
+	KubeExcludedNamespaces []*string
+
+	// Only consider pods running in namespaces that match this label
+	// selector. If empty, namespace labels are not taken into account.
+	KubeNamespaceSelector string
+
+	// Keep track of pods via watch events instead of listing them at every
+	// run, which is lighter on large clusters and also catches pods that ran
+	// briefly between runs.
+	WatchPods bool
+
+	// Safety brakes that prevent images from being removed when the view of
+	// the cluster looks wrong, such as when no pods are found due to a wrong
+	// namespace or missing RBAC permissions. MinPods only applies to the pods
+	// source, and MinImagesPerSource to each of the other sources. Zero
+	// values disable the checks.
+	MinPods            int
+	MinImagesPerSource int
+	MinImagesInUse     int
+
+	// Maximum fraction (0-1) of a repository's images that can be removed
+	// in a single run. Zero disables the check.
+	MaxDeleteRatio float64
+
+	// Images only get removed after being considered old and unused during
+	// this whole period. Zero disables this, so that images are removed as
+	// soon as they are considered old and unused.
+	GracePeriod time.Duration
+
+	// Images seen in use during this period are not removed, even if they are
+	// not in use anymore, which protects images used by short-lived pods such
+	// as Jobs. Zero disables this.
+	InUseLookback time.Duration
+
+	// Where to persist the controller state between runs: either a path to a
+	// local file, or a ConfigMap in the "namespace/name" format.
+	StateFile      string
+	StateConfigMap string
+
+	// Kubeconfig context of the cluster where the state ConfigMap and the
+	// plans waiting for approval live. If empty, the current context of the
+	// merged kubeconfig files is used, or the cluster the controller is
+	// running in if there are none.
+	StateContext string
+
+	// Removing more than this number of images from a repository in a single
+	// run requires approval. Zero disables this.
+	ApprovalThreshold int
+
+	// Namespace where plans waiting for approval are published.
+	ApprovalNamespace string
+
+	// Remove the tags that do not match any keep filters from old unused
+	// images kept by those filters, instead of keeping all their tags.
+	PruneTags bool
+
+	// Instead of removing images right away, quarantine them by replacing
+	// their tags with a quarantine tag, and only remove them after being in
+	// quarantine for this period. Zero disables this.
+	QuarantinePeriod time.Duration
+
+	// Where to back up the manifests of images before removing them, so
+	// that they can be restored: either a path to a local directory, or an
+	// "s3://bucket/prefix" URL. If empty, images are not backed up.
+	BackupLocation string
+
+	// Custom S3 endpoint URL, for backing up to S3-compatible object stores.
+	BackupEndpoint string
+
+	// Path to a PEM-encoded CA bundle used to verify the S3 endpoint's TLS
+	// certificate. If empty, the system's trusted roots are used.
+	BackupCABundle string
+
+	// Images with a valid cosign signature from one of these public keys,
+	// given as paths to PEM files, are never removed.
+	SignatureKeys []*string
+
+	// Images with a valid keyless cosign signature from one of these
+	// identities, whose certificates are issued by the roots in the
+	// SignatureRoots PEM file, are never removed.
+	SignatureIdentities []*string
+	SignatureRoots      string
+
+	// Images carrying any of these labels or manifest annotations, given as
+	// "key" or "key=value", are never removed.
+	KeepLabels []*string
+
+	// Labels or manifest annotations holding a date, such as "2024-12-31",
+	// until which images carrying them are not removed.
+	RetainUntilLabels []*string
+
+	// Name of the order in which unused images are removed, such as
+	// "push-date", which removes the least recently pushed images first.
+	Ordering string
+
+	// Order in which unused images are removed from specific repositories,
+	// indexed by repository name, instead of the default one.
+	RepositoryOrderings map[string]string
+
+	// Sources of the images considered in use, such as "pods", "workloads",
+	// or "gitops=/path", all of which must succeed for any images to be
+	// removed. Pods are the only source by default.
+	InUseSources []*string
+
+	// URL of a webhook, or path to an executable, that may veto the removal
+	// of the images selected in each repository.
+	VetoHook string
+
+	// Time to wait for the veto hook before failing, in which case no images
+	// are removed.
+	VetoHookTimeout time.Duration
+
+	// JSON file holding the policies deciding whether the images of each
+	// repository are kept or deleted, if any.
+	PolicyFile string
+
+	// Images with scan findings of this severity, or of a more severe one,
+	// are considered vulnerable.
+	VulnerableSeverity string
+
+	// Remove vulnerable images before any others, instead of removing the
+	// oldest images first.
+	RemoveVulnerableFirst bool
+
+	// Keep at most this number of unused vulnerable images in each
+	// repository, removing the oldest ones beyond it. Zero disables this.
+	MaxVulnerableImages int
+
+	// Path to a file where a JSON report is written after every run.
+	ReportFile string
+
 	DryRun bool
 
 	RegistryID *string
@@ -30,13 +177,109 @@ type CleanupTask struct {
 	KeepFilters []*string
 }
 
+// VerifiesSignatures returns whether images signed by trusted keys or
+// identities are protected.
+func (t *CleanupTask) VerifiesSignatures() bool {
+	return len(t.SignatureKeys) > 0 || len(t.SignatureIdentities) > 0
+}
+
+// RetainsByLabels returns whether images are retained based on their labels
+// or annotations.
+func (t *CleanupTask) RetainsByLabels() bool {
+	return len(t.KeepLabels) > 0 || len(t.RetainUntilLabels) > 0
+}
+
+// VulnerabilityAware returns whether the scan findings of images are taken
+// into account when selecting the images to remove.
+func (t *CleanupTask) VulnerabilityAware() bool {
+	return t.RemoveVulnerableFirst || t.MaxVulnerableImages > 0
+}
+
+// OrderingFor returns the name of the order in which unused images are
+// removed from the given repository.
+func (t *CleanupTask) OrderingFor(repoName string) string {
+	if ordering, ok := t.RepositoryOrderings[repoName]; ok {
+		return ordering
+	}
+	return t.Ordering
+}
+
+// NamespaceFilter selects the namespaces whose pods are inspected.
+type NamespaceFilter struct {
+
+	// Namespaces to inspect. If empty, all namespaces are inspected.
+	Include []*string
+
+	// Namespaces not to inspect, even if included.
+	Exclude []*string
+
+	// Label selector the namespaces must match.
+	LabelSelector string
+}
+
+// NamespaceFilter returns the filter that selects the namespaces whose pods
+// are inspected.
+func (t *CleanupTask) NamespaceFilter() *NamespaceFilter {
+	return &NamespaceFilter{
+		Include:       t.KubeNamespaces,
+		Exclude:       t.KubeExcludedNamespaces,
+		LabelSelector: t.KubeNamespaceSelector,
+	}
+}
+
+// Matches returns whether the given namespace is selected by the filter,
+// not taking the label selector into account.
+func (f *NamespaceFilter) Matches(namespace string) bool {
+	for _, ns := range f.Exclude {
+		if *ns == namespace {
+			return false
+		}
+	}
+
+	if len(f.Include) == 0 {
+		return true
+	}
+
+	for _, ns := range f.Include {
+		if *ns == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// InUseSourceSpecs returns the sources of the images considered in use, pods
+// if none are set.
+func (t *CleanupTask) InUseSourceSpecs() []string {
+	specs := []string{}
+	for _, source := range t.InUseSources {
+		specs = append(specs, *source)
+	}
+
+	if len(specs) == 0 {
+		specs = append(specs, "pods")
+	}
+
+	return specs
+}
+
 // NewCleanupTask creates a CleanupTask with default values.
 func NewCleanupTask() *CleanupTask {
 	return &CleanupTask{
-		Interval:    30,
-		MaxImages:   900,
-		AwsRegion:   "us-east-1",
-		DryRun:      false,
-		KeepFilters: []*string{},
+		Interval:            30,
+		MaxImages:           900,
+		AwsRegion:           "us-east-1",
+		MinPods:             1,
+		MinImagesPerSource:  1,
+		MinImagesInUse:      1,
+		MaxDeleteRatio:      0.5,
+		ApprovalNamespace:   "default",
+		Ordering:            "push-date",
+		RepositoryOrderings: map[string]string{},
+		VulnerableSeverity:  "CRITICAL",
+		VetoHookTimeout:     10 * time.Second,
+		DryRun:              false,
+		KeepFilters:         []*string{},
 	}
 }
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -13,7 +14,84 @@ func TestNewCleanupTask(t *testing.T) {
 	if task.MaxImages != 900 {
 		t.Errorf("Expected max images to be 900, but was %d", task.MaxImages)
 	}
+	if task.MinPods != 1 {
+		t.Errorf("Expected min pods to be 1, but was %d", task.MinPods)
+	}
+
+	if task.MinImagesPerSource != 1 {
+		t.Errorf("Expected min images per source to be 1, but was %d", task.MinImagesPerSource)
+	}
+	if task.MinImagesInUse != 1 {
+		t.Errorf("Expected min images in use to be 1, but was %d", task.MinImagesInUse)
+	}
+	if task.MaxDeleteRatio != 0.5 {
+		t.Errorf("Expected max delete ratio to be 0.5, but was %v", task.MaxDeleteRatio)
+	}
 	if task.AwsRegion != "us-east-1" {
 		t.Errorf("Expected aws region to be 'us-east-1', but was %s", task.AwsRegion)
 	}
 }
+
+func TestNamespaceFilterMatches(t *testing.T) {
+	ns1, ns2, ns3 := "ns-1", "ns-2", "ns-3"
+
+	testCases := []struct {
+		filter   *NamespaceFilter
+		expected map[string]bool
+	}{
+		// All namespaces
+		{
+			filter:   &NamespaceFilter{},
+			expected: map[string]bool{ns1: true, ns2: true, ns3: true},
+		},
+
+		// All namespaces but the excluded ones
+		{
+			filter:   &NamespaceFilter{Exclude: []*string{&ns2}},
+			expected: map[string]bool{ns1: true, ns2: false, ns3: true},
+		},
+
+		// Only the included namespaces
+		{
+			filter:   &NamespaceFilter{Include: []*string{&ns1, &ns2}},
+			expected: map[string]bool{ns1: true, ns2: true, ns3: false},
+		},
+
+		// Exclusion takes precedence over inclusion
+		{
+			filter:   &NamespaceFilter{Include: []*string{&ns1, &ns2}, Exclude: []*string{&ns2}},
+			expected: map[string]bool{ns1: true, ns2: false, ns3: false},
+		},
+	}
+
+	for _, testCase := range testCases {
+		for namespace, expected := range testCase.expected {
+			if actual := testCase.filter.Matches(namespace); actual != expected {
+				t.Errorf("Expected namespace '%s' match to be %v, but was %v", namespace, expected, actual)
+			}
+		}
+	}
+}
+
+func TestInUseSourceSpecs(t *testing.T) {
+	workloads, gitops := "workloads", "gitops=/git/deployments"
+
+	testCases := []struct {
+		sources  []*string
+		expected []string
+	}{
+		{nil, []string{"pods"}},
+		{[]*string{&workloads}, []string{"workloads"}},
+		{[]*string{&workloads, &gitops}, []string{"workloads", "gitops=/git/deployments"}},
+	}
+
+	for i, testCase := range testCases {
+		task := &CleanupTask{
+			InUseSources: testCase.sources,
+		}
+
+		if specs := task.InUseSourceSpecs(); !reflect.DeepEqual(specs, testCase.expected) {
+			t.Errorf("Expected specs in test case %d to be %v, but was %v", i, testCase.expected, specs)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// VetoHook defines the expected interface of any object capable of vetoing
+// the removal of images, such as an external webhook or executable.
+type VetoHook interface {
+
+	// Veto returns the images in the given review whose removal is vetoed,
+	// along with the reason, by digest.
+	Veto(review *VetoReview) (map[string]string, error)
+}
+
+// VetoReview lists the images about to be removed from a repository, which
+// is sent to veto hooks.
+type VetoReview struct {
+	Repository string `json:"repository"`
+
+	// Whether the images are not going to be removed yet, either because
+	// dry-run is set or because removals are only being planned or explained.
+	DryRun bool `json:"dryRun"`
+
+	Images []*ImageRecord `json:"images"`
+
+	// Images about to lose the listed tags, which are kept along with their
+	// other tags. Vetoing any of them keeps all its tags.
+	PrunedTags []*ImageRecord `json:"prunedTags,omitempty"`
+}
+
+// VetoResponse lists the images whose removal a veto hook vetoes.
+type VetoResponse struct {
+	Vetoes []*Veto `json:"vetoes"`
+}
+
+// Veto identifies an image whose removal is vetoed, and why.
+type Veto struct {
+	Digest string `json:"digest"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewVetoReview returns a VetoReview of the given images, about to be
+// removed from the repository with the given name.
+func NewVetoReview(repoName string, dryRun bool, images []*ecr.ImageDetail) *VetoReview {
+	review := &VetoReview{
+		Repository: repoName,
+		DryRun:     dryRun,
+		Images:     []*ImageRecord{},
+	}
+
+	for _, image := range images {
+		review.Images = append(review.Images, NewImageRecord(image))
+	}
+
+	return review
+}
@@ -0,0 +1,30 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestNewVetoReview(t *testing.T) {
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest: aws.String("sha256:a1"),
+			ImageTags:   []*string{aws.String("v1")},
+		},
+		{
+			ImageDigest: aws.String("sha256:a2"),
+		},
+	}
+
+	review := NewVetoReview("repo", true, images)
+
+	if review.Repository != "repo" || !review.DryRun {
+		t.Errorf("Expected review of 'repo' in dry-run, but was %+v", review)
+	}
+
+	if len(review.Images) != 2 || review.Images[0].Digest != "sha256:a1" || review.Images[0].Tags[0] != "v1" {
+		t.Errorf("Expected review to hold the given images, but was %+v", review.Images)
+	}
+}
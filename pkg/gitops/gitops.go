@@ -0,0 +1,238 @@
+package gitops
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+)
+
+// Matches images hosted on ECR, optionally tagged and pinned to a digest
+var ecrImageRegexp = regexp.MustCompile(`[0-9]{12}\.dkr\.ecr\.[a-z0-9-]+\.amazonaws\.com(?:\.cn)?/[a-z0-9][a-z0-9._/-]*(?::[A-Za-z0-9_][A-Za-z0-9_.-]{0,127})?(?:@sha256:[0-9a-f]{64})?`)
+
+// ScanDirectory looks for references to ECR images in the YAML files under
+// the given directory, such as Kubernetes manifests, Kustomize files and Helm
+// values files, and returns the files referencing each image tag, indexed by
+// repository name and tag, and by digest for images pinned to one. Hidden
+// directories, such as ".git", are skipped.
+//
+// Besides full image references found anywhere in the files, images split
+// in several fields are recognized, as in the "registry", "repository", "tag"
+// and "digest" fields of Helm values files, or the "newName", "newTag" and
+// "digest" fields of Kustomize image overrides.
+func ScanDirectory(dir string) (map[string]map[string][]string, error) {
+	// The directory may be a symlink, as with git-sync checkouts
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]map[string][]string{}
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if path != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		for _, image := range ScanFile(data) {
+			addReference(refs, image, path)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return refs, nil
+}
+
+// ScanFile returns the unique ECR image references, as "repository:tag" or
+// "repository@digest", in the given YAML file, sorted. Images both tagged and
+// pinned to a digest are returned once with each. Files that are not valid
+// YAML, such as Helm templates, are only searched for full image references.
+func ScanFile(data []byte) []string {
+	images := []string{}
+	encountered := map[string]bool{}
+
+	add := func(image string) {
+		if !encountered[image] {
+			encountered[image] = true
+			images = append(images, image)
+		}
+	}
+
+	parse := func(image string) {
+		repoName, tag, digest, ok := aws.ParseImageReference(image)
+		if !ok {
+			return
+		}
+
+		if tag != "" {
+			add(repoName + ":" + tag)
+		}
+		if digest != "" {
+			add(repoName + "@" + digest)
+		}
+	}
+
+	for _, match := range ecrImageRegexp.FindAll(data, -1) {
+		parse(string(match))
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc node
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			glog.V(4).Infof("Cannot parse YAML, only searching for full image references: %v", err)
+			break
+		}
+
+		doc.walk(func(n *node) {
+			for _, image := range splitImages(n) {
+				parse(image)
+			}
+		})
+	}
+
+	sort.Strings(images)
+	return images
+}
+
+// node is a YAML value that keeps scalars as written, since decoding them
+// would turn tags such as 1.10 into the number 1.1.
+type node struct {
+	mapping  map[interface{}]*node
+	sequence []*node
+	scalar   string
+}
+
+// UnmarshalYAML decodes the value as a mapping, a sequence or a scalar,
+// whichever it is.
+func (n *node) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&n.mapping); err == nil {
+		return nil
+	}
+	n.mapping = nil
+
+	if err := unmarshal(&n.sequence); err == nil {
+		return nil
+	}
+	n.sequence = nil
+
+	return unmarshal(&n.scalar)
+}
+
+// walk calls fn with each mapping in the given YAML value.
+func (n *node) walk(fn func(*node)) {
+	if n == nil {
+		return
+	}
+
+	if n.mapping != nil {
+		fn(n)
+	}
+
+	for _, value := range n.mapping {
+		value.walk(fn)
+	}
+
+	for _, value := range n.sequence {
+		value.walk(fn)
+	}
+}
+
+// field returns the scalar held by the given field of the mapping, as
+// written, or an empty string if it does not hold a scalar.
+func (n *node) field(name string) string {
+	value, ok := n.mapping[name]
+	if !ok || value == nil || value.mapping != nil || value.sequence != nil {
+		return ""
+	}
+	return value.scalar
+}
+
+// splitImages returns the images whose name, tag and digest are held by
+// separate fields of the given mapping.
+func splitImages(n *node) []string {
+	images := []string{}
+
+	// Helm values, as in "image: {registry: ..., repository: ..., tag: ...}"
+	if repository := n.field("repository"); repository != "" {
+		if registry := n.field("registry"); registry != "" {
+			repository = registry + "/" + repository
+		}
+		images = append(images, joinImage(repository, n.field("tag"), n.field("digest")))
+	}
+
+	// Kustomize, as in "images: [{name: ..., newName: ..., newTag: ...}]"
+	if tag, digest := n.field("newTag"), n.field("digest"); tag != "" || digest != "" {
+		name := n.field("newName")
+		if name == "" {
+			name = n.field("name")
+		}
+		images = append(images, joinImage(name, tag, digest))
+	}
+
+	return images
+}
+
+// joinImage returns the reference to the image with the given name, and the
+// given tag and digest, if set.
+func joinImage(name, tag, digest string) string {
+	if tag != "" {
+		name += ":" + tag
+	}
+	if digest != "" {
+		name += "@" + digest
+	}
+	return name
+}
+
+// addReference records that the given file references the given image, as
+// "repository:tag" or "repository@digest", unless tagged "latest".
+func addReference(refs map[string]map[string][]string, image, path string) {
+	i := strings.LastIndex(image, "@")
+	if i < 0 {
+		i = strings.LastIndex(image, ":")
+	}
+	repoName, reference := image[:i], image[i+1:]
+
+	if reference == "latest" {
+		return
+	}
+
+	if _, ok := refs[repoName]; !ok {
+		refs[repoName] = map[string][]string{}
+	}
+	refs[repoName][reference] = append(refs[repoName][reference], path)
+}
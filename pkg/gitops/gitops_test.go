@@ -0,0 +1,179 @@
+package gitops
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const (
+	registry = "123456789012.dkr.ecr.us-east-1.amazonaws.com"
+	digest   = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+	}
+}
+
+func TestScanFile(t *testing.T) {
+	testCases := []struct {
+		content  string
+		expected []string
+	}{
+		// Kubernetes manifests, in several documents
+		{`
+apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      containers:
+      - image: ` + registry + `/team/app:v1.2.3
+---
+apiVersion: batch/v1
+kind: Job
+spec:
+  template:
+    spec:
+      containers:
+      - image: ` + registry + `/job:build-42
+`, []string{"job:build-42", "team/app:v1.2.3"}},
+
+		// Helm values, with and without a registry
+		{`
+image:
+  repository: ` + registry + `/app
+  tag: v2
+sidecar:
+  image:
+    registry: ` + registry + `
+    repository: sidecar
+    tag: 1.5
+other:
+  repository: docker.io/library/nginx
+  tag: "1.21"
+`, []string{"app:v2", "sidecar:1.5"}},
+
+		// Tags that look like numbers, kept as written
+		{`
+app:
+  repository: ` + registry + `/app
+  tag: 1.10
+worker:
+  repository: ` + registry + `/worker
+  tag: 2.0
+job:
+  repository: ` + registry + `/job
+  tag: 010
+images:
+- name: ` + registry + `/tools
+  newTag: 3.20
+`, []string{"app:1.10", "job:010", "tools:3.20", "worker:2.0"}},
+
+		// Kustomize image overrides
+		{`
+images:
+- name: app
+  newName: ` + registry + `/app
+  newTag: v3
+- name: ` + registry + `/worker
+  newTag: v4
+`, []string{"app:v3", "worker:v4"}},
+
+		// Pinned to a digest, with and without a tag
+		{`
+containers:
+- image: ` + registry + `/app@` + digest + `
+- image: ` + registry + `/worker:v1@` + digest + `
+`, []string{"app@" + digest, "worker:v1", "worker@" + digest}},
+
+		// Kustomize image overrides and Helm values pinned to a digest
+		{`
+images:
+- name: app
+  newName: ` + registry + `/app
+  digest: ` + digest + `
+- name: ` + registry + `/worker
+  newTag: v4
+  digest: ` + digest + `
+image:
+  repository: ` + registry + `/tools
+  digest: ` + digest + `
+`, []string{"app@" + digest, "tools@" + digest, "worker:v4", "worker@" + digest}},
+
+		// Helm templates, which are not valid YAML
+		{`
+containers:
+- image: {{ .Values.image }}
+- image: "` + registry + `/app:{{ .Values.tag }}"
+- image: "` + registry + `/tools:v5"
+`, []string{"tools:v5"}},
+
+		// Same image referenced twice
+		{`
+a: ` + registry + `/app:v1
+b: ` + registry + `/app:v1
+`, []string{"app:v1"}},
+	}
+
+	for i, testCase := range testCases {
+		images := ScanFile([]byte(testCase.content))
+
+		if !reflect.DeepEqual(images, testCase.expected) {
+			t.Errorf("Expected images in test case %d to be %v, but was %v", i, testCase.expected, images)
+		}
+	}
+}
+
+func TestScanDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	writeFiles(t, dir, map[string]string{
+		"apps/app/deployment.yaml": "image: " + registry + "/app:v1\n",
+		"apps/app/values.yml":      "image: {repository: " + registry + "/app, tag: v2}\n",
+		"apps/app/pinned.yaml":     "image: " + registry + "/app@" + digest + "\n",
+		"apps/other/job.yaml":      "image: " + registry + "/app:v1\nlatest: " + registry + "/app:latest\n",
+		"README.md":                registry + "/app:v3\n",
+		".git/config.yaml":         "image: " + registry + "/app:v4\n",
+	})
+
+	// Checkouts of git-sync are symlinks
+	link := filepath.Join(t.TempDir(), "checkout")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	refs, err := ScanDirectory(link)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	tags := []string{}
+	for tag := range refs["app"] {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	if expected := []string{digest, "v1", "v2"}; len(refs) != 1 || !reflect.DeepEqual(tags, expected) {
+		t.Errorf("Expected tags of 'app' to be %v, but references were %v", expected, refs)
+	}
+
+	if files := refs["app"]["v1"]; len(files) != 2 {
+		t.Errorf("Expected 'app:v1' to be referenced by 2 files, but was %v", files)
+	}
+
+	if _, err = ScanDirectory(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
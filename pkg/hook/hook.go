@@ -0,0 +1,170 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+)
+
+const (
+	// Maximum size of the responses read from hooks.
+	maxResponseSize = 1 << 20
+
+	// Time to wait for the output of executables to be closed once they exit
+	// or are killed, since processes they started may keep it open.
+	outputWaitDelay = time.Second
+)
+
+// limitedBuffer is a bytes.Buffer that refuses to grow beyond a maximum
+// size, so that executables cannot make the controller hold unbounded
+// output.
+type limitedBuffer struct {
+	bytes.Buffer
+
+	max      int
+	exceeded bool
+}
+
+// WebHook sends veto reviews to an HTTP endpoint, as JSON in the body of a
+// POST request, and reads the vetoes from the JSON body of the response.
+type WebHook struct {
+	client *http.Client
+
+	URL string
+}
+
+// ExecHook runs a local executable for each veto review, which reads the
+// review as JSON from its standard input and writes the vetoes as JSON to
+// its standard output.
+type ExecHook struct {
+	Path    string
+	Timeout time.Duration
+}
+
+// NewHook returns a core.VetoHook that sends reviews to the given location,
+// either an "http://" or "https://" URL, or the path to an executable. Hooks
+// that do not respond within the given timeout fail.
+func NewHook(location string, timeout time.Duration) core.VetoHook {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return NewWebHook(location, timeout)
+	}
+
+	return &ExecHook{
+		Path:    location,
+		Timeout: timeout,
+	}
+}
+
+// NewWebHook returns a WebHook that sends reviews to the given URL.
+func NewWebHook(url string, timeout time.Duration) *WebHook {
+	return &WebHook{
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		URL: url,
+	}
+}
+
+// Veto sends the given review to the webhook, and returns the vetoes in its
+// response. Responses with a status other than 200 OK are errors.
+func (h *WebHook) Veto(review *core.VetoReview) (map[string]string, error) {
+	data, err := json.Marshal(review)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := h.client.Post(h.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > maxResponseSize {
+		return nil, fmt.Errorf("Response larger than %d bytes", maxResponseSize)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status '%s': %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return parseResponse(body)
+}
+
+// Veto runs the executable with the given review, and returns the vetoes it
+// outputs. Executables that exit with a non-zero status are errors.
+func (h *ExecHook) Veto(review *core.VetoReview) (map[string]string, error) {
+	data, err := json.Marshal(review)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{max: maxResponseSize}
+	stderr := &limitedBuffer{max: maxResponseSize}
+
+	cmd := exec.CommandContext(ctx, h.Path)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = outputWaitDelay
+
+	err = cmd.Run()
+
+	if stdout.exceeded {
+		return nil, fmt.Errorf("Response larger than %d bytes", maxResponseSize)
+	}
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("Timed out after %v", h.Timeout)
+		}
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return parseResponse(stdout.Bytes())
+}
+
+// Write appends the given data to the buffer, unless that would make it
+// larger than its maximum size, in which case it fails.
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.max {
+		b.exceeded = true
+		return 0, fmt.Errorf("Output larger than %d bytes", b.max)
+	}
+
+	return b.Buffer.Write(p)
+}
+
+// parseResponse returns the vetoes in the given response, by digest.
+func parseResponse(data []byte) (map[string]string, error) {
+	var resp core.VetoResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("Cannot parse response: %v", err)
+	}
+
+	vetoes := map[string]string{}
+	for _, veto := range resp.Vetoes {
+		if veto == nil || veto.Digest == "" {
+			return nil, fmt.Errorf("Veto without a digest in response")
+		}
+		vetoes[veto.Digest] = veto.Reason
+	}
+
+	return vetoes, nil
+}
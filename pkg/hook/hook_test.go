@@ -0,0 +1,142 @@
+package hook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+)
+
+func newTestReview() *core.VetoReview {
+	return &core.VetoReview{
+		Repository: "repo",
+		Images: []*core.ImageRecord{
+			{Digest: "sha256:a1"},
+			{Digest: "sha256:a2"},
+		},
+	}
+}
+
+func TestWebHook(t *testing.T) {
+	testCases := []struct {
+		status         int
+		body           string
+		delay          time.Duration
+		expectedVetoes map[string]string
+		expectedError  bool
+	}{
+		// Vetoes with and without a reason
+		{http.StatusOK, `{"vetoes": [{"digest": "sha256:a1", "reason": "deployed"}, {"digest": "sha256:a2"}]}`, 0, map[string]string{"sha256:a1": "deployed", "sha256:a2": ""}, false},
+
+		// No vetoes
+		{http.StatusOK, `{}`, 0, map[string]string{}, false},
+
+		// Unexpected status
+		{http.StatusInternalServerError, `{}`, 0, nil, true},
+
+		// Invalid response
+		{http.StatusOK, `not json`, 0, nil, true},
+
+		// Veto without a digest
+		{http.StatusOK, `{"vetoes": [{"reason": "deployed"}]}`, 0, nil, true},
+
+		// Timeout
+		{http.StatusOK, `{}`, 200 * time.Millisecond, nil, true},
+	}
+
+	for i, testCase := range testCases {
+		var received core.VetoReview
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+				t.Errorf("Expected error to be nil, but was %v", err)
+			}
+
+			time.Sleep(testCase.delay)
+			w.WriteHeader(testCase.status)
+			fmt.Fprint(w, testCase.body)
+		}))
+
+		vetoes, err := NewHook(server.URL, 100*time.Millisecond).Veto(newTestReview())
+		server.Close()
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned in test case %d: %v, but was %v", i, testCase.expectedError, err)
+		}
+
+		if !reflect.DeepEqual(vetoes, testCase.expectedVetoes) {
+			t.Errorf("Expected vetoes in test case %d to be %v, but was %v", i, testCase.expectedVetoes, vetoes)
+		}
+
+		if received.Repository != "repo" || len(received.Images) != 2 {
+			t.Errorf("Expected review of 'repo' with 2 images to be received in test case %d, but was %+v", i, received)
+		}
+	}
+}
+
+func TestExecHook(t *testing.T) {
+	testCases := []struct {
+		script         string
+		expectedVetoes map[string]string
+		expectedError  bool
+	}{
+		// Vetoes the first image of the review
+		{`sed -e 's/.*"digest":"\([^"]*\)".*"digest".*/{"vetoes": [{"digest": "\1"}]}/'`, map[string]string{"sha256:a1": ""}, false},
+
+		// Non-zero exit status
+		{`cat >/dev/null; echo failed >&2; exit 1`, nil, true},
+
+		// Invalid response
+		{`cat >/dev/null; echo not json`, nil, true},
+
+		// Timeout
+		{`exec sleep 1`, nil, true},
+
+		// Response too large
+		{`cat >/dev/null; exec yes`, nil, true},
+	}
+
+	for i, testCase := range testCases {
+		path := filepath.Join(t.TempDir(), "hook")
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+testCase.script+"\n"), 0700); err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+
+		vetoes, err := NewHook(path, 200*time.Millisecond).Veto(newTestReview())
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned in test case %d: %v, but was %v", i, testCase.expectedError, err)
+		}
+
+		if !reflect.DeepEqual(vetoes, testCase.expectedVetoes) {
+			t.Errorf("Expected vetoes in test case %d to be %v, but was %v", i, testCase.expectedVetoes, vetoes)
+		}
+	}
+}
+
+func TestExecHookWithLingeringChild(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hook")
+
+	// The child keeps the hook's output open long after the hook is killed
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\nsleep 10 &\nexec sleep 1\n"), 0700); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	start := time.Now()
+	_, err := NewHook(path, 200*time.Millisecond).Veto(newTestReview())
+
+	if err == nil {
+		t.Errorf("Expected error to be returned, but was nil")
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected hook to give up waiting for its output, but it took %v", elapsed)
+	}
+}
@@ -0,0 +1,144 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"k8s.io/client-go/kubernetes"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ApprovedAnnotation must be set to the hash of the published plan in
+	// order to approve it.
+	ApprovedAnnotation = "ecr-cleanup-controller/approved"
+
+	approvalConfigMapPrefix = "ecr-cleanup-approval-"
+	approvalRepositoryKey   = "repository"
+	approvalHashKey         = "hash"
+	approvalPlanKey         = "plan.json"
+
+	// ConfigMap names must be DNS subdomains, which are limited to 253
+	// characters
+	maxConfigMapNameLength = 253
+	nameHashLength         = 10
+)
+
+var (
+	// Characters not allowed in ConfigMap names
+	invalidNameCharsRegexp = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+	// Dots next to dots or dashes, which would leave empty labels or labels
+	// starting or ending with a dash
+	invalidLabelSeparatorRegexp = regexp.MustCompile(`[.-]*\.[.-]*`)
+)
+
+// ConfigMapApprover publishes the plans waiting for approval as ConfigMaps,
+// one per repository. A plan is approved by setting the ApprovedAnnotation
+// of its ConfigMap to the plan's hash, so that approvals given to previous
+// versions of the plan do not apply to the current one.
+type ConfigMapApprover struct {
+	clientset kubernetes.Interface
+
+	Namespace string
+}
+
+// NewConfigMapApprover returns a core.Approver that publishes plans in the
+// given namespace, in the cluster the given client talks to.
+func NewConfigMapApprover(c *KubernetesClientImpl, namespace string) *ConfigMapApprover {
+	return &ConfigMapApprover{
+		clientset: c.clientset,
+		Namespace: namespace,
+	}
+}
+
+// Approved publishes the given plan, replacing any previously published plan
+// of the same repository and expiring its approval, and returns whether the
+// published plan has been approved.
+func (a *ConfigMapApprover) Approved(plan *core.RepositoryPlan) (bool, error) {
+	hash := plan.Hash()
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return false, err
+	}
+
+	planData := map[string]string{
+		approvalRepositoryKey: plan.Name,
+		approvalHashKey:       hash,
+		approvalPlanKey:       string(data),
+	}
+
+	ctx := context.TODO()
+	configMaps := a.clientset.CoreV1().ConfigMaps(a.Namespace)
+	name := ApprovalConfigMapName(plan.Name)
+
+	configMap, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, &apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: a.Namespace,
+				Name:      name,
+			},
+			Data: planData,
+		}, metav1.CreateOptions{})
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if repoName, ok := configMap.Data[approvalRepositoryKey]; ok && repoName != plan.Name {
+		return false, fmt.Errorf("ConfigMap '%s/%s' holds the plan of repo '%s'", a.Namespace, name, repoName)
+	}
+
+	if configMap.Data[approvalHashKey] == hash {
+		return configMap.Annotations[ApprovedAnnotation] == hash, nil
+	}
+
+	// The plan changed, so any approval refers to a stale plan
+	delete(configMap.Annotations, ApprovedAnnotation)
+	configMap.Data = planData
+
+	_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+	return false, err
+}
+
+// Clear deletes the ConfigMap holding the plan of the given repository, if
+// it exists.
+func (a *ConfigMapApprover) Clear(repoName string) error {
+	err := a.clientset.CoreV1().ConfigMaps(a.Namespace).Delete(context.TODO(), ApprovalConfigMapName(repoName), metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// ApprovalConfigMapName returns the name of the ConfigMap holding the plan
+// of the given repository. Names that would exceed the maximum length are
+// truncated and suffixed with a hash of the repository name, so that they
+// remain distinct.
+func ApprovalConfigMapName(repoName string) string {
+	name := invalidNameCharsRegexp.ReplaceAllString(strings.ToLower(repoName), "-")
+	name = invalidLabelSeparatorRegexp.ReplaceAllString(name, ".")
+	name = strings.Trim(approvalConfigMapPrefix+name, "-.")
+
+	if len(name) <= maxConfigMapNameLength {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(repoName))
+	hash := hex.EncodeToString(sum[:])[:nameHashLength]
+
+	name = strings.TrimRight(name[:maxConfigMapNameLength-len(hash)-1], "-.")
+	return name + "-" + hash
+}
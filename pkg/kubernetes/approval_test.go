@@ -0,0 +1,150 @@
+package kubernetes
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"k8s.io/client-go/kubernetes/fake"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestApprovalConfigMapName(t *testing.T) {
+	testCases := []struct {
+		repoName string
+		expected string
+	}{
+		{"repo", "ecr-cleanup-approval-repo"},
+		{"team/My_Repo", "ecr-cleanup-approval-team-my-repo"},
+		{"repo_", "ecr-cleanup-approval-repo"},
+		{"team/.repo", "ecr-cleanup-approval-team.repo"},
+		{"team/_/..repo", "ecr-cleanup-approval-team.repo"},
+	}
+
+	for _, testCase := range testCases {
+		name := ApprovalConfigMapName(testCase.repoName)
+		if name != testCase.expected {
+			t.Errorf("Expected name for '%s' to be '%s', but was '%s'", testCase.repoName, testCase.expected, name)
+		}
+	}
+}
+
+func TestApprovalConfigMapNameLongRepoName(t *testing.T) {
+	subdomainRegexp := regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+	nested := strings.Repeat("team/sub_team.", 20)
+	repoNames := []string{
+		nested + "repo-1",
+		nested + "repo-2",
+	}
+
+	names := map[string]bool{}
+	for _, repoName := range repoNames {
+		name := ApprovalConfigMapName(repoName)
+		if len(name) > 253 {
+			t.Errorf("Expected name for '%s' to have at most 253 characters, but had %d", repoName, len(name))
+		}
+		if !subdomainRegexp.MatchString(name) {
+			t.Errorf("Expected name for '%s' to be a DNS subdomain, but was '%s'", repoName, name)
+		}
+		if !strings.HasPrefix(name, "ecr-cleanup-approval-team-sub-team.team-sub-team.") {
+			t.Errorf("Expected name for '%s' to keep the start of the repo name, but was '%s'", repoName, name)
+		}
+		if name != ApprovalConfigMapName(repoName) {
+			t.Errorf("Expected name for '%s' to be stable", repoName)
+		}
+		names[name] = true
+	}
+
+	if len(names) != len(repoNames) {
+		t.Errorf("Expected names of repos with a common prefix to be distinct, but were %v", names)
+	}
+}
+
+func TestConfigMapApprover(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	approver := NewConfigMapApprover(&KubernetesClientImpl{
+		clientset: clientset,
+	}, "namespace")
+
+	newPlan := func(digests ...string) *core.RepositoryPlan {
+		plan := &core.RepositoryPlan{Name: "repo"}
+		for _, digest := range digests {
+			plan.Images = append(plan.Images, &core.PlannedImage{
+				ImageRecord: core.ImageRecord{Digest: digest},
+			})
+		}
+		return plan
+	}
+
+	approve := func(hash string) {
+		ctx := context.TODO()
+		configMaps := clientset.CoreV1().ConfigMaps("namespace")
+
+		configMap, err := configMaps.Get(ctx, "ecr-cleanup-approval-repo", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+
+		configMap.Annotations = map[string]string{ApprovedAnnotation: hash}
+		if _, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+	}
+
+	plan := newPlan("digest-1", "digest-2")
+	changedPlan := newPlan("digest-1", "digest-2", "digest-3")
+
+	testCases := []struct {
+		plan     *core.RepositoryPlan
+		approval string
+		expected bool
+	}{
+		// Publishes the plan
+		{plan, "", false},
+
+		// Approval with the wrong hash
+		{plan, "wrong", false},
+
+		// Approval with the right hash
+		{plan, plan.Hash(), true},
+
+		// Plan changed, so the approval expired
+		{changedPlan, "", false},
+		{changedPlan, "", false},
+
+		// Approval of the changed plan
+		{changedPlan, changedPlan.Hash(), true},
+	}
+
+	for i, testCase := range testCases {
+		if testCase.approval != "" {
+			approve(testCase.approval)
+		}
+
+		approved, err := approver.Approved(testCase.plan)
+		if err != nil {
+			t.Errorf("Expected error to be nil, but was %v", err)
+		}
+		if approved != testCase.expected {
+			t.Errorf("Expected approved to be %v in test case %d, but was %v", testCase.expected, i, approved)
+		}
+	}
+
+	if err := approver.Clear("repo"); err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+
+	_, err := clientset.CoreV1().ConfigMaps("namespace").Get(context.TODO(), "ecr-cleanup-approval-repo", metav1.GetOptions{})
+	if err == nil {
+		t.Errorf("Expected ConfigMap to be deleted")
+	}
+
+	// Clearing a missing plan is not an error
+	if err = approver.Clear("repo"); err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+}
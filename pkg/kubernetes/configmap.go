@@ -0,0 +1,90 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/state"
+	"k8s.io/client-go/kubernetes"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	stateConfigMapKey = "state.json"
+)
+
+// ConfigMapStore persists the controller state as JSON in a ConfigMap.
+type ConfigMapStore struct {
+	clientset kubernetes.Interface
+
+	Namespace string
+	Name      string
+}
+
+// NewConfigMapStore returns a state.Store backed by the ConfigMap with the
+// given namespace and name, in the cluster the given client talks to.
+func NewConfigMapStore(c *KubernetesClientImpl, namespace, name string) *ConfigMapStore {
+	return &ConfigMapStore{
+		clientset: c.clientset,
+		Namespace: namespace,
+		Name:      name,
+	}
+}
+
+// Load reads the state from the ConfigMap. If the ConfigMap does not exist,
+// an empty state is returned.
+func (c *ConfigMapStore) Load() (*state.State, error) {
+	configMap, err := c.clientset.CoreV1().ConfigMaps(c.Namespace).Get(context.TODO(), c.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return state.New(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := configMap.Data[stateConfigMapKey]
+	if !ok {
+		return state.New(), nil
+	}
+
+	return state.Unmarshal([]byte(data))
+}
+
+// Save writes the state to the ConfigMap, creating it if needed.
+func (c *ConfigMapStore) Save(s *state.State) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.TODO()
+	configMaps := c.clientset.CoreV1().ConfigMaps(c.Namespace)
+
+	configMap, err := configMaps.Get(ctx, c.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, &apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: c.Namespace,
+				Name:      c.Name,
+			},
+			Data: map[string]string{
+				stateConfigMapKey: string(data),
+			},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data[stateConfigMapKey] = string(data)
+
+	_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,45 @@
+package kubernetes
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/state"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigMapStore(t *testing.T) {
+	store := NewConfigMapStore(&KubernetesClientImpl{
+		clientset: fake.NewSimpleClientset(),
+	}, "namespace", "state")
+
+	// Missing ConfigMap results in empty state
+	s, err := store.Load()
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+	if len(s.Marks) != 0 {
+		t.Errorf("Expected state to be empty, but was %+v", s)
+	}
+
+	// Creates the ConfigMap, then updates it
+	for _, digest := range []string{"digest-1", "digest-2"} {
+		s.Mark("repo", []string{digest}, time.Unix(0, 0).UTC())
+		if err = store.Save(s); err != nil {
+			t.Errorf("Expected error to be nil, but was %v", err)
+		}
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+
+	expected := state.New()
+	expected.Mark("repo", []string{"digest-2"}, time.Unix(0, 0).UTC())
+
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Errorf("Expected loaded state to be %+v, but was %+v", expected, loaded)
+	}
+}
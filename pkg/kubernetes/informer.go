@@ -0,0 +1,229 @@
+package kubernetes
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+
+	apiv1 "k8s.io/api/core/v1"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	informerResyncPeriod = 10 * time.Minute
+)
+
+// InformerClient keeps track of pods via shared informers, which keep a local
+// cache in sync with the API server through watch events, instead of listing
+// all pods every time. Only the pods of the namespaces selected when the
+// client was created are watched.
+type InformerClient struct {
+	client *KubernetesClientImpl
+	filter *core.NamespaceFilter
+
+	// One pod lister per watched namespace, or a single one for all
+	// namespaces if the filter does not include specific namespaces.
+	listers []listersv1.PodLister
+
+	// Only set if namespaces are selected by labels.
+	namespaceLister listersv1.NamespaceLister
+
+	synced cache.InformerSynced
+
+	// Pods that were removed since the last time the pods were listed. This
+	// ensures pods that ran briefly between cleanup runs are not missed.
+	mutex    sync.Mutex
+	departed []*apiv1.Pod
+}
+
+// NewInformerClient returns a client that lists pods from a cache that is
+// kept in sync with the cluster the given client talks to, until the given
+// channel is closed. Only the pods of the namespaces included by the given
+// filter are watched, and namespaces are only watched if the filter selects
+// them by labels.
+func NewInformerClient(c *KubernetesClientImpl, filter *core.NamespaceFilter, stop <-chan struct{}) *InformerClient {
+	client := &InformerClient{
+		client: c,
+		filter: filter,
+	}
+
+	factories := []informers.SharedInformerFactory{}
+	if len(filter.Include) == 0 {
+		factories = append(factories, informers.NewSharedInformerFactory(c.clientset, informerResyncPeriod))
+	}
+	for _, ns := range filter.Include {
+		if filter.Matches(*ns) {
+			factories = append(factories, informers.NewSharedInformerFactoryWithOptions(c.clientset, informerResyncPeriod, informers.WithNamespace(*ns)))
+		}
+	}
+
+	synced := []cache.InformerSynced{}
+
+	for _, factory := range factories {
+		informer := factory.Core().V1().Pods()
+		informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldPod, newPod := oldObj.(*apiv1.Pod), newObj.(*apiv1.Pod)
+				if !sameImages(oldPod, newPod) {
+					client.recordDeparted(oldPod)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				if pod, ok := obj.(*apiv1.Pod); ok {
+					client.recordDeparted(pod)
+				}
+			},
+		})
+
+		client.listers = append(client.listers, informer.Lister())
+		synced = append(synced, informer.Informer().HasSynced)
+	}
+
+	// Namespaces are cluster-scoped, so they are watched by a factory of
+	// their own
+	if filter.LabelSelector != "" {
+		factory := informers.NewSharedInformerFactory(c.clientset, informerResyncPeriod)
+		namespaceInformer := factory.Core().V1().Namespaces()
+
+		client.namespaceLister = namespaceInformer.Lister()
+		synced = append(synced, namespaceInformer.Informer().HasSynced)
+		factories = append(factories, factory)
+	}
+
+	client.synced = func() bool {
+		for _, hasSynced := range synced {
+			if !hasSynced() {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, factory := range factories {
+		factory.Start(stop)
+	}
+
+	return client
+}
+
+// ListAllPods returns all pods from the namespaces selected by the given
+// filter currently in the cache, along with the pods removed from those
+// namespaces since the last call. The filter must not select namespaces that
+// are not watched, since their pods would be missed.
+func (c *InformerClient) ListAllPods(filter *core.NamespaceFilter) ([]*apiv1.Pod, error) {
+	if err := c.checkWatched(filter); err != nil {
+		return nil, err
+	}
+
+	if !c.synced() {
+		return nil, fmt.Errorf("pod cache has not synced yet")
+	}
+
+	var namespaces map[string]bool
+	if filter.LabelSelector != "" {
+		selector, err := labels.Parse(filter.LabelSelector)
+		if err != nil {
+			return nil, err
+		}
+
+		selectedNamespaces, err := c.namespaceLister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+
+		namespaces = map[string]bool{}
+		for _, ns := range selectedNamespaces {
+			namespaces[ns.Name] = filter.Matches(ns.Name)
+		}
+	}
+
+	cachedPods := []*apiv1.Pod{}
+	for _, lister := range c.listers {
+		pods, err := lister.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		cachedPods = append(cachedPods, pods...)
+	}
+
+	c.mutex.Lock()
+	departedPods := c.departed
+	c.departed = nil
+	c.mutex.Unlock()
+
+	pods := []*apiv1.Pod{}
+	for _, pod := range append(cachedPods, departedPods...) {
+		var selected bool
+		if namespaces != nil {
+			selected = namespaces[pod.Namespace]
+		} else {
+			selected = filter.Matches(pod.Namespace)
+		}
+
+		if selected {
+			pods = append(pods, pod)
+		}
+	}
+
+	return pods, nil
+}
+
+// checkWatched returns an error if the given filter may select namespaces
+// whose pods are not watched, or selects namespaces by labels while
+// namespaces are not watched.
+func (c *InformerClient) checkWatched(filter *core.NamespaceFilter) error {
+	if filter.LabelSelector != "" && c.namespaceLister == nil {
+		return fmt.Errorf("namespaces are not watched, cannot select them by labels")
+	}
+
+	if len(c.filter.Include) == 0 {
+		return nil
+	}
+
+	if len(filter.Include) == 0 {
+		return fmt.Errorf("only the pods of some namespaces are watched, cannot list the pods of all namespaces")
+	}
+
+	for _, ns := range filter.Include {
+		if filter.Matches(*ns) && !c.filter.Matches(*ns) {
+			return fmt.Errorf("pods of namespace '%s' are not watched", *ns)
+		}
+	}
+
+	return nil
+}
+
+func (c *InformerClient) recordDeparted(pod *apiv1.Pod) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.departed = append(c.departed, pod)
+}
+
+// sameImages returns whether the given pods reference the same images.
+func sameImages(a, b *apiv1.Pod) bool {
+	return sameContainerImages(a.Spec.InitContainers, b.Spec.InitContainers) &&
+		sameContainerImages(a.Spec.Containers, b.Spec.Containers)
+}
+
+func sameContainerImages(a, b []apiv1.Container) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Image != b[i].Image {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,186 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestPod(namespace, name, image string) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				{
+					Image: image,
+				},
+			},
+		},
+	}
+}
+
+// newSyncedInformerClient returns an informer client watching the pods
+// selected by the given filter, once its cache has synced.
+func newSyncedInformerClient(t *testing.T, clientset *fake.Clientset, filter *core.NamespaceFilter, stop <-chan struct{}) *InformerClient {
+	client := NewInformerClient(&KubernetesClientImpl{clientset: clientset}, filter, stop)
+
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return client.synced(), nil
+	})
+	if err != nil {
+		t.Fatalf("Expected pod cache to sync, but it did not: %v", err)
+	}
+
+	return client
+}
+
+func TestInformerClientListAllPods(t *testing.T) {
+	namespace, otherNamespace := "namespace", "other-namespace"
+
+	testCases := []struct {
+		filter         *core.NamespaceFilter
+		expectedCached int
+		expectedPods   int
+	}{
+		// Only the included namespaces are watched
+		{&core.NamespaceFilter{Include: []*string{&namespace}}, 2, 2},
+
+		// All namespaces
+		{&core.NamespaceFilter{}, 3, 3},
+
+		// Namespaces matching a label selector
+		{&core.NamespaceFilter{LabelSelector: "protect=true"}, 3, 1},
+	}
+
+	for i, testCase := range testCases {
+		clientset := fake.NewSimpleClientset(
+			newTestNamespace(namespace, nil),
+			newTestNamespace(otherNamespace, map[string]string{"protect": "true"}),
+			newTestPod(namespace, "pod-1", "id.dkr.ecr.region.amazonaws.com/repo:tag-1"),
+			newTestPod(namespace, "pod-2", "id.dkr.ecr.region.amazonaws.com/repo:tag-2"),
+			newTestPod(otherNamespace, "pod-3", "id.dkr.ecr.region.amazonaws.com/repo:tag-3"),
+		)
+
+		stop := make(chan struct{})
+		client := newSyncedInformerClient(t, clientset, testCase.filter, stop)
+
+		cached := 0
+		for _, lister := range client.listers {
+			pods, _ := lister.List(labels.Everything())
+			cached += len(pods)
+		}
+		if cached != testCase.expectedCached {
+			t.Errorf("Expected %d pods to be cached in test case %d, but was %d", testCase.expectedCached, i, cached)
+		}
+
+		// Namespaces are only watched to select them by labels
+		expectedWatched := testCase.filter.LabelSelector != ""
+		if watched := client.namespaceLister != nil; watched != expectedWatched {
+			t.Errorf("Expected namespaces to be watched in test case %d: %v, but was %v", i, expectedWatched, watched)
+		}
+
+		pods, err := client.ListAllPods(testCase.filter)
+		close(stop)
+
+		if err != nil {
+			t.Errorf("Expected error to be nil in test case %d, but was %v", i, err)
+		}
+		if len(pods) != testCase.expectedPods {
+			t.Errorf("Expected pods to contain %d elements in test case %d, but it contains %d", testCase.expectedPods, i, len(pods))
+		}
+	}
+}
+
+func TestInformerClientListAllPodsNotWatched(t *testing.T) {
+	namespace, otherNamespace := "namespace", "other-namespace"
+	clientset := fake.NewSimpleClientset(newTestNamespace(namespace, nil))
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	client := newSyncedInformerClient(t, clientset, &core.NamespaceFilter{Include: []*string{&namespace}}, stop)
+
+	filters := []*core.NamespaceFilter{
+		{},
+		{Include: []*string{&otherNamespace}},
+		{Include: []*string{&namespace}, LabelSelector: "protect=true"},
+	}
+
+	for i, filter := range filters {
+		if _, err := client.ListAllPods(filter); err == nil {
+			t.Errorf("Expected error to be returned in test case %d, but was nil", i)
+		}
+	}
+}
+
+func TestInformerClientListDepartedPods(t *testing.T) {
+	namespace := "namespace"
+	clientset := fake.NewSimpleClientset(
+		newTestNamespace(namespace, nil),
+		newTestPod(namespace, "pod-1", "id.dkr.ecr.region.amazonaws.com/repo:tag-1"),
+		newTestPod(namespace, "pod-2", "id.dkr.ecr.region.amazonaws.com/repo:tag-2"),
+	)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	filter := &core.NamespaceFilter{Include: []*string{&namespace}}
+	client := newSyncedInformerClient(t, clientset, filter, stop)
+
+	// Pods removed between calls are still returned once
+	err := clientset.CoreV1().Pods(namespace).Delete(context.TODO(), "pod-1", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		client.mutex.Lock()
+		defer client.mutex.Unlock()
+		return len(client.departed) > 0, nil
+	})
+	if err != nil {
+		t.Fatalf("Expected pod removal to be recorded, but it was not: %v", err)
+	}
+
+	pods, err := client.ListAllPods(filter)
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+	if len(pods) != 2 {
+		t.Errorf("Expected pods to contain 2 elements, but it contains %d", len(pods))
+	}
+
+	pods, err = client.ListAllPods(filter)
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+	if len(pods) != 1 {
+		t.Errorf("Expected pods to contain 1 element, but it contains %d", len(pods))
+	}
+}
+
+func TestSameImages(t *testing.T) {
+	pod := newTestPod("namespace", "pod", "image:tag-1")
+
+	if !sameImages(pod, pod.DeepCopy()) {
+		t.Errorf("Expected pods to reference the same images, but they did not")
+	}
+
+	updatedPod := pod.DeepCopy()
+	updatedPod.Spec.Containers[0].Image = "image:tag-2"
+
+	if sameImages(pod, updatedPod) {
+		t.Errorf("Expected pods to reference different images, but they did not")
+	}
+}
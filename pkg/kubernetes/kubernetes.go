@@ -2,8 +2,10 @@ package kubernetes
 
 import (
 	"context"
-	"regexp"
+	"fmt"
 
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -15,23 +17,58 @@ import (
 // KubernetesClient defines the expected interface of any object capable of
 // listing pods from a Kubernetes cluster.
 type KubernetesClient interface {
-	ListAllPods(namespace []*string) ([]*apiv1.Pod, error)
+	ListAllPods(filter *core.NamespaceFilter) ([]*apiv1.Pod, error)
 }
 
 type KubernetesClientImpl struct {
-	clientset *kubernetes.Clientset
+	clientset kubernetes.Interface
+}
+
+// Cluster associates a human-readable name to the client used to talk to
+// a Kubernetes cluster.
+type Cluster struct {
+	Name   string
+	Client KubernetesClient
+}
+
+// MultiClusterClient lists pods from several Kubernetes clusters at once,
+// so that images used in any of those clusters are considered in use.
+type MultiClusterClient struct {
+	Clusters []*Cluster
 }
 
 // NewKubernetesClient returns a client capable of talking to the API server
-// of a Kubernetes cluster specified in the given kubeconfig filepath. If no
+// of a Kubernetes cluster specified in the given kubeconfig filepaths. If no
 // kubeconfig filepath is specified, it assumes it's running inside a Kubernetes
 // cluster, and will try to connect to it via the exposed service account.
-func NewKubernetesClient(kubeconfig string) (*KubernetesClientImpl, error) {
+//
+// If more than one kubeconfig filepath is specified, they are merged just
+// like kubectl does with the KUBECONFIG environment variable. If kubeContext
+// is not empty, it overrides the kubeconfig's current context; if no
+// kubeconfig filepath is specified along with it, the context is resolved
+// from the default kubeconfig files, as kubectl does.
+func NewKubernetesClient(kubeconfigs []*string, kubeContext string) (*KubernetesClientImpl, error) {
 	var config *rest.Config
 	var err error
 
-	if kubeconfig != "" {
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if len(kubeconfigs) > 0 || kubeContext != "" {
+		rules := &clientcmd.ClientConfigLoadingRules{}
+		switch len(kubeconfigs) {
+		case 0:
+			rules = clientcmd.NewDefaultClientConfigLoadingRules()
+		case 1:
+			rules.ExplicitPath = *kubeconfigs[0]
+		default:
+			for _, kubeconfig := range kubeconfigs {
+				rules.Precedence = append(rules.Precedence, *kubeconfig)
+			}
+		}
+
+		overrides := &clientcmd.ConfigOverrides{
+			CurrentContext: kubeContext,
+		}
+
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
 	} else {
 		config, err = rest.InClusterConfig()
 	}
@@ -50,36 +87,162 @@ func NewKubernetesClient(kubeconfig string) (*KubernetesClientImpl, error) {
 	}, nil
 }
 
-// ListAllPods returns all pods from the given namespaces.
-func (c *KubernetesClientImpl) ListAllPods(namespace []*string) ([]*apiv1.Pod, error) {
-	opts := metav1.ListOptions{}
+// NewMultiClusterClient returns a client that lists pods from all clusters
+// identified by the given kubeconfig filepaths and contexts.
+//
+// If contexts are specified, each context is a cluster, and they are resolved
+// from the merged kubeconfig files. Otherwise, each kubeconfig file is a
+// cluster, accessed via its current context. If neither is specified, the
+// only cluster is the one the controller is running in.
+func NewMultiClusterClient(kubeconfigs []*string, contexts []*string) (*MultiClusterClient, error) {
+	multiClient := &MultiClusterClient{
+		Clusters: []*Cluster{},
+	}
+
+	add := func(name string, kubeconfigs []*string, kubeContext string) error {
+		client, err := NewKubernetesClient(kubeconfigs, kubeContext)
+		if err != nil {
+			return fmt.Errorf("cluster '%s': %v", name, err)
+		}
+
+		multiClient.Clusters = append(multiClient.Clusters, &Cluster{
+			Name:   name,
+			Client: client,
+		})
+		return nil
+	}
+
+	var err error
+
+	switch {
+	case len(contexts) > 0:
+		for _, kubeContext := range contexts {
+			if err = add(*kubeContext, kubeconfigs, *kubeContext); err != nil {
+				return nil, err
+			}
+		}
+	case len(kubeconfigs) > 0:
+		for _, kubeconfig := range kubeconfigs {
+			if err = add(*kubeconfig, []*string{kubeconfig}, ""); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		if err = add("in-cluster", nil, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return multiClient, nil
+}
+
+// WatchPods replaces the clients of all clusters with informer-backed ones,
+// which keep track of the pods of the namespaces selected by the given filter
+// until the given channel is closed.
+func (c *MultiClusterClient) WatchPods(filter *core.NamespaceFilter, stop <-chan struct{}) error {
+	for _, cluster := range c.Clusters {
+		client, ok := cluster.Client.(*KubernetesClientImpl)
+		if !ok {
+			return fmt.Errorf("cluster '%s': cannot watch pods with %T", cluster.Name, cluster.Client)
+		}
+
+		cluster.Client = NewInformerClient(client, filter, stop)
+	}
+
+	return nil
+}
+
+// ListAllPods returns all pods from the selected namespaces in all clusters.
+// If any of the clusters cannot be reached, an error is returned instead of
+// the pods from the remaining clusters, since acting on partial data might
+// cause images in use to be deleted.
+func (c *MultiClusterClient) ListAllPods(filter *core.NamespaceFilter) ([]*apiv1.Pod, error) {
 	pods := []*apiv1.Pod{}
-	ctx := context.TODO()
 
-	for _, ns := range namespace {
-		podList, err := c.clientset.CoreV1().Pods(*ns).List(ctx, opts)
+	for _, cluster := range c.Clusters {
+		clusterPods, err := cluster.Client.ListAllPods(filter)
+		if err != nil {
+			return nil, fmt.Errorf("cluster '%s': %v", cluster.Name, err)
+		}
+
+		pods = append(pods, clusterPods...)
+	}
+
+	return pods, nil
+}
+
+// ListAllPods returns all pods from the namespaces selected by the given
+// filter. Namespaces are resolved at every call, so that pods from new
+// namespaces are picked up.
+//
+// If the filter explicitly lists the namespaces to inspect and does not use
+// a label selector, pods are listed from each namespace individually, so that
+// only permissions in those namespaces are needed.
+func (c *KubernetesClientImpl) ListAllPods(filter *core.NamespaceFilter) ([]*apiv1.Pod, error) {
+	namespaces, err := c.selectNamespaces(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	pods := []*apiv1.Pod{}
+
+	for _, ns := range namespaces {
+		podList, err := c.clientset.CoreV1().Pods(ns).List(context.TODO(), metav1.ListOptions{})
 		if err != nil {
 			return nil, err
 		}
 
 		for i := range podList.Items {
-			pods = append(pods, &podList.Items[i])
+			if filter.Matches(podList.Items[i].Namespace) {
+				pods = append(pods, &podList.Items[i])
+			}
 		}
 	}
 
 	return pods, nil
 }
 
+// selectNamespaces returns the namespaces selected by the given filter, or
+// only metav1.NamespaceAll if the filter selects all namespaces but the
+// excluded ones, which must then be filtered out of the listed objects.
+func (c *KubernetesClientImpl) selectNamespaces(filter *core.NamespaceFilter) ([]string, error) {
+	namespaces := []string{}
+
+	switch {
+	case filter.LabelSelector != "":
+		nsList, err := c.clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{
+			LabelSelector: filter.LabelSelector,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ns := range nsList.Items {
+			if filter.Matches(ns.Name) {
+				namespaces = append(namespaces, ns.Name)
+			}
+		}
+	case len(filter.Include) > 0:
+		for _, ns := range filter.Include {
+			if filter.Matches(*ns) {
+				namespaces = append(namespaces, *ns)
+			}
+		}
+	default:
+		namespaces = append(namespaces, metav1.NamespaceAll)
+	}
+
+	return namespaces, nil
+}
+
 // ECRImagesFromPods converts the given list of pods to a map where the keys
 // are the ECR repository names and their values are a slice of strings
-// containing the unique image tags referenced by those pods.
+// containing the unique image tags referenced by those pods, along with the
+// digests of the images pinned to one.
 func ECRImagesFromPods(pods []*apiv1.Pod) map[string][]string {
 	imagesPerRepo := map[string][]string{}
 	encountered := map[string]bool{}
 
-	// Only matches tagged images hosted on ECR
-	re := regexp.MustCompile(`^.*\.dkr\.ecr\.[^\.]+\.amazonaws\.com/([^:]+):(.*)$`)
-
 	for _, pod := range pods {
 		podContainers := append(pod.Spec.InitContainers, pod.Spec.Containers...)
 
@@ -87,23 +250,19 @@ func ECRImagesFromPods(pods []*apiv1.Pod) map[string][]string {
 
 			// Ignore images we already seen
 			if !encountered[container.Image] {
-				imageData := re.FindStringSubmatch(container.Image)
-				if imageData == nil {
+				repoName, imageTag, imageDigest, ok := aws.ParseImageReference(container.Image)
+				if !ok {
 					continue
 				}
 
-				repoName, imageTag := imageData[1], imageData[2]
+				for _, reference := range []string{imageTag, imageDigest} {
 
-				// Ignore 'latest' tag
-				if imageTag == "latest" {
-					continue
-				}
+					// Ignore 'latest' tag
+					if reference == "" || reference == "latest" {
+						continue
+					}
 
-				_, ok := imagesPerRepo[repoName]
-				if ok {
-					imagesPerRepo[repoName] = append(imagesPerRepo[repoName], imageTag)
-				} else {
-					imagesPerRepo[repoName] = []string{imageTag}
+					imagesPerRepo[repoName] = append(imagesPerRepo[repoName], reference)
 				}
 
 				encountered[container.Image] = true
@@ -113,3 +272,40 @@ func ECRImagesFromPods(pods []*apiv1.Pod) map[string][]string {
 
 	return imagesPerRepo
 }
+
+// ECRImageUsersFromPods converts the given list of pods to a map where the
+// keys are the ECR repository names and their values are maps from the image
+// tags referenced by those pods, and the digests of the images pinned to one,
+// to the "namespace/name" of those pods.
+func ECRImageUsersFromPods(pods []*apiv1.Pod) map[string]map[string][]string {
+	usersPerRepo := map[string]map[string][]string{}
+
+	for _, pod := range pods {
+		podName := pod.Namespace + "/" + pod.Name
+		encountered := map[string]bool{}
+
+		for _, containers := range [][]apiv1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+			for _, container := range containers {
+				repoName, imageTag, imageDigest, ok := aws.ParseImageReference(container.Image)
+				if !ok || encountered[container.Image] {
+					continue
+				}
+
+				for _, reference := range []string{imageTag, imageDigest} {
+					if reference == "" {
+						continue
+					}
+
+					if _, ok := usersPerRepo[repoName]; !ok {
+						usersPerRepo[repoName] = map[string][]string{}
+					}
+
+					usersPerRepo[repoName][reference] = append(usersPerRepo[repoName][reference], podName)
+				}
+				encountered[container.Image] = true
+			}
+		}
+	}
+
+	return usersPerRepo
+}
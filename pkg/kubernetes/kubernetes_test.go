@@ -1,10 +1,17 @@
 package kubernetes
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"k8s.io/client-go/kubernetes/fake"
+
 	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestECRImagesFromPods(t *testing.T) {
@@ -172,6 +179,27 @@ func TestECRImagesFromPods(t *testing.T) {
 				"repo-1": []string{"tag-2"},
 			},
 		},
+
+		// Pinned to a digest, with and without a tag
+		{
+			pods: []*apiv1.Pod{
+				{
+					Spec: apiv1.PodSpec{
+						Containers: []apiv1.Container{
+							{
+								Image: "id.dkr.ecr.region.amazonaws.com/repo-1@sha256:abcd",
+							},
+							{
+								Image: "id.dkr.ecr.region.amazonaws.com/repo-1:tag-2@sha256:ef01",
+							},
+						},
+					},
+				},
+			},
+			expected: map[string][]string{
+				"repo-1": []string{"sha256:abcd", "tag-2", "sha256:ef01"},
+			},
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -182,3 +210,265 @@ func TestECRImagesFromPods(t *testing.T) {
 		}
 	}
 }
+
+func TestECRImageUsersFromPods(t *testing.T) {
+	pods := []*apiv1.Pod{
+		newTestPod("ns-1", "pod-1", "id.dkr.ecr.region.amazonaws.com/repo-1:tag-1"),
+		newTestPod("ns-2", "pod-2", "id.dkr.ecr.region.amazonaws.com/repo-1:tag-1"),
+		newTestPod("ns-2", "pod-3", "id.dkr.ecr.region.amazonaws.com/repo-2:tag-2"),
+		newTestPod("ns-2", "pod-4", "other-registry.com/repo-1:tag-1"),
+
+		// Pinned to a digest, with and without a tag
+		newTestPod("ns-3", "pod-5", "id.dkr.ecr.region.amazonaws.com/repo-3@sha256:abcd"),
+		newTestPod("ns-3", "pod-6", "id.dkr.ecr.region.amazonaws.com/repo-3:v1@sha256:ef01"),
+	}
+
+	// Same image in more than one container of the same pod
+	pods[0].Spec.InitContainers = pods[0].Spec.Containers
+
+	expected := map[string]map[string][]string{
+		"repo-1": {
+			"tag-1": []string{"ns-1/pod-1", "ns-2/pod-2"},
+		},
+		"repo-2": {
+			"tag-2": []string{"ns-2/pod-3"},
+		},
+		"repo-3": {
+			"sha256:abcd": []string{"ns-3/pod-5"},
+			"v1":          []string{"ns-3/pod-6"},
+			"sha256:ef01": []string{"ns-3/pod-6"},
+		},
+	}
+
+	actual := ECRImageUsersFromPods(pods)
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected result to be %+v, but was %+v", expected, actual)
+	}
+}
+
+// mockKubeClient returns a fixed list of pods, or an error.
+type mockKubeClient struct {
+	pods []*apiv1.Pod
+	err  error
+}
+
+func (m *mockKubeClient) ListAllPods(filter *core.NamespaceFilter) ([]*apiv1.Pod, error) {
+	return m.pods, m.err
+}
+
+const testKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: staging
+  cluster:
+    server: https://staging.example.com
+- name: prod
+  cluster:
+    server: https://prod.example.com
+users:
+- name: user
+  user:
+    token: token
+contexts:
+- name: staging
+  context:
+    cluster: staging
+    user: user
+- name: prod
+  context:
+    cluster: prod
+    user: user
+current-context: staging
+`
+
+func TestNewMultiClusterClient(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	if err := os.WriteFile(kubeconfig, []byte(testKubeConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Contexts given without kubeconfig files are resolved from the default
+	// ones, as kubectl does
+	t.Setenv("KUBECONFIG", kubeconfig)
+
+	staging, prod, unknown := "staging", "prod", "unknown"
+
+	testCases := []struct {
+		kubeconfigs []*string
+		contexts    []*string
+		expected    []string
+		expectError bool
+	}{
+		// Each context is a cluster
+		{
+			kubeconfigs: []*string{&kubeconfig},
+			contexts:    []*string{&staging, &prod},
+			expected:    []string{staging, prod},
+		},
+
+		// Each context is a cluster, from the default kubeconfig files
+		{
+			contexts: []*string{&staging, &prod},
+			expected: []string{staging, prod},
+		},
+
+		// Each kubeconfig file is a cluster
+		{
+			kubeconfigs: []*string{&kubeconfig},
+			expected:    []string{kubeconfig},
+		},
+
+		// Unknown context
+		{
+			kubeconfigs: []*string{&kubeconfig},
+			contexts:    []*string{&staging, &unknown},
+			expectError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		client, err := NewMultiClusterClient(testCase.kubeconfigs, testCase.contexts)
+
+		if testCase.expectError {
+			if err == nil {
+				t.Errorf("Expected error not to be nil, but it was")
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Expected error to be nil, but was %v", err)
+			continue
+		}
+
+		names := []string{}
+		for _, cluster := range client.Clusters {
+			names = append(names, cluster.Name)
+		}
+
+		if !reflect.DeepEqual(names, testCase.expected) {
+			t.Errorf("Expected clusters to be %v, but was %v", testCase.expected, names)
+		}
+	}
+}
+
+func TestMultiClusterClientListAllPods(t *testing.T) {
+	client := &MultiClusterClient{
+		Clusters: []*Cluster{
+			{
+				Name:   "cluster-1",
+				Client: &mockKubeClient{pods: []*apiv1.Pod{{}}},
+			},
+			{
+				Name:   "cluster-2",
+				Client: &mockKubeClient{pods: []*apiv1.Pod{{}, {}}},
+			},
+		},
+	}
+
+	pods, err := client.ListAllPods(&core.NamespaceFilter{})
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+
+	if len(pods) != 3 {
+		t.Errorf("Expected pods to contain 3 elements, but it contains %d", len(pods))
+	}
+}
+
+func TestMultiClusterClientListAllPodsWithUnreachableCluster(t *testing.T) {
+	client := &MultiClusterClient{
+		Clusters: []*Cluster{
+			{
+				Name:   "cluster-1",
+				Client: &mockKubeClient{pods: []*apiv1.Pod{{}}},
+			},
+			{
+				Name:   "cluster-2",
+				Client: &mockKubeClient{err: fmt.Errorf("unreachable")},
+			},
+		},
+	}
+
+	pods, err := client.ListAllPods(&core.NamespaceFilter{})
+
+	if pods != nil {
+		t.Errorf("Expected pods to be nil, but was %v", pods)
+	}
+
+	if err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func newTestNamespace(name string, labels map[string]string) *apiv1.Namespace {
+	return &apiv1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+	}
+}
+
+func TestListAllPods(t *testing.T) {
+	ns1, ns2, ns3 := "ns-1", "ns-2", "ns-3"
+
+	client := &KubernetesClientImpl{
+		clientset: fake.NewSimpleClientset(
+			newTestNamespace(ns1, map[string]string{"protect": "true"}),
+			newTestNamespace(ns2, map[string]string{"protect": "true"}),
+			newTestNamespace(ns3, nil),
+			newTestPod(ns1, "pod-1", "image"),
+			newTestPod(ns2, "pod-2", "image"),
+			newTestPod(ns3, "pod-3", "image"),
+		),
+	}
+
+	testCases := []struct {
+		filter   *core.NamespaceFilter
+		expected []string
+	}{
+		// All namespaces
+		{
+			filter:   &core.NamespaceFilter{},
+			expected: []string{"pod-1", "pod-2", "pod-3"},
+		},
+
+		// All namespaces but the excluded ones
+		{
+			filter:   &core.NamespaceFilter{Exclude: []*string{&ns1}},
+			expected: []string{"pod-2", "pod-3"},
+		},
+
+		// Only the included namespaces
+		{
+			filter:   &core.NamespaceFilter{Include: []*string{&ns1, &ns3}},
+			expected: []string{"pod-1", "pod-3"},
+		},
+
+		// Namespaces matching a label selector
+		{
+			filter:   &core.NamespaceFilter{LabelSelector: "protect=true", Exclude: []*string{&ns2}},
+			expected: []string{"pod-1"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		pods, err := client.ListAllPods(testCase.filter)
+
+		if err != nil {
+			t.Errorf("Expected error to be nil, but was %v", err)
+		}
+
+		names := []string{}
+		for _, pod := range pods {
+			names = append(names, pod.Name)
+		}
+
+		if !reflect.DeepEqual(names, testCase.expected) {
+			t.Errorf("Expected pods to be %v, but was %v", testCase.expected, names)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WorkloadLister defines the expected interface of any object capable of
+// listing the pod templates of the workloads in a Kubernetes cluster, which
+// reference the images of their pods even when no pods are running, as with
+// deployments scaled to zero or cron jobs between runs.
+type WorkloadLister interface {
+	ListWorkloadTemplates(filter *core.NamespaceFilter) ([]*apiv1.Pod, error)
+}
+
+// ListWorkloadTemplates returns the pod templates of the deployments, replica
+// sets, stateful sets, daemon sets, jobs and cron jobs from the namespaces
+// selected by the given filter, as pods named after their workload, as in
+// "Deployment/name". Replica sets include the ones kept by deployments in
+// order to roll back.
+func (c *KubernetesClientImpl) ListWorkloadTemplates(filter *core.NamespaceFilter) ([]*apiv1.Pod, error) {
+	namespaces, err := c.selectNamespaces(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := []*apiv1.Pod{}
+	add := func(kind string, meta metav1.ObjectMeta, spec apiv1.PodSpec) {
+		if filter.Matches(meta.Namespace) {
+			templates = append(templates, &apiv1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: meta.Namespace,
+					Name:      kind + "/" + meta.Name,
+				},
+				Spec: spec,
+			})
+		}
+	}
+
+	ctx, opts := context.TODO(), metav1.ListOptions{}
+	apps, batch := c.clientset.AppsV1(), c.clientset.BatchV1()
+
+	for _, ns := range namespaces {
+		deployments, err := apps.Deployments(ns).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range deployments.Items {
+			add("Deployment", d.ObjectMeta, d.Spec.Template.Spec)
+		}
+
+		replicaSets, err := apps.ReplicaSets(ns).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, rs := range replicaSets.Items {
+			add("ReplicaSet", rs.ObjectMeta, rs.Spec.Template.Spec)
+		}
+
+		statefulSets, err := apps.StatefulSets(ns).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, ss := range statefulSets.Items {
+			add("StatefulSet", ss.ObjectMeta, ss.Spec.Template.Spec)
+		}
+
+		daemonSets, err := apps.DaemonSets(ns).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, ds := range daemonSets.Items {
+			add("DaemonSet", ds.ObjectMeta, ds.Spec.Template.Spec)
+		}
+
+		jobs, err := batch.Jobs(ns).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, j := range jobs.Items {
+			add("Job", j.ObjectMeta, j.Spec.Template.Spec)
+		}
+
+		cronJobs, err := batch.CronJobs(ns).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, cj := range cronJobs.Items {
+			add("CronJob", cj.ObjectMeta, cj.Spec.JobTemplate.Spec.Template.Spec)
+		}
+	}
+
+	return templates, nil
+}
+
+// ListWorkloadTemplates returns the pod templates of the workloads from the
+// namespaces selected by the given filter, in all clusters. If any of the
+// clusters cannot be reached, an error is returned instead.
+func (c *MultiClusterClient) ListWorkloadTemplates(filter *core.NamespaceFilter) ([]*apiv1.Pod, error) {
+	templates := []*apiv1.Pod{}
+
+	for _, cluster := range c.Clusters {
+		lister, ok := cluster.Client.(WorkloadLister)
+		if !ok {
+			return nil, fmt.Errorf("cluster '%s': cannot list workloads with %T", cluster.Name, cluster.Client)
+		}
+
+		clusterTemplates, err := lister.ListWorkloadTemplates(filter)
+		if err != nil {
+			return nil, fmt.Errorf("cluster '%s': %v", cluster.Name, err)
+		}
+
+		templates = append(templates, clusterTemplates...)
+	}
+
+	return templates, nil
+}
+
+// ListWorkloadTemplates returns the pod templates of the workloads from the
+// namespaces selected by the given filter. Unlike pods, workloads are not
+// cached, but listed at every call.
+func (c *InformerClient) ListWorkloadTemplates(filter *core.NamespaceFilter) ([]*apiv1.Pod, error) {
+	return c.client.ListWorkloadTemplates(filter)
+}
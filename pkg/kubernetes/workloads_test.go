@@ -0,0 +1,120 @@
+package kubernetes
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"k8s.io/client-go/kubernetes/fake"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestTemplate(image string) apiv1.PodTemplateSpec {
+	return apiv1.PodTemplateSpec{
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				{
+					Image: image,
+				},
+			},
+		},
+	}
+}
+
+func TestListWorkloadTemplates(t *testing.T) {
+	ns1, ns2 := "ns-1", "ns-2"
+
+	client := &KubernetesClientImpl{
+		clientset: fake.NewSimpleClientset(
+			newTestNamespace(ns1, nil),
+			newTestNamespace(ns2, nil),
+			&appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ns1, Name: "app"},
+				Spec:       appsv1.DeploymentSpec{Template: newTestTemplate("image-1")},
+			},
+			&appsv1.ReplicaSet{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ns1, Name: "app-1234"},
+				Spec:       appsv1.ReplicaSetSpec{Template: newTestTemplate("image-2")},
+			},
+			&appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ns1, Name: "db"},
+				Spec:       appsv1.StatefulSetSpec{Template: newTestTemplate("image-3")},
+			},
+			&appsv1.DaemonSet{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ns2, Name: "agent"},
+				Spec:       appsv1.DaemonSetSpec{Template: newTestTemplate("image-4")},
+			},
+			&batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ns2, Name: "migrate"},
+				Spec:       batchv1.JobSpec{Template: newTestTemplate("image-5")},
+			},
+			&batchv1.CronJob{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ns2, Name: "report"},
+				Spec: batchv1.CronJobSpec{
+					JobTemplate: batchv1.JobTemplateSpec{
+						Spec: batchv1.JobSpec{Template: newTestTemplate("image-6")},
+					},
+				},
+			},
+		),
+	}
+
+	testCases := []struct {
+		filter   *core.NamespaceFilter
+		expected []string
+	}{
+		// All namespaces
+		{
+			filter:   &core.NamespaceFilter{},
+			expected: []string{"ns-1/Deployment/app=image-1", "ns-1/ReplicaSet/app-1234=image-2", "ns-1/StatefulSet/db=image-3", "ns-2/DaemonSet/agent=image-4", "ns-2/Job/migrate=image-5", "ns-2/CronJob/report=image-6"},
+		},
+
+		// Only the included namespaces
+		{
+			filter:   &core.NamespaceFilter{Include: []*string{&ns2}},
+			expected: []string{"ns-2/DaemonSet/agent=image-4", "ns-2/Job/migrate=image-5", "ns-2/CronJob/report=image-6"},
+		},
+
+		// All namespaces but the excluded ones
+		{
+			filter:   &core.NamespaceFilter{Exclude: []*string{&ns2}},
+			expected: []string{"ns-1/Deployment/app=image-1", "ns-1/ReplicaSet/app-1234=image-2", "ns-1/StatefulSet/db=image-3"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		templates, err := client.ListWorkloadTemplates(testCase.filter)
+
+		if err != nil {
+			t.Errorf("Expected error to be nil, but was %v", err)
+		}
+
+		names := []string{}
+		for _, template := range templates {
+			names = append(names, template.Namespace+"/"+template.Name+"="+template.Spec.Containers[0].Image)
+		}
+
+		if !reflect.DeepEqual(names, testCase.expected) {
+			t.Errorf("Expected templates to be %v, but was %v", testCase.expected, names)
+		}
+	}
+}
+
+func TestMultiClusterClientListWorkloadTemplatesWithoutLister(t *testing.T) {
+	client := &MultiClusterClient{
+		Clusters: []*Cluster{
+			{
+				Name:   "cluster",
+				Client: &mockKubeClient{},
+			},
+		},
+	}
+
+	if _, err := client.ListWorkloadTemplates(&core.NamespaceFilter{}); err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
@@ -0,0 +1,200 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/google/cel-go/cel"
+)
+
+// Decision is the outcome of evaluating a policy against an image.
+type Decision string
+
+const (
+	// Keep means the image is never removed.
+	Keep Decision = "keep"
+
+	// Delete means the image is removed, unless in use or kept by other
+	// rules, regardless of the number of images to keep.
+	Delete Decision = "delete"
+
+	// NoDecision means the image is left to the other rules.
+	NoDecision Decision = ""
+)
+
+// Image holds the attributes of an image that policies are evaluated
+// against, each available to expressions as a variable of the same name.
+type Image struct {
+	Tags     []string
+	Digest   string
+	PushedAt time.Time
+
+	// Last time the image was pulled, or the Unix epoch if never pulled or
+	// if unknown.
+	LastPulledAt time.Time
+
+	// Whether the last time the image was pulled is known, which tells
+	// images never pulled apart from images pulled at the Unix epoch.
+	Pulled bool
+
+	SizeBytes int64
+	InUse     bool
+
+	// Number of scan findings of each severity, with all severities
+	// present.
+	Severities map[string]int64
+}
+
+// Policy is an expression that decides whether images are kept or deleted,
+// by evaluating to "keep", "delete", or an empty string to leave images to
+// the other rules. Expressions are written in the Common Expression Language
+// (CEL), such as:
+//
+//	tags.exists(t, t.startsWith("release-")) ? "keep" :
+//	severities["CRITICAL"] > 0 && now - pushedAt > duration("720h") ? "delete" : ""
+type Policy struct {
+	Expression string
+
+	program cel.Program
+}
+
+// Set holds the policies of each repository.
+type Set struct {
+
+	// Policy of the repositories without a policy of their own, if any.
+	Default *Policy
+
+	// Policies of specific repositories, indexed by repository name.
+	Repositories map[string]*Policy
+}
+
+// file is the format of policy files.
+type file struct {
+	Default      string            `json:"default,omitempty"`
+	Repositories map[string]string `json:"repositories,omitempty"`
+}
+
+// newEnv returns the CEL environment expressions are compiled in, which
+// declares the variables available to them.
+func newEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("tags", cel.ListType(cel.StringType)),
+		cel.Variable("digest", cel.StringType),
+		cel.Variable("pushedAt", cel.TimestampType),
+		cel.Variable("lastPulledAt", cel.TimestampType),
+		cel.Variable("pulled", cel.BoolType),
+		cel.Variable("sizeBytes", cel.IntType),
+		cel.Variable("inUse", cel.BoolType),
+		cel.Variable("severities", cel.MapType(cel.StringType, cel.IntType)),
+		cel.Variable("now", cel.TimestampType),
+	)
+}
+
+// Compile parses and type-checks the given expression, which must evaluate
+// to a string.
+func Compile(expression string) (*Policy, error) {
+	env, err := newEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+
+	if !ast.OutputType().IsExactType(cel.StringType) {
+		return nil, fmt.Errorf("Expression must evaluate to a string, but evaluates to %v", ast.OutputType())
+	}
+
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Policy{
+		Expression: expression,
+		program:    program,
+	}, nil
+}
+
+// Evaluate evaluates the policy against the given image, at the given time.
+func (p *Policy) Evaluate(image *Image, now time.Time) (Decision, error) {
+	out, _, err := p.program.Eval(map[string]interface{}{
+		"tags":         image.Tags,
+		"digest":       image.Digest,
+		"pushedAt":     image.PushedAt,
+		"lastPulledAt": image.LastPulledAt,
+		"pulled":       image.Pulled,
+		"sizeBytes":    image.SizeBytes,
+		"inUse":        image.InUse,
+		"severities":   image.Severities,
+		"now":          now,
+	})
+
+	if err != nil {
+		return NoDecision, fmt.Errorf("Cannot evaluate policy: %v", err)
+	}
+
+	value, ok := out.Value().(string)
+	if !ok {
+		return NoDecision, fmt.Errorf("Cannot evaluate policy: evaluates to %v", out.Type())
+	}
+
+	switch decision := Decision(value); decision {
+	case Keep, Delete, NoDecision:
+		return decision, nil
+	default:
+		return NoDecision, fmt.Errorf("Unknown decision '%s'", decision)
+	}
+}
+
+// LoadFile reads and compiles the policies in the given JSON file, which
+// holds the expression of each repository in "repositories", indexed by
+// repository name, and optionally the expression of all other repositories
+// in "default".
+func LoadFile(path string) (*Set, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f file
+	if err = json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("Cannot parse policy file: %v", err)
+	}
+
+	s := &Set{
+		Repositories: map[string]*Policy{},
+	}
+
+	if f.Default != "" {
+		if s.Default, err = Compile(f.Default); err != nil {
+			return nil, fmt.Errorf("Cannot compile default policy: %v", err)
+		}
+	}
+
+	for repoName, expression := range f.Repositories {
+		if s.Repositories[repoName], err = Compile(expression); err != nil {
+			return nil, fmt.Errorf("Cannot compile policy of repo '%s': %v", repoName, err)
+		}
+	}
+
+	return s, nil
+}
+
+// For returns the policy of the given repository, or nil if it has none.
+// It is safe to call on a nil Set.
+func (s *Set) For(repoName string) *Policy {
+	if s == nil {
+		return nil
+	}
+
+	if p, ok := s.Repositories[repoName]; ok {
+		return p
+	}
+
+	return s.Default
+}
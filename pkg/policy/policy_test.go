@@ -0,0 +1,119 @@
+package policy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEvaluate(t *testing.T) {
+	now := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	image := &Image{
+		Tags:         []string{"release-1"},
+		Digest:       "sha256:a1",
+		PushedAt:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		LastPulledAt: time.Unix(0, 0),
+		SizeBytes:    1024,
+		Severities:   map[string]int64{"CRITICAL": 1},
+	}
+
+	testCases := []struct {
+		expression    string
+		expected      Decision
+		expectedError bool
+	}{
+		{`tags.exists(t, t.startsWith("release-")) ? "keep" : ""`, Keep, false},
+		{`severities["CRITICAL"] > 0 && now - pushedAt > duration("720h") ? "delete" : ""`, Delete, false},
+		{`lastPulledAt > pushedAt || inUse || sizeBytes > 2048 || digest != "sha256:a1" ? "delete" : ""`, NoDecision, false},
+		{`!pulled && lastPulledAt == timestamp("1970-01-01T00:00:00Z") ? "delete" : ""`, Delete, false},
+		{`"maybe"`, NoDecision, true},
+		{`severities["LOW"] > 0 ? "delete" : ""`, NoDecision, true},
+	}
+
+	for _, testCase := range testCases {
+		p, err := Compile(testCase.expression)
+		if err != nil {
+			t.Errorf("Expected error compiling '%s' to be nil, but was %v", testCase.expression, err)
+			continue
+		}
+
+		decision, err := p.Evaluate(image, now)
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error evaluating '%s' to be returned: %v, but was %v", testCase.expression, testCase.expectedError, err)
+		}
+
+		if decision != testCase.expected {
+			t.Errorf("Expected '%s' to decide '%s', but was '%s'", testCase.expression, testCase.expected, decision)
+		}
+	}
+
+	if _, err := Compile(`inUse`); err == nil {
+		t.Errorf("Expected error compiling non-string expression not to be nil, but it was")
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	testCases := []string{
+		``,
+		`"keep" +`,
+		`unknown == 1 ? "keep" : ""`,
+		`sizeBytes + "a" ? "keep" : ""`,
+		`inUse ? 1 : "keep"`,
+		`tags.exists(t, t) ? "keep" : ""`,
+		`1 in tags ? "keep" : ""`,
+		`now < 1 ? "keep" : ""`,
+		`sizeBytes`,
+		`tags`,
+	}
+
+	for _, expression := range testCases {
+		if _, err := Compile(expression); err == nil {
+			t.Errorf("Expected error compiling '%s' not to be nil, but it was", expression)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	testCases := []struct {
+		contents      string
+		expectedError bool
+	}{
+		{`{"default": "\"\"", "repositories": {"repo-1": "inUse ? \"keep\" : \"delete\""}}`, false},
+		{`{"repositories": {"repo-1": "inUse"}}`, true},
+		{`{"default": "unknown"}`, true},
+		{`not json`, true},
+	}
+
+	for i, testCase := range testCases {
+		path := filepath.Join(t.TempDir(), "policies.json")
+		if err := ioutil.WriteFile(path, []byte(testCase.contents), 0644); err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+
+		s, err := LoadFile(path)
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned in test case %d: %v, but was %v", i, testCase.expectedError, err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if s.For("repo-1") != s.Repositories["repo-1"] || s.For("repo-2") != s.Default {
+			t.Errorf("Expected repositories without a policy to get the default one")
+		}
+	}
+
+	if _, err := LoadFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+
+	var s *Set
+	if s.For("repo-1") != nil {
+		t.Errorf("Expected nil set not to have any policies")
+	}
+}
@@ -0,0 +1,174 @@
+package processor
+
+import (
+	"fmt"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/policy"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/signature"
+)
+
+// ImageFacts holds what is known about the images of a repository besides
+// their details, which the rules selecting the images to remove rely on.
+type ImageFacts struct {
+
+	// Relationship between image indexes and the images they reference, and
+	// between artifacts and the images they describe.
+	Graph *aws.ImageGraph
+
+	// Digests of the images with a valid signature.
+	Signed map[string]bool
+
+	// Labels and annotations of the candidates, by digest.
+	Metadata map[string]*aws.ImageMetadata
+
+	// Number of scan findings of each severity, by digest.
+	Findings map[string]map[string]int64
+
+	// Order in which the unused images are removed.
+	Ordering aws.ImageOrdering
+
+	// Policy of the repository, if any, and its decisions other than
+	// policy.NoDecision, by digest.
+	Policy    *policy.Policy
+	Decisions map[string]policy.Decision
+}
+
+// GatherImageFacts retrieves what the task's rules need to know about the
+// given images of a repository, besides their details. Signatures are only
+// verified if a verifier is given, and the repository's policy among the
+// given ones, if any, is evaluated at the given time.
+func GatherImageFacts(t *core.CleanupTask, ecrClient aws.ECRClient, verifier *signature.Verifier, policies *policy.Set, repoName string, images []*ecr.ImageDetail, tagsInUse []string, now time.Time) (*ImageFacts, error) {
+	facts := &ImageFacts{
+		Findings:  map[string]map[string]int64{},
+		Policy:    policies.For(repoName),
+		Decisions: map[string]policy.Decision{},
+	}
+
+	var err error
+	if facts.Ordering, err = aws.NewImageOrdering(t.OrderingFor(repoName), ecrClient); err != nil {
+		return nil, fmt.Errorf("Cannot order images of repo '%s': %v", repoName, err)
+	}
+
+	if facts.Graph, err = aws.NewImageGraph(ecrClient, images); err != nil {
+		return nil, fmt.Errorf("Cannot retrieve image indexes from repo '%s': %v", repoName, err)
+	}
+
+	regular, _, _ := splitImages(t, images, facts.Graph)
+
+	// Only the findings of the images that may be removed are relevant
+	if t.VulnerabilityAware() || facts.Policy != nil {
+		if facts.Findings, err = FetchScanFindings(ecrClient, removableImages(regular, tagsInUse)); err != nil {
+			return nil, fmt.Errorf("Cannot retrieve scan findings from repo '%s': %v", repoName, err)
+		}
+	}
+
+	if facts.Policy != nil {
+		if facts.Decisions, err = EvaluatePolicy(facts.Policy, ecrClient, regular, facts.Findings, tagsInUse, now); err != nil {
+			return nil, fmt.Errorf("Cannot evaluate policy in repo '%s': %v", repoName, err)
+		}
+	}
+
+	if facts.Signed, err = verifier.SignedImages(ecrClient, facts.Graph, images); err != nil {
+		return nil, fmt.Errorf("Cannot verify image signatures in repo '%s': %v", repoName, err)
+	}
+
+	if facts.Metadata, err = FetchImageMetadata(t, ecrClient, images, facts, tagsInUse); err != nil {
+		return nil, fmt.Errorf("Cannot retrieve image labels from repo '%s': %v", repoName, err)
+	}
+
+	return facts, nil
+}
+
+// FetchImageMetadata retrieves the labels and annotations of the images of a
+// repository that may be selected for removal, if the task retains images
+// based on them. Image indexes also get the labels of the images they
+// reference, since they have no config of their own.
+func FetchImageMetadata(t *core.CleanupTask, ecrClient aws.ECRClient, images []*ecr.ImageDetail, facts *ImageFacts, tagsInUse []string) (map[string]*aws.ImageMetadata, error) {
+	if !t.RetainsByLabels() {
+		return map[string]*aws.ImageMetadata{}, nil
+	}
+
+	regular, _, _ := splitImages(t, images, facts.Graph)
+	candidates, excess, deleted := candidateImages(t, facts, regular, tagsInUse)
+	toFetch := append(append(candidates, excess...), deleted...)
+
+	imagesByDigest := map[string]*ecr.ImageDetail{}
+	for _, image := range images {
+		imagesByDigest[awssdk.StringValue(image.ImageDigest)] = image
+	}
+
+	indexes, isFetched := []*ecr.ImageDetail{}, imageSet(toFetch)
+	for _, image := range toFetch {
+		children := facts.Graph.Children[awssdk.StringValue(image.ImageDigest)]
+		if len(children) > 0 {
+			indexes = append(indexes, image)
+		}
+
+		for _, digest := range children {
+			if child, ok := imagesByDigest[digest]; ok && !isFetched[child] {
+				toFetch = append(toFetch, child)
+				isFetched[child] = true
+			}
+		}
+	}
+
+	metadata, err := ecrClient.GetImageMetadata(toFetch)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, index := range indexes {
+		digest := awssdk.StringValue(index.ImageDigest)
+
+		children := []*aws.ImageMetadata{}
+		for _, child := range facts.Graph.Children[digest] {
+			children = append(children, metadata[child])
+		}
+
+		metadata[digest] = metadata[digest].WithChildLabels(children)
+	}
+
+	return metadata, nil
+}
+
+// FetchScanFindings returns the number of scan findings of each severity of
+// the given images, by digest. The findings are retrieved separately for
+// scanned images whose details do not include them.
+func FetchScanFindings(ecrClient aws.ECRClient, images []*ecr.ImageDetail) (map[string]map[string]int64, error) {
+	findings := map[string]map[string]int64{}
+
+	for _, image := range images {
+		switch {
+		case aws.HasScanSummary(image):
+			findings[*image.ImageDigest] = aws.SeverityCounts(image)
+		case aws.HasCompletedScan(image):
+			counts, err := ecrClient.GetScanFindings(image)
+			if err != nil {
+				return nil, err
+			}
+			findings[*image.ImageDigest] = counts
+		}
+	}
+
+	return findings, nil
+}
+
+// removableImages returns the given images that are neither in use nor
+// tagged "latest", which are the only ones that may be removed.
+func removableImages(images []*ecr.ImageDetail, tagsInUse []string) []*ecr.ImageDetail {
+	inUse := tagSet(tagsInUse)
+	removable := []*ecr.ImageDetail{}
+
+	for _, image := range images {
+		if !hasTag(image, "latest") && !isInUse(image, inUse) {
+			removable = append(removable, image)
+		}
+	}
+
+	return removable
+}
@@ -0,0 +1,59 @@
+package processor
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+)
+
+func TestRemoveOldImagesWithGitOpsSource(t *testing.T) {
+	dir := t.TempDir()
+	manifest := "image: 123456789012.dkr.ecr.us-east-1.amazonaws.com/repo:v1\n"
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "deployment.yaml"), []byte(manifest), 0600); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	testCases := []struct {
+		dir                 string
+		expectedRemoveCalls [][]string
+		expectedErrors      int
+	}{
+		// Referenced by the GitOps directory
+		{dir, [][]string{{"sha256:a2", "sha256:a3"}}, 0},
+
+		// Fails closed
+		{filepath.Join(dir, "missing"), nil, 1},
+	}
+
+	for i, testCase := range testCases {
+		namespace, repoName := "namespace", "repo"
+
+		kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:v4",
+			[]string{"sha256:a1", "sha256:a2", "sha256:a3", "sha256:a4"},
+			[]string{"v1", "v2", "v3", "v4"})
+
+		ecrClient.expectedRemoveCalls = testCase.expectedRemoveCalls
+
+		pods, gitops := "pods", "gitops="+testCase.dir
+
+		task := &core.CleanupTask{
+			KubeNamespaces:  []*string{&namespace},
+			EcrRepositories: []*string{&repoName},
+			InUseSources:    []*string{&pods, &gitops},
+			MaxImages:       2,
+		}
+
+		_, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+		if len(errs) != testCase.expectedErrors {
+			t.Errorf("Expected %d errors in test case %d, but was %q", testCase.expectedErrors, i, errs)
+		}
+
+		if ecrClient.removeCalls != len(testCase.expectedRemoveCalls) {
+			t.Errorf("Expected images to be removed %d times in test case %d, but was %d times", len(testCase.expectedRemoveCalls), i, ecrClient.removeCalls)
+		}
+	}
+}
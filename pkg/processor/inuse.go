@@ -0,0 +1,402 @@
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/gitops"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/kubernetes"
+)
+
+// Names of the kinds of in-use sources, as given in the task's list of
+// sources, followed by "=" and their argument, if any.
+const (
+	PodSourceName       = "pods"
+	WorkloadSourceName  = "workloads"
+	GitOpsSourceName    = "gitops"
+	AllowlistSourceName = "allowlist"
+	EndpointSourceName  = "endpoint"
+	ECSSourceName       = "ecs"
+	LambdaSourceName    = "lambda"
+)
+
+// Name of the source of the tags only considered in use because they were
+// seen in use during the in-use lookback period.
+const lookbackSourceName = "in-use-lookback"
+
+// Time to wait for in-use endpoints to respond.
+const endpointTimeout = 30 * time.Second
+
+// InUseSource defines the expected interface of any object capable of finding
+// which ECR images are in use.
+type InUseSource interface {
+
+	// Name identifies the source in logs and reports.
+	Name() string
+
+	// ImagesInUse returns what uses each image tag, described as in
+	// "pod 'namespace/name'", indexed by repository name and tag, or by
+	// digest for images referenced by digest.
+	ImagesInUse() (map[string]map[string][]string, error)
+}
+
+// PodSource finds the images used by the pods in the selected namespaces.
+type PodSource struct {
+	Client kubernetes.KubernetesClient
+	Filter *core.NamespaceFilter
+
+	// Number of pods found the last time the images in use were found.
+	Count int
+}
+
+// WorkloadSource finds the images referenced by the pod templates of the
+// workloads in the selected namespaces, even if no pods are running.
+type WorkloadSource struct {
+	Client kubernetes.KubernetesClient
+	Filter *core.NamespaceFilter
+}
+
+// GitOpsSource finds the images referenced by the YAML files in a directory.
+type GitOpsSource struct {
+	Dir string
+}
+
+// AllowlistSource reads the images to consider in use from a file, which
+// holds an ECR image reference, or "repository:tag", per line. Blank lines
+// and lines starting with "#" are ignored.
+type AllowlistSource struct {
+	Path string
+}
+
+// EndpointSource gets the images to consider in use from an HTTP endpoint,
+// which responds to GET requests with a JSON object whose "images" field
+// lists ECR image references, or "repository:tag".
+type EndpointSource struct {
+	client *http.Client
+
+	URL string
+}
+
+// ECSSource finds the images used by the task definitions of the ECS services
+// in an account and region.
+type ECSSource struct {
+	Client aws.ECSClient
+
+	// Region, optionally followed by "/" and the ARN of the role assumed to
+	// access another account, or empty for the task's region.
+	Location string
+}
+
+// LambdaSource finds the images used by the container image Lambda functions
+// in an account and region.
+type LambdaSource struct {
+	Client aws.LambdaClient
+
+	// Region, optionally followed by "/" and the ARN of the role assumed to
+	// access another account, or empty for the task's region.
+	Location string
+}
+
+// NewInUseSources returns the sources of images in use set by the task,
+// which may list pods and workloads via the given client.
+func NewInUseSources(t *core.CleanupTask, kubeClient kubernetes.KubernetesClient) ([]InUseSource, error) {
+	sources := []InUseSource{}
+
+	for _, spec := range t.InUseSourceSpecs() {
+		source, err := NewInUseSource(t, kubeClient, spec)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
+
+// NewInUseSource returns the source of images in use with the given
+// specification, which is the name of the source, followed by "=" and its
+// argument, if any, as in "gitops=/git/deployments".
+func NewInUseSource(t *core.CleanupTask, kubeClient kubernetes.KubernetesClient, spec string) (InUseSource, error) {
+	name, arg := spec, ""
+	if i := strings.Index(spec, "="); i >= 0 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+
+	switch {
+	case name == PodSourceName && arg == "":
+		return &PodSource{Client: kubeClient, Filter: t.NamespaceFilter()}, nil
+	case name == WorkloadSourceName && arg == "":
+		return &WorkloadSource{Client: kubeClient, Filter: t.NamespaceFilter()}, nil
+	case name == GitOpsSourceName && arg != "":
+		return &GitOpsSource{Dir: arg}, nil
+	case name == AllowlistSourceName && arg != "":
+		return &AllowlistSource{Path: arg}, nil
+	case name == EndpointSourceName && arg != "":
+		return NewEndpointSource(arg), nil
+	case name == ECSSourceName:
+		// The task's CA bundle only applies to the ECR endpoint
+		region, roleARN := awsLocation(t, arg)
+		client, err := aws.NewECSClient(region, roleARN, "")
+		if err != nil {
+			return nil, err
+		}
+		return &ECSSource{Client: client, Location: arg}, nil
+	case name == LambdaSourceName:
+		region, roleARN := awsLocation(t, arg)
+		client, err := aws.NewLambdaClient(region, roleARN, "")
+		if err != nil {
+			return nil, err
+		}
+		return &LambdaSource{Client: client, Location: arg}, nil
+	default:
+		return nil, fmt.Errorf("Invalid in-use source '%s'", spec)
+	}
+}
+
+// NewEndpointSource returns an EndpointSource that gets the images in use
+// from the given URL.
+func NewEndpointSource(url string) *EndpointSource {
+	return &EndpointSource{
+		client: &http.Client{
+			Timeout: endpointTimeout,
+		},
+		URL: url,
+	}
+}
+
+func (s *PodSource) Name() string {
+	return PodSourceName
+}
+
+// ImagesInUse lists the pods from the selected namespaces, and returns the
+// images they use.
+func (s *PodSource) ImagesInUse() (map[string]map[string][]string, error) {
+	pods, err := s.Client.ListAllPods(s.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list pods: %v", err)
+	}
+
+	s.Count = len(pods)
+	return describeUsers(kubernetes.ECRImageUsersFromPods(pods), "pod"), nil
+}
+
+func (s *WorkloadSource) Name() string {
+	return WorkloadSourceName
+}
+
+// ImagesInUse lists the workloads from the selected namespaces, and returns
+// the images their pod templates reference.
+func (s *WorkloadSource) ImagesInUse() (map[string]map[string][]string, error) {
+	lister, ok := s.Client.(kubernetes.WorkloadLister)
+	if !ok {
+		return nil, fmt.Errorf("Cannot list workloads with %T", s.Client)
+	}
+
+	templates, err := lister.ListWorkloadTemplates(s.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list workloads: %v", err)
+	}
+
+	return describeUsers(kubernetes.ECRImageUsersFromPods(templates), "workload"), nil
+}
+
+func (s *GitOpsSource) Name() string {
+	return GitOpsSourceName + "=" + s.Dir
+}
+
+// ImagesInUse scans the directory, and returns the images referenced by its
+// files.
+func (s *GitOpsSource) ImagesInUse() (map[string]map[string][]string, error) {
+	refs, err := gitops.ScanDirectory(s.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot scan GitOps directory '%s': %v", s.Dir, err)
+	}
+
+	return describeUsers(refs, "file"), nil
+}
+
+func (s *AllowlistSource) Name() string {
+	return AllowlistSourceName + "=" + s.Path
+}
+
+// ImagesInUse reads the images listed in the file.
+func (s *AllowlistSource) ImagesInUse() (map[string]map[string][]string, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			images = append(images, line)
+		}
+	}
+
+	return imageUsers(images, fmt.Sprintf("allowlist '%s'", s.Path))
+}
+
+func (s *EndpointSource) Name() string {
+	return EndpointSourceName + "=" + s.URL
+}
+
+// ImagesInUse gets the images listed by the endpoint. Responses with a status
+// other than 200 OK are errors.
+func (s *EndpointSource) ImagesInUse() (map[string]map[string][]string, error) {
+	resp, err := s.client.Get(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status '%s'", resp.Status)
+	}
+
+	var body struct {
+		Images []string `json:"images"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("Cannot parse response: %v", err)
+	}
+
+	return imageUsers(body.Images, fmt.Sprintf("endpoint '%s'", s.URL))
+}
+
+func (s *ECSSource) Name() string {
+	return locatedSourceName(ECSSourceName, s.Location)
+}
+
+// ImagesInUse lists the ECS services of all clusters, and returns the ECR
+// images their task definitions use.
+func (s *ECSSource) ImagesInUse() (map[string]map[string][]string, error) {
+	images, err := s.Client.ListServiceImages()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list ECS services: %v", err)
+	}
+
+	return describeUsers(ecrImageUsers(images), "ECS service"), nil
+}
+
+func (s *LambdaSource) Name() string {
+	return locatedSourceName(LambdaSourceName, s.Location)
+}
+
+// ImagesInUse lists the Lambda functions, and returns the ECR images used by
+// any of their versions.
+func (s *LambdaSource) ImagesInUse() (map[string]map[string][]string, error) {
+	images, err := s.Client.ListFunctionImages()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list Lambda functions: %v", err)
+	}
+
+	return describeUsers(ecrImageUsers(images), "Lambda function"), nil
+}
+
+// awsLocation returns the region and the ARN of the role to assume given by
+// the argument of an AWS source, as in "us-west-2/arn:aws:iam::...:role/x",
+// defaulting to the task's region and the default credentials.
+func awsLocation(t *core.CleanupTask, location string) (string, string) {
+	region, roleARN := location, ""
+	if i := strings.Index(location, "/"); i >= 0 {
+		region, roleARN = location[:i], location[i+1:]
+	}
+
+	if region == "" {
+		region = t.AwsRegion
+	}
+
+	return region, roleARN
+}
+
+// locatedSourceName returns the name of an AWS source with the given
+// location, if any.
+func locatedSourceName(name, location string) string {
+	if location == "" {
+		return name
+	}
+	return name + "=" + location
+}
+
+// ecrImageUsers returns the users of the ECR images among the given ones,
+// indexed by repository name and tag, and by digest for images pinned to one.
+func ecrImageUsers(images map[string][]string) map[string]map[string][]string {
+	users := map[string]map[string][]string{}
+
+	for image, names := range images {
+		repoName, tag, digest, ok := aws.ParseImageReference(image)
+		if !ok {
+			continue
+		}
+
+		if _, ok := users[repoName]; !ok {
+			users[repoName] = map[string][]string{}
+		}
+
+		for _, reference := range []string{tag, digest} {
+			if reference != "" {
+				users[repoName][reference] = append(users[repoName][reference], names...)
+			}
+		}
+	}
+
+	for _, references := range users {
+		for _, names := range references {
+			sort.Strings(names)
+		}
+	}
+
+	return users
+}
+
+// imageUsers returns the given user of each of the given images, indexed by
+// repository name and tag, and by digest for images pinned to one. Images are
+// either ECR image references, "repository:tag" or "repository@digest".
+func imageUsers(images []string, user string) (map[string]map[string][]string, error) {
+	users := map[string]map[string][]string{}
+
+	for _, image := range images {
+		if i := strings.Index(image, ".amazonaws.com"); i >= 0 && strings.Contains(image[:i], ".dkr.ecr.") {
+			image = image[strings.Index(image, "/")+1:]
+		}
+
+		name, digest := image, ""
+		if i := strings.Index(image, "@"); i >= 0 {
+			name, digest = image[:i], image[i+1:]
+		}
+
+		repoName, tag := name, ""
+		if i := strings.LastIndex(name, ":"); i >= 0 {
+			repoName, tag = name[:i], name[i+1:]
+		}
+
+		if repoName == "" || (tag == "" && !isDigest(digest)) || (digest != "" && !isDigest(digest)) {
+			return nil, fmt.Errorf("Invalid image '%s', expected 'repository:tag' or 'repository@digest'", image)
+		}
+
+		if _, ok := users[repoName]; !ok {
+			users[repoName] = map[string][]string{}
+		}
+
+		for _, reference := range []string{tag, digest} {
+			if reference != "" {
+				users[repoName][reference] = append(users[repoName][reference], user)
+			}
+		}
+	}
+
+	return users, nil
+}
@@ -0,0 +1,406 @@
+package processor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+)
+
+func writeAllowlist(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "allowlist.txt")
+
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	return path
+}
+
+func TestNewInUseSource(t *testing.T) {
+	testCases := []struct {
+		spec         string
+		expectedName string
+		expectError  bool
+	}{
+		{"pods", "pods", false},
+		{"workloads", "workloads", false},
+		{"gitops=/git/deployments", "gitops=/git/deployments", false},
+		{"allowlist=/etc/allowlist.txt", "allowlist=/etc/allowlist.txt", false},
+		{"endpoint=http://inventory/images", "endpoint=http://inventory/images", false},
+		{"ecs", "ecs", false},
+		{"lambda=us-west-2/arn:aws:iam::123456789012:role/ecr-cleanup", "lambda=us-west-2/arn:aws:iam::123456789012:role/ecr-cleanup", false},
+		{"pods=namespace", "", true},
+		{"gitops", "", true},
+		{"allowlist=", "", true},
+		{"unknown", "", true},
+	}
+
+	for _, testCase := range testCases {
+		source, err := NewInUseSource(&core.CleanupTask{}, nil, testCase.spec)
+
+		if testCase.expectError {
+			if err == nil {
+				t.Errorf("Expected error for spec '%s', but was nil", testCase.spec)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Expected error for spec '%s' to be nil, but was %v", testCase.spec, err)
+			continue
+		}
+
+		if source.Name() != testCase.expectedName {
+			t.Errorf("Expected name for spec '%s' to be '%s', but was '%s'", testCase.spec, testCase.expectedName, source.Name())
+		}
+	}
+}
+
+func TestAllowlistSource(t *testing.T) {
+	path := writeAllowlist(t, "# Pinned by the release team\n123456789012.dkr.ecr.us-east-1.amazonaws.com/repo:v1\n\nother/repo:v2\n")
+	user := fmt.Sprintf("allowlist '%s'", path)
+
+	users, err := (&AllowlistSource{Path: path}).ImagesInUse()
+
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	expected := map[string]map[string][]string{
+		"repo":       {"v1": {user}},
+		"other/repo": {"v2": {user}},
+	}
+
+	if !reflect.DeepEqual(users, expected) {
+		t.Errorf("Expected images in use to be %v, but was %v", expected, users)
+	}
+
+	if _, err = (&AllowlistSource{Path: writeAllowlist(t, "repo\n")}).ImagesInUse(); err == nil {
+		t.Errorf("Expected error for image without tag, but was nil")
+	}
+
+	if _, err = (&AllowlistSource{Path: filepath.Join(t.TempDir(), "missing")}).ImagesInUse(); err == nil {
+		t.Errorf("Expected error for missing file, but was nil")
+	}
+}
+
+func TestEndpointSource(t *testing.T) {
+	testCases := []struct {
+		status      int
+		body        string
+		expected    map[string][]string
+		expectError bool
+	}{
+		{http.StatusOK, `{"images": ["repo:v1", "repo:v2"]}`, map[string][]string{"v1": nil, "v2": nil}, false},
+		{http.StatusOK, `{"images": []}`, map[string][]string{}, false},
+		{http.StatusOK, `{"images": ["repo@sha256:a1"]}`, map[string][]string{"sha256:a1": nil}, false},
+		{http.StatusOK, `{"images": ["repo"]}`, nil, true},
+		{http.StatusOK, `{"images": ["repo@a1"]}`, nil, true},
+		{http.StatusOK, `not json`, nil, true},
+		{http.StatusInternalServerError, `{"images": ["repo:v1"]}`, nil, true},
+	}
+
+	for i, testCase := range testCases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(testCase.status)
+			w.Write([]byte(testCase.body))
+		}))
+
+		users, err := NewEndpointSource(server.URL).ImagesInUse()
+		server.Close()
+
+		if testCase.expectError {
+			if err == nil {
+				t.Errorf("Expected error in test case %d, but was nil", i)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Expected error in test case %d to be nil, but was %v", i, err)
+			continue
+		}
+
+		if len(users["repo"]) != len(testCase.expected) {
+			t.Errorf("Expected tags in use in test case %d to be %v, but was %v", i, testCase.expected, users["repo"])
+		}
+
+		for tag := range testCase.expected {
+			if len(users["repo"][tag]) != 1 {
+				t.Errorf("Expected tag '%s' in test case %d to have 1 user, but was %v", tag, i, users["repo"][tag])
+			}
+		}
+	}
+}
+
+// mockImageLister returns a fixed set of images as the ones used by ECS
+// services or Lambda functions.
+type mockImageLister struct {
+	images map[string][]string
+	err    error
+}
+
+func (m *mockImageLister) ListServiceImages() (map[string][]string, error) {
+	return m.images, m.err
+}
+
+func (m *mockImageLister) ListFunctionImages() (map[string][]string, error) {
+	return m.images, m.err
+}
+
+func TestAWSSources(t *testing.T) {
+	lister := &mockImageLister{
+		images: map[string][]string{
+			"123456789012.dkr.ecr.us-east-1.amazonaws.com/repo:v1":           {"b", "a"},
+			"123456789012.dkr.ecr.us-east-1.amazonaws.com/repo:v2@sha256:a2": {"a"},
+			"123456789012.dkr.ecr.us-east-1.amazonaws.com/repo@sha256:a3":    {"a"},
+			"nginx:1.21": {"a"},
+		},
+	}
+
+	testCases := []struct {
+		source       InUseSource
+		expectedName string
+		expectedKind string
+	}{
+		{&ECSSource{Client: lister}, "ecs", "ECS service"},
+		{&LambdaSource{Client: lister, Location: "us-west-2"}, "lambda=us-west-2", "Lambda function"},
+	}
+
+	for _, testCase := range testCases {
+		if testCase.source.Name() != testCase.expectedName {
+			t.Errorf("Expected name to be '%s', but was '%s'", testCase.expectedName, testCase.source.Name())
+		}
+
+		lister.err = nil
+		users, err := testCase.source.ImagesInUse()
+
+		if err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+
+		expected := map[string]map[string][]string{
+			"repo": {
+				"v1":        {testCase.expectedKind + " 'a'", testCase.expectedKind + " 'b'"},
+				"v2":        {testCase.expectedKind + " 'a'"},
+				"sha256:a2": {testCase.expectedKind + " 'a'"},
+				"sha256:a3": {testCase.expectedKind + " 'a'"},
+			},
+		}
+
+		if !reflect.DeepEqual(users, expected) {
+			t.Errorf("Expected images in use according to '%s' to be %v, but was %v", testCase.expectedName, expected, users)
+		}
+
+		lister.err = fmt.Errorf("access denied")
+
+		if _, err = testCase.source.ImagesInUse(); err == nil {
+			t.Errorf("Expected error from '%s', but was nil", testCase.expectedName)
+		}
+	}
+}
+
+func TestAWSLocation(t *testing.T) {
+	testCases := []struct {
+		location        string
+		expectedRegion  string
+		expectedRoleARN string
+	}{
+		{"", "us-east-1", ""},
+		{"us-west-2", "us-west-2", ""},
+		{"us-west-2/arn:aws:iam::123456789012:role/ecr-cleanup", "us-west-2", "arn:aws:iam::123456789012:role/ecr-cleanup"},
+		{"/arn:aws:iam::123456789012:role/ecr-cleanup", "us-east-1", "arn:aws:iam::123456789012:role/ecr-cleanup"},
+	}
+
+	for _, testCase := range testCases {
+		region, roleARN := awsLocation(&core.CleanupTask{AwsRegion: "us-east-1"}, testCase.location)
+
+		if region != testCase.expectedRegion || roleARN != testCase.expectedRoleARN {
+			t.Errorf("Expected location '%s' to be (%s, %s), but was (%s, %s)", testCase.location, testCase.expectedRegion, testCase.expectedRoleARN, region, roleARN)
+		}
+	}
+}
+
+func TestRemoveOldImagesWithInUseSources(t *testing.T) {
+	path := writeAllowlist(t, "repo:v1\n")
+	emptyPath := writeAllowlist(t, "# Nothing in use\n")
+
+	testCases := []struct {
+		sources             []string
+		expectedRemoveCalls [][]string
+		expectedProtectedBy map[string][]string
+		expectedErrors      int
+	}{
+		// Pods only
+		{[]string{"pods"}, [][]string{{"sha256:a1", "sha256:a2"}}, map[string][]string{"sha256:a4": {"pods"}}, 0},
+
+		// Pods and allowlist
+		{[]string{"pods", "allowlist=" + path}, [][]string{{"sha256:a2", "sha256:a3"}}, map[string][]string{
+			"sha256:a1": {"allowlist=" + path},
+			"sha256:a4": {"pods"},
+		}, 0},
+
+		// Allowlist only, without listing pods
+		{[]string{"allowlist=" + path}, [][]string{{"sha256:a2", "sha256:a3"}}, map[string][]string{
+			"sha256:a1": {"allowlist=" + path},
+		}, 0},
+
+		// Fails closed
+		{[]string{"pods", "allowlist=" + filepath.Join(t.TempDir(), "missing")}, nil, nil, 1},
+
+		// Safety brake tripped by a source that finds no images in use
+		{[]string{"pods", "allowlist=" + emptyPath}, [][]string{}, map[string][]string{"sha256:a4": {"pods"}}, 1},
+	}
+
+	for i, testCase := range testCases {
+		namespace, repoName := "namespace", "repo"
+
+		kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:v4",
+			[]string{"sha256:a1", "sha256:a2", "sha256:a3", "sha256:a4"},
+			[]string{"v1", "v2", "v3", "v4"})
+
+		ecrClient.expectedRemoveCalls = testCase.expectedRemoveCalls
+
+		sources := []*string{}
+		for j := range testCase.sources {
+			sources = append(sources, &testCase.sources[j])
+		}
+
+		task := &core.CleanupTask{
+			KubeNamespaces:     []*string{&namespace},
+			EcrRepositories:    []*string{&repoName},
+			InUseSources:       sources,
+			MaxImages:          2,
+			MinImagesPerSource: 1,
+		}
+
+		report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+		if len(errs) != testCase.expectedErrors {
+			t.Errorf("Expected %d errors in test case %d, but was %q", testCase.expectedErrors, i, errs)
+		}
+
+		if ecrClient.removeCalls != len(testCase.expectedRemoveCalls) {
+			t.Errorf("Expected images to be removed %d times in test case %d, but was %d times", len(testCase.expectedRemoveCalls), i, ecrClient.removeCalls)
+		}
+
+		if testCase.expectedProtectedBy == nil {
+			continue
+		}
+
+		protectedBy := map[string][]string{}
+		for _, repoReport := range report.Repositories {
+			for _, record := range repoReport.InUse {
+				protectedBy[record.Digest] = record.ProtectedBy
+			}
+		}
+
+		if !reflect.DeepEqual(protectedBy, testCase.expectedProtectedBy) {
+			t.Errorf("Expected images in use in test case %d to be protected by %v, but was %v", i, testCase.expectedProtectedBy, protectedBy)
+		}
+	}
+}
+
+func TestRemoveOldImagesWithDigestsInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowlist.txt")
+	namespace, repoName := "namespace", "repo"
+
+	// Untagged after its tag moved to another image
+	untagged := newTestImage("sha256:a1")
+	quarantined := newTestImage("sha256:a2", "quarantine-20200101-a2")
+	pinned := newTestImage("sha256:a3", "v3")
+
+	testCases := []struct {
+		name       string
+		allowlist  string
+		expectedIn []string
+	}{
+		{"in use by digest", "repo@sha256:a1\nrepo@sha256:a2\nrepo@sha256:a3\n", []string{"sha256:a1", "sha256:a2", "sha256:a3"}},
+		{"in use by tag and digest", "repo:v3@sha256:a1\n", []string{"sha256:a1", "sha256:a3"}},
+	}
+
+	for _, testCase := range testCases {
+		if err := ioutil.WriteFile(path, []byte(testCase.allowlist), 0600); err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+
+		kubeClient := &mockKubeClient{
+			t: t,
+
+			expectedNamespace: []string{namespace},
+		}
+
+		ecrClient := &mockECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			listRepositoriesResult: []*ecr.Repository{
+				{
+					RepositoryName: &repoName,
+				},
+			},
+
+			expectedImagesRepositoryName: repoName,
+			listImagesResult:             []*ecr.ImageDetail{untagged, quarantined, pinned},
+			expectedRemoveCalls:          [][]string{},
+		}
+
+		if len(testCase.expectedIn) < 3 {
+			ecrClient.expectedRemoveCalls = [][]string{{"sha256:a2"}}
+		}
+
+		source := "allowlist=" + path
+		task := &core.CleanupTask{
+			KubeNamespaces:   []*string{&namespace},
+			EcrRepositories:  []*string{&repoName},
+			InUseSources:     []*string{&source},
+			QuarantinePeriod: 24 * time.Hour,
+			MaxImages:        0,
+		}
+
+		report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+		if len(errs) != 0 {
+			t.Errorf("Expected errors in test case '%s' to be empty, but is %q", testCase.name, errs)
+		}
+
+		inUse := []string{}
+		for _, record := range report.Repositories[0].InUse {
+			inUse = append(inUse, record.Digest)
+			if !reflect.DeepEqual(record.ProtectedBy, []string{source}) {
+				t.Errorf("Expected %s in test case '%s' to be protected by %s, but was %v", record.Digest, testCase.name, source, record.ProtectedBy)
+			}
+		}
+		sort.Strings(inUse)
+
+		if !reflect.DeepEqual(inUse, testCase.expectedIn) {
+			t.Errorf("Expected images in use in test case '%s' to be %v, but was %v", testCase.name, testCase.expectedIn, inUse)
+		}
+
+		if len(report.Repositories[0].Quarantined) != 0 {
+			t.Errorf("Expected no images to be quarantined in test case '%s', but was %+v", testCase.name, report.Repositories[0].Quarantined)
+		}
+
+		plan := core.NewPlan(nil)
+		plan.Repositories = append(plan.Repositories, &core.RepositoryPlan{
+			Name:   repoName,
+			Images: []*core.PlannedImage{{ImageRecord: core.ImageRecord{Digest: "sha256:a1"}}},
+		})
+
+		ecrClient.expectedRemoveCalls, ecrClient.removeCalls = [][]string{}, 0
+		task.QuarantinePeriod = 0
+
+		if _, errs = ApplyPlan(task, kubeClient, ecrClient, nil, plan); len(errs) != 1 {
+			t.Errorf("Expected plan in test case '%s' not to be applied, but errors were %q", testCase.name, errs)
+		}
+	}
+}
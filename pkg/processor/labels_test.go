@@ -0,0 +1,154 @@
+package processor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestRemoveOldImagesWithLabels(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	keepLabel, retainUntilLabel := "keep=true", "retain-until"
+
+	kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:v4",
+		[]string{"sha256:a1", "sha256:a2", "sha256:a3", "sha256:a4"},
+		[]string{"v1", "v2", "v3", "v4"})
+
+	ecrClient.metadata = map[string]*aws.ImageMetadata{
+		"sha256:a1": {Labels: map[string]string{"keep": "true"}},
+		"sha256:a2": {Annotations: map[string]string{"retain-until": time.Now().Add(time.Hour).Format(time.RFC3339)}},
+		"sha256:a3": {Labels: map[string]string{"retain-until": "2020-01-01"}},
+	}
+
+	removed := "sha256:a3"
+	ecrClient.expectedImagesToRemove = []*ecr.ImageDetail{
+		{
+			ImageDigest: &removed,
+		},
+	}
+
+	task := &core.CleanupTask{
+		KubeNamespaces:    []*string{&namespace},
+		EcrRepositories:   []*string{&repoName},
+		KeepLabels:        []*string{&keepLabel},
+		RetainUntilLabels: []*string{&retainUntilLabel},
+
+		// Would cause all images to be deleted
+		MaxImages: 0,
+	}
+
+	report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	deleted := report.Repositories[0].Deleted
+	if len(deleted) != 1 || deleted[0].Digest != removed {
+		t.Errorf("Expected %s to be deleted, but was %+v", removed, deleted)
+	}
+
+	// Labels of images in use are not retrieved
+	if expected := []string{"sha256:a1", "sha256:a2", "sha256:a3"}; !reflect.DeepEqual(ecrClient.metadataDigests, expected) {
+		t.Errorf("Expected metadata of %v to be retrieved, but was %v", expected, ecrClient.metadataDigests)
+	}
+}
+
+func TestRemoveOldImagesWithLabelsOfImageIndexes(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	keepLabel, indexType := "keep=true", "application/vnd.oci.image.index.v1+json"
+
+	// Only the index whose platform images carry the label is kept
+	kept, removed := newTestImage("sha256:a1", "v1"), newTestImage("sha256:a2", "v2")
+	kept.ImageManifestMediaType = &indexType
+	removed.ImageManifestMediaType = &indexType
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*apiv1.Pod{},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             []*ecr.ImageDetail{kept, removed, newTestImage("sha256:b1"), newTestImage("sha256:b2")},
+
+		manifests: map[string]string{
+			"sha256:a1": `{"manifests": [{"digest": "sha256:b1"}]}`,
+			"sha256:a2": `{"manifests": [{"digest": "sha256:b2"}]}`,
+		},
+
+		metadata: map[string]*aws.ImageMetadata{
+			"sha256:b1": {Labels: map[string]string{"keep": "true"}},
+		},
+
+		expectedRemoveCalls: [][]string{
+			{"sha256:a2"},
+			{"sha256:b2"},
+		},
+	}
+
+	task := &core.CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		KeepLabels:      []*string{&keepLabel},
+
+		// Would cause all images to be deleted
+		MaxImages: 0,
+	}
+
+	_, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	if ecrClient.removeCalls != 2 {
+		t.Errorf("Expected 2 calls to remove images, but was %d", ecrClient.removeCalls)
+	}
+}
+
+func TestExplainImageWithLabels(t *testing.T) {
+	keepLabel := "keep=true"
+	image := newTestImage("sha256:a1", "v1")
+
+	sel := &Selection{
+		Images:     []*ecr.ImageDetail{image},
+		Candidates: []*ecr.ImageDetail{image},
+		Filtered:   []*ecr.ImageDetail{},
+		Removable:  []*ecr.ImageDetail{},
+		Metadata: map[string]*aws.ImageMetadata{
+			"sha256:a1": {Labels: map[string]string{"keep": "true"}},
+		},
+	}
+
+	decision := ExplainImage(&core.CleanupTask{KeepLabels: []*string{&keepLabel}}, sel, nil, nil, nil, image, time.Now())
+
+	if decision.Delete {
+		t.Errorf("Expected image to be kept")
+	}
+
+	found := false
+	for _, rule := range decision.Rules {
+		found = found || (rule.Rule == "label" && rule.Keep)
+	}
+
+	if !found {
+		t.Errorf("Expected decision to contain the label rule, but was %+v", decision.Rules)
+	}
+}
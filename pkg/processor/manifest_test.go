@@ -0,0 +1,293 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestRemoveOldImagesWithImageIndexes(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	indexType := "application/vnd.oci.image.index.v1+json"
+	pushedAt := []time.Time{time.Unix(0, 0), time.Unix(1, 0)}
+
+	// Old unused index, whose children are removed along with it, except
+	// the ones also referenced by a kept index
+	oldIndex := newTestImage("sha256:a1", "old")
+	oldIndex.ImageManifestMediaType = &indexType
+	oldIndex.ImagePushedAt = &pushedAt[0]
+
+	// Index in use
+	newIndex := newTestImage("sha256:a2", "new")
+	newIndex.ImageManifestMediaType = &indexType
+	newIndex.ImagePushedAt = &pushedAt[1]
+
+	children := []*ecr.ImageDetail{
+		newTestImage("sha256:b1"),
+		newTestImage("sha256:b2"),
+		newTestImage("sha256:b3"),
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*apiv1.Pod{
+			{
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{
+							Image: "id.dkr.ecr.region.amazonaws.com/repo:new",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             append([]*ecr.ImageDetail{oldIndex, newIndex}, children...),
+
+		manifests: map[string]string{
+			"sha256:a1": `{"manifests": [{"digest": "sha256:b1"}, {"digest": "sha256:b2"}]}`,
+			"sha256:a2": `{"manifests": [{"digest": "sha256:b2"}, {"digest": "sha256:b3"}]}`,
+		},
+
+		// The index is removed before its children
+		expectedRemoveCalls: [][]string{
+			{"sha256:a1"},
+			{"sha256:b1"},
+		},
+	}
+
+	task := &core.CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		// Would cause all images to be deleted
+		MaxImages: 0,
+	}
+
+	report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	if ecrClient.removeCalls != 2 {
+		t.Errorf("Expected 2 calls to remove images, but was %d", ecrClient.removeCalls)
+	}
+
+	if deleted := len(report.Repositories[0].Deleted); deleted != 2 {
+		t.Errorf("Expected 2 deleted images, but was %d", deleted)
+	}
+}
+
+func TestExplainImageWithImageIndexChild(t *testing.T) {
+	index := newTestImage("sha256:a1", "v1")
+	child := newTestImage("sha256:b1")
+
+	sel := &Selection{
+		Images:    []*ecr.ImageDetail{index, child},
+		Removable: []*ecr.ImageDetail{},
+		Children:  []*ecr.ImageDetail{child},
+		Graph: &aws.ImageGraph{
+			Children: map[string][]string{"sha256:a1": {"sha256:b1"}},
+			Parents:  map[string][]string{"sha256:b1": {"sha256:a1"}},
+		},
+	}
+
+	decision := ExplainImage(&core.CleanupTask{}, sel, nil, nil, nil, child, time.Now())
+
+	if decision.Delete {
+		t.Errorf("Expected child of kept index to be kept")
+	}
+
+	if len(decision.Rules) != 1 || decision.Rules[0].Rule != "image-index" {
+		t.Errorf("Expected decision to contain the image-index rule, but was %+v", decision.Rules)
+	}
+}
+
+func TestRemoveOldImagesWithArtifacts(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	pushedAt := []time.Time{time.Unix(0, 0), time.Unix(1, 0), time.Unix(2, 0)}
+
+	oldImage := newTestImage("sha256:a1", "old")
+	oldImage.ImagePushedAt = &pushedAt[0]
+
+	newImage := newTestImage("sha256:a2", "new")
+	newImage.ImagePushedAt = &pushedAt[1]
+
+	// Artifacts are newer than the images they describe, but they do not
+	// count toward the max images
+	artifacts := []*ecr.ImageDetail{
+		newTestImage("sha256:c1", "sha256-a1.sig"),
+		newTestImage("sha256:c2", "sha256-a2.sig"),
+		newTestImage("sha256:c3", "sha256-a2.att"),
+	}
+	for _, artifact := range artifacts {
+		artifact.ImagePushedAt = &pushedAt[2]
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*apiv1.Pod{},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             append([]*ecr.ImageDetail{oldImage, newImage}, artifacts...),
+
+		// The signature is removed along with the image it describes
+		expectedRemoveCalls: [][]string{
+			{"sha256:a1", "sha256:c1"},
+		},
+	}
+
+	task := &core.CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		MaxImages:       1,
+	}
+
+	report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	if ecrClient.removeCalls != 1 {
+		t.Errorf("Expected 1 call to remove images, but was %d", ecrClient.removeCalls)
+	}
+
+	if deleted := len(report.Repositories[0].Deleted); deleted != 2 {
+		t.Errorf("Expected 2 deleted images, but was %d", deleted)
+	}
+}
+
+func TestRemoveOldImagesWithArtifactsOfMissingImages(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	pushedAt := []time.Time{time.Unix(0, 0), time.Unix(1, 0)}
+
+	// Artifact whose image is not in the repository, which counts toward
+	// the max images like any other image
+	artifact := newTestImage("sha256:c1", "sha256-b1.sig")
+	artifact.ImagePushedAt = &pushedAt[0]
+
+	image := newTestImage("sha256:a1", "v1")
+	image.ImagePushedAt = &pushedAt[1]
+
+	testCases := []struct {
+		maxImages           int
+		expectedRemoveCalls [][]string
+	}{
+		{2, [][]string{}},
+		{1, [][]string{{"sha256:c1"}}},
+	}
+
+	for _, testCase := range testCases {
+		kubeClient := &mockKubeClient{
+			t: t,
+
+			expectedNamespace: []string{namespace},
+			listAllPodsResult: []*apiv1.Pod{},
+		}
+
+		ecrClient := &mockECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			listRepositoriesResult: []*ecr.Repository{
+				{
+					RepositoryName: &repoName,
+				},
+			},
+
+			expectedImagesRepositoryName: repoName,
+			listImagesResult:             []*ecr.ImageDetail{artifact, image},
+
+			expectedRemoveCalls: testCase.expectedRemoveCalls,
+		}
+
+		task := &core.CleanupTask{
+			KubeNamespaces:  []*string{&namespace},
+			EcrRepositories: []*string{&repoName},
+			MaxImages:       testCase.maxImages,
+		}
+
+		_, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+		if len(errs) != 0 {
+			t.Errorf("Expected errors to be empty, but is %q", errs)
+		}
+
+		if ecrClient.removeCalls != len(testCase.expectedRemoveCalls) {
+			t.Errorf("Expected %d calls to remove images, but was %d", len(testCase.expectedRemoveCalls), ecrClient.removeCalls)
+		}
+	}
+}
+
+func TestExplainImageWithArtifact(t *testing.T) {
+	image := newTestImage("sha256:a1", "v1")
+	removedImage := newTestImage("sha256:b1", "v0")
+	signature := newTestImage("sha256:c1", "sha256-a1.sig")
+	orphan := newTestImage("sha256:c2", "sha256-b1.sig")
+
+	graph, err := aws.NewImageGraph(&mockECRClient{t: t}, []*ecr.ImageDetail{image, removedImage, signature, orphan})
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	sel := &Selection{
+		Images:    []*ecr.ImageDetail{image, removedImage, signature, orphan},
+		Removable: []*ecr.ImageDetail{removedImage, orphan},
+		Children:  []*ecr.ImageDetail{signature, orphan},
+		Graph:     graph,
+	}
+
+	testCases := []struct {
+		image          *ecr.ImageDetail
+		expectedDelete bool
+		expectedDetail string
+	}{
+		{signature, false, "describes image 'sha256:a1', which is kept"},
+		{orphan, true, "describes image 'sha256:b1', which is removed"},
+	}
+
+	for _, testCase := range testCases {
+		decision := ExplainImage(&core.CleanupTask{}, sel, nil, nil, nil, testCase.image, time.Now())
+
+		if decision.Delete != testCase.expectedDelete {
+			t.Errorf("Expected artifact '%s' to be deleted: %v, but was %v", *testCase.image.ImageDigest, testCase.expectedDelete, decision.Delete)
+		}
+
+		if len(decision.Rules) != 1 || decision.Rules[0].Rule != "artifact" || decision.Rules[0].Detail != testCase.expectedDetail {
+			t.Errorf("Expected decision to contain the artifact rule, but was %+v", decision.Rules)
+		}
+	}
+}
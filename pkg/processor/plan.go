@@ -0,0 +1,264 @@
+package processor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/kubernetes"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/state"
+	"github.com/golang/glog"
+)
+
+// PlanRemoval computes which images would be removed from each repository,
+// along with the reasons, without removing any images or saving any state.
+func PlanRemoval(t *core.CleanupTask, kubeClient kubernetes.KubernetesClient, ecrClient aws.ECRClient, store state.Store) (*core.Plan, []error) {
+	errors := []error{}
+	plan := core.NewPlan(t.RegistryID)
+
+	st, err := loadState(store)
+	if err != nil {
+		return nil, append(errors, err)
+	}
+
+	inUse, err := FindImagesInUse(t, kubeClient, st)
+	if err != nil {
+		return nil, append(errors, err)
+	}
+
+	verifier, err := NewSignatureVerifier(t)
+	if err != nil {
+		return nil, append(errors, fmt.Errorf("Cannot create signature verifier: %v", err))
+	}
+
+	policies, err := NewPolicies(t)
+	if err != nil {
+		return nil, append(errors, fmt.Errorf("Cannot load policies: %v", err))
+	}
+
+	vetoHook := NewVetoHook(t)
+
+	repos, err := ecrClient.ListRepositories(t.EcrRepositories, t.RegistryID)
+	if err != nil {
+		return nil, append(errors, fmt.Errorf("Cannot list ECR repositories: %v", err))
+	}
+
+	for _, repo := range repos {
+		repoName := *repo.RepositoryName
+
+		images, err := ecrClient.ListImages(&repoName, t.RegistryID)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("Cannot list images from repo '%s': %v", repoName, err))
+			continue
+		}
+
+		now := time.Now()
+		facts, err := GatherImageFacts(t, ecrClient, verifier, policies, repoName, images, inUse.References(repoName), now)
+		if err != nil {
+			errors = append(errors, err)
+			continue
+		}
+
+		// Marks are evaluated as they were before this run
+		var marks map[string]time.Time
+		if t.GracePeriod > 0 {
+			marks = st.Marks[repoName]
+		}
+
+		// Plans are applied without pruning any tags
+		sel := SelectImages(t, st, repoName, images, facts, inUse.References(repoName), now)
+		sel.Prunable = []*ecr.ImageDetail{}
+
+		if err = VetoImages(t, vetoHook, repoName, sel, true); err != nil {
+			errors = append(errors, err)
+			continue
+		}
+
+		if err = CheckSafetyBrakes(t, inUse, len(images), len(sel.Removable)); err != nil && len(sel.Removable) > 0 {
+			errors = append(errors, fmt.Errorf("Safety brake tripped for repo '%s', not planning to remove any images: %v", repoName, err))
+			continue
+		}
+
+		plan.Repositories = append(plan.Repositories, planRepository(t, repoName, sel, inUse.Users[repoName], marks, now))
+	}
+
+	return plan, errors
+}
+
+// ApplyPlan removes exactly the images listed in the given plan. Before
+// removing the images of a repository, it makes sure none of them became in
+// use or got signed since the plan was created; if any did, or if the safety
+// brakes trip, no images are removed from that repository. Images that no
+// longer exist are skipped.
+func ApplyPlan(t *core.CleanupTask, kubeClient kubernetes.KubernetesClient, ecrClient aws.ECRClient, store state.Store, plan *core.Plan) (*core.Report, []error) {
+	errors := []error{}
+	report := core.NewReport(t.DryRun)
+
+	var registryID *string
+	if plan.RegistryID != "" {
+		registryID = &plan.RegistryID
+	}
+
+	st, err := loadState(store)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report, append(errors, err)
+	}
+
+	inUse, err := FindImagesInUse(t, kubeClient, st)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report, append(errors, err)
+	}
+
+	verifier, err := NewSignatureVerifier(t)
+	if err != nil {
+		err = fmt.Errorf("Cannot create signature verifier: %v", err)
+		report.Errors = append(report.Errors, err.Error())
+		return report, append(errors, err)
+	}
+
+	vetoHook := NewVetoHook(t)
+
+	for _, repoPlan := range plan.Repositories {
+		repoName := repoPlan.Name
+		glog.Infof("Applying plan to '%s' ECR repo.", repoName)
+
+		repoReport := core.NewRepositoryReport(repoName)
+		report.Repositories = append(report.Repositories, repoReport)
+
+		repoFail := func(err error) {
+			errors = append(errors, err)
+			repoReport.Failures = append(repoReport.Failures, err.Error())
+		}
+
+		images, err := ecrClient.ListImages(&repoName, registryID)
+		if err != nil {
+			repoFail(fmt.Errorf("Cannot list images from repo '%s': %v", repoName, err))
+			continue
+		}
+		repoReport.Listed = len(images)
+
+		imagesByDigest := map[string]*ecr.ImageDetail{}
+		for _, image := range images {
+			imagesByDigest[awssdk.StringValue(image.ImageDigest)] = image
+		}
+
+		signed := map[string]bool{}
+		if verifier != nil {
+			graph, err := aws.NewImageGraph(ecrClient, images)
+			if err != nil {
+				repoFail(fmt.Errorf("Cannot retrieve image indexes from repo '%s': %v", repoName, err))
+				continue
+			}
+
+			if signed, err = verifier.SignedImages(ecrClient, graph, images); err != nil {
+				repoFail(fmt.Errorf("Cannot verify image signatures in repo '%s': %v", repoName, err))
+				continue
+			}
+		}
+
+		tagsInUse := tagSet(inUse.References(repoName))
+		toRemove, nowInUse, nowSigned := []*ecr.ImageDetail{}, []string{}, []string{}
+
+		for _, planned := range repoPlan.Images {
+			image, ok := imagesByDigest[planned.Digest]
+			if !ok {
+				glog.Infof("Image '%s' no longer exists in repo '%s', skipping.", planned.Digest, repoName)
+				continue
+			}
+
+			if isInUse(image, tagsInUse) || hasTag(image, "latest") {
+				nowInUse = append(nowInUse, planned.Digest)
+				reportInUse(repoReport, image, inUse.Sources[repoName])
+				continue
+			}
+
+			if signed[planned.Digest] {
+				nowSigned = append(nowSigned, planned.Digest)
+				ReportImages(&repoReport.KeptByFilter, []*ecr.ImageDetail{image})
+				continue
+			}
+
+			toRemove = append(toRemove, image)
+		}
+
+		if len(nowInUse) > 0 {
+			ReportImages(&repoReport.KeptByPolicy, toRemove)
+			repoFail(fmt.Errorf("Images from repo '%s' became in use since the plan was created, not removing any images: %s", repoName, strings.Join(nowInUse, ", ")))
+			continue
+		}
+
+		if len(nowSigned) > 0 {
+			ReportImages(&repoReport.KeptByPolicy, toRemove)
+			repoFail(fmt.Errorf("Images from repo '%s' got signed since the plan was created, not removing any images: %s", repoName, strings.Join(nowSigned, ", ")))
+			continue
+		}
+
+		vetoed, err := VetoedImages(t, vetoHook, repoName, toRemove)
+		if err != nil {
+			ReportImages(&repoReport.KeptByPolicy, toRemove)
+			repoFail(err)
+			continue
+		}
+
+		if len(vetoed) > 0 {
+			ReportImages(&repoReport.KeptByPolicy, toRemove)
+			repoFail(fmt.Errorf("Images from repo '%s' got vetoed since the plan was created, not removing any images: %s", repoName, strings.Join(vetoed, ", ")))
+			continue
+		}
+
+		if err = CheckSafetyBrakes(t, inUse, len(images), len(toRemove)); err != nil && len(toRemove) > 0 {
+			ReportImages(&repoReport.KeptByPolicy, toRemove)
+			repoFail(fmt.Errorf("Safety brake tripped for repo '%s', not removing any images: %v", repoName, err))
+			continue
+		}
+
+		if t.DryRun {
+			glog.Infof("Would have removed %d images.", len(toRemove))
+			ReportImages(&repoReport.Deleted, toRemove)
+			continue
+		}
+
+		glog.Infof("Removing %d planned images.", len(toRemove))
+		if err = removeImages(t, ecrClient, repoReport, toRemove, time.Now()); err != nil {
+			repoFail(fmt.Errorf("Could not batch remove images from repo '%s': %v", repoName, err))
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	return report, errors
+}
+
+// planRepository lists the images of the given selection that are going to be
+// removed, along with the reasons, and the tags that are going to be pruned.
+func planRepository(t *core.CleanupTask, repoName string, sel *Selection, users map[string][]string, marks map[string]time.Time, now time.Time) *core.RepositoryPlan {
+	repoPlan := &core.RepositoryPlan{
+		Name:   repoName,
+		Images: []*core.PlannedImage{},
+	}
+
+	for _, image := range sel.Removable {
+		decision := ExplainImage(t, sel, users, marks, nil, image, now)
+		repoPlan.Images = append(repoPlan.Images, core.NewPlannedImage(decision))
+	}
+
+	if len(sel.Prunable) > 0 {
+		repoPlan.PrunedTags = PrunedTagRecords(t, sel.Prunable)
+	}
+
+	return repoPlan
+}
+
+func hasTag(image *ecr.ImageDetail, tag string) bool {
+	for _, imageTag := range image.ImageTags {
+		if *imageTag == tag {
+			return true
+		}
+	}
+	return false
+}
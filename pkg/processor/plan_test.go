@@ -0,0 +1,206 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func newPlanTestClients(t *testing.T, podImage string, digests, tags []string) (*mockKubeClient, *mockECRClient) {
+	namespace, repoName := "namespace", "repo"
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*apiv1.Pod{
+			{
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{
+							Image: podImage,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	images := []*ecr.ImageDetail{}
+	for i := range digests {
+		pushedAt := time.Unix(int64(i), 0)
+		images = append(images, &ecr.ImageDetail{
+			RepositoryName: &repoName,
+			ImageDigest:    &digests[i],
+			ImageTags:      []*string{&tags[i]},
+			ImagePushedAt:  &pushedAt,
+		})
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             images,
+	}
+
+	return kubeClient, ecrClient
+}
+
+func TestPlanRemoval(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	digests := []string{"digest-1", "digest-2", "digest-3"}
+	tags := []string{"tag-1", "tag-2", "tag-3"}
+
+	kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:tag-1", digests, tags)
+
+	task := &core.CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		// Will cause the unused images to be planned for removal
+		MaxImages: 0,
+	}
+
+	plan, errs := PlanRemoval(task, kubeClient, ecrClient, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	if len(plan.Repositories) != 1 || plan.Repositories[0].Name != repoName {
+		t.Fatalf("Expected plan to contain repo '%s', but was %+v", repoName, plan.Repositories)
+	}
+
+	planned := plan.Repositories[0].Images
+	if len(planned) != 2 || planned[0].Digest != digests[1] || planned[1].Digest != digests[2] {
+		t.Errorf("Expected %s and %s to be planned for removal, but was %+v", digests[1], digests[2], planned)
+	}
+
+	if len(planned) > 0 && len(planned[0].Reasons) == 0 {
+		t.Errorf("Expected planned image to have reasons, but it did not")
+	}
+}
+
+func TestApplyPlan(t *testing.T) {
+	namespace := "namespace"
+	digests := []string{"digest-1", "digest-2"}
+	tags := []string{"tag-1", "tag-2"}
+
+	kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:tag-1", digests, tags)
+	ecrClient.expectedImagesToRemove = []*ecr.ImageDetail{
+		{
+			ImageDigest: &digests[1],
+		},
+	}
+
+	plan := core.NewPlan(nil)
+	plan.Repositories = append(plan.Repositories, &core.RepositoryPlan{
+		Name: "repo",
+		Images: []*core.PlannedImage{
+			{ImageRecord: core.ImageRecord{Digest: digests[1]}},
+			{ImageRecord: core.ImageRecord{Digest: "digest-gone"}},
+		},
+	})
+
+	task := &core.CleanupTask{
+		KubeNamespaces: []*string{&namespace},
+	}
+
+	report, errs := ApplyPlan(task, kubeClient, ecrClient, nil, plan)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	deleted := report.Repositories[0].Deleted
+	if len(deleted) != 1 || deleted[0].Digest != digests[1] {
+		t.Errorf("Expected %s to be deleted, but was %+v", digests[1], deleted)
+	}
+}
+
+func TestApplyPlanWithImageNowInUse(t *testing.T) {
+	namespace := "namespace"
+	digests := []string{"digest-1", "digest-2"}
+	tags := []string{"tag-1", "tag-2"}
+
+	kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:tag-1", digests, tags)
+
+	// No images must be removed
+	ecrClient.expectedImagesToRemove = []*ecr.ImageDetail{}
+
+	plan := core.NewPlan(nil)
+	plan.Repositories = append(plan.Repositories, &core.RepositoryPlan{
+		Name: "repo",
+		Images: []*core.PlannedImage{
+			{ImageRecord: core.ImageRecord{Digest: digests[0]}},
+			{ImageRecord: core.ImageRecord{Digest: digests[1]}},
+		},
+	})
+
+	task := &core.CleanupTask{
+		KubeNamespaces: []*string{&namespace},
+	}
+
+	report, errs := ApplyPlan(task, kubeClient, ecrClient, nil, plan)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+
+	if len(report.Repositories[0].Deleted) != 0 {
+		t.Errorf("Expected no images to be deleted, but was %+v", report.Repositories[0].Deleted)
+	}
+}
+
+func TestApplyPlanWithSafetyBrake(t *testing.T) {
+	namespace := "namespace"
+	digests := []string{"digest-1", "digest-2"}
+	tags := []string{"tag-1", "tag-2"}
+
+	kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:tag-1", digests, tags)
+
+	// Wrong cluster, or pods no longer visible
+	kubeClient.listAllPodsResult = []*apiv1.Pod{}
+
+	// No images must be removed
+	ecrClient.expectedRemoveCalls = [][]string{}
+
+	plan := core.NewPlan(nil)
+	plan.Repositories = append(plan.Repositories, &core.RepositoryPlan{
+		Name: "repo",
+		Images: []*core.PlannedImage{
+			{ImageRecord: core.ImageRecord{Digest: digests[0]}},
+			{ImageRecord: core.ImageRecord{Digest: digests[1]}},
+		},
+	})
+
+	task := &core.CleanupTask{
+		KubeNamespaces: []*string{&namespace},
+		MinPods:        1,
+	}
+
+	report, errs := ApplyPlan(task, kubeClient, ecrClient, nil, plan)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+
+	if len(report.Repositories[0].Deleted) != 0 {
+		t.Errorf("Expected no images to be deleted, but was %+v", report.Repositories[0].Deleted)
+	}
+
+	if len(report.Repositories[0].KeptByPolicy) != 2 {
+		t.Errorf("Expected 2 images to be kept, but was %+v", report.Repositories[0].KeptByPolicy)
+	}
+}
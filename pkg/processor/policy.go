@@ -0,0 +1,87 @@
+package processor
+
+import (
+	"fmt"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/policy"
+)
+
+// NewPolicies returns the policies deciding whether images are kept or
+// deleted, or nil if the task has no policy file.
+func NewPolicies(t *core.CleanupTask) (*policy.Set, error) {
+	if t.PolicyFile == "" {
+		return nil, nil
+	}
+
+	return policy.LoadFile(t.PolicyFile)
+}
+
+// EvaluatePolicy evaluates the given policy against the given images, and
+// returns the decisions other than policy.NoDecision, by digest.
+func EvaluatePolicy(p *policy.Policy, ecrClient aws.ECRClient, images []*ecr.ImageDetail, findings map[string]map[string]int64, tagsInUse []string, now time.Time) (map[string]policy.Decision, error) {
+	decisions := map[string]policy.Decision{}
+	inUse := tagSet(tagsInUse)
+
+	for _, image := range images {
+		decision, err := p.Evaluate(policyImage(ecrClient, image, findings, inUse), now)
+		if err != nil {
+			return nil, fmt.Errorf("Image '%s': %v", awssdk.StringValue(image.ImageDigest), err)
+		}
+
+		if decision != policy.NoDecision {
+			decisions[awssdk.StringValue(image.ImageDigest)] = decision
+		}
+	}
+
+	return decisions, nil
+}
+
+// PolicyDeletedImages returns the unused images, among the given ones, that
+// the given decisions delete, in the given order.
+func PolicyDeletedImages(ordering aws.ImageOrdering, images []*ecr.ImageDetail, tagsInUse []string, decisions map[string]policy.Decision) []*ecr.ImageDetail {
+	inUse := tagSet(tagsInUse)
+	deleted := []*ecr.ImageDetail{}
+
+	for _, image := range images {
+		if hasTag(image, "latest") || isInUse(image, inUse) {
+			continue
+		}
+
+		if decisions[awssdk.StringValue(image.ImageDigest)] == policy.Delete {
+			deleted = append(deleted, image)
+		}
+	}
+
+	ordering.Sort(deleted)
+	return deleted
+}
+
+// policyImage returns the attributes of the given image that policies are
+// evaluated against.
+func policyImage(ecrClient aws.ECRClient, image *ecr.ImageDetail, findings map[string]map[string]int64, inUse map[string]bool) *policy.Image {
+	lastPulledAt, ok := ecrClient.LastPullTime(image)
+	if !ok {
+		lastPulledAt = time.Unix(0, 0)
+	}
+
+	severities := map[string]int64{}
+	for _, severity := range aws.ScanSeverities {
+		severities[severity] = findings[awssdk.StringValue(image.ImageDigest)][severity]
+	}
+
+	return &policy.Image{
+		Tags:         awssdk.StringValueSlice(image.ImageTags),
+		Digest:       awssdk.StringValue(image.ImageDigest),
+		PushedAt:     awssdk.TimeValue(image.ImagePushedAt),
+		LastPulledAt: lastPulledAt,
+		Pulled:       ok,
+		SizeBytes:    awssdk.Int64Value(image.ImageSizeInBytes),
+		InUse:        isInUse(image, inUse),
+		Severities:   severities,
+	}
+}
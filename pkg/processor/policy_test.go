@@ -0,0 +1,173 @@
+package processor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/policy"
+)
+
+func writePolicyFile(t *testing.T, repositories map[string]string) string {
+	data, err := json.Marshal(map[string]interface{}{
+		"repositories": repositories,
+	})
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "policies.json")
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	return path
+}
+
+func TestRemoveOldImagesWithPolicy(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+
+	kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:v5",
+		[]string{"sha256:a1", "sha256:a2", "sha256:a3", "sha256:a4", "sha256:a5"},
+		[]string{"v1", "v2", "v3", "v4", "v5"})
+
+	// Keeps v1, which is beyond the images to keep, and deletes v4 and v5,
+	// which are within them, though v5 is in use
+	ecrClient.expectedRemoveCalls = [][]string{{"sha256:a2", "sha256:a4"}}
+
+	task := &core.CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		MaxImages:       3,
+		PolicyFile: writePolicyFile(t, map[string]string{
+			repoName: `"v1" in tags ? "keep" : tags.exists(t, t == "v4" || t == "v5") ? "delete" : ""`,
+		}),
+	}
+
+	report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	if ecrClient.removeCalls != 1 {
+		t.Errorf("Expected images to be removed once, but was %d times", ecrClient.removeCalls)
+	}
+
+	if kept := report.Repositories[0].KeptByFilter; len(kept) != 1 || kept[0].Digest != "sha256:a1" {
+		t.Errorf("Expected only 'sha256:a1' to be kept by filter, but was %+v", kept)
+	}
+}
+
+func TestRemoveOldImagesWithFailingPolicy(t *testing.T) {
+	testCases := []struct {
+		expression string
+	}{
+		// Index out of range
+		{`tags[1] == "v1" ? "keep" : ""`},
+
+		// Unknown decision
+		{`"remove"`},
+	}
+
+	for _, testCase := range testCases {
+		namespace, repoName := "namespace", "repo"
+
+		kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:v3",
+			[]string{"sha256:a1", "sha256:a2", "sha256:a3"},
+			[]string{"v1", "v2", "v3"})
+
+		task := &core.CleanupTask{
+			KubeNamespaces:  []*string{&namespace},
+			EcrRepositories: []*string{&repoName},
+			MaxImages:       1,
+			PolicyFile: writePolicyFile(t, map[string]string{
+				repoName: testCase.expression,
+			}),
+		}
+
+		_, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+		if len(errs) != 1 {
+			t.Errorf("Expected one error for policy '%s', but was %q", testCase.expression, errs)
+		}
+
+		if ecrClient.removeCalls != 0 {
+			t.Errorf("Expected no images to be removed with policy '%s', but was %d times", testCase.expression, ecrClient.removeCalls)
+		}
+	}
+}
+
+func TestEvaluatePolicy(t *testing.T) {
+	p, err := policy.Compile(`!pulled && severities["HIGH"] == 0 ? "delete" : ""`)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	pulled, vulnerable, other := newTestImage("sha256:a1"), newTestImage("sha256:a2"), newTestImage("sha256:a3")
+
+	ecrClient := &mockECRClient{
+		t: t,
+		pullTimes: map[string]time.Time{
+			"sha256:a1": time.Unix(0, 0),
+		},
+	}
+
+	findings := map[string]map[string]int64{
+		"sha256:a2": {"HIGH": 1},
+	}
+
+	decisions, err := EvaluatePolicy(p, ecrClient, []*ecr.ImageDetail{pulled, vulnerable, other}, findings, nil, time.Now())
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if len(decisions) != 1 || decisions["sha256:a3"] != policy.Delete {
+		t.Errorf("Expected only 'sha256:a3' to be deleted, but decisions were %v", decisions)
+	}
+}
+
+func TestExplainImageWithPolicy(t *testing.T) {
+	image := newTestImage("sha256:a1", "v1")
+
+	testCases := []struct {
+		decisions      map[string]policy.Decision
+		expectedKeep   bool
+		expectedDetail string
+	}{
+		{map[string]policy.Decision{"sha256:a1": policy.Keep}, true, "kept by policy"},
+		{map[string]policy.Decision{"sha256:a1": policy.Delete}, false, "deleted by policy"},
+		{map[string]policy.Decision{}, false, "no policy decision"},
+	}
+
+	for _, testCase := range testCases {
+		sel := &Selection{
+			Images:     []*ecr.ImageDetail{image},
+			Candidates: []*ecr.ImageDetail{image},
+			Policy:     &policy.Policy{},
+			Decisions:  testCase.decisions,
+		}
+
+		decision := ExplainImage(&core.CleanupTask{}, sel, nil, nil, nil, image, time.Now())
+
+		found := false
+		for _, rule := range decision.Rules {
+			if rule.Rule != "policy" {
+				continue
+			}
+
+			found = true
+			if rule.Keep != testCase.expectedKeep || rule.Detail != testCase.expectedDetail {
+				t.Errorf("Expected policy rule to be %v '%s', but was %v '%s'", testCase.expectedKeep, testCase.expectedDetail, rule.Keep, rule.Detail)
+			}
+		}
+
+		if !found {
+			t.Errorf("Expected decision to contain the policy rule, but was %+v", decision.Rules)
+		}
+	}
+}
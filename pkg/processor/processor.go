@@ -2,12 +2,21 @@ package processor
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/backup"
 	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
 	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/kubernetes"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/policy"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/signature"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/state"
 	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/utils"
 	"github.com/golang/glog"
 )
@@ -15,22 +24,42 @@ import (
 // ImageCleanupLoop runs the image cleanup repeatedly at an interval.
 func ImageCleanupLoop(t *core.CleanupTask, done chan struct{}, wg *sync.WaitGroup) {
 	go func() {
-		ecrClient := aws.NewECRClient(t.AwsRegion)
+		ecrClient, kubeClient, err := NewClients(t)
+		if err != nil {
+			glog.Fatal(err)
+		}
 
-		kubeClient, err := kubernetes.NewKubernetesClient(t.KubeConfig)
+		if t.WatchPods {
+			if err = kubeClient.WatchPods(t.NamespaceFilter(), done); err != nil {
+				glog.Fatalf("Cannot watch pods: %v", err)
+			}
+		}
+
+		store, err := NewStateStore(t)
 		if err != nil {
-			glog.Fatalf("Cannot create Kubernetes client: %v", err)
+			glog.Fatalf("Cannot create state store: %v", err)
+		}
+
+		approver, err := NewApprover(t)
+		if err != nil {
+			glog.Fatalf("Cannot create approver: %v", err)
 		}
 
 		for {
 			select {
 			case <-time.After(time.Duration(t.Interval) * time.Minute):
-				errors := RemoveOldImages(t, kubeClient, ecrClient)
+				report, errors := RemoveOldImages(t, kubeClient, ecrClient, store, approver)
 				if len(errors) > 0 {
 					for _, err := range errors {
 						glog.Error(err)
 					}
 				}
+
+				if t.ReportFile != "" {
+					if err = report.WriteFile(t.ReportFile); err != nil {
+						glog.Errorf("Cannot write report: %v", err)
+					}
+				}
 			case <-done:
 				wg.Done()
 				glog.Info("Stopped deployment status watcher.")
@@ -40,63 +69,1118 @@ func ImageCleanupLoop(t *core.CleanupTask, done chan struct{}, wg *sync.WaitGrou
 	}()
 }
 
+// NewClients returns the clients used to talk to ECR and to the Kubernetes
+// clusters specified in the given task. If the task specifies a backup
+// location, the ECR client backs up images before removing them.
+func NewClients(t *core.CleanupTask) (aws.ECRClient, *kubernetes.MultiClusterClient, error) {
+	ecrClientImpl, err := aws.NewECRClient(t.AwsRegion, t.AwsEndpoint, t.AwsCABundle)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot create ECR client: %v", err)
+	}
+
+	var ecrClient aws.ECRClient = ecrClientImpl
+
+	backups, err := NewBackupStore(t)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot create backup store: %v", err)
+	}
+
+	if backups != nil {
+		ecrClient = backup.NewClient(ecrClient, backups)
+	}
+
+	kubeClient, err := kubernetes.NewMultiClusterClient(t.KubeConfigs, t.KubeContexts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot create Kubernetes client: %v", err)
+	}
+
+	return ecrClient, kubeClient, nil
+}
+
+// NewBackupStore returns the store where images are backed up before being
+// removed, or nil if the task does not specify any.
+func NewBackupStore(t *core.CleanupTask) (backup.Store, error) {
+	if t.BackupLocation == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(t.BackupLocation, "s3://") {
+		return backup.NewDirStore(t.BackupLocation), nil
+	}
+
+	s3Client, err := aws.NewS3Client(t.AwsRegion, t.BackupEndpoint, t.BackupCABundle)
+	if err != nil {
+		return nil, err
+	}
+
+	return backup.NewS3Store(s3Client, t.BackupLocation)
+}
+
+// NewStateStore returns the store used to persist the controller state
+// between runs, or nil if the task does not specify any.
+func NewStateStore(t *core.CleanupTask) (state.Store, error) {
+	if t.StateFile != "" {
+		return state.NewFileStore(t.StateFile), nil
+	}
+
+	if t.StateConfigMap != "" {
+		parts := strings.SplitN(t.StateConfigMap, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("ConfigMap must be in the 'namespace/name' format, but was '%s'", t.StateConfigMap)
+		}
+
+		kubeClient, err := kubernetes.NewKubernetesClient(t.KubeConfigs, t.StateContext)
+		if err != nil {
+			return nil, err
+		}
+
+		return kubernetes.NewConfigMapStore(kubeClient, parts[0], parts[1]), nil
+	}
+
+	return nil, nil
+}
+
+// NewSignatureVerifier returns the verifier used to protect signed images,
+// or nil if the task does not trust any keys or identities.
+func NewSignatureVerifier(t *core.CleanupTask) (*signature.Verifier, error) {
+	if !t.VerifiesSignatures() {
+		return nil, nil
+	}
+
+	return signature.NewVerifier(t.SignatureKeys, t.SignatureIdentities, t.SignatureRoots)
+}
+
+// NewApprover returns the approver used to hold back large removals until
+// they are approved, or nil if the task does not require approvals.
+func NewApprover(t *core.CleanupTask) (core.Approver, error) {
+	if t.ApprovalThreshold <= 0 {
+		return nil, nil
+	}
+
+	kubeClient, err := kubernetes.NewKubernetesClient(t.KubeConfigs, t.StateContext)
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewConfigMapApprover(kubeClient, t.ApprovalNamespace), nil
+}
+
+// ImagesInUse holds the ECR images considered in use during a run.
+type ImagesInUse struct {
+
+	// Number of pods found, or -1 if pods are not among the sources.
+	PodsCount int
+
+	// Number of images currently in use.
+	Count int
+
+	// Number of images currently in use according to each source other than
+	// pods, indexed by source name.
+	SourceCounts map[string]int
+
+	// Image tags currently in use, or seen in use during the lookback period,
+	// indexed by repository name.
+	Tags map[string][]string
+
+	// Digests of the images referenced by digest rather than by tag, such as
+	// the images Lambda functions run, in use or seen in use during the
+	// lookback period, indexed by repository name.
+	Digests map[string][]string
+
+	// What currently uses each image tag or digest, such as "pod
+	// 'namespace/name'" or "file 'path'", indexed by repository name and tag
+	// or digest.
+	Users map[string]map[string][]string
+
+	// Names of the sources each image tag or digest is in use according to,
+	// indexed by repository name and tag or digest.
+	Sources map[string]map[string][]string
+}
+
+// Selection holds the outcome of each step of the selection of images to
+// remove from a repository.
+type Selection struct {
+	Images    []*ecr.ImageDetail
+	TagsInUse []string
+
+	// Old unused images.
+	Candidates []*ecr.ImageDetail
+
+	// Candidates that do not match any keep filters.
+	Filtered []*ecr.ImageDetail
+
+	// Images that are going to be removed.
+	Removable []*ecr.ImageDetail
+
+	// Images in quarantine, which are not considered for removal again.
+	Quarantined []*ecr.ImageDetail
+
+	// Candidates kept by keep filters that have redundant tags to remove.
+	Prunable []*ecr.ImageDetail
+
+	// Digests of the images with a valid signature, which are never removed.
+	Signed map[string]bool
+
+	// Labels and annotations of the candidates, by digest.
+	Metadata map[string]*aws.ImageMetadata
+
+	// Number of scan findings of each severity, by digest.
+	Findings map[string]map[string]int64
+
+	// Unused vulnerable images beyond the maximum number to keep, which are
+	// also candidates.
+	ExcessVulnerable []*ecr.ImageDetail
+
+	// Policy of the repository, if any, and its decisions other than
+	// policy.NoDecision, by digest.
+	Policy    *policy.Policy
+	Decisions map[string]policy.Decision
+
+	// Unused images deleted by the policy regardless of the number of images
+	// to keep, which are also candidates.
+	PolicyDeleted []*ecr.ImageDetail
+
+	// Reasons given by the veto hook for keeping images that would otherwise
+	// be removed, by digest. Nil if no hook was asked.
+	Vetoes map[string]string
+
+	// Relationship between image indexes and the images they reference, and
+	// between artifacts and the images they describe.
+	Graph *aws.ImageGraph
+
+	// Images referenced by image indexes, which are only removed along with
+	// all of those indexes, and artifacts, which are only removed along with
+	// the images they describe.
+	Children []*ecr.ImageDetail
+}
+
+// FindImagesInUse asks the sources of images in use set by the task, such as
+// the pods from the selected namespaces, which images are in use. If any of
+// the sources fails, an error is returned, since acting on partial data might
+// cause images in use to be deleted. If an in-use lookback period is set, the
+// images in use are recorded in the given state, and the ones seen in use
+// during that period are also considered in use.
+func FindImagesInUse(t *core.CleanupTask, kubeClient kubernetes.KubernetesClient, st *state.State) (*ImagesInUse, error) {
+	sources, err := NewInUseSources(t, kubeClient)
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := &ImagesInUse{
+		PodsCount:    -1,
+		SourceCounts: map[string]int{},
+		Tags:         map[string][]string{},
+		Digests:      map[string][]string{},
+		Users:        map[string]map[string][]string{},
+		Sources:      map[string]map[string][]string{},
+	}
+
+	for _, source := range sources {
+		users, err := source.ImagesInUse()
+		if err != nil {
+			return nil, fmt.Errorf("In-use source '%s' failed: %v", source.Name(), err)
+		}
+
+		if pods, ok := source.(*PodSource); ok {
+			inUse.PodsCount = pods.Count
+			glog.Infof("There are currently %d running pods.", pods.Count)
+		} else {
+			inUse.SourceCounts[source.Name()] = countUsedTags(users)
+		}
+
+		glog.Infof("There are %d ECR images in use according to '%s'.", countUsedTags(users), source.Name())
+		inUse.add(source.Name(), users)
+	}
+
+	inUse.Count = countTags(inUse.Tags) + countTags(inUse.Digests)
+	glog.Infof("There are currently %d ECR images in use.", inUse.Count)
+
+	if t.InUseLookback > 0 {
+		references := map[string][]string{}
+		for repoName := range inUse.Tags {
+			references[repoName] = inUse.References(repoName)
+		}
+		for repoName := range inUse.Digests {
+			references[repoName] = inUse.References(repoName)
+		}
+
+		now := time.Now()
+		st.RecordInUse(references, now)
+		inUse.Tags, inUse.Digests = splitDigests(st.SeenInUseSince(now.Add(-t.InUseLookback)))
+
+		glog.Infof("There were %d ECR images in use during the last %v.", countTags(inUse.Tags)+countTags(inUse.Digests), t.InUseLookback)
+
+		for _, seen := range []map[string][]string{inUse.Tags, inUse.Digests} {
+			for repoName, references := range seen {
+				for _, reference := range references {
+					if len(inUse.Sources[repoName][reference]) == 0 {
+						inUse.addSource(repoName, reference, lookbackSourceName)
+					}
+				}
+			}
+		}
+	}
+
+	return inUse, nil
+}
+
+// References returns the tags and digests in use in the given repository.
+// Since tags cannot contain colons, digests are never mistaken for tags.
+func (u *ImagesInUse) References(repoName string) []string {
+	return append(append([]string{}, u.Tags[repoName]...), u.Digests[repoName]...)
+}
+
+// SelectImages selects which of the given images of a repository are going
+// to be removed. If a grace period is set, the selected images are marked in
+// the given state, and only the ones marked for long enough are removed. If
+// a quarantine period is set, images already in quarantine are left out.
+//
+// Images referenced by image indexes in the given graph are not selected on
+// their own, but only along with all indexes referencing them, if untagged.
+// Likewise, artifacts such as signatures and SBOMs are only selected along
+// with the images they describe.
+// Images whose digests are among the given signed ones, or retained by the
+// labels and annotations in the given facts, are never selected, while the
+// scan findings in the given facts may get images selected earlier. The
+// decisions of the repository's policy in the given facts keep images, or
+// select them regardless of the number of images to keep.
+func SelectImages(t *core.CleanupTask, st *state.State, repoName string, images []*ecr.ImageDetail, facts *ImageFacts, tagsInUse []string, now time.Time) *Selection {
+	sel := &Selection{
+		Images:    images,
+		TagsInUse: tagsInUse,
+		Prunable:  []*ecr.ImageDetail{},
+		Signed:    facts.Signed,
+		Metadata:  facts.Metadata,
+		Findings:  facts.Findings,
+		Policy:    facts.Policy,
+		Decisions: facts.Decisions,
+		Graph:     facts.Graph,
+	}
+
+	var regular []*ecr.ImageDetail
+	regular, sel.Quarantined, sel.Children = splitImages(t, images, sel.Graph)
+	if t.QuarantinePeriod > 0 {
+		glog.Infof("Number of images in quarantine: %d", len(sel.Quarantined))
+	}
+
+	glog.V(10).Infof("Max Images is %d", t.MaxImages)
+	sel.Candidates, sel.ExcessVulnerable, sel.PolicyDeleted = candidateImages(t, facts, regular, tagsInUse)
+	if t.MaxVulnerableImages > 0 {
+		glog.Infof("Number of vulnerable images beyond the maximum to keep: %d", len(sel.ExcessVulnerable))
+	}
+	if sel.Policy != nil {
+		glog.Infof("Number of images deleted by policy: %d", len(sel.PolicyDeleted))
+	}
+	sel.Candidates = append(append(sel.Candidates, sel.ExcessVulnerable...), sel.PolicyDeleted...)
+
+	sel.Filtered = utils.ApplyKeepFilters(sel.Candidates, t.KeepFilters)
+	glog.Infof("Number of images after blacklist filter: %d", len(sel.Filtered))
+
+	if t.VerifiesSignatures() {
+		sel.Filtered = utils.ApplySignatureFilter(sel.Filtered, sel.Signed)
+		glog.Infof("Number of images after signature filter: %d", len(sel.Filtered))
+	}
+
+	if t.RetainsByLabels() {
+		sel.Filtered = utils.ApplyLabelFilters(sel.Filtered, sel.Metadata, t.KeepLabels, t.RetainUntilLabels, now)
+		glog.Infof("Number of images after label filter: %d", len(sel.Filtered))
+	}
+
+	if sel.Policy != nil {
+		sel.Filtered = utils.ApplyPolicyFilter(sel.Filtered, sel.Decisions)
+		glog.Infof("Number of images after policy filter: %d", len(sel.Filtered))
+	}
+
+	if t.PruneTags {
+		sel.Prunable = PrunableImages(t, sel)
+		glog.Infof("Number of images with redundant tags: %d", len(sel.Prunable))
+	}
+
+	sel.Removable = sel.Filtered
+	if t.GracePeriod > 0 {
+		sel.Removable, sel.Prunable = SweepMarkedImages(st, repoName, sel.Filtered, sel.Prunable, t.GracePeriod, now)
+		glog.Infof("Number of images unused during the whole grace period: %d", len(sel.Removable))
+		if t.PruneTags {
+			glog.Infof("Number of images with redundant tags during the whole grace period: %d", len(sel.Prunable))
+		}
+	}
+
+	if orphaned := sel.Graph.OrphanedChildren(sel.Removable, sel.Children); len(orphaned) > 0 {
+		sel.Removable = append(sel.Removable, orphaned...)
+		glog.Infof("Number of images and artifacts removed along with other images: %d", len(orphaned))
+	}
+
+	return sel
+}
+
+// splitImages separates the images of a repository that are considered for
+// removal on their own from the ones in quarantine, if the task sets a
+// quarantine period, and from the ones only removed along with others.
+func splitImages(t *core.CleanupTask, images []*ecr.ImageDetail, graph *aws.ImageGraph) ([]*ecr.ImageDetail, []*ecr.ImageDetail, []*ecr.ImageDetail) {
+	regular, quarantined := images, []*ecr.ImageDetail{}
+	if t.QuarantinePeriod > 0 {
+		regular, quarantined = SplitQuarantinedImages(images)
+	}
+
+	regular, children := graph.SplitChildren(regular)
+	return regular, quarantined, children
+}
+
+// candidateImages returns the unused images, among the given ones, that are
+// beyond the number of images to keep in the repository's order, with the
+// vulnerable ones first if the task removes them first. The unused images
+// selected by other rules are returned separately: the vulnerable images
+// beyond the maximum number of them to keep, and the images the repository's
+// policy deletes. At most aws.BatchRemoveMaxImages images are returned.
+func candidateImages(t *core.CleanupTask, facts *ImageFacts, images []*ecr.ImageDetail, tagsInUse []string) ([]*ecr.ImageDetail, []*ecr.ImageDetail, []*ecr.ImageDetail) {
+	sortImages := facts.Ordering.Sort
+	if t.RemoveVulnerableFirst {
+		sortImages = func(images []*ecr.ImageDetail) {
+			SortImagesByVulnerability(facts.Ordering, images, facts.Findings, t.VulnerableSeverity)
+		}
+	}
+
+	candidates := aws.FilterOldUnusedImagesBy(t.MaxImages, images, tagsInUse, sortImages)
+	room := aws.BatchRemoveMaxImages - len(candidates)
+
+	excess := []*ecr.ImageDetail{}
+	if t.MaxVulnerableImages > 0 {
+		excess = ExcessVulnerableImages(facts.Ordering, images, candidates, tagsInUse, facts.Findings, t.VulnerableSeverity, t.MaxVulnerableImages)
+		if len(excess) > room {
+			excess = excess[:room]
+		}
+		room -= len(excess)
+	}
+
+	isSelected := imageSet(append(append([]*ecr.ImageDetail{}, candidates...), excess...))
+	deleted := []*ecr.ImageDetail{}
+
+	for _, image := range PolicyDeletedImages(facts.Ordering, images, tagsInUse, facts.Decisions) {
+		if !isSelected[image] && len(deleted) < room {
+			deleted = append(deleted, image)
+		}
+	}
+
+	return candidates, excess, deleted
+}
+
 // RemoveOldImages deletes ECR images that have been determined to be old.
-func RemoveOldImages(t *core.CleanupTask, kubeClient kubernetes.KubernetesClient, ecrClient aws.ECRClient) []error {
+// If a state store is given, the state is loaded from it before and saved
+// to it after the cleanup. The returned report describes what was deleted
+// and kept in each repository, and why.
+//
+// If more images than the task's approval threshold would be removed from a
+// repository, they are only removed once the given approver approves the
+// plan to remove them.
+func RemoveOldImages(t *core.CleanupTask, kubeClient kubernetes.KubernetesClient, ecrClient aws.ECRClient, store state.Store, approver core.Approver) (*core.Report, []error) {
 	errors := []error{}
+	report := core.NewReport(t.DryRun)
+
+	fail := func(err error) {
+		errors = append(errors, err)
+		report.Errors = append(report.Errors, err.Error())
+		report.FinishedAt = time.Now()
+	}
 
 	glog.Info("Cleanup loop started.")
 
-	pods, err := kubeClient.ListAllPods(t.KubeNamespaces)
+	st, err := loadState(store)
 	if err != nil {
-		errors = append(errors, fmt.Errorf("Cannot list pods: %v", err))
-		return errors
+		fail(err)
+		return report, errors
 	}
-	glog.Infof("There are currently %d running pods.", len(pods))
 
-	repos, err := ecrClient.ListRepositories(t.EcrRepositories, t.RegistryID)
+	inUse, err := FindImagesInUse(t, kubeClient, st)
 	if err != nil {
-		errors = append(errors, fmt.Errorf("Cannot list ECR repositories: %v", err))
-		return errors
+		fail(err)
+		return report, errors
 	}
 
-	usedImages := kubernetes.ECRImagesFromPods(pods)
-	glog.Infof("There are currently %d ECR images in use.", len(usedImages))
+	verifier, err := NewSignatureVerifier(t)
+	if err != nil {
+		fail(fmt.Errorf("Cannot create signature verifier: %v", err))
+		return report, errors
+	}
+
+	policies, err := NewPolicies(t)
+	if err != nil {
+		fail(fmt.Errorf("Cannot load policies: %v", err))
+		return report, errors
+	}
+
+	vetoHook := NewVetoHook(t)
+
+	repos, err := ecrClient.ListRepositories(t.EcrRepositories, t.RegistryID)
+	if err != nil {
+		fail(fmt.Errorf("Cannot list ECR repositories: %v", err))
+		return report, errors
+	}
 
 	for _, repo := range repos {
 		repoName := *repo.RepositoryName
 		glog.Infof("Processing '%s' ECR repo.", repoName)
 
+		repoReport := core.NewRepositoryReport(repoName)
+		report.Repositories = append(report.Repositories, repoReport)
+
+		repoFail := func(err error) {
+			errors = append(errors, err)
+			repoReport.Failures = append(repoReport.Failures, err.Error())
+		}
+
 		images, err := ecrClient.ListImages(&repoName, t.RegistryID)
 		if err != nil {
-			errors = append(errors, fmt.Errorf("Cannot list images from repo '%s': %v", repoName, err))
+			repoFail(fmt.Errorf("Cannot list images from repo '%s': %v", repoName, err))
 			continue
 		}
 		glog.Infof("Number of images in ECR repo: %d", len(images))
 
-		glog.V(10).Infof("Max Images is %d", t.MaxImages)
-		unusedOldImages := aws.FilterOldUnusedImages(t.MaxImages, images, usedImages[repoName])
+		now := time.Now()
+		facts, err := GatherImageFacts(t, ecrClient, verifier, policies, repoName, images, inUse.References(repoName), now)
+		if err != nil {
+			repoFail(err)
+			continue
+		}
+
+		// Marks are evaluated as they were before this run
+		var marks map[string]time.Time
+		if t.GracePeriod > 0 {
+			marks = st.Marks[repoName]
+		}
+
+		sel := SelectImages(t, st, repoName, images, facts, inUse.References(repoName), now)
+		vetoErr := VetoImages(t, vetoHook, repoName, sel, t.DryRun)
+		unusedImages := sel.Removable
 
-		unusedImages := utils.ApplyKeepFilters(unusedOldImages, t.KeepFilters)
-		glog.Infof("Number of images after blacklist filter: %d", len(unusedImages))
+		ReportKeptImages(repoReport, sel, inUse.Sources[repoName])
+
+		if vetoErr != nil {
+			ReportImages(&repoReport.KeptByPolicy, unusedImages)
+			repoFail(vetoErr)
+			continue
+		}
+
+		if err = sweepQuarantinedImages(t, ecrClient, vetoHook, repoReport, inUse, sel, now); err != nil {
+			repoFail(err)
+		}
+
+		// Images losing their redundant tags count as much as removed ones
+		affected := len(unusedImages) + len(sel.Prunable)
+		needsApproval := t.ApprovalThreshold > 0 && affected > t.ApprovalThreshold
+
+		// Plans published by previous runs are no longer waiting for approval
+		if !needsApproval && approver != nil && !t.DryRun {
+			if err = approver.Clear(repoName); err != nil {
+				repoFail(fmt.Errorf("Cannot clear pending plan for repo '%s': %v", repoName, err))
+			}
+		}
 
-		if len(unusedImages) == 0 {
+		if affected == 0 {
 			glog.Info("There's no old unused images to remove. Continuing.")
 			continue
 		}
 
+		if err = CheckSafetyBrakes(t, inUse, len(images), affected); err != nil {
+			ReportImages(&repoReport.KeptByPolicy, unusedImages)
+			repoFail(fmt.Errorf("Safety brake tripped for repo '%s', not removing any images or tags: %v", repoName, err))
+			continue
+		}
+
+		if needsApproval && !t.DryRun {
+			if approver == nil {
+				ReportImages(&repoReport.KeptByPolicy, unusedImages)
+				repoFail(fmt.Errorf("Removing %d images and the tags of %d images from repo '%s' requires approval, but no approver is set", len(unusedImages), len(sel.Prunable), repoName))
+				continue
+			}
+
+			approved, err := approver.Approved(planRepository(t, repoName, sel, inUse.Users[repoName], marks, now))
+			if err != nil {
+				ReportImages(&repoReport.KeptByPolicy, unusedImages)
+				repoFail(fmt.Errorf("Cannot check approval for repo '%s': %v", repoName, err))
+				continue
+			}
+
+			if !approved {
+				glog.Infof("Removing %d images and the tags of %d images from repo '%s' requires approval, waiting for it.", len(unusedImages), len(sel.Prunable), repoName)
+				ReportImages(&repoReport.KeptByPolicy, unusedImages)
+				continue
+			}
+		}
+
 		if t.DryRun {
+			if needsApproval {
+				glog.Infof("Removing %d images and the tags of %d images from repo '%s' would require approval.", len(unusedImages), len(sel.Prunable), repoName)
+			}
 			glog.Info("Not deleting images due to dry-run being set")
-			glog.Infof("Would have removed %d images.", len(unusedImages))
-		} else {
+			glog.Infof("Would have removed %d images and the redundant tags of %d images.", len(unusedImages), len(sel.Prunable))
+			ReportImages(&repoReport.Deleted, unusedImages)
+			repoReport.PrunedTags = append(repoReport.PrunedTags, PrunedTagRecords(t, sel.Prunable)...)
+			continue
+		}
+
+		failed := false
+		if err = pruneTags(t, ecrClient, repoReport, sel.Prunable); err != nil {
+			repoFail(err)
+			failed = true
+		}
+
+		if len(unusedImages) > 0 {
 			glog.Infof("Removing %d old unused images.", len(unusedImages))
-			if err = ecrClient.BatchRemoveImages(unusedImages); err != nil {
-				errors = append(errors, fmt.Errorf("Could not batch remove images from repo '%s': %v", repoName, err))
+			if err = removeImages(t, ecrClient, repoReport, unusedImages, now); err != nil {
+				repoFail(fmt.Errorf("Could not batch remove images from repo '%s': %v", repoName, err))
 				continue
 			}
 		}
+
+		if needsApproval && !failed {
+			if err = approver.Clear(repoName); err != nil {
+				repoFail(fmt.Errorf("Cannot clear approved plan for repo '%s': %v", repoName, err))
+			}
+		}
+	}
+
+	if store != nil {
+		if err = store.Save(st); err != nil {
+			fail(fmt.Errorf("Cannot save state: %v", err))
+		}
 	}
 
 	glog.Info("Cleanup loop finished.")
 
-	return errors
+	report.FinishedAt = time.Now()
+	return report, errors
+}
+
+// ExplainImages evaluates the rules that decide whether each image of the
+// given repository is kept or deleted, without removing any images or saving
+// any state.
+func ExplainImages(t *core.CleanupTask, kubeClient kubernetes.KubernetesClient, ecrClient aws.ECRClient, store state.Store, repoName string) ([]*core.ImageDecision, error) {
+	st, err := loadState(store)
+	if err != nil {
+		return nil, err
+	}
+
+	inUse, err := FindImagesInUse(t, kubeClient, st)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := ecrClient.ListImages(&repoName, t.RegistryID)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list images from repo '%s': %v", repoName, err)
+	}
+
+	verifier, err := NewSignatureVerifier(t)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create signature verifier: %v", err)
+	}
+
+	policies, err := NewPolicies(t)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load policies: %v", err)
+	}
+
+	now := time.Now()
+	facts, err := GatherImageFacts(t, ecrClient, verifier, policies, repoName, images, inUse.References(repoName), now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Marks are evaluated as they were before this run
+	var marks map[string]time.Time
+	if t.GracePeriod > 0 {
+		marks = st.Marks[repoName]
+	}
+
+	sel := SelectImages(t, st, repoName, images, facts, inUse.References(repoName), now)
+	if err = VetoImages(t, NewVetoHook(t), repoName, sel, true); err != nil {
+		return nil, err
+	}
+
+	brakeErr := CheckSafetyBrakes(t, inUse, len(images), len(sel.Removable))
+
+	isQuarantined := imageSet(sel.Quarantined)
+
+	decisions := []*core.ImageDecision{}
+	for _, image := range images {
+		if isQuarantined[image] {
+			decisions = append(decisions, ExplainQuarantinedImage(t, image, inUse.References(repoName), now))
+			continue
+		}
+
+		decisions = append(decisions, ExplainImage(t, sel, inUse.Users[repoName], marks, brakeErr, image, now))
+	}
+
+	return decisions, nil
+}
+
+// ExplainImage lists the outcome of each rule evaluated against the given
+// image during the given selection.
+func ExplainImage(t *core.CleanupTask, sel *Selection, users map[string][]string, marks map[string]time.Time, brakeErr error, image *ecr.ImageDetail, now time.Time) *core.ImageDecision {
+	isCandidate, isFiltered, isRemovable := imageSet(sel.Candidates), imageSet(sel.Filtered), imageSet(sel.Removable)
+	tagsInUse := tagSet(sel.TagsInUse)
+
+	decision := &core.ImageDecision{
+		Image: core.NewImageRecord(image),
+	}
+
+	if subject, ok := sel.Graph.Subject(image); ok && imageSet(sel.Children)[image] {
+		switch {
+		case !isRemovable[image]:
+			decision.AddRule("artifact", true, "describes image '%s', which is kept", subject)
+		case brakeErr != nil:
+			decision.AddRule("artifact", false, "describes image '%s', which is removed", subject)
+			decision.AddRule("safety-brake", true, "%v", brakeErr)
+		default:
+			decision.AddRule("artifact", false, "describes image '%s', which is removed", subject)
+			decision.Delete = true
+		}
+
+		return decision
+	}
+
+	if imageSet(sel.Children)[image] {
+		parents := strings.Join(sel.Graph.Parents[awssdk.StringValue(image.ImageDigest)], "', '")
+
+		switch {
+		case !isRemovable[image]:
+			decision.AddRule("image-index", true, "referenced by image indexes '%s', not all of which are removed", parents)
+		case brakeErr != nil:
+			decision.AddRule("image-index", false, "referenced only by image indexes '%s', which are removed", parents)
+			decision.AddRule("safety-brake", true, "%v", brakeErr)
+		default:
+			decision.AddRule("image-index", false, "referenced only by image indexes '%s', which are removed", parents)
+			decision.Delete = true
+		}
+
+		return decision
+	}
+
+	latest := hasTag(image, "latest")
+	if latest {
+		decision.AddRule("protected-tag", true, "tagged 'latest'")
+	} else {
+		decision.AddRule("protected-tag", false, "not tagged 'latest'")
+	}
+
+	inUse := false
+	for _, tag := range image.ImageTags {
+		if *tag == "latest" {
+			continue
+		}
+		for _, user := range users[*tag] {
+			inUse = true
+			decision.AddRule("in-use", true, "tag '%s' in use by %s", *tag, user)
+		}
+		if len(users[*tag]) == 0 && tagsInUse[*tag] {
+			inUse = true
+			decision.AddRule("in-use", true, "tag '%s' seen in use during the last %v", *tag, t.InUseLookback)
+		}
+	}
+	if digest := awssdk.StringValue(image.ImageDigest); tagsInUse[digest] {
+		inUse = true
+		for _, user := range users[digest] {
+			decision.AddRule("in-use", true, "digest in use by %s", user)
+		}
+		if len(users[digest]) == 0 {
+			decision.AddRule("in-use", true, "digest seen in use during the last %v", t.InUseLookback)
+		}
+	}
+	if !inUse {
+		decision.AddRule("in-use", false, "not in use")
+	}
+
+	filtered := false
+	for _, filter := range t.KeepFilters {
+		reg, err := regexp.Compile(*filter)
+		if err != nil {
+			continue
+		}
+		for _, tag := range image.ImageTags {
+			if reg.MatchString(*tag) {
+				filtered = true
+				decision.AddRule("keep-filter", true, "tag '%s' matches keep filter '%s'", *tag, *filter)
+			}
+		}
+	}
+	if !filtered {
+		decision.AddRule("keep-filter", false, "no keep filters match")
+	}
+
+	if t.VerifiesSignatures() {
+		if sel.Signed[awssdk.StringValue(image.ImageDigest)] {
+			decision.AddRule("signature", true, "signed by a trusted key or identity")
+		} else {
+			decision.AddRule("signature", false, "not signed by any trusted key or identity")
+		}
+	}
+
+	if md, ok := sel.Metadata[awssdk.StringValue(image.ImageDigest)]; ok && t.RetainsByLabels() {
+		reasons := utils.RetainingLabels(md, t.KeepLabels, t.RetainUntilLabels, now)
+		for _, reason := range reasons {
+			decision.AddRule("label", true, "%s", reason)
+		}
+		if len(reasons) == 0 {
+			decision.AddRule("label", false, "no labels or annotations retain it")
+		}
+	}
+
+	if t.VulnerabilityAware() {
+		counts, ok := sel.Findings[awssdk.StringValue(image.ImageDigest)]
+		switch {
+		case latest || inUse:
+			decision.AddRule("vulnerability", false, "scan findings not retrieved for images that are kept")
+		case ok:
+			decision.AddRule("vulnerability", false, "scan findings: %s", aws.DescribeSeverityCounts(counts))
+		default:
+			decision.AddRule("vulnerability", false, "no scan findings available")
+		}
+	}
+
+	if sel.Policy != nil {
+		switch sel.Decisions[awssdk.StringValue(image.ImageDigest)] {
+		case policy.Keep:
+			decision.AddRule("policy", true, "kept by policy")
+		case policy.Delete:
+			decision.AddRule("policy", false, "deleted by policy")
+		default:
+			decision.AddRule("policy", false, "no policy decision")
+		}
+	}
+
+	if filtered && t.PruneTags && isCandidate[image] {
+		if tags := RedundantTags(t, image); len(tags) > 0 {
+			decision.AddRule("prune-tags", false, "tags '%s' do not match any keep filter and are removed", strings.Join(awssdk.StringValueSlice(tags), "', '"))
+		}
+	}
+
+	if !latest && !inUse {
+		// Describes the images kept according to the repository's ordering
+		older, recent := "older than", "most recent "
+		if ordering := t.OrderingFor(awssdk.StringValue(image.RepositoryName)); ordering != "" && ordering != aws.PushDateOrderingName {
+			older, recent = fmt.Sprintf("in '%s' order, beyond", ordering), ""
+		}
+
+		switch {
+		case imageSet(sel.PolicyDeleted)[image]:
+			decision.AddRule("max-images", false, "deleted by policy regardless of the %d images to keep", t.MaxImages)
+		case imageSet(sel.ExcessVulnerable)[image]:
+			decision.AddRule("max-vulnerable-images", false, "%s the %d %svulnerable images to keep", older, t.MaxVulnerableImages, recent)
+		case isCandidate[image] && t.RemoveVulnerableFirst:
+			decision.AddRule("max-images", false, "beyond the %d images to keep, vulnerable images being removed first", t.MaxImages)
+		case isCandidate[image]:
+			decision.AddRule("max-images", false, "%s the %d %simages to keep", older, t.MaxImages, recent)
+		default:
+			decision.AddRule("max-images", true, "within the %d %simages to keep, or beyond the %d images removed per run", t.MaxImages, recent, aws.BatchRemoveMaxImages)
+		}
+	}
+
+	vetoReason, vetoed := sel.Vetoes[awssdk.StringValue(image.ImageDigest)]
+
+	if t.GracePeriod > 0 && isFiltered[image] {
+		markedAt, ok := marks[awssdk.StringValue(image.ImageDigest)]
+		switch {
+		case isRemovable[image] || vetoed:
+			decision.AddRule("grace-period", false, "unused since %s, longer than the %v grace period", markedAt.Format(time.RFC3339), t.GracePeriod)
+		case ok:
+			decision.AddRule("grace-period", true, "unused since %s, less than the %v grace period", markedAt.Format(time.RFC3339), t.GracePeriod)
+		default:
+			decision.AddRule("grace-period", true, "unused since %s, less than the %v grace period", now.Format(time.RFC3339), t.GracePeriod)
+		}
+	}
+
+	if vetoed {
+		if vetoReason == "" {
+			vetoReason = "no reason given"
+		}
+		decision.AddRule("veto-hook", true, "vetoed by hook: %s", vetoReason)
+	}
+
+	if isRemovable[image] {
+		if brakeErr != nil {
+			decision.AddRule("safety-brake", true, "%v", brakeErr)
+		} else {
+			decision.Delete = true
+		}
+	}
+
+	return decision
+}
+
+// ReportKeptImages adds the images of a repository that are not going to
+// be removed to the given report, according to the reason they are kept.
+// Images in use are reported along with the names of the sources their tags
+// are in use according to, given by tag.
+func ReportKeptImages(r *core.RepositoryReport, sel *Selection, sources map[string][]string) {
+	isCandidate, isFiltered, isRemovable := imageSet(sel.Candidates), imageSet(sel.Filtered), imageSet(sel.Removable)
+	isQuarantined := imageSet(sel.Quarantined)
+	inUse := tagSet(sel.TagsInUse)
+
+	for _, image := range sel.Images {
+
+		// Quarantined images are reported when sweeping the quarantine
+		if isRemovable[image] || isQuarantined[image] {
+			continue
+		}
+
+		record := core.NewImageRecord(image)
+
+		switch {
+		case isFiltered[image]:
+			r.KeptByPolicy = append(r.KeptByPolicy, record)
+		case isCandidate[image]:
+			r.KeptByFilter = append(r.KeptByFilter, record)
+		case isInUse(image, inUse):
+			reportInUse(r, image, sources)
+		default:
+			r.KeptByPolicy = append(r.KeptByPolicy, record)
+		}
+	}
+
+	r.Listed = len(sel.Images)
+}
+
+// reportInUse appends the given image to the images in use of the given
+// report, along with the names of the sources its tags or digest are in use
+// according to, given by tag or digest.
+func reportInUse(r *core.RepositoryReport, image *ecr.ImageDetail, sources map[string][]string) {
+	record := core.NewImageRecord(image)
+
+	for _, reference := range append([]string{record.Digest}, record.Tags...) {
+		for _, source := range sources[reference] {
+			if !tagSet(record.ProtectedBy)[source] {
+				record.ProtectedBy = append(record.ProtectedBy, source)
+			}
+		}
+	}
+
+	r.InUse = append(r.InUse, record)
+}
+
+// ReportImages appends the given images to the given list of records.
+func ReportImages(records *[]*core.ImageRecord, images []*ecr.ImageDetail) {
+	for _, image := range images {
+		*records = append(*records, core.NewImageRecord(image))
+	}
+}
+
+func loadState(store state.Store) (*state.State, error) {
+	if store == nil {
+		return state.New(), nil
+	}
+
+	st, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load state: %v", err)
+	}
+
+	return st, nil
+}
+
+// add considers the image tags and digests used by the given users in use
+// according to the source with the given name, along with those users,
+// indexed by repository name and tag or digest. Tags and digests in use are
+// kept sorted, and tags do not include "latest".
+func (u *ImagesInUse) add(source string, users map[string]map[string][]string) {
+	for repoName, references := range users {
+		if _, ok := u.Users[repoName]; !ok {
+			u.Users[repoName] = map[string][]string{}
+		}
+
+		for reference, names := range references {
+			u.Users[repoName][reference] = append(u.Users[repoName][reference], names...)
+			if reference == "latest" {
+				continue
+			}
+
+			inUse := u.Tags
+			if isDigest(reference) {
+				inUse = u.Digests
+			}
+
+			if !tagSet(inUse[repoName])[reference] {
+				inUse[repoName] = append(inUse[repoName], reference)
+				sort.Strings(inUse[repoName])
+			}
+			u.addSource(repoName, reference, source)
+		}
+	}
+}
+
+// addSource records that the given image tag or digest is in use according
+// to the source with the given name.
+func (u *ImagesInUse) addSource(repoName, tag, source string) {
+	if _, ok := u.Sources[repoName]; !ok {
+		u.Sources[repoName] = map[string][]string{}
+	}
+
+	for _, s := range u.Sources[repoName][tag] {
+		if s == source {
+			return
+		}
+	}
+	u.Sources[repoName][tag] = append(u.Sources[repoName][tag], source)
+}
+
+// describeUsers returns the given users of each image tag, indexed by
+// repository name and tag, described as being of the given kind, as in
+// "pod 'namespace/name'".
+func describeUsers(users map[string]map[string][]string, kind string) map[string]map[string][]string {
+	described := map[string]map[string][]string{}
+
+	for repoName, tags := range users {
+		described[repoName] = map[string][]string{}
+		for tag, names := range tags {
+			for _, name := range names {
+				described[repoName][tag] = append(described[repoName][tag], fmt.Sprintf("%s '%s'", kind, name))
+			}
+		}
+	}
+
+	return described
+}
+
+// splitDigests separates the digests from the tags among the given ones,
+// indexed by repository name.
+func splitDigests(references map[string][]string) (map[string][]string, map[string][]string) {
+	tags, digests := map[string][]string{}, map[string][]string{}
+
+	for repoName, repoReferences := range references {
+		for _, reference := range repoReferences {
+			if isDigest(reference) {
+				digests[repoName] = append(digests[repoName], reference)
+			} else {
+				tags[repoName] = append(tags[repoName], reference)
+			}
+		}
+	}
+
+	return tags, digests
+}
+
+// isDigest returns whether the given reference to an image is a digest, as
+// in "sha256:...", rather than a tag.
+func isDigest(reference string) bool {
+	return strings.Contains(reference, ":")
+}
+
+func countUsedTags(users map[string]map[string][]string) int {
+	count := 0
+	for _, tags := range users {
+		count += len(tags)
+	}
+	return count
+}
+
+func countTags(tags map[string][]string) int {
+	count := 0
+	for _, repoTags := range tags {
+		count += len(repoTags)
+	}
+	return count
+}
+
+func imageSet(images []*ecr.ImageDetail) map[*ecr.ImageDetail]bool {
+	set := map[*ecr.ImageDetail]bool{}
+	for _, image := range images {
+		set[image] = true
+	}
+	return set
+}
+
+func tagSet(tags []string) map[string]bool {
+	set := map[string]bool{}
+	for _, tag := range tags {
+		set[tag] = true
+	}
+	return set
+}
+
+// isInUse returns whether any of the tags of the given image, other than
+// "latest", or its digest are among the given ones in use.
+func isInUse(image *ecr.ImageDetail, inUse map[string]bool) bool {
+	if inUse[awssdk.StringValue(image.ImageDigest)] {
+		return true
+	}
+
+	for _, tag := range image.ImageTags {
+		if *tag != "latest" && inUse[*tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// SweepMarkedImages marks the given images as removal candidates, and the
+// given prunable images as having redundant tags to prune, in the given
+// state, and returns only those that have been marked for at least the given
+// grace period. Prunable images are marked apart from removal candidates, so
+// that their grace period toward removal only starts once they become
+// candidates.
+func SweepMarkedImages(st *state.State, repoName string, images, prunable []*ecr.ImageDetail, gracePeriod time.Duration, now time.Time) ([]*ecr.ImageDetail, []*ecr.ImageDetail) {
+	keys := make([]string, 0, len(images)+len(prunable))
+	for _, image := range images {
+		keys = append(keys, awssdk.StringValue(image.ImageDigest))
+	}
+	for _, image := range prunable {
+		keys = append(keys, pruneMarkKey(image))
+	}
+
+	st.Mark(repoName, keys, now)
+	expired := st.MarkedBefore(repoName, now.Add(-gracePeriod))
+
+	sweptImages, sweptPrunable := []*ecr.ImageDetail{}, []*ecr.ImageDetail{}
+	for _, image := range images {
+		if expired[awssdk.StringValue(image.ImageDigest)] {
+			sweptImages = append(sweptImages, image)
+		}
+	}
+	for _, image := range prunable {
+		if expired[pruneMarkKey(image)] {
+			sweptPrunable = append(sweptPrunable, image)
+		}
+	}
+
+	return sweptImages, sweptPrunable
+}
+
+// pruneMarkKey returns the key under which the given image is marked as
+// having redundant tags to prune.
+func pruneMarkKey(image *ecr.ImageDetail) string {
+	return "prune-tags/" + awssdk.StringValue(image.ImageDigest)
+}
+
+// CheckSafetyBrakes returns an error if the number of pods or images in use
+// is suspiciously low, overall or according to any of the sources, or if too
+// many of the repository's images would be removed or lose their redundant
+// tags, according to the thresholds set in the given task.
+func CheckSafetyBrakes(t *core.CleanupTask, inUse *ImagesInUse, repoImagesCount, removeCount int) error {
+	if inUse.PodsCount >= 0 && inUse.PodsCount < t.MinPods {
+		return fmt.Errorf("found %d pods, expected at least %d", inUse.PodsCount, t.MinPods)
+	}
+
+	sources := make([]string, 0, len(inUse.SourceCounts))
+	for source := range inUse.SourceCounts {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	for _, source := range sources {
+		if count := inUse.SourceCounts[source]; count < t.MinImagesPerSource {
+			return fmt.Errorf("found %d ECR images in use according to '%s', expected at least %d", count, source, t.MinImagesPerSource)
+		}
+	}
+
+	if inUse.Count < t.MinImagesInUse {
+		return fmt.Errorf("found %d ECR images in use, expected at least %d", inUse.Count, t.MinImagesInUse)
+	}
+
+	if t.MaxDeleteRatio > 0 && repoImagesCount > 0 {
+		ratio := float64(removeCount) / float64(repoImagesCount)
+		if ratio > t.MaxDeleteRatio {
+			return fmt.Errorf("would remove or prune the tags of %d of %d images (%.2f), expected at most %.2f", removeCount, repoImagesCount, ratio, t.MaxDeleteRatio)
+		}
+	}
+
+	return nil
 }
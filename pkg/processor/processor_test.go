@@ -2,11 +2,19 @@ package processor
 
 import (
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
 	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/state"
 	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // mockKubeClient is used to verify that the Kubernetes client is being called
@@ -38,9 +46,66 @@ type mockECRClient struct {
 
 	expectedImagesToRemove []*ecr.ImageDetail
 	batchRemoveImagesError error
+
+	// If set, the images removed in each call are checked against these
+	// digests instead of expectedImagesToRemove.
+	expectedRemoveCalls [][]string
+	removeCalls         int
+
+	manifests map[string]string
+	layers    map[string][]byte
+	metadata  map[string]*aws.ImageMetadata
+
+	// Digests of the images whose metadata was retrieved.
+	metadataDigests []string
+
+	findings        map[string]map[string]int64
+	findingsDigests []string
+	pullTimes       map[string]time.Time
+	putImages       []*ecr.Image
+	removedTags     []string
+}
+
+// mockStore keeps the controller state in memory.
+type mockStore struct {
+	state *state.State
+
+	loadError error
+	saveError error
+}
+
+func (m *mockStore) Load() (*state.State, error) {
+	return m.state, m.loadError
+}
+
+func (m *mockStore) Save(s *state.State) error {
+	m.state = s
+	return m.saveError
+}
+
+// mockApprover approves plans according to its approved field, and keeps
+// track of the published and cleared plans.
+type mockApprover struct {
+	approved      bool
+	approvedError error
+
+	published []*core.RepositoryPlan
+	cleared   []string
 }
 
-func (m *mockKubeClient) ListAllPods(namespace []*string) ([]*apiv1.Pod, error) {
+func (m *mockApprover) Approved(plan *core.RepositoryPlan) (bool, error) {
+	m.published = append(m.published, plan)
+	return m.approved, m.approvedError
+}
+
+func (m *mockApprover) Clear(repoName string) error {
+	m.cleared = append(m.cleared, repoName)
+	return nil
+}
+
+func (m *mockKubeClient) ListAllPods(filter *core.NamespaceFilter) ([]*apiv1.Pod, error) {
+	namespace := filter.Include
+
 	if len(namespace) != len(m.expectedNamespace) {
 		m.t.Errorf("Expected namespaces to contain %d elements, but it contains %d", len(m.expectedNamespace), len(namespace))
 	}
@@ -76,7 +141,84 @@ func (m *mockECRClient) ListImages(repositoryName *string, registryID *string) (
 	return m.listImagesResult, m.listImagesError
 }
 
+func (m *mockECRClient) GetImages(images []*ecr.ImageDetail) ([]*ecr.Image, error) {
+	manifests := []*ecr.Image{}
+	for _, image := range images {
+		manifests = append(manifests, &ecr.Image{
+			ImageId: &ecr.ImageIdentifier{
+				ImageDigest: image.ImageDigest,
+			},
+			ImageManifest: image.ImageDigest,
+		})
+
+		if manifest, ok := m.manifests[*image.ImageDigest]; ok {
+			manifests[len(manifests)-1].ImageManifest = &manifest
+		}
+	}
+	return manifests, nil
+}
+
+func (m *mockECRClient) GetLayer(repositoryName *string, registryID *string, digest string) ([]byte, error) {
+	layer, ok := m.layers[digest]
+	if !ok {
+		return nil, fmt.Errorf("layer '%s' not found", digest)
+	}
+	return layer, nil
+}
+
+func (m *mockECRClient) GetImageMetadata(images []*ecr.ImageDetail) (map[string]*aws.ImageMetadata, error) {
+	result := map[string]*aws.ImageMetadata{}
+	for _, image := range images {
+		m.metadataDigests = append(m.metadataDigests, *image.ImageDigest)
+		if md, ok := m.metadata[*image.ImageDigest]; ok {
+			result[*image.ImageDigest] = md
+		}
+	}
+	return result, nil
+}
+
+func (m *mockECRClient) GetScanFindings(image *ecr.ImageDetail) (map[string]int64, error) {
+	m.findingsDigests = append(m.findingsDigests, *image.ImageDigest)
+	return m.findings[*image.ImageDigest], nil
+}
+
+func (m *mockECRClient) LastPullTime(image *ecr.ImageDetail) (time.Time, bool) {
+	pulledAt, ok := m.pullTimes[*image.ImageDigest]
+	return pulledAt, ok
+}
+
+func (m *mockECRClient) PutImage(image *ecr.Image) error {
+	m.putImages = append(m.putImages, image)
+	return nil
+}
+
+func (m *mockECRClient) BatchRemoveTags(repositoryName *string, registryID *string, tags []*string) error {
+	for _, tag := range tags {
+		m.removedTags = append(m.removedTags, *tag)
+	}
+	return nil
+}
+
 func (m *mockECRClient) BatchRemoveImages(images []*ecr.ImageDetail) error {
+	if m.expectedRemoveCalls != nil {
+		if m.removeCalls >= len(m.expectedRemoveCalls) {
+			m.t.Errorf("Expected %d calls to remove images, but got more", len(m.expectedRemoveCalls))
+			return m.batchRemoveImagesError
+		}
+
+		digests := []string{}
+		for _, image := range images {
+			digests = append(digests, *image.ImageDigest)
+		}
+
+		if !reflect.DeepEqual(digests, m.expectedRemoveCalls[m.removeCalls]) {
+			m.t.Errorf("Expected call %d to remove images %v, but was %v", m.removeCalls, m.expectedRemoveCalls[m.removeCalls], digests)
+		}
+
+		m.removeCalls++
+		return m.batchRemoveImagesError
+	}
+
 	if len(images) != len(m.expectedImagesToRemove) {
 		m.t.Errorf("Expected images to contain %d elements, but it contains %d", len(m.expectedImagesToRemove), len(images))
 	}
@@ -90,6 +232,22 @@ func (m *mockECRClient) BatchRemoveImages(images []*ecr.ImageDetail) error {
 	return m.batchRemoveImagesError
 }
 
+func newTestImage(digest string, tags ...string) *ecr.ImageDetail {
+	repoName, pushedAt := "repo", time.Unix(0, 0)
+
+	image := &ecr.ImageDetail{
+		RepositoryName: &repoName,
+		ImageDigest:    &digest,
+		ImagePushedAt:  &pushedAt,
+	}
+
+	for i := range tags {
+		image.ImageTags = append(image.ImageTags, &tags[i])
+	}
+
+	return image
+}
+
 func TestRemoveOldImagesWithKubeListPodsError(t *testing.T) {
 	namespace := "namespace"
 	kubeClient := &mockKubeClient{
@@ -105,7 +263,7 @@ func TestRemoveOldImagesWithKubeListPodsError(t *testing.T) {
 		KubeNamespaces: []*string{&namespace},
 	}
 
-	errs := RemoveOldImages(task, kubeClient, nil)
+	_, errs := RemoveOldImages(task, kubeClient, nil, nil, nil)
 
 	if len(errs) != 1 {
 		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
@@ -136,7 +294,7 @@ func TestRemoveOldImagesWithECRListRepositoriesError(t *testing.T) {
 		EcrRepositories: []*string{&repoName},
 	}
 
-	errs := RemoveOldImages(task, kubeClient, ecrClient)
+	_, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
 
 	if len(errs) != 1 {
 		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
@@ -183,7 +341,7 @@ func TestRemoveOldImagesWithECRListImagesError(t *testing.T) {
 		MaxImages:       1,
 	}
 
-	errs := RemoveOldImages(task, kubeClient, ecrClient)
+	_, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
 
 	if len(errs) != 1 {
 		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
@@ -235,7 +393,7 @@ func TestRemoveOldImagesWithoutOldImagesToRemove(t *testing.T) {
 		MaxImages: 1000,
 	}
 
-	errs := RemoveOldImages(task, kubeClient, ecrClient)
+	_, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
 
 	if len(errs) != 0 {
 		t.Errorf("Expected errors to be empty, but is %q", errs)
@@ -294,11 +452,21 @@ func TestRemoveOldImagesWithECRBatchRemoveImagesError(t *testing.T) {
 		MaxImages: 0,
 	}
 
-	errs := RemoveOldImages(task, kubeClient, ecrClient)
+	report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
 
 	if len(errs) == 0 {
 		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
 	}
+
+	repoReport := report.Repositories[0]
+
+	if len(repoReport.Deleted) != 0 {
+		t.Errorf("Expected no images to be reported deleted, but was %+v", repoReport.Deleted)
+	}
+
+	if len(repoReport.Failed) != 1 || repoReport.Failed[0].Digest != imageDigest {
+		t.Errorf("Expected image '%s' to be reported failed, but was %+v", imageDigest, repoReport.Failed)
+	}
 }
 
 func TestRemoveOldImagesWithKeepFilter(t *testing.T) {
@@ -363,7 +531,7 @@ func TestRemoveOldImagesWithKeepFilter(t *testing.T) {
 		KeepFilters: []*string{&keep},
 	}
 
-	errs := RemoveOldImages(task, kubeClient, ecrClient)
+	_, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
 
 	if len(errs) != 0 {
 		t.Errorf("Expected errors to be empty, but is %q", errs)
@@ -421,7 +589,7 @@ func TestRemoveOldImages(t *testing.T) {
 		MaxImages: 0,
 	}
 
-	errs := RemoveOldImages(task, kubeClient, ecrClient)
+	_, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
 
 	if len(errs) != 0 {
 		t.Errorf("Expected errors to be empty, but is %q", errs)
@@ -480,9 +648,715 @@ func TestRemoveOldImagesWithDryRun(t *testing.T) {
 		MaxImages: 0,
 	}
 
-	errs := RemoveOldImages(task, kubeClient, ecrClient)
+	_, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
 
 	if len(errs) != 0 {
 		t.Errorf("Expected errors to be empty, but is %q", errs)
 	}
 }
+
+func TestRemoveOldImagesWithSafetyBrake(t *testing.T) {
+	namespace, repoName, imageDigest := "namespace", "repo", "image-digest"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*apiv1.Pod{},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+
+		// No images must be removed
+		expectedImagesToRemove: []*ecr.ImageDetail{},
+	}
+
+	task := &core.CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		MinPods:         1,
+
+		// Would cause the image to be deleted
+		MaxImages: 0,
+	}
+
+	_, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+}
+
+func TestCheckSafetyBrakes(t *testing.T) {
+	testCases := []struct {
+		task            *core.CleanupTask
+		inUse           *ImagesInUse
+		repoImagesCount int
+		removeCount     int
+		expectError     bool
+	}{
+		// Checks disabled
+		{
+			task:            &core.CleanupTask{},
+			inUse:           &ImagesInUse{},
+			repoImagesCount: 10,
+			removeCount:     10,
+		},
+
+		// Not enough pods
+		{
+			task:        &core.CleanupTask{MinPods: 1},
+			inUse:       &ImagesInUse{},
+			expectError: true,
+		},
+
+		// Pods are not among the sources
+		{
+			task:  &core.CleanupTask{MinPods: 1},
+			inUse: &ImagesInUse{PodsCount: -1},
+		},
+
+		// Not enough images in use according to a source
+		{
+			task:        &core.CleanupTask{MinPods: 1, MinImagesPerSource: 1},
+			inUse:       &ImagesInUse{PodsCount: -1, Count: 1, SourceCounts: map[string]int{"allowlist=/a": 1, "workloads": 0}},
+			expectError: true,
+		},
+
+		// Not enough images in use
+		{
+			task:        &core.CleanupTask{MinPods: 1, MinImagesInUse: 2},
+			inUse:       &ImagesInUse{PodsCount: 1, Count: 1},
+			expectError: true,
+		},
+
+		// Too many images to remove
+		{
+			task:            &core.CleanupTask{MaxDeleteRatio: 0.5},
+			inUse:           &ImagesInUse{},
+			repoImagesCount: 10,
+			removeCount:     6,
+			expectError:     true,
+		},
+
+		// Within limits
+		{
+			task:            &core.CleanupTask{MinPods: 1, MinImagesPerSource: 1, MinImagesInUse: 1, MaxDeleteRatio: 0.5},
+			inUse:           &ImagesInUse{PodsCount: 1, Count: 1, SourceCounts: map[string]int{"workloads": 1}},
+			repoImagesCount: 10,
+			removeCount:     5,
+		},
+	}
+
+	for i, testCase := range testCases {
+		err := CheckSafetyBrakes(testCase.task, testCase.inUse, testCase.repoImagesCount, testCase.removeCount)
+
+		if testCase.expectError && err == nil {
+			t.Errorf("Expected error in test case %d not to be nil, but it was", i)
+		}
+		if !testCase.expectError && err != nil {
+			t.Errorf("Expected error in test case %d to be nil, but was %v", i, err)
+		}
+	}
+}
+
+func TestRemoveOldImagesWithStateLoadError(t *testing.T) {
+	task := &core.CleanupTask{}
+
+	_, errs := RemoveOldImages(task, nil, nil, &mockStore{loadError: fmt.Errorf("")}, nil)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+}
+
+func TestRemoveOldImagesWithGracePeriod(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	digests := []string{"digest-1", "digest-2"}
+	pushedAt := []time.Time{time.Unix(0, 0), time.Unix(1, 0)}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*apiv1.Pod{},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest:   &digests[0],
+				ImagePushedAt: &pushedAt[0],
+			},
+			{
+				ImageDigest:   &digests[1],
+				ImagePushedAt: &pushedAt[1],
+			},
+		},
+
+		// Only the image marked long ago must be removed
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &digests[0],
+			},
+		},
+	}
+
+	store := &mockStore{state: state.New()}
+	store.state.Mark(repoName, []string{digests[0]}, time.Now().Add(-2*time.Hour))
+
+	task := &core.CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		GracePeriod:     time.Hour,
+
+		// Will cause the images to be deleted
+		MaxImages: 0,
+	}
+
+	_, errs := RemoveOldImages(task, kubeClient, ecrClient, store, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	if len(store.state.Marks[repoName]) != 2 {
+		t.Errorf("Expected both images to be marked, but marks are %v", store.state.Marks[repoName])
+	}
+}
+
+func TestRemoveOldImagesWithInUseLookback(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	digests := []string{"digest-1", "digest-2", "digest-3"}
+	tags := []string{"tag-1", "tag-2", "tag-3"}
+	pushedAt := []time.Time{time.Unix(0, 0), time.Unix(1, 0), time.Unix(2, 0)}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*apiv1.Pod{
+			{
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{
+							Image: "id.dkr.ecr.region.amazonaws.com/repo:tag-3",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	images := []*ecr.ImageDetail{}
+	for i := range digests {
+		images = append(images, &ecr.ImageDetail{
+			ImageDigest:   &digests[i],
+			ImageTags:     []*string{&tags[i]},
+			ImagePushedAt: &pushedAt[i],
+		})
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             images,
+
+		// The image seen in use recently must be kept
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &digests[0],
+			},
+		},
+	}
+
+	store := &mockStore{state: state.New()}
+	store.state.RecordInUse(map[string][]string{repoName: {tags[0]}}, time.Now().Add(-2*time.Hour))
+	store.state.RecordInUse(map[string][]string{repoName: {tags[1]}}, time.Now().Add(-30*time.Minute))
+
+	task := &core.CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		InUseLookback:   time.Hour,
+
+		// Will cause the unused images to be deleted
+		MaxImages: 0,
+	}
+
+	_, errs := RemoveOldImages(task, kubeClient, ecrClient, store, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	if len(store.state.History[repoName]) != 2 {
+		t.Errorf("Expected history to contain 2 tags, but was %v", store.state.History[repoName])
+	}
+}
+
+func TestRemoveOldImagesReport(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	digests := []string{"digest-1", "digest-2", "digest-3", "digest-4"}
+	tags := []string{"tag-1", "keep-1", "latest", "tag-2"}
+	pushedAt := []time.Time{time.Unix(0, 0), time.Unix(1, 0), time.Unix(2, 0), time.Unix(3, 0)}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*apiv1.Pod{
+			{
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{
+							Image: "id.dkr.ecr.region.amazonaws.com/repo:tag-1",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	images := []*ecr.ImageDetail{}
+	for i := range digests {
+		images = append(images, &ecr.ImageDetail{
+			ImageDigest:   &digests[i],
+			ImageTags:     []*string{&tags[i]},
+			ImagePushedAt: &pushedAt[i],
+		})
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             images,
+
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &digests[3],
+			},
+		},
+	}
+
+	keep := "^keep"
+	task := &core.CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		KeepFilters:     []*string{&keep},
+
+		// Will cause the unused images to be deleted
+		MaxImages: 0,
+	}
+
+	report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	if len(report.Repositories) != 1 {
+		t.Fatalf("Expected report to contain 1 repository, but it contains %d", len(report.Repositories))
+	}
+
+	repoReport := report.Repositories[0]
+
+	if repoReport.Listed != 4 {
+		t.Errorf("Expected 4 images to be listed, but was %d", repoReport.Listed)
+	}
+
+	testCases := []struct {
+		name     string
+		records  []*core.ImageRecord
+		expected string
+	}{
+		{"in use", repoReport.InUse, digests[0]},
+		{"kept by filter", repoReport.KeptByFilter, digests[1]},
+		{"kept by policy", repoReport.KeptByPolicy, digests[2]},
+		{"deleted", repoReport.Deleted, digests[3]},
+	}
+
+	for _, testCase := range testCases {
+		if len(testCase.records) != 1 || testCase.records[0].Digest != testCase.expected {
+			t.Errorf("Expected %s images to be [%s], but was %+v", testCase.name, testCase.expected, testCase.records)
+		}
+	}
+}
+
+func TestExplainImages(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	digests := []string{"digest-1", "digest-2", "digest-3", "digest-4"}
+	tags := []string{"tag-1", "keep-1", "latest", "tag-2"}
+	pushedAt := []time.Time{time.Unix(0, 0), time.Unix(1, 0), time.Unix(2, 0), time.Unix(3, 0)}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*apiv1.Pod{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: namespace,
+					Name:      "pod",
+				},
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{
+							Image: "id.dkr.ecr.region.amazonaws.com/repo:tag-1",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	images := []*ecr.ImageDetail{}
+	for i := range digests {
+		images = append(images, &ecr.ImageDetail{
+			ImageDigest:   &digests[i],
+			ImageTags:     []*string{&tags[i]},
+			ImagePushedAt: &pushedAt[i],
+		})
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             images,
+	}
+
+	keep := "^keep"
+	task := &core.CleanupTask{
+		KubeNamespaces: []*string{&namespace},
+		KeepFilters:    []*string{&keep},
+
+		// Will cause the unused images to be deleted
+		MaxImages: 0,
+	}
+
+	decisions, err := ExplainImages(task, kubeClient, ecrClient, nil, repoName)
+
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	testCases := []struct {
+		delete bool
+		rule   string
+		detail string
+	}{
+		{false, "in-use", "tag 'tag-1' in use by pod 'namespace/pod'"},
+		{false, "keep-filter", "tag 'keep-1' matches keep filter '^keep'"},
+		{false, "protected-tag", "tagged 'latest'"},
+		{true, "max-images", "older than the 0 most recent images to keep"},
+	}
+
+	for i, testCase := range testCases {
+		decision := decisions[i]
+
+		if decision.Delete != testCase.delete {
+			t.Errorf("Expected image %s delete to be %v, but was %v", digests[i], testCase.delete, decision.Delete)
+		}
+
+		found := false
+		for _, rule := range decision.Rules {
+			if rule.Rule == testCase.rule && strings.Contains(rule.Detail, testCase.detail) {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("Expected image %s rules to contain %s '%s', but were %+v", digests[i], testCase.rule, testCase.detail, decision.Rules)
+		}
+	}
+}
+
+func TestSweepMarkedImages(t *testing.T) {
+	now := time.Unix(3600, 0)
+	digests := []string{"digest-1", "digest-2", "digest-3"}
+
+	st := state.New()
+	st.Mark("repo", digests[:2], now.Add(-time.Hour))
+	st.Mark("repo", digests, now.Add(-time.Minute))
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest: &digests[1],
+		},
+		{
+			ImageDigest: &digests[2],
+		},
+	}
+
+	swept, sweptPrunable := SweepMarkedImages(st, "repo", images, images[:1], time.Hour, now)
+
+	if len(swept) != 1 || *swept[0].ImageDigest != digests[1] {
+		t.Errorf("Expected only %s to be swept, but got %+v", digests[1], swept)
+	}
+
+	// Removal marks do not count toward the grace period of tag pruning
+	if len(sweptPrunable) != 0 {
+		t.Errorf("Expected no prunable images to be swept, but got %+v", sweptPrunable)
+	}
+
+	// Images that are no longer candidates are unmarked
+	if _, ok := st.Marks["repo"][digests[0]]; ok {
+		t.Errorf("Expected %s to be unmarked, but it was not", digests[0])
+	}
+
+	_, sweptPrunable = SweepMarkedImages(st, "repo", images, images[:1], time.Hour, now.Add(time.Hour))
+
+	if len(sweptPrunable) != 1 || *sweptPrunable[0].ImageDigest != digests[1] {
+		t.Errorf("Expected only %s to be swept for tag pruning, but got %+v", digests[1], sweptPrunable)
+	}
+}
+
+func TestRemoveOldImagesWithApproval(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	digests := []string{"digest-1", "digest-2"}
+	pushedAt := []time.Time{time.Unix(0, 0), time.Unix(1, 0)}
+
+	testCases := []struct {
+		approver        *mockApprover
+		threshold       int
+		dryRun          bool
+		expectedDeleted int
+		expectedErrors  int
+		expectedPlans   int
+		expectedCleared int
+	}{
+		// Below the threshold, no approval needed, and pending plans are cleared
+		{&mockApprover{}, 2, false, 2, 0, 0, 1},
+
+		// Above the threshold, waiting for approval
+		{&mockApprover{}, 1, false, 0, 0, 1, 0},
+
+		// Above the threshold, approved
+		{&mockApprover{approved: true}, 1, false, 2, 0, 1, 1},
+
+		// Above the threshold, cannot check approval
+		{&mockApprover{approvedError: fmt.Errorf("")}, 1, false, 0, 1, 1, 0},
+
+		// Above the threshold, no approver
+		{nil, 1, false, 0, 1, 0, 0},
+
+		// Above the threshold, dry-run does not publish the plan
+		{&mockApprover{}, 1, true, 2, 0, 0, 0},
+	}
+
+	for i, testCase := range testCases {
+		images := []*ecr.ImageDetail{}
+		for j := range digests {
+			images = append(images, &ecr.ImageDetail{
+				ImageDigest:   &digests[j],
+				ImagePushedAt: &pushedAt[j],
+			})
+		}
+
+		expectedImagesToRemove := []*ecr.ImageDetail{}
+		if testCase.expectedDeleted > 0 && !testCase.dryRun {
+			expectedImagesToRemove = images
+		}
+
+		kubeClient := &mockKubeClient{
+			t: t,
+
+			expectedNamespace: []string{namespace},
+			listAllPodsResult: []*apiv1.Pod{{}},
+		}
+
+		ecrClient := &mockECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			listRepositoriesResult: []*ecr.Repository{
+				{
+					RepositoryName: &repoName,
+				},
+			},
+
+			expectedImagesRepositoryName: repoName,
+			listImagesResult:             images,
+			expectedImagesToRemove:       expectedImagesToRemove,
+		}
+
+		task := &core.CleanupTask{
+			KubeNamespaces:    []*string{&namespace},
+			EcrRepositories:   []*string{&repoName},
+			ApprovalThreshold: testCase.threshold,
+			DryRun:            testCase.dryRun,
+		}
+
+		var approver core.Approver
+		if testCase.approver != nil {
+			approver = testCase.approver
+		}
+
+		report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, approver)
+
+		if len(errs) != testCase.expectedErrors {
+			t.Errorf("Expected %d errors in test case %d, but was %q", testCase.expectedErrors, i, errs)
+		}
+
+		if deleted := len(report.Repositories[0].Deleted); deleted != testCase.expectedDeleted {
+			t.Errorf("Expected %d deleted images in test case %d, but was %d", testCase.expectedDeleted, i, deleted)
+		}
+
+		if testCase.approver == nil {
+			continue
+		}
+
+		if len(testCase.approver.published) != testCase.expectedPlans {
+			t.Errorf("Expected %d published plans in test case %d, but was %d", testCase.expectedPlans, i, len(testCase.approver.published))
+		}
+
+		for _, plan := range testCase.approver.published {
+			if len(plan.Images) != len(digests) {
+				t.Errorf("Expected published plan to contain %d images in test case %d, but was %d", len(digests), i, len(plan.Images))
+			}
+		}
+
+		if len(testCase.approver.cleared) != testCase.expectedCleared {
+			t.Errorf("Expected %d cleared plans in test case %d, but was %d", testCase.expectedCleared, i, len(testCase.approver.cleared))
+		}
+	}
+}
+
+func TestRemoveOldImagesWithRepositoryOrdering(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+
+	kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:v4",
+		[]string{"sha256:a1", "sha256:a2", "sha256:a3", "sha256:a4"},
+		[]string{"v1", "v2", "v3", "v4"})
+
+	sizes := []int64{10, 30, 20, 40}
+	for i := range sizes {
+		ecrClient.listImagesResult[i].ImageSizeInBytes = &sizes[i]
+	}
+
+	ecrClient.expectedRemoveCalls = [][]string{{"sha256:a2", "sha256:a3"}}
+
+	task := &core.CleanupTask{
+		KubeNamespaces:      []*string{&namespace},
+		EcrRepositories:     []*string{&repoName},
+		Ordering:            "push-date",
+		RepositoryOrderings: map[string]string{repoName: "size"},
+		MaxImages:           2,
+	}
+
+	_, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	if ecrClient.removeCalls != 1 {
+		t.Errorf("Expected images to be removed once, but was %d times", ecrClient.removeCalls)
+	}
+
+	// Unknown orderings fail the repository
+	task.RepositoryOrderings[repoName] = "oldest"
+	ecrClient.expectedRemoveCalls = [][]string{}
+
+	if _, errs = RemoveOldImages(task, kubeClient, ecrClient, nil, nil); len(errs) != 1 {
+		t.Errorf("Expected one error to be returned, but was %q", errs)
+	}
+}
+
+func TestNewStateStoreWithStateContext(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	content := `apiVersion: v1
+kind: Config
+clusters:
+- name: staging
+  cluster:
+    server: https://staging.example.com
+- name: prod
+  cluster:
+    server: https://prod.example.com
+users:
+- name: user
+  user:
+    token: token
+contexts:
+- name: staging
+  context:
+    cluster: staging
+    user: user
+- name: prod
+  context:
+    cluster: prod
+    user: user
+current-context: staging
+`
+	if err := ioutil.WriteFile(kubeconfig, []byte(content), 0600); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	testCases := []struct {
+		stateContext string
+		expectError  bool
+	}{
+		{"", false},
+		{"prod", false},
+		{"unknown", true},
+	}
+
+	for _, testCase := range testCases {
+		task := &core.CleanupTask{
+			KubeConfigs:    []*string{&kubeconfig},
+			StateConfigMap: "namespace/name",
+			StateContext:   testCase.stateContext,
+		}
+
+		store, err := NewStateStore(task)
+
+		if (err != nil) != testCase.expectError {
+			t.Errorf("Expected error with state context '%s' to be returned: %v, but was %v", testCase.stateContext, testCase.expectError, err)
+		}
+
+		if err == nil && store == nil {
+			t.Errorf("Expected store with state context '%s' not to be nil", testCase.stateContext)
+		}
+	}
+}
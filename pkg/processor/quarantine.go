@@ -0,0 +1,343 @@
+package processor
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/backup"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/utils"
+	"github.com/golang/glog"
+)
+
+const (
+	quarantineDateLayout = "20060102"
+
+	// Number of digest characters in quarantine tags, which makes them
+	// unique among the images quarantined in the same day.
+	quarantineDigestLength = 12
+)
+
+// Only matches tags added when quarantining images
+var quarantineTagRegexp = regexp.MustCompile(`^quarantine-(\d{8})-[0-9a-f]+$`)
+
+// QuarantineTag returns the tag that marks the given image as quarantined
+// at the given time.
+func QuarantineTag(image *ecr.ImageDetail, now time.Time) string {
+	digest := awssdk.StringValue(image.ImageDigest)
+	digest = digest[strings.Index(digest, ":")+1:]
+
+	if len(digest) > quarantineDigestLength {
+		digest = digest[:quarantineDigestLength]
+	}
+
+	return fmt.Sprintf("quarantine-%s-%s", now.UTC().Format(quarantineDateLayout), digest)
+}
+
+// QuarantinedAt returns when the given image was quarantined. Images are
+// only considered quarantined if all their tags are quarantine tags, so that
+// images retagged after being quarantined are handled as any other image.
+func QuarantinedAt(image *ecr.ImageDetail) (time.Time, bool) {
+	var quarantinedAt time.Time
+
+	if len(image.ImageTags) == 0 {
+		return quarantinedAt, false
+	}
+
+	for _, tag := range image.ImageTags {
+		match := quarantineTagRegexp.FindStringSubmatch(*tag)
+		if match == nil {
+			return time.Time{}, false
+		}
+
+		date, err := time.Parse(quarantineDateLayout, match[1])
+		if err != nil {
+			return time.Time{}, false
+		}
+
+		if date.After(quarantinedAt) {
+			quarantinedAt = date
+		}
+	}
+
+	return quarantinedAt, true
+}
+
+// SplitQuarantinedImages separates the quarantined images from the others.
+func SplitQuarantinedImages(images []*ecr.ImageDetail) ([]*ecr.ImageDetail, []*ecr.ImageDetail) {
+	regular, quarantined := []*ecr.ImageDetail{}, []*ecr.ImageDetail{}
+
+	for _, image := range images {
+		if _, ok := QuarantinedAt(image); ok {
+			quarantined = append(quarantined, image)
+		} else {
+			regular = append(regular, image)
+		}
+	}
+
+	return regular, quarantined
+}
+
+// ExpiredQuarantinedImages returns the given quarantined images that have
+// been in quarantine for at least the given period and are not in use.
+func ExpiredQuarantinedImages(images []*ecr.ImageDetail, tagsInUse []string, period time.Duration, now time.Time) []*ecr.ImageDetail {
+	inUse := tagSet(tagsInUse)
+	expired := []*ecr.ImageDetail{}
+
+	for _, image := range images {
+		quarantinedAt, ok := QuarantinedAt(image)
+		if ok && !isInUse(image, inUse) && !now.Before(quarantinedAt.Add(period)) {
+			expired = append(expired, image)
+		}
+	}
+
+	return expired
+}
+
+// QuarantineImages tags each of the given images with a quarantine tag, then
+// removes all their other tags, so that they can be restored by tagging them
+// again until they are removed for good. If the given client backs up images,
+// they are backed up first, so that their backups hold their original tags.
+// All images must be stored in the same repository for this to work.
+func QuarantineImages(ecrClient aws.ECRClient, images []*ecr.ImageDetail, now time.Time) error {
+
+	// No images to be quarantined
+	if len(images) == 0 {
+		return nil
+	}
+
+	manifests, err := ecrClient.GetImages(images)
+	if err != nil {
+		return fmt.Errorf("Cannot retrieve manifests to quarantine: %v", err)
+	}
+
+	if backupClient, ok := ecrClient.(*backup.Client); ok {
+		if err = backupClient.BackUpImages(images, manifests); err != nil {
+			return fmt.Errorf("Cannot back up images to quarantine: %v", err)
+		}
+	}
+
+	manifestsByDigest := map[string]*ecr.Image{}
+	for _, manifest := range manifests {
+		if manifest.ImageId != nil {
+			manifestsByDigest[awssdk.StringValue(manifest.ImageId.ImageDigest)] = manifest
+		}
+	}
+
+	tags := []*string{}
+
+	for _, image := range images {
+		digest := awssdk.StringValue(image.ImageDigest)
+
+		manifest, ok := manifestsByDigest[digest]
+		if !ok {
+			return fmt.Errorf("Cannot quarantine image '%s': manifest not found", digest)
+		}
+
+		// Tagging the image first keeps it from being deleted once its
+		// other tags are removed
+		err = ecrClient.PutImage(&ecr.Image{
+			RegistryId:     image.RegistryId,
+			RepositoryName: image.RepositoryName,
+			ImageId: &ecr.ImageIdentifier{
+				ImageDigest: image.ImageDigest,
+				ImageTag:    awssdk.String(QuarantineTag(image, now)),
+			},
+			ImageManifest:          manifest.ImageManifest,
+			ImageManifestMediaType: manifest.ImageManifestMediaType,
+		})
+		if err != nil {
+			return fmt.Errorf("Cannot quarantine image '%s': %v", digest, err)
+		}
+
+		tags = append(tags, image.ImageTags...)
+	}
+
+	for start := 0; start < len(tags); start += aws.BatchRemoveMaxImages {
+		end := start + aws.BatchRemoveMaxImages
+		if end > len(tags) {
+			end = len(tags)
+		}
+
+		if err = ecrClient.BatchRemoveTags(images[0].RepositoryName, images[0].RegistryId, tags[start:end]); err != nil {
+			return fmt.Errorf("Cannot remove tags of quarantined images: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// ExplainQuarantinedImage lists the outcome of each rule evaluated against
+// the given quarantined image.
+func ExplainQuarantinedImage(t *core.CleanupTask, image *ecr.ImageDetail, tagsInUse []string, now time.Time) *core.ImageDecision {
+	decision := &core.ImageDecision{
+		Image: core.NewImageRecord(image),
+	}
+
+	quarantinedAt, _ := QuarantinedAt(image)
+
+	switch {
+	case isInUse(image, tagSet(tagsInUse)):
+		decision.AddRule("in-use", true, "quarantine tag in use")
+	case now.Before(quarantinedAt.Add(t.QuarantinePeriod)):
+		decision.AddRule("quarantine", true, "quarantined since %s, less than the %v quarantine period", quarantinedAt.Format(time.RFC3339), t.QuarantinePeriod)
+	default:
+		decision.AddRule("quarantine", false, "quarantined since %s, longer than the %v quarantine period", quarantinedAt.Format(time.RFC3339), t.QuarantinePeriod)
+		decision.Delete = true
+	}
+
+	return decision
+}
+
+// sweepQuarantinedImages removes the quarantined images of a repository that
+// have been in quarantine for long enough, and adds the outcome to the given
+// report. Quarantined images referenced by image indexes that are kept,
+// signed since they were quarantined, or whose removal the given veto hook
+// vetoes, are not removed. If the hook fails, no quarantined images are
+// removed.
+func sweepQuarantinedImages(t *core.CleanupTask, ecrClient aws.ECRClient, h core.VetoHook, r *core.RepositoryReport, inUse *ImagesInUse, sel *Selection, now time.Time) error {
+	expired := ExpiredQuarantinedImages(sel.Quarantined, inUse.References(r.Name), t.QuarantinePeriod, now)
+	expired = sel.Graph.WithoutKeptChildren(expired)
+	expired = utils.ApplySignatureFilter(expired, sel.Signed)
+
+	vetoed, vetoErr := VetoedImages(t, h, r.Name, expired)
+	if vetoErr != nil {
+		expired = []*ecr.ImageDetail{}
+	} else if len(vetoed) > 0 {
+		isVetoed := tagSet(vetoed)
+		notVetoed := []*ecr.ImageDetail{}
+		for _, image := range expired {
+			if !isVetoed[awssdk.StringValue(image.ImageDigest)] {
+				notVetoed = append(notVetoed, image)
+			}
+		}
+
+		// Children are kept along with the vetoed images referencing them
+		expired = sel.Graph.WithoutKeptChildren(notVetoed)
+	}
+
+	isExpired := imageSet(expired)
+	tagsInUse := tagSet(inUse.References(r.Name))
+
+	for _, image := range sel.Quarantined {
+		switch {
+		case isExpired[image]:
+			continue
+		case isInUse(image, tagsInUse):
+			reportInUse(r, image, inUse.Sources[r.Name])
+		default:
+			ReportImages(&r.KeptByPolicy, []*ecr.ImageDetail{image})
+		}
+	}
+
+	if vetoErr != nil {
+		return vetoErr
+	}
+
+	if len(expired) == 0 {
+		return nil
+	}
+
+	if err := CheckSafetyBrakes(t, inUse, r.Listed, len(expired)); err != nil {
+		ReportImages(&r.KeptByPolicy, expired)
+		return fmt.Errorf("Safety brake tripped for repo '%s', not removing any quarantined images: %v", r.Name, err)
+	}
+
+	if t.DryRun {
+		glog.Infof("Would have removed %d quarantined images.", len(expired))
+		ReportImages(&r.Deleted, expired)
+		return nil
+	}
+
+	// Backups saved when the images were quarantined hold their original tags
+	remove := ecrClient.BatchRemoveImages
+	if backupClient, ok := ecrClient.(*backup.Client); ok {
+		remove = backupClient.BatchRemoveBackedUpImages
+	}
+
+	glog.Infof("Removing %d images quarantined for longer than %v.", len(expired), t.QuarantinePeriod)
+	if err := batchRemoveImages(remove, r, expired); err != nil {
+		return fmt.Errorf("Could not batch remove quarantined images from repo '%s': %v", r.Name, err)
+	}
+
+	return nil
+}
+
+// removeImages removes the given images, or quarantines them if the task
+// sets a quarantine period, and adds them to the given report accordingly.
+func removeImages(t *core.CleanupTask, ecrClient aws.ECRClient, r *core.RepositoryReport, images []*ecr.ImageDetail, now time.Time) error {
+	if t.QuarantinePeriod == 0 {
+		return batchRemoveImages(ecrClient.BatchRemoveImages, r, images)
+	}
+
+	for start := 0; start < len(images); start += aws.BatchRemoveMaxImages {
+		end := start + aws.BatchRemoveMaxImages
+		if end > len(images) {
+			end = len(images)
+		}
+
+		if err := QuarantineImages(ecrClient, images[start:end], now); err != nil {
+			ReportImages(&r.Failed, images[start:])
+			return err
+		}
+
+		ReportImages(&r.Quarantined, images[start:end])
+	}
+
+	return nil
+}
+
+// batchRemoveImages removes the given images with the given function in as
+// many calls as needed, and adds them to the given report. Image indexes are
+// removed before any other images, since ECR refuses to remove images
+// referenced by an index. If a call fails, the images not removed yet are
+// reported as failed, except the ones ECR removed before refusing to remove
+// the others of the same call.
+func batchRemoveImages(remove func([]*ecr.ImageDetail) error, r *core.RepositoryReport, images []*ecr.ImageDetail) error {
+	indexes, others := aws.SplitImageIndexes(images)
+	isRemoved := map[*ecr.ImageDetail]bool{}
+
+	for _, group := range [][]*ecr.ImageDetail{indexes, others} {
+		for start := 0; start < len(group); start += aws.BatchRemoveMaxImages {
+			end := start + aws.BatchRemoveMaxImages
+			if end > len(group) {
+				end = len(group)
+			}
+
+			err := remove(group[start:end])
+
+			removed := group[start:end]
+			if removeErr, ok := err.(*aws.BatchRemoveError); ok {
+				removed = []*ecr.ImageDetail{}
+				for _, image := range group[start:end] {
+					if _, failed := removeErr.Failures[awssdk.StringValue(image.ImageDigest)]; !failed {
+						removed = append(removed, image)
+					}
+				}
+			} else if err != nil {
+				removed = []*ecr.ImageDetail{}
+			}
+
+			ReportImages(&r.Deleted, removed)
+			for _, image := range removed {
+				isRemoved[image] = true
+			}
+
+			if err != nil {
+				for _, image := range images {
+					if !isRemoved[image] {
+						ReportImages(&r.Failed, []*ecr.ImageDetail{image})
+					}
+				}
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,336 @@
+package processor
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/backup"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestQuarantineTag(t *testing.T) {
+	now := time.Date(2020, 1, 2, 23, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		digest   string
+		expected string
+	}{
+		{"sha256:0123456789abcdef", "quarantine-20200102-0123456789ab"},
+		{"sha256:0123", "quarantine-20200102-0123"},
+	}
+
+	for _, testCase := range testCases {
+		tag := QuarantineTag(newTestImage(testCase.digest), now)
+		if tag != testCase.expected {
+			t.Errorf("Expected tag for '%s' to be '%s', but was '%s'", testCase.digest, testCase.expected, tag)
+		}
+	}
+}
+
+func TestQuarantinedAt(t *testing.T) {
+	testCases := []struct {
+		tags        []string
+		expected    time.Time
+		quarantined bool
+	}{
+		{[]string{}, time.Time{}, false},
+		{[]string{"v1"}, time.Time{}, false},
+		{[]string{"quarantine-20200102-abc"}, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), true},
+		{[]string{"quarantine-20200102-abc", "quarantine-20200105-abc"}, time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC), true},
+
+		// Retagged after being quarantined
+		{[]string{"quarantine-20200102-abc", "v1"}, time.Time{}, false},
+
+		// Not a valid date
+		{[]string{"quarantine-20201350-abc"}, time.Time{}, false},
+	}
+
+	for _, testCase := range testCases {
+		quarantinedAt, ok := QuarantinedAt(newTestImage("sha256:abc", testCase.tags...))
+
+		if ok != testCase.quarantined {
+			t.Errorf("Expected image tagged %v to be quarantined: %v, but was %v", testCase.tags, testCase.quarantined, ok)
+		}
+
+		if !quarantinedAt.Equal(testCase.expected) {
+			t.Errorf("Expected image tagged %v to be quarantined at %v, but was %v", testCase.tags, testCase.expected, quarantinedAt)
+		}
+	}
+}
+
+func TestExpiredQuarantinedImages(t *testing.T) {
+	now := time.Date(2020, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	old := newTestImage("sha256:a1", "quarantine-20200101-a1")
+	recent := newTestImage("sha256:b2", "quarantine-20200110-b2")
+	used := newTestImage("sha256:c3", "quarantine-20200101-c3")
+
+	expired := ExpiredQuarantinedImages([]*ecr.ImageDetail{old, recent, used}, []string{"quarantine-20200101-c3"}, 72*time.Hour, now)
+
+	if !reflect.DeepEqual(expired, []*ecr.ImageDetail{old}) {
+		t.Errorf("Expected only the old image to be expired, but was %v", expired)
+	}
+}
+
+func TestQuarantineImages(t *testing.T) {
+	now := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	ecrClient := &mockECRClient{t: t}
+
+	images := []*ecr.ImageDetail{
+		newTestImage("sha256:aaa", "v1", "build-1"),
+		newTestImage("sha256:bbb"),
+	}
+
+	if err := QuarantineImages(ecrClient, images, now); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	putTags := []string{}
+	for _, image := range ecrClient.putImages {
+		putTags = append(putTags, *image.ImageId.ImageTag)
+
+		if *image.ImageManifest != *image.ImageId.ImageDigest {
+			t.Errorf("Expected image '%s' to be put with its own manifest, but was '%s'", *image.ImageId.ImageDigest, *image.ImageManifest)
+		}
+	}
+
+	expectedPutTags := []string{"quarantine-20200102-aaa", "quarantine-20200102-bbb"}
+	if !reflect.DeepEqual(putTags, expectedPutTags) {
+		t.Errorf("Expected put tags to be %v, but was %v", expectedPutTags, putTags)
+	}
+
+	expectedRemovedTags := []string{"v1", "build-1"}
+	if !reflect.DeepEqual(ecrClient.removedTags, expectedRemovedTags) {
+		t.Errorf("Expected removed tags to be %v, but was %v", expectedRemovedTags, ecrClient.removedTags)
+	}
+}
+
+func TestRemoveOldImagesWithQuarantine(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	now := time.Now()
+
+	regular := newTestImage("sha256:regular", "v1")
+	expired := newTestImage("sha256:e1", "quarantine-20200101-e1")
+	recent := newTestImage("sha256:b2", QuarantineTag(newTestImage("sha256:b2"), now))
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*apiv1.Pod{{}},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             []*ecr.ImageDetail{regular, expired, recent},
+
+		// Only the images quarantined for long enough are removed
+		expectedImagesToRemove: []*ecr.ImageDetail{expired},
+	}
+
+	task := &core.CleanupTask{
+		KubeNamespaces:   []*string{&namespace},
+		EcrRepositories:  []*string{&repoName},
+		QuarantinePeriod: 24 * time.Hour,
+
+		// Would cause all images to be deleted
+		MaxImages: 0,
+	}
+
+	report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	repoReport := report.Repositories[0]
+
+	if repoReport.Listed != 3 {
+		t.Errorf("Expected 3 images to be listed, but was %d", repoReport.Listed)
+	}
+
+	testCases := []struct {
+		name     string
+		records  []*core.ImageRecord
+		expected string
+	}{
+		{"quarantined", repoReport.Quarantined, "sha256:regular"},
+		{"deleted", repoReport.Deleted, "sha256:e1"},
+		{"kept by policy", repoReport.KeptByPolicy, "sha256:b2"},
+	}
+
+	for _, testCase := range testCases {
+		if len(testCase.records) != 1 || testCase.records[0].Digest != testCase.expected {
+			t.Errorf("Expected %s images to be ['%s'], but was %+v", testCase.name, testCase.expected, testCase.records)
+		}
+	}
+
+	if !reflect.DeepEqual(ecrClient.removedTags, []string{"v1"}) {
+		t.Errorf("Expected removed tags to be [v1], but was %v", ecrClient.removedTags)
+	}
+}
+
+func TestRemoveOldImagesWithQuarantineAndBackups(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+
+	regular := newTestImage("sha256:regular", "v1")
+	expired := newTestImage("sha256:e1", "quarantine-20200101-e1")
+	backedUp := newTestImage("sha256:e2", "quarantine-20200101-e2")
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*apiv1.Pod{{}},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             []*ecr.ImageDetail{regular, expired, backedUp},
+		expectedImagesToRemove:       []*ecr.ImageDetail{expired, backedUp},
+	}
+
+	// Backed up when it was quarantined
+	store := backup.NewDirStore(t.TempDir())
+	if err := store.Save(&backup.Backup{Repository: repoName, Digest: "sha256:e2", Tags: []string{"v0"}}); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	task := &core.CleanupTask{
+		KubeNamespaces:   []*string{&namespace},
+		EcrRepositories:  []*string{&repoName},
+		QuarantinePeriod: 24 * time.Hour,
+	}
+
+	_, errs := RemoveOldImages(task, kubeClient, backup.NewClient(ecrClient, store), nil, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	testCases := []struct {
+		digest       string
+		expectedTags []string
+	}{
+		// Backed up before its tags were replaced
+		{"sha256:regular", []string{"v1"}},
+
+		// Not backed up before, so backed up as it is
+		{"sha256:e1", []string{"quarantine-20200101-e1"}},
+
+		// Backup saved when it was quarantined is kept
+		{"sha256:e2", []string{"v0"}},
+	}
+
+	for _, testCase := range testCases {
+		b, err := store.Load(repoName, testCase.digest)
+		if err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+
+		if !reflect.DeepEqual(b.Tags, testCase.expectedTags) {
+			t.Errorf("Expected backup of image '%s' to hold tags %v, but was %v", testCase.digest, testCase.expectedTags, b.Tags)
+		}
+	}
+}
+
+func TestBatchRemoveImagesWithFailure(t *testing.T) {
+	indexType := "application/vnd.oci.image.index.v1+json"
+
+	index, a1, a2 := newTestImage("sha256:index"), newTestImage("sha256:a1"), newTestImage("sha256:a2")
+	index.ImageManifestMediaType = &indexType
+
+	// Image indexes are removed first, then the removal of the others fails
+	calls := 0
+	remove := func(images []*ecr.ImageDetail) error {
+		calls++
+		if calls > 1 {
+			return fmt.Errorf("")
+		}
+		return nil
+	}
+
+	r := core.NewRepositoryReport("repo")
+	if err := batchRemoveImages(remove, r, []*ecr.ImageDetail{a1, index, a2}); err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+
+	testCases := []struct {
+		bucket   string
+		records  []*core.ImageRecord
+		expected []string
+	}{
+		{"deleted", r.Deleted, []string{"sha256:index"}},
+		{"failed", r.Failed, []string{"sha256:a1", "sha256:a2"}},
+	}
+
+	for _, testCase := range testCases {
+		digests := []string{}
+		for _, record := range testCase.records {
+			digests = append(digests, record.Digest)
+		}
+
+		if !reflect.DeepEqual(digests, testCase.expected) {
+			t.Errorf("Expected %s images to be %v, but was %v", testCase.bucket, testCase.expected, digests)
+		}
+	}
+}
+
+func TestBatchRemoveImagesWithImageFailures(t *testing.T) {
+	a1, a2, a3 := newTestImage("sha256:a1"), newTestImage("sha256:a2"), newTestImage("sha256:a3")
+
+	// ECR refuses to remove one of the images, and removes the others
+	remove := func(images []*ecr.ImageDetail) error {
+		return &aws.BatchRemoveError{
+			Failures: map[string]string{"sha256:a2": "ImageNotFound: not found"},
+		}
+	}
+
+	r := core.NewRepositoryReport("repo")
+	if err := batchRemoveImages(remove, r, []*ecr.ImageDetail{a1, a2, a3}); err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+
+	testCases := []struct {
+		bucket   string
+		records  []*core.ImageRecord
+		expected []string
+	}{
+		{"deleted", r.Deleted, []string{"sha256:a1", "sha256:a3"}},
+		{"failed", r.Failed, []string{"sha256:a2"}},
+	}
+
+	for _, testCase := range testCases {
+		digests := []string{}
+		for _, record := range testCase.records {
+			digests = append(digests, record.Digest)
+		}
+
+		if !reflect.DeepEqual(digests, testCase.expected) {
+			t.Errorf("Expected %s images to be %v, but was %v", testCase.bucket, testCase.expected, digests)
+		}
+	}
+}
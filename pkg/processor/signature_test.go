@@ -0,0 +1,155 @@
+package processor
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/signature"
+)
+
+// newSignedTestClients returns clients for a repository where 'sha256:a1' is
+// signed by the returned public key, while 'sha256:a2' is not.
+func newSignedTestClients(t *testing.T) (*mockKubeClient, *mockECRClient, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "cosign.pub")
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := []byte(`{"critical": {"image": {"docker-manifest-digest": "sha256:a1"}}}`)
+	payloadDigest := sha256.Sum256(payload)
+
+	sig, err := ecdsa.SignASN1(rand.Reader, key, payloadDigest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer := fmt.Sprintf("sha256:%x", payloadDigest)
+
+	kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:other",
+		[]string{"sha256:a1", "sha256:a2", "sha256:c1"},
+		[]string{"v1", "v2", "sha256-a1.sig"})
+
+	ecrClient.manifests = map[string]string{
+		"sha256:c1": fmt.Sprintf(`{"layers": [{"digest": "%s", "annotations": {"%s": "%s"}}]}`, layer, signature.SignatureAnnotation, base64.StdEncoding.EncodeToString(sig)),
+	}
+	ecrClient.layers = map[string][]byte{
+		layer: payload,
+	}
+
+	return kubeClient, ecrClient, keyFile
+}
+
+func TestRemoveOldImagesWithSignedImages(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	kubeClient, ecrClient, keyFile := newSignedTestClients(t)
+
+	// The signed image and its signature are kept
+	unsigned := "sha256:a2"
+	ecrClient.expectedImagesToRemove = []*ecr.ImageDetail{
+		{
+			ImageDigest: &unsigned,
+		},
+	}
+
+	task := &core.CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		SignatureKeys:   []*string{&keyFile},
+
+		// Would cause all images to be deleted
+		MaxImages: 0,
+	}
+
+	report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	deleted := report.Repositories[0].Deleted
+	if len(deleted) != 1 || deleted[0].Digest != unsigned {
+		t.Errorf("Expected %s to be deleted, but was %+v", unsigned, deleted)
+	}
+
+	if kept := len(report.Repositories[0].KeptByFilter); kept != 1 {
+		t.Errorf("Expected 1 image to be kept by filter, but was %d", kept)
+	}
+}
+
+func TestRemoveOldImagesWithMissingSignaturePayload(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	kubeClient, ecrClient, keyFile := newSignedTestClients(t)
+
+	// No images must be removed
+	ecrClient.layers = map[string][]byte{}
+	ecrClient.expectedImagesToRemove = []*ecr.ImageDetail{}
+
+	task := &core.CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		SignatureKeys:   []*string{&keyFile},
+	}
+
+	report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+
+	if len(report.Repositories[0].Deleted) != 0 {
+		t.Errorf("Expected no images to be deleted, but was %+v", report.Repositories[0].Deleted)
+	}
+}
+
+func TestApplyPlanWithImageNowSigned(t *testing.T) {
+	namespace := "namespace"
+	kubeClient, ecrClient, keyFile := newSignedTestClients(t)
+
+	// No images must be removed
+	ecrClient.expectedImagesToRemove = []*ecr.ImageDetail{}
+
+	plan := core.NewPlan(nil)
+	plan.Repositories = append(plan.Repositories, &core.RepositoryPlan{
+		Name: "repo",
+		Images: []*core.PlannedImage{
+			{ImageRecord: core.ImageRecord{Digest: "sha256:a1"}},
+			{ImageRecord: core.ImageRecord{Digest: "sha256:a2"}},
+		},
+	})
+
+	task := &core.CleanupTask{
+		KubeNamespaces: []*string{&namespace},
+		SignatureKeys:  []*string{&keyFile},
+	}
+
+	report, errs := ApplyPlan(task, kubeClient, ecrClient, nil, plan)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+
+	if len(report.Repositories[0].Deleted) != 0 {
+		t.Errorf("Expected no images to be deleted, but was %+v", report.Repositories[0].Deleted)
+	}
+}
@@ -0,0 +1,102 @@
+package processor
+
+import (
+	"fmt"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/backup"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/utils"
+	"github.com/golang/glog"
+)
+
+// RedundantTags returns the tags of the given image that do not match any
+// of the task's keep filters, which are the only tags protecting old unused
+// images.
+func RedundantTags(t *core.CleanupTask, image *ecr.ImageDetail) []*string {
+	tags := []*string{}
+
+	for _, tag := range utils.UnprotectedTags(image, t.KeepFilters) {
+		if *tag != "latest" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+// PrunableImages returns the candidates of the given selection that are kept
+// due to keep filters, and have redundant tags. Candidates kept for other
+// reasons, such as signatures, are left alone, since all their tags may be
+// redundant.
+func PrunableImages(t *core.CleanupTask, sel *Selection) []*ecr.ImageDetail {
+	isFiltered := imageSet(sel.Filtered)
+	prunable := []*ecr.ImageDetail{}
+
+	for _, image := range sel.Candidates {
+		redundant := RedundantTags(t, image)
+
+		if !isFiltered[image] && len(redundant) > 0 && len(redundant) < len(image.ImageTags) {
+			prunable = append(prunable, image)
+		}
+	}
+
+	return prunable
+}
+
+// PrunedTagRecords returns the records of the given images, each listing
+// only its redundant tags.
+func PrunedTagRecords(t *core.CleanupTask, images []*ecr.ImageDetail) []*core.ImageRecord {
+	records := []*core.ImageRecord{}
+
+	for _, image := range images {
+		record := core.NewImageRecord(image)
+		record.Tags = awssdk.StringValueSlice(RedundantTags(t, image))
+		records = append(records, record)
+	}
+
+	return records
+}
+
+// pruneTags removes the redundant tags of the given images of a repository,
+// which keep their protected tags, and adds them to the given report. If the
+// given client backs up images, they are backed up first, so that restoring
+// them brings back their pruned tags.
+func pruneTags(t *core.CleanupTask, ecrClient aws.ECRClient, r *core.RepositoryReport, images []*ecr.ImageDetail) error {
+	if len(images) == 0 {
+		return nil
+	}
+
+	if backupClient, ok := ecrClient.(*backup.Client); ok {
+		manifests, err := ecrClient.GetImages(images)
+		if err != nil {
+			return fmt.Errorf("Cannot retrieve manifests to back up before pruning tags from repo '%s': %v", r.Name, err)
+		}
+
+		if err = backupClient.BackUpImages(images, manifests); err != nil {
+			return fmt.Errorf("Cannot back up images before pruning tags from repo '%s': %v", r.Name, err)
+		}
+	}
+
+	tags := []*string{}
+	for _, image := range images {
+		tags = append(tags, RedundantTags(t, image)...)
+	}
+
+	for start := 0; start < len(tags); start += aws.BatchRemoveMaxImages {
+		end := start + aws.BatchRemoveMaxImages
+		if end > len(tags) {
+			end = len(tags)
+		}
+
+		glog.Infof("Removing %d redundant tags.", end-start)
+		if err := ecrClient.BatchRemoveTags(images[0].RepositoryName, images[0].RegistryId, tags[start:end]); err != nil {
+			return fmt.Errorf("Could not batch remove tags from repo '%s': %v", r.Name, err)
+		}
+	}
+
+	r.PrunedTags = append(r.PrunedTags, PrunedTagRecords(t, images)...)
+	return nil
+}
@@ -0,0 +1,280 @@
+package processor
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/backup"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/state"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestRedundantTags(t *testing.T) {
+	keep := "^v"
+	task := &core.CleanupTask{
+		KeepFilters: []*string{&keep},
+	}
+
+	image := newTestImage("sha256:a1", "v1.4.2", "build-123", "latest")
+
+	tags := []string{}
+	for _, tag := range RedundantTags(task, image) {
+		tags = append(tags, *tag)
+	}
+
+	if !reflect.DeepEqual(tags, []string{"build-123"}) {
+		t.Errorf("Expected redundant tags to be [build-123], but was %v", tags)
+	}
+}
+
+func TestRemoveOldImagesWithPruneTags(t *testing.T) {
+	namespace, repoName, keep := "namespace", "repo", "^v"
+
+	testCases := []struct {
+		pruneTags           bool
+		dryRun              bool
+		expectedRemovedTags []string
+		expectedPrunedTags  []string
+	}{
+		{false, false, nil, nil},
+		{true, false, []string{"build-1"}, []string{"build-1"}},
+		{true, true, nil, []string{"build-1"}},
+	}
+
+	for i, testCase := range testCases {
+		pushedAt := []time.Time{time.Unix(0, 0), time.Unix(1, 0), time.Unix(2, 0)}
+
+		// Kept by the keep filter, along with its redundant tag
+		release := newTestImage("sha256:a1", "v1", "build-1")
+		release.ImagePushedAt = &pushedAt[0]
+
+		// Only protected tags
+		protected := newTestImage("sha256:b2", "v2")
+		protected.ImagePushedAt = &pushedAt[1]
+
+		// No protected tags
+		unprotected := newTestImage("sha256:c3", "build-3")
+		unprotected.ImagePushedAt = &pushedAt[2]
+
+		expectedImagesToRemove := []*ecr.ImageDetail{unprotected}
+		if testCase.dryRun {
+			expectedImagesToRemove = nil
+		}
+
+		kubeClient := &mockKubeClient{
+			t: t,
+
+			expectedNamespace: []string{namespace},
+			listAllPodsResult: []*apiv1.Pod{{}},
+		}
+
+		ecrClient := &mockECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			listRepositoriesResult: []*ecr.Repository{
+				{
+					RepositoryName: &repoName,
+				},
+			},
+
+			expectedImagesRepositoryName: repoName,
+			listImagesResult:             []*ecr.ImageDetail{release, protected, unprotected},
+			expectedImagesToRemove:       expectedImagesToRemove,
+		}
+
+		task := &core.CleanupTask{
+			KubeNamespaces:  []*string{&namespace},
+			EcrRepositories: []*string{&repoName},
+			KeepFilters:     []*string{&keep},
+			PruneTags:       testCase.pruneTags,
+			DryRun:          testCase.dryRun,
+
+			// Would cause all images to be deleted
+			MaxImages: 0,
+		}
+
+		report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+		if len(errs) != 0 {
+			t.Errorf("Expected errors to be empty in test case %d, but is %q", i, errs)
+		}
+
+		if !reflect.DeepEqual(ecrClient.removedTags, testCase.expectedRemovedTags) {
+			t.Errorf("Expected removed tags to be %v in test case %d, but was %v", testCase.expectedRemovedTags, i, ecrClient.removedTags)
+		}
+
+		var prunedTags []string
+		for _, record := range report.Repositories[0].PrunedTags {
+			if record.Digest != "sha256:a1" {
+				t.Errorf("Expected only image 'sha256:a1' to have its tags pruned in test case %d, but was '%s'", i, record.Digest)
+			}
+			prunedTags = append(prunedTags, record.Tags...)
+		}
+
+		if !reflect.DeepEqual(prunedTags, testCase.expectedPrunedTags) {
+			t.Errorf("Expected pruned tags to be %v in test case %d, but was %v", testCase.expectedPrunedTags, i, prunedTags)
+		}
+
+		if deleted := report.Repositories[0].Deleted; len(deleted) != 1 || deleted[0].Digest != "sha256:c3" {
+			t.Errorf("Expected only image 'sha256:c3' to be deleted in test case %d, but was %+v", i, deleted)
+		}
+	}
+}
+
+func TestRemoveOldImagesWithPruneTagsSafeguards(t *testing.T) {
+	namespace, repoName, keep := "namespace", "repo", "^v"
+
+	testCases := []struct {
+		gracePeriod         time.Duration
+		markedAt            time.Duration
+		vetoes              string
+		maxDeleteRatio      float64
+		approvalThreshold   int
+		expectedRemoveCalls [][]string
+		expectedRemovedTags []string
+		expectedErrors      int
+	}{
+		// Not marked for long enough
+		{time.Hour, 0, "", 0, 0, [][]string{}, nil, 0},
+
+		// Marked for longer than the grace period
+		{time.Hour, 2 * time.Hour, "", 0, 0, [][]string{{"sha256:c3"}}, []string{"build-1"}, 0},
+
+		// Vetoed tag pruning
+		{0, 0, "sha256:a1", 0, 0, [][]string{{"sha256:c3"}}, nil, 0},
+
+		// Pruning tags counts toward the safety brake
+		{0, 0, "", 0.5, 0, [][]string{}, nil, 1},
+
+		// Pruning tags counts toward the approval threshold
+		{0, 0, "", 0, 1, [][]string{}, nil, 0},
+	}
+
+	for i, testCase := range testCases {
+		pushedAt := []time.Time{time.Unix(0, 0), time.Unix(1, 0), time.Unix(2, 0)}
+
+		release := newTestImage("sha256:a1", "v1", "build-1")
+		release.ImagePushedAt = &pushedAt[0]
+
+		protected := newTestImage("sha256:b2", "v2")
+		protected.ImagePushedAt = &pushedAt[1]
+
+		unprotected := newTestImage("sha256:c3", "build-3")
+		unprotected.ImagePushedAt = &pushedAt[2]
+
+		kubeClient := &mockKubeClient{
+			t: t,
+
+			expectedNamespace: []string{namespace},
+			listAllPodsResult: []*apiv1.Pod{{}},
+		}
+
+		ecrClient := &mockECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			listRepositoriesResult: []*ecr.Repository{
+				{
+					RepositoryName: &repoName,
+				},
+			},
+
+			expectedImagesRepositoryName: repoName,
+			listImagesResult:             []*ecr.ImageDetail{release, protected, unprotected},
+			expectedRemoveCalls:          testCase.expectedRemoveCalls,
+		}
+
+		store := &mockStore{state: state.New()}
+		if testCase.markedAt > 0 {
+			store.state.Mark(repoName, []string{"sha256:c3", "prune-tags/sha256:a1"}, time.Now().Add(-testCase.markedAt))
+		}
+
+		task := &core.CleanupTask{
+			KubeNamespaces:    []*string{&namespace},
+			EcrRepositories:   []*string{&repoName},
+			KeepFilters:       []*string{&keep},
+			PruneTags:         true,
+			GracePeriod:       testCase.gracePeriod,
+			MaxDeleteRatio:    testCase.maxDeleteRatio,
+			ApprovalThreshold: testCase.approvalThreshold,
+		}
+
+		server := newTestVetoHook(http.StatusOK, `{"vetoes": [{"digest": "`+testCase.vetoes+`"}]}`)
+		if testCase.vetoes != "" {
+			task.VetoHook = server.URL
+			task.VetoHookTimeout = time.Second
+		}
+
+		_, errs := RemoveOldImages(task, kubeClient, ecrClient, store, &mockApprover{})
+		server.Close()
+
+		if len(errs) != testCase.expectedErrors {
+			t.Errorf("Expected %d errors in test case %d, but was %q", testCase.expectedErrors, i, errs)
+		}
+
+		if !reflect.DeepEqual(ecrClient.removedTags, testCase.expectedRemovedTags) {
+			t.Errorf("Expected removed tags to be %v in test case %d, but was %v", testCase.expectedRemovedTags, i, ecrClient.removedTags)
+		}
+
+		if ecrClient.removeCalls != len(testCase.expectedRemoveCalls) {
+			t.Errorf("Expected images to be removed %d times in test case %d, but was %d times", len(testCase.expectedRemoveCalls), i, ecrClient.removeCalls)
+		}
+	}
+}
+
+func TestRemoveOldImagesWithPruneTagsBacksUpImages(t *testing.T) {
+	namespace, repoName, keep := "namespace", "repo", "^v"
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*apiv1.Pod{{}},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             []*ecr.ImageDetail{newTestImage("sha256:a1", "v1", "build-1")},
+	}
+
+	task := &core.CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		KeepFilters:     []*string{&keep},
+		PruneTags:       true,
+	}
+
+	store := backup.NewDirStore(t.TempDir())
+
+	if _, errs := RemoveOldImages(task, kubeClient, backup.NewClient(ecrClient, store), nil, nil); len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	if !reflect.DeepEqual(ecrClient.removedTags, []string{"build-1"}) {
+		t.Errorf("Expected removed tags to be [build-1], but was %v", ecrClient.removedTags)
+	}
+
+	// Restoring the image brings back its pruned tags
+	b, err := store.Load(repoName, "sha256:a1")
+	if err != nil {
+		t.Fatalf("Expected image to be backed up, but got error: %v", err)
+	}
+
+	if !reflect.DeepEqual(b.Tags, []string{"v1", "build-1"}) {
+		t.Errorf("Expected backed up tags to be [v1 build-1], but was %v", b.Tags)
+	}
+}
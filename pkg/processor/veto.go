@@ -0,0 +1,102 @@
+package processor
+
+import (
+	"fmt"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/hook"
+	"github.com/golang/glog"
+)
+
+// NewVetoHook returns the hook that may veto the removal of images, or nil if
+// the task does not set one.
+func NewVetoHook(t *core.CleanupTask) core.VetoHook {
+	if t.VetoHook == "" {
+		return nil
+	}
+
+	return hook.NewHook(t.VetoHook, t.VetoHookTimeout)
+}
+
+// VetoImages sends the images selected for removal from a repository, and
+// the ones whose redundant tags are about to be pruned, to the given hook, if
+// any. It keeps the images whose removal it vetoes, along with the images and
+// artifacts that were only removed along with them, and the tags of the
+// images whose pruning it vetoes. If the hook fails, an error is returned,
+// and no images or tags should be removed. The review tells the hook whether
+// the images are only going to be removed if not dry-run, so commands that
+// never remove images, such as plan and explain, always send dry-run reviews.
+func VetoImages(t *core.CleanupTask, h core.VetoHook, repoName string, sel *Selection, dryRun bool) error {
+	if h == nil || len(sel.Removable)+len(sel.Prunable) == 0 {
+		return nil
+	}
+
+	review := core.NewVetoReview(repoName, dryRun, sel.Removable)
+	if len(sel.Prunable) > 0 {
+		review.PrunedTags = PrunedTagRecords(t, sel.Prunable)
+	}
+
+	vetoes, err := h.Veto(review)
+	if err != nil {
+		return fmt.Errorf("Veto hook failed for repo '%s', not removing any images: %v", repoName, err)
+	}
+
+	sel.Vetoes = vetoes
+	if len(vetoes) == 0 {
+		return nil
+	}
+
+	isVetoed := func(image *ecr.ImageDetail) bool {
+		_, ok := vetoes[awssdk.StringValue(image.ImageDigest)]
+		return ok
+	}
+
+	prunable := []*ecr.ImageDetail{}
+	for _, image := range sel.Prunable {
+		if !isVetoed(image) {
+			prunable = append(prunable, image)
+		}
+	}
+	sel.Prunable = prunable
+
+	removable, children := []*ecr.ImageDetail{}, []*ecr.ImageDetail{}
+	for _, image := range sel.Removable {
+		if !isVetoed(image) && !sel.Graph.IsChild(image) {
+			removable = append(removable, image)
+		}
+	}
+	for _, child := range sel.Children {
+		if !isVetoed(child) {
+			children = append(children, child)
+		}
+	}
+
+	sel.Removable = append(removable, sel.Graph.OrphanedChildren(removable, children)...)
+	glog.Infof("Number of images after veto hook: %d", len(sel.Removable))
+
+	return nil
+}
+
+// VetoedImages returns the digests of the given images, about to be removed
+// from a repository, whose removal the given hook, if any, vetoes.
+func VetoedImages(t *core.CleanupTask, h core.VetoHook, repoName string, images []*ecr.ImageDetail) ([]string, error) {
+	vetoed := []string{}
+	if h == nil || len(images) == 0 {
+		return vetoed, nil
+	}
+
+	vetoes, err := h.Veto(core.NewVetoReview(repoName, t.DryRun, images))
+	if err != nil {
+		return nil, fmt.Errorf("Veto hook failed for repo '%s', not removing any images: %v", repoName, err)
+	}
+
+	for _, image := range images {
+		if _, ok := vetoes[awssdk.StringValue(image.ImageDigest)]; ok {
+			vetoed = append(vetoed, *image.ImageDigest)
+		}
+	}
+
+	return vetoed, nil
+}
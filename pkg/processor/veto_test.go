@@ -0,0 +1,229 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+)
+
+// newTestVetoHook returns a webhook server that responds with the given
+// status and body, which must be closed once done.
+func newTestVetoHook(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestReadOnlyCommandsSendDryRunReviews(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+
+	for _, command := range []string{"plan", "explain"} {
+		kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:v2",
+			[]string{"sha256:a1", "sha256:a2"}, []string{"v1", "v2"})
+
+		reviews := []*core.VetoReview{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			review := &core.VetoReview{}
+			if err := json.NewDecoder(r.Body).Decode(review); err == nil {
+				reviews = append(reviews, review)
+			}
+			fmt.Fprint(w, `{"vetoes": []}`)
+		}))
+
+		task := &core.CleanupTask{
+			KubeNamespaces:  []*string{&namespace},
+			EcrRepositories: []*string{&repoName},
+			VetoHook:        server.URL,
+			VetoHookTimeout: time.Second,
+			DryRun:          false,
+		}
+
+		if command == "plan" {
+			PlanRemoval(task, kubeClient, ecrClient, nil)
+		} else {
+			ExplainImages(task, kubeClient, ecrClient, nil, repoName)
+		}
+		server.Close()
+
+		if len(reviews) != 1 || !reviews[0].DryRun {
+			t.Errorf("Expected %s to send a single dry-run review, but was %+v", command, reviews)
+		}
+	}
+}
+
+func TestRemoveOldImagesWithVetoHook(t *testing.T) {
+	testCases := []struct {
+		status              int
+		body                string
+		expectedRemoveCalls [][]string
+		expectedErrors      int
+	}{
+		// Vetoes the oldest image
+		{http.StatusOK, `{"vetoes": [{"digest": "sha256:a1", "reason": "deployed"}]}`, [][]string{{"sha256:a2"}}, 0},
+
+		// No vetoes
+		{http.StatusOK, `{"vetoes": []}`, [][]string{{"sha256:a1", "sha256:a2"}}, 0},
+
+		// Fails closed
+		{http.StatusServiceUnavailable, ``, nil, 1},
+	}
+
+	for i, testCase := range testCases {
+		namespace, repoName := "namespace", "repo"
+
+		kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:v4",
+			[]string{"sha256:a1", "sha256:a2", "sha256:a3", "sha256:a4"},
+			[]string{"v1", "v2", "v3", "v4"})
+
+		ecrClient.expectedRemoveCalls = testCase.expectedRemoveCalls
+
+		server := newTestVetoHook(testCase.status, testCase.body)
+
+		task := &core.CleanupTask{
+			KubeNamespaces:  []*string{&namespace},
+			EcrRepositories: []*string{&repoName},
+			MaxImages:       2,
+			VetoHook:        server.URL,
+			VetoHookTimeout: time.Second,
+		}
+
+		_, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+		server.Close()
+
+		if len(errs) != testCase.expectedErrors {
+			t.Errorf("Expected %d errors in test case %d, but was %q", testCase.expectedErrors, i, errs)
+		}
+
+		if ecrClient.removeCalls != len(testCase.expectedRemoveCalls) {
+			t.Errorf("Expected images to be removed %d times in test case %d, but was %d times", len(testCase.expectedRemoveCalls), i, ecrClient.removeCalls)
+		}
+	}
+}
+
+func TestApplyPlanWithImageNowVetoed(t *testing.T) {
+	namespace := "namespace"
+	digests := []string{"digest-1", "digest-2"}
+	tags := []string{"tag-1", "tag-2"}
+
+	kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:tag-1", digests, tags)
+
+	// No images must be removed
+	ecrClient.expectedImagesToRemove = []*ecr.ImageDetail{}
+
+	plan := core.NewPlan(nil)
+	plan.Repositories = append(plan.Repositories, &core.RepositoryPlan{
+		Name: "repo",
+		Images: []*core.PlannedImage{
+			{ImageRecord: core.ImageRecord{Digest: digests[1]}},
+		},
+	})
+
+	server := newTestVetoHook(http.StatusOK, `{"vetoes": [{"digest": "digest-2"}]}`)
+	defer server.Close()
+
+	task := &core.CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		VetoHook:        server.URL,
+		VetoHookTimeout: time.Second,
+	}
+
+	report, errs := ApplyPlan(task, kubeClient, ecrClient, nil, plan)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+
+	if len(report.Repositories[0].Deleted) != 0 {
+		t.Errorf("Expected no images to be deleted, but was %+v", report.Repositories[0].Deleted)
+	}
+}
+
+func TestRemoveOldImagesWithVetoedQuarantinedImages(t *testing.T) {
+	testCases := []struct {
+		status              int
+		body                string
+		expectedRemoveCalls [][]string
+		expectedKept        int
+		expectedErrors      int
+	}{
+		// Vetoes one of the expired images
+		{http.StatusOK, `{"vetoes": [{"digest": "sha256:e1", "reason": "deployed"}]}`, [][]string{{"sha256:e2"}}, 1, 0},
+
+		// No vetoes
+		{http.StatusOK, `{"vetoes": []}`, [][]string{{"sha256:e1", "sha256:e2"}}, 0, 0},
+
+		// Fails closed
+		{http.StatusServiceUnavailable, ``, nil, 2, 1},
+	}
+
+	for i, testCase := range testCases {
+		namespace, repoName := "namespace", "repo"
+
+		kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:v1",
+			[]string{"sha256:a1", "sha256:e1", "sha256:e2"},
+			[]string{"v1", "quarantine-20200101-e1", "quarantine-20200101-e2"})
+
+		ecrClient.expectedRemoveCalls = testCase.expectedRemoveCalls
+
+		server := newTestVetoHook(testCase.status, testCase.body)
+
+		task := &core.CleanupTask{
+			KubeNamespaces:   []*string{&namespace},
+			EcrRepositories:  []*string{&repoName},
+			MaxImages:        1,
+			QuarantinePeriod: 24 * time.Hour,
+			VetoHook:         server.URL,
+			VetoHookTimeout:  time.Second,
+		}
+
+		report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+		server.Close()
+
+		if len(errs) != testCase.expectedErrors {
+			t.Errorf("Expected %d errors in test case %d, but was %q", testCase.expectedErrors, i, errs)
+		}
+
+		if ecrClient.removeCalls != len(testCase.expectedRemoveCalls) {
+			t.Errorf("Expected images to be removed %d times in test case %d, but was %d times", len(testCase.expectedRemoveCalls), i, ecrClient.removeCalls)
+		}
+
+		if kept := len(report.Repositories[0].KeptByPolicy); kept != testCase.expectedKept {
+			t.Errorf("Expected %d images to be kept by policy in test case %d, but was %d", testCase.expectedKept, i, kept)
+		}
+	}
+}
+
+func TestExplainImageWithVeto(t *testing.T) {
+	image := newTestImage("sha256:a1", "v1")
+
+	sel := &Selection{
+		Images:     []*ecr.ImageDetail{image},
+		Candidates: []*ecr.ImageDetail{image},
+		Filtered:   []*ecr.ImageDetail{image},
+		Vetoes: map[string]string{
+			"sha256:a1": "deployed",
+		},
+	}
+
+	decision := ExplainImage(&core.CleanupTask{}, sel, nil, nil, nil, image, time.Now())
+
+	if decision.Delete {
+		t.Errorf("Expected image not to be deleted")
+	}
+
+	rules := map[string]string{}
+	for _, rule := range decision.Rules {
+		rules[rule.Rule] = rule.Detail
+	}
+
+	if detail := rules["veto-hook"]; detail != "vetoed by hook: deployed" {
+		t.Errorf("Expected veto-hook rule to hold the reason, but was '%s'", detail)
+	}
+}
@@ -0,0 +1,51 @@
+package processor
+
+import (
+	"sort"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+)
+
+// SortImagesByVulnerability sorts the given images in the given order, except
+// that images with findings of the given severity, or of a more severe one,
+// go before the others.
+func SortImagesByVulnerability(ordering aws.ImageOrdering, images []*ecr.ImageDetail, findings map[string]map[string]int64, severity string) {
+	ordering.Sort(images)
+
+	sort.SliceStable(images, func(i, j int) bool {
+		return isVulnerable(images[i], findings, severity) && !isVulnerable(images[j], findings, severity)
+	})
+}
+
+// ExcessVulnerableImages returns the unused images with findings of the given
+// severity, or of a more severe one, that come first in the given order, so
+// that no more than the given number of them is kept, given the candidates
+// already being removed.
+func ExcessVulnerableImages(ordering aws.ImageOrdering, images, candidates []*ecr.ImageDetail, tagsInUse []string, findings map[string]map[string]int64, severity string, keepMax int) []*ecr.ImageDetail {
+	isCandidate := imageSet(candidates)
+	inUse := tagSet(tagsInUse)
+	vulnerable := []*ecr.ImageDetail{}
+
+	for _, image := range images {
+		if isCandidate[image] || hasTag(image, "latest") || isInUse(image, inUse) {
+			continue
+		}
+
+		if isVulnerable(image, findings, severity) {
+			vulnerable = append(vulnerable, image)
+		}
+	}
+
+	if len(vulnerable) <= keepMax {
+		return []*ecr.ImageDetail{}
+	}
+
+	ordering.Sort(vulnerable)
+	return vulnerable[:len(vulnerable)-keepMax]
+}
+
+func isVulnerable(image *ecr.ImageDetail, findings map[string]map[string]int64, severity string) bool {
+	return aws.IsVulnerable(findings[awssdk.StringValue(image.ImageDigest)], severity)
+}
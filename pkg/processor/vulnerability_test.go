@@ -0,0 +1,180 @@
+package processor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/core"
+)
+
+func withScanFindings(image *ecr.ImageDetail, counts map[string]int64) {
+	summary := &ecr.ImageScanFindingsSummary{
+		FindingSeverityCounts: map[string]*int64{},
+	}
+
+	for severity, count := range counts {
+		summary.FindingSeverityCounts[severity] = awssdk.Int64(count)
+	}
+
+	image.ImageScanFindingsSummary = summary
+}
+
+func TestRemoveOldImagesWithVulnerableFirst(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+
+	kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:v5",
+		[]string{"sha256:a1", "sha256:a2", "sha256:a3", "sha256:a4", "sha256:a5"},
+		[]string{"v1", "v2", "v3", "v4", "v5"})
+
+	withScanFindings(ecrClient.listImagesResult[2], map[string]int64{"CRITICAL": 1})
+
+	// Scanned, but their findings are not included in their details, which
+	// are only retrieved for images that are not in use
+	for _, i := range []int{3, 4} {
+		ecrClient.listImagesResult[i].ImageScanStatus = &ecr.ImageScanStatus{
+			Status: awssdk.String(ecr.ScanStatusComplete),
+		}
+	}
+	ecrClient.findings = map[string]map[string]int64{
+		"sha256:a4": {"HIGH": 2},
+		"sha256:a5": {"HIGH": 1},
+	}
+
+	ecrClient.expectedRemoveCalls = [][]string{{"sha256:a3", "sha256:a1"}}
+
+	task := &core.CleanupTask{
+		KubeNamespaces:        []*string{&namespace},
+		EcrRepositories:       []*string{&repoName},
+		VulnerableSeverity:    "CRITICAL",
+		RemoveVulnerableFirst: true,
+		MaxImages:             3,
+	}
+
+	_, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	if ecrClient.removeCalls != 1 {
+		t.Errorf("Expected images to be removed once, but was %d times", ecrClient.removeCalls)
+	}
+
+	if expected := []string{"sha256:a4"}; !reflect.DeepEqual(ecrClient.findingsDigests, expected) {
+		t.Errorf("Expected findings of %v to be retrieved, but was %v", expected, ecrClient.findingsDigests)
+	}
+}
+
+func TestRemoveOldImagesWithMaxVulnerableImages(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+
+	kubeClient, ecrClient := newPlanTestClients(t, "id.dkr.ecr.region.amazonaws.com/repo:v5",
+		[]string{"sha256:a1", "sha256:a2", "sha256:a3", "sha256:a4", "sha256:a5"},
+		[]string{"v1", "v2", "v3", "v4", "v5"})
+
+	for _, i := range []int{0, 1, 2, 4} {
+		withScanFindings(ecrClient.listImagesResult[i], map[string]int64{"HIGH": 1})
+	}
+
+	ecrClient.expectedRemoveCalls = [][]string{{"sha256:a1", "sha256:a2"}}
+
+	task := &core.CleanupTask{
+		KubeNamespaces:      []*string{&namespace},
+		EcrRepositories:     []*string{&repoName},
+		VulnerableSeverity:  "HIGH",
+		MaxVulnerableImages: 1,
+		MaxImages:           10,
+	}
+
+	report, errs := RemoveOldImages(task, kubeClient, ecrClient, nil, nil)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	if deleted := report.Repositories[0].Deleted; len(deleted) != 2 {
+		t.Errorf("Expected 2 images to be deleted, but was %+v", deleted)
+	}
+}
+
+func TestSortImagesByVulnerability(t *testing.T) {
+	images := []*ecr.ImageDetail{
+		newTestImage("sha256:a1"),
+		newTestImage("sha256:a2"),
+		newTestImage("sha256:a3"),
+	}
+
+	for i := range images {
+		pushedAt := time.Unix(int64(i), 0)
+		images[i].ImagePushedAt = &pushedAt
+	}
+
+	findings := map[string]map[string]int64{
+		"sha256:a2": {"LOW": 1},
+		"sha256:a3": {"CRITICAL": 1},
+	}
+
+	testCases := []struct {
+		severity string
+		expected []string
+	}{
+		{"CRITICAL", []string{"sha256:a3", "sha256:a1", "sha256:a2"}},
+		{"LOW", []string{"sha256:a2", "sha256:a3", "sha256:a1"}},
+	}
+
+	for _, testCase := range testCases {
+		SortImagesByVulnerability(&aws.PushDateOrdering{}, images, findings, testCase.severity)
+
+		digests := []string{}
+		for _, image := range images {
+			digests = append(digests, *image.ImageDigest)
+		}
+
+		if !reflect.DeepEqual(digests, testCase.expected) {
+			t.Errorf("Expected images sorted at severity '%s' to be %v, but was %v", testCase.severity, testCase.expected, digests)
+		}
+	}
+}
+
+func TestExplainImageWithExcessVulnerable(t *testing.T) {
+	image := newTestImage("sha256:a1", "v1")
+
+	sel := &Selection{
+		Images:           []*ecr.ImageDetail{image},
+		Candidates:       []*ecr.ImageDetail{image},
+		Filtered:         []*ecr.ImageDetail{image},
+		Removable:        []*ecr.ImageDetail{image},
+		ExcessVulnerable: []*ecr.ImageDetail{image},
+		Findings: map[string]map[string]int64{
+			"sha256:a1": {"CRITICAL": 2, "HIGH": 1},
+		},
+	}
+
+	task := &core.CleanupTask{
+		VulnerableSeverity:  "CRITICAL",
+		MaxVulnerableImages: 1,
+	}
+
+	decision := ExplainImage(task, sel, nil, nil, nil, image, time.Now())
+
+	if !decision.Delete {
+		t.Errorf("Expected image to be deleted")
+	}
+
+	rules := map[string]string{}
+	for _, rule := range decision.Rules {
+		rules[rule.Rule] = rule.Detail
+	}
+
+	if detail := rules["vulnerability"]; detail != "scan findings: 2 CRITICAL, 1 HIGH" {
+		t.Errorf("Expected vulnerability rule to list the findings, but was '%s'", detail)
+	}
+
+	if _, ok := rules["max-vulnerable-images"]; !ok {
+		t.Errorf("Expected decision to contain the max-vulnerable-images rule, but was %+v", decision.Rules)
+	}
+}
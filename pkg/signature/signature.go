@@ -0,0 +1,299 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/golang/glog"
+)
+
+// Annotations set by cosign on the layers of signature manifests.
+const (
+	SignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	CertificateAnnotation = "dev.sigstore.cosign/certificate"
+	ChainAnnotation       = "dev.sigstore.cosign/chain"
+)
+
+// Verifier checks cosign signatures stored in ECR repositories against
+// trusted public keys, or against certificates issued to trusted identities.
+type Verifier struct {
+	Keys []crypto.PublicKey
+
+	// Identities, such as emails or URIs, whose certificates are trusted
+	// when issued by one of the roots.
+	Identities []string
+	Roots      *x509.CertPool
+}
+
+// manifest holds the parts of a signature manifest needed to verify it.
+type manifest struct {
+	Layers []struct {
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+}
+
+// payload holds the parts of a cosign simple signing payload needed to verify
+// it.
+type payload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// NewVerifier returns a verifier that trusts the public keys stored in the
+// given PEM files, and the given identities, whose certificates must be
+// issued by the roots in the given PEM file.
+func NewVerifier(keyFiles []*string, identities []*string, rootsFile string) (*Verifier, error) {
+	v := &Verifier{
+		Keys:       []crypto.PublicKey{},
+		Identities: awssdk.StringValueSlice(identities),
+	}
+
+	for _, keyFile := range keyFiles {
+		key, err := LoadPublicKey(*keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load public key '%s': %v", *keyFile, err)
+		}
+		v.Keys = append(v.Keys, key)
+	}
+
+	if len(v.Identities) > 0 {
+		if rootsFile == "" {
+			return nil, fmt.Errorf("Cannot trust identities without the roots that issue their certificates")
+		}
+
+		data, err := ioutil.ReadFile(rootsFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read roots: %v", err)
+		}
+
+		v.Roots = x509.NewCertPool()
+		if !v.Roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in roots file '%s'", rootsFile)
+		}
+	}
+
+	return v, nil
+}
+
+// LoadPublicKey reads a PEM-encoded public key, such as the ones generated by
+// `cosign generate-key-pair`.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found")
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// SignedImages returns the digests of the given images, all stored in the
+// same repository, that have at least one valid signature. Signatures are
+// found among the artifacts of each image in the given graph.
+func (v *Verifier) SignedImages(ecrClient aws.ECRClient, graph *aws.ImageGraph, images []*ecr.ImageDetail) (map[string]bool, error) {
+	signed := map[string]bool{}
+	if v == nil || graph == nil {
+		return signed, nil
+	}
+
+	signatures := []*ecr.ImageDetail{}
+	for _, image := range images {
+		subject, ok := graph.Subject(image)
+		if ok && graph.Exists(subject) && isSignature(image) {
+			signatures = append(signatures, image)
+		}
+	}
+
+	for start := 0; start < len(signatures); start += aws.BatchRemoveMaxImages {
+		end := start + aws.BatchRemoveMaxImages
+		if end > len(signatures) {
+			end = len(signatures)
+		}
+
+		manifests, err := ecrClient.GetImages(signatures[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("Cannot retrieve signatures: %v", err)
+		}
+
+		for _, image := range manifests {
+			if image.ImageId == nil {
+				continue
+			}
+
+			digest := awssdk.StringValue(image.ImageId.ImageDigest)
+			subject := graph.Subjects[digest]
+			if signed[subject] {
+				continue
+			}
+
+			ok, err := v.verifyManifest(ecrClient, image, subject)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot verify signature '%s': %v", digest, err)
+			}
+
+			signed[subject] = ok
+		}
+	}
+
+	return signed, nil
+}
+
+// verifyManifest returns whether any of the signatures in the given signature
+// manifest is a valid signature of the given subject.
+func (v *Verifier) verifyManifest(ecrClient aws.ECRClient, image *ecr.Image, subject string) (bool, error) {
+	m := &manifest{}
+	if err := json.Unmarshal([]byte(awssdk.StringValue(image.ImageManifest)), m); err != nil {
+		return false, err
+	}
+
+	for _, layer := range m.Layers {
+		sig, ok := layer.Annotations[SignatureAnnotation]
+		if !ok {
+			continue
+		}
+
+		data, err := ecrClient.GetLayer(image.RepositoryName, image.RegistryId, layer.Digest)
+		if err != nil {
+			return false, err
+		}
+
+		if err = v.Verify(data, sig, layer.Annotations[CertificateAnnotation], layer.Annotations[ChainAnnotation], subject); err != nil {
+			glog.V(4).Infof("Signature '%s' of image '%s' is not trusted: %v", layer.Digest, subject, err)
+			continue
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Verify checks whether the given base64-encoded signature of the given
+// payload is valid, and whether the payload refers to the given subject.
+// If a PEM-encoded certificate is given, the signature is checked against
+// it instead of the trusted keys.
+func (v *Verifier) Verify(data []byte, sig, cert, chain, subject string) error {
+	p := &payload{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return fmt.Errorf("Cannot parse payload: %v", err)
+	}
+
+	if p.Critical.Image.DockerManifestDigest != subject {
+		return fmt.Errorf("Payload refers to image '%s'", p.Critical.Image.DockerManifestDigest)
+	}
+
+	rawSig, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("Cannot decode signature: %v", err)
+	}
+
+	keys := v.Keys
+	if cert != "" {
+		key, err := v.verifyCertificate(cert, chain)
+		if err != nil {
+			return err
+		}
+		keys = []crypto.PublicKey{key}
+	}
+
+	for _, key := range keys {
+		if verifySignature(key, data, rawSig) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Signature does not match any trusted key")
+}
+
+// verifyCertificate checks whether the given certificate was issued to one
+// of the trusted identities by one of the roots, and returns its public key.
+// Since such certificates are short-lived, it is checked as of the time it
+// was issued.
+func (v *Verifier) verifyCertificate(certPEM, chainPEM string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse certificate: %v", err)
+	}
+
+	if v.Roots == nil {
+		return nil, fmt.Errorf("No roots to verify certificate against")
+	}
+
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM([]byte(chainPEM))
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   cert.NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot verify certificate: %v", err)
+	}
+
+	names := cert.EmailAddresses
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, identity := range v.Identities {
+		for _, name := range names {
+			if name == identity {
+				return cert.PublicKey, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("Certificate issued to untrusted identities '%s'", strings.Join(names, "', '"))
+}
+
+func verifySignature(key crypto.PublicKey, data, sig []byte) bool {
+	digest := sha256.Sum256(data)
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, data, sig)
+	}
+
+	return false
+}
+
+func isSignature(image *ecr.ImageDetail) bool {
+	for _, tag := range image.ImageTags {
+		if strings.HasSuffix(*tag, ".sig") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,364 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+)
+
+// mockECRClient serves signature manifests and payloads from memory.
+type mockECRClient struct {
+	manifests map[string]string
+	layers    map[string][]byte
+}
+
+func (m *mockECRClient) ListRepositories(repositoryNames []*string, registryID *string) ([]*ecr.Repository, error) {
+	return nil, nil
+}
+
+func (m *mockECRClient) ListImages(repositoryName *string, registryID *string) ([]*ecr.ImageDetail, error) {
+	return nil, nil
+}
+
+func (m *mockECRClient) GetImages(images []*ecr.ImageDetail) ([]*ecr.Image, error) {
+	manifests := []*ecr.Image{}
+	for _, image := range images {
+		manifest := m.manifests[*image.ImageDigest]
+		manifests = append(manifests, &ecr.Image{
+			RepositoryName: image.RepositoryName,
+			ImageId: &ecr.ImageIdentifier{
+				ImageDigest: image.ImageDigest,
+			},
+			ImageManifest: &manifest,
+		})
+	}
+	return manifests, nil
+}
+
+func (m *mockECRClient) PutImage(image *ecr.Image) error {
+	return nil
+}
+
+func (m *mockECRClient) GetLayer(repositoryName *string, registryID *string, digest string) ([]byte, error) {
+	layer, ok := m.layers[digest]
+	if !ok {
+		return nil, fmt.Errorf("layer '%s' not found", digest)
+	}
+	return layer, nil
+}
+
+func (m *mockECRClient) GetImageMetadata(images []*ecr.ImageDetail) (map[string]*aws.ImageMetadata, error) {
+	return nil, nil
+}
+
+func (m *mockECRClient) GetScanFindings(image *ecr.ImageDetail) (map[string]int64, error) {
+	return nil, nil
+}
+
+func (m *mockECRClient) LastPullTime(image *ecr.ImageDetail) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (m *mockECRClient) BatchRemoveTags(repositoryName *string, registryID *string, tags []*string) error {
+	return nil
+}
+
+func (m *mockECRClient) BatchRemoveImages(images []*ecr.ImageDetail) error {
+	return nil
+}
+
+func newTestPayload(subject string) []byte {
+	return []byte(fmt.Sprintf(`{"critical": {"identity": {"docker-reference": "repo"}, "image": {"docker-manifest-digest": "%s"}, "type": "cosign container image signature"}, "optional": null}`, subject))
+}
+
+func signECDSA(t *testing.T, key *ecdsa.PrivateKey, data []byte) string {
+	digest := sha256.Sum256(data)
+
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("Cannot sign payload: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func writePEM(t *testing.T, dir, name, blockType string, data []byte) string {
+	path := filepath.Join(dir, name)
+
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600); err != nil {
+		t.Fatalf("Cannot write %s: %v", name, err)
+	}
+
+	return path
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate key: %v", err)
+	}
+	return key
+}
+
+func TestLoadPublicKey(t *testing.T) {
+	dir := t.TempDir()
+
+	der, _ := x509.MarshalPKIXPublicKey(&newTestKey(t).PublicKey)
+	keyFile := writePEM(t, dir, "cosign.pub", "PUBLIC KEY", der)
+
+	invalidFile := filepath.Join(dir, "invalid.pub")
+	ioutil.WriteFile(invalidFile, []byte("not a key"), 0600)
+
+	testCases := []struct {
+		path          string
+		expectedError bool
+	}{
+		{keyFile, false},
+		{invalidFile, true},
+		{filepath.Join(dir, "missing.pub"), true},
+	}
+
+	for _, testCase := range testCases {
+		key, err := LoadPublicKey(testCase.path)
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned: %v, but was %v", testCase.expectedError, err)
+		}
+
+		if err == nil {
+			if _, ok := key.(*ecdsa.PublicKey); !ok {
+				t.Errorf("Expected key to be an ECDSA key, but was %T", key)
+			}
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	subject := "sha256:a1"
+	payload := newTestPayload(subject)
+
+	trusted, untrusted := newTestKey(t), newTestKey(t)
+
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := &Verifier{
+		Keys: []crypto.PublicKey{&trusted.PublicKey, edPublic},
+	}
+
+	testCases := []struct {
+		payload       []byte
+		sig           string
+		subject       string
+		expectedError bool
+	}{
+		{payload, signECDSA(t, trusted, payload), subject, false},
+		{payload, base64.StdEncoding.EncodeToString(ed25519.Sign(edPrivate, payload)), subject, false},
+		{payload, signECDSA(t, untrusted, payload), subject, true},
+		{payload, signECDSA(t, trusted, payload), "sha256:a2", true},
+		{payload, "not base64", subject, true},
+		{[]byte("not json"), signECDSA(t, trusted, []byte("not json")), subject, true},
+	}
+
+	for i, testCase := range testCases {
+		err := v.Verify(testCase.payload, testCase.sig, "", "", testCase.subject)
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned in case %d: %v, but was %v", i, testCase.expectedError, err)
+		}
+	}
+}
+
+func TestVerifyWithCertificate(t *testing.T) {
+	subject := "sha256:a1"
+	payload := newTestPayload(subject)
+
+	// Root that issues short-lived certificates, which have already expired
+	rootKey := newTestKey(t)
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := x509.ParseCertificate(rootDER)
+
+	newCert := func(email string) (*ecdsa.PrivateKey, string) {
+		key := newTestKey(t)
+		template := &x509.Certificate{
+			SerialNumber:   big.NewInt(2),
+			NotBefore:      time.Now().Add(-time.Hour),
+			NotAfter:       time.Now().Add(-50 * time.Minute),
+			EmailAddresses: []string{email},
+			KeyUsage:       x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, root, &key.PublicKey, rootKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	v := &Verifier{
+		Identities: []string{"release@example.com"},
+		Roots:      roots,
+	}
+
+	releaseKey, releaseCert := newCert("release@example.com")
+	otherKey, otherCert := newCert("someone@example.com")
+
+	testCases := []struct {
+		sig           string
+		cert          string
+		expectedError bool
+	}{
+		{signECDSA(t, releaseKey, payload), releaseCert, false},
+		{signECDSA(t, otherKey, payload), otherCert, true},
+		{signECDSA(t, otherKey, payload), releaseCert, true},
+		{signECDSA(t, releaseKey, payload), "not a certificate", true},
+	}
+
+	for i, testCase := range testCases {
+		err := v.Verify(payload, testCase.sig, testCase.cert, "", subject)
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned in case %d: %v, but was %v", i, testCase.expectedError, err)
+		}
+	}
+
+	// Certificates are not trusted without roots
+	v.Roots = nil
+	if err := v.Verify(payload, signECDSA(t, releaseKey, payload), releaseCert, "", subject); err == nil {
+		t.Errorf("Expected error to be returned without roots")
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	dir := t.TempDir()
+
+	der, _ := x509.MarshalPKIXPublicKey(&newTestKey(t).PublicKey)
+	keyFile := writePEM(t, dir, "cosign.pub", "PUBLIC KEY", der)
+	missingFile := filepath.Join(dir, "missing.pem")
+	identity := "release@example.com"
+
+	testCases := []struct {
+		keyFiles      []*string
+		identities    []*string
+		rootsFile     string
+		expectedError bool
+	}{
+		{[]*string{&keyFile}, nil, "", false},
+		{[]*string{&missingFile}, nil, "", true},
+		{nil, []*string{&identity}, "", true},
+		{nil, []*string{&identity}, missingFile, true},
+		{nil, []*string{&identity}, keyFile, true},
+	}
+
+	for i, testCase := range testCases {
+		_, err := NewVerifier(testCase.keyFiles, testCase.identities, testCase.rootsFile)
+
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error to be returned in case %d: %v, but was %v", i, testCase.expectedError, err)
+		}
+	}
+}
+
+func TestSignedImages(t *testing.T) {
+	repoName := "repo"
+	key := newTestKey(t)
+
+	newImage := func(digest string, tags ...string) *ecr.ImageDetail {
+		image := &ecr.ImageDetail{
+			RepositoryName: &repoName,
+			ImageDigest:    &digest,
+		}
+		for i := range tags {
+			image.ImageTags = append(image.ImageTags, &tags[i])
+		}
+		return image
+	}
+
+	signedPayload, forgedPayload := newTestPayload("sha256:a1"), newTestPayload("sha256:a2")
+	signedLayer := fmt.Sprintf("sha256:%x", sha256.Sum256(signedPayload))
+	forgedLayer := fmt.Sprintf("sha256:%x", sha256.Sum256(forgedPayload))
+
+	ecrClient := &mockECRClient{
+		manifests: map[string]string{
+			"sha256:c1": fmt.Sprintf(`{"layers": [{"digest": "%s", "annotations": {"%s": "%s"}}]}`, signedLayer, SignatureAnnotation, signECDSA(t, key, signedPayload)),
+			"sha256:c2": fmt.Sprintf(`{"layers": [{"digest": "%s", "annotations": {"%s": "%s"}}]}`, forgedLayer, SignatureAnnotation, signECDSA(t, newTestKey(t), forgedPayload)),
+		},
+		layers: map[string][]byte{
+			signedLayer: signedPayload,
+			forgedLayer: forgedPayload,
+		},
+	}
+
+	images := []*ecr.ImageDetail{
+		newImage("sha256:a1", "v1"),
+		newImage("sha256:a2", "v2"),
+		newImage("sha256:a3", "v3"),
+		newImage("sha256:c1", "sha256-a1.sig"),
+		newImage("sha256:c2", "sha256-a2.sig"),
+
+		// Attestations are not signatures
+		newImage("sha256:c3", "sha256-a3.att"),
+	}
+
+	graph, err := aws.NewImageGraph(ecrClient, images)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	v := &Verifier{
+		Keys: []crypto.PublicKey{&key.PublicKey},
+	}
+
+	signed, err := v.SignedImages(ecrClient, graph, images)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if !signed["sha256:a1"] || signed["sha256:a2"] || signed["sha256:a3"] {
+		t.Errorf("Expected only sha256:a1 to be signed, but was %v", signed)
+	}
+
+	// Missing payloads are errors, so that signed images are not removed
+	delete(ecrClient.layers, signedLayer)
+	if _, err = v.SignedImages(ecrClient, graph, images); err == nil {
+		t.Errorf("Expected error to be returned when payloads are missing")
+	}
+
+	var nilVerifier *Verifier
+	if signed, err = nilVerifier.SignedImages(ecrClient, graph, images); err != nil || len(signed) != 0 {
+		t.Errorf("Expected nil verifier not to find any signed images, but was %v (%v)", signed, err)
+	}
+}
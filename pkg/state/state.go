@@ -0,0 +1,185 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// State holds the data the controller needs to keep between runs.
+type State struct {
+
+	// Images marked for removal, indexed by repository name and image digest,
+	// along with the time in which they were first marked.
+	Marks map[string]map[string]time.Time `json:"marks,omitempty"`
+
+	// Image tags seen in use, indexed by repository name and tag, along with
+	// the last time they were seen in use.
+	History map[string]map[string]time.Time `json:"history,omitempty"`
+}
+
+// Store defines the expected interface of any object capable of persisting
+// the controller state.
+type Store interface {
+	Load() (*State, error)
+	Save(s *State) error
+}
+
+// FileStore persists the controller state as JSON in a local file.
+type FileStore struct {
+	Path string
+}
+
+// New returns an empty State.
+func New() *State {
+	return &State{
+		Marks:   map[string]map[string]time.Time{},
+		History: map[string]map[string]time.Time{},
+	}
+}
+
+// Mark records the given image digests as removal candidates of the given
+// repository. Digests that were already marked keep their original mark
+// time, and digests that are no longer candidates are unmarked, so that an
+// image needs to remain a candidate in every run to eventually be removed.
+func (s *State) Mark(repo string, digests []string, now time.Time) {
+	oldMarks := s.Marks[repo]
+	newMarks := map[string]time.Time{}
+
+	for _, digest := range digests {
+		if markedAt, ok := oldMarks[digest]; ok {
+			newMarks[digest] = markedAt
+		} else {
+			newMarks[digest] = now
+		}
+	}
+
+	if len(newMarks) == 0 {
+		delete(s.Marks, repo)
+		return
+	}
+
+	s.Marks[repo] = newMarks
+}
+
+// MarkedBefore returns the digests of the given repository that were marked
+// at or before the given time.
+func (s *State) MarkedBefore(repo string, t time.Time) map[string]bool {
+	digests := map[string]bool{}
+
+	for digest, markedAt := range s.Marks[repo] {
+		if !markedAt.After(t) {
+			digests[digest] = true
+		}
+	}
+
+	return digests
+}
+
+// RecordInUse records the given image tags, indexed by repository name, as
+// seen in use at the given time.
+func (s *State) RecordInUse(usedImages map[string][]string, now time.Time) {
+	for repo, tags := range usedImages {
+		if _, ok := s.History[repo]; !ok {
+			s.History[repo] = map[string]time.Time{}
+		}
+
+		for _, tag := range tags {
+			s.History[repo][tag] = now
+		}
+	}
+}
+
+// SeenInUseSince returns the image tags, indexed by repository name, that
+// were seen in use at or after the given time. Older entries are forgotten.
+func (s *State) SeenInUseSince(t time.Time) map[string][]string {
+	usedImages := map[string][]string{}
+
+	for repo, tags := range s.History {
+		for tag, seenAt := range tags {
+			if seenAt.Before(t) {
+				delete(tags, tag)
+				continue
+			}
+
+			usedImages[repo] = append(usedImages[repo], tag)
+		}
+
+		if len(tags) == 0 {
+			delete(s.History, repo)
+			continue
+		}
+
+		sort.Strings(usedImages[repo])
+	}
+
+	return usedImages
+}
+
+// NewFileStore returns a Store backed by the file in the given path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{
+		Path: path,
+	}
+}
+
+// Load reads the state from the file. If the file does not exist, an empty
+// state is returned.
+func (f *FileStore) Load() (*State, error) {
+	data, err := os.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return New(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return Unmarshal(data)
+}
+
+// Save writes the state to the file. The file is replaced atomically, so
+// the previous state is kept intact if the write fails midway.
+func (f *FileStore) Save(s *State) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), filepath.Base(f.Path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// Unmarshal parses the JSON-encoded state, making sure all its fields are
+// initialized.
+func Unmarshal(data []byte) (*State, error) {
+	s := New()
+
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+
+	if s.Marks == nil {
+		s.Marks = map[string]map[string]time.Time{}
+	}
+
+	if s.History == nil {
+		s.History = map[string]map[string]time.Time{}
+	}
+
+	return s, nil
+}
@@ -0,0 +1,108 @@
+package state
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMark(t *testing.T) {
+	t0, t1 := time.Unix(0, 0), time.Unix(1, 0)
+
+	s := New()
+
+	s.Mark("repo", []string{"digest-1", "digest-2"}, t0)
+	s.Mark("repo", []string{"digest-2", "digest-3"}, t1)
+
+	expected := map[string]time.Time{
+		"digest-2": t0,
+		"digest-3": t1,
+	}
+
+	if !reflect.DeepEqual(s.Marks["repo"], expected) {
+		t.Errorf("Expected marks to be %v, but was %v", expected, s.Marks["repo"])
+	}
+
+	s.Mark("repo", []string{}, t1)
+
+	if _, ok := s.Marks["repo"]; ok {
+		t.Errorf("Expected repo marks to be removed, but was %v", s.Marks["repo"])
+	}
+}
+
+func TestMarkedBefore(t *testing.T) {
+	t0, t1, t2 := time.Unix(0, 0), time.Unix(1, 0), time.Unix(2, 0)
+
+	s := New()
+	s.Mark("repo", []string{"digest-1"}, t0)
+	s.Mark("repo", []string{"digest-1", "digest-2"}, t1)
+	s.Mark("repo", []string{"digest-1", "digest-2", "digest-3"}, t2)
+
+	actual := s.MarkedBefore("repo", t1)
+	expected := map[string]bool{
+		"digest-1": true,
+		"digest-2": true,
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected marked digests to be %v, but was %v", expected, actual)
+	}
+
+	if len(s.MarkedBefore("other-repo", t2)) != 0 {
+		t.Errorf("Expected no marked digests for unknown repo")
+	}
+}
+
+func TestSeenInUseSince(t *testing.T) {
+	t0, t1, t2 := time.Unix(0, 0), time.Unix(1, 0), time.Unix(2, 0)
+
+	s := New()
+	s.RecordInUse(map[string][]string{"repo-1": {"tag-1", "tag-2"}, "repo-2": {"tag-1"}}, t0)
+	s.RecordInUse(map[string][]string{"repo-1": {"tag-2", "tag-3"}}, t1)
+	s.RecordInUse(map[string][]string{"repo-1": {"tag-4"}}, t2)
+
+	actual := s.SeenInUseSince(t1)
+	expected := map[string][]string{
+		"repo-1": {"tag-2", "tag-3", "tag-4"},
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected images seen in use to be %v, but was %v", expected, actual)
+	}
+
+	// Entries older than the lookback window are forgotten
+	if _, ok := s.History["repo-2"]; ok {
+		t.Errorf("Expected repo-2 history to be removed, but was %v", s.History["repo-2"])
+	}
+	if _, ok := s.History["repo-1"]["tag-1"]; ok {
+		t.Errorf("Expected tag-1 to be removed from repo-1 history, but it was not")
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+
+	// Missing file results in empty state
+	s, err := store.Load()
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+	if len(s.Marks) != 0 || len(s.History) != 0 {
+		t.Errorf("Expected state to be empty, but was %+v", s)
+	}
+
+	s.Mark("repo", []string{"digest-1"}, time.Unix(0, 0).UTC())
+	s.RecordInUse(map[string][]string{"repo": {"tag-1"}}, time.Unix(0, 0).UTC())
+	if err = store.Save(s); err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+	if !reflect.DeepEqual(loaded, s) {
+		t.Errorf("Expected loaded state to be %+v, but was %+v", s, loaded)
+	}
+}
@@ -1,12 +1,20 @@
 package utils
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/policy"
 )
 
+// Format of retention dates without a time, which retain images until the end
+// of that day.
+const retainUntilDateLayout = "2006-01-02"
+
 // ParseCommaSeparatedList takes a comma-separated string, such as "str1, str2",
 // and returns a list of pointers to each element.
 func ParseCommaSeparatedList(commaSeparatedList string) []*string {
@@ -49,3 +57,115 @@ func ApplyKeepFilters(images []*ecr.ImageDetail, filters []*string) []*ecr.Image
 
 	return filtered
 }
+
+// ApplySignatureFilter takes a list of images and removes those whose digests
+// are among the signed ones.
+func ApplySignatureFilter(images []*ecr.ImageDetail, signed map[string]bool) []*ecr.ImageDetail {
+	filtered := make([]*ecr.ImageDetail, 0)
+
+	for _, image := range images {
+		if image.ImageDigest == nil || !signed[*image.ImageDigest] {
+			filtered = append(filtered, image)
+		}
+	}
+
+	return filtered
+}
+
+// ApplyPolicyFilter takes a list of images and removes those the given policy
+// decisions keep.
+func ApplyPolicyFilter(images []*ecr.ImageDetail, decisions map[string]policy.Decision) []*ecr.ImageDetail {
+	filtered := make([]*ecr.ImageDetail, 0)
+
+	for _, image := range images {
+		if image.ImageDigest == nil || decisions[*image.ImageDigest] != policy.Keep {
+			filtered = append(filtered, image)
+		}
+	}
+
+	return filtered
+}
+
+// ApplyLabelFilters takes a list of images and removes those retained by their
+// labels or annotations, according to RetainingLabels.
+func ApplyLabelFilters(images []*ecr.ImageDetail, metadata map[string]*aws.ImageMetadata, keepLabels, retainUntilLabels []*string, now time.Time) []*ecr.ImageDetail {
+	filtered := make([]*ecr.ImageDetail, 0)
+
+	for _, image := range images {
+		var md *aws.ImageMetadata
+		if image.ImageDigest != nil {
+			md = metadata[*image.ImageDigest]
+		}
+
+		if len(RetainingLabels(md, keepLabels, retainUntilLabels, now)) == 0 {
+			filtered = append(filtered, image)
+		}
+	}
+
+	return filtered
+}
+
+// RetainingLabels returns why an image with the given metadata is retained:
+// it carries a label or annotation matching one of the keep labels, given as
+// "key" or "key=value", or one of the retain-until labels holds a date that
+// has not passed yet. Dates that cannot be parsed also retain the image.
+func RetainingLabels(md *aws.ImageMetadata, keepLabels, retainUntilLabels []*string, now time.Time) []string {
+	reasons := []string{}
+
+	for _, keepLabel := range keepLabels {
+		parts := strings.SplitN(*keepLabel, "=", 2)
+
+		value, ok := md.Lookup(parts[0])
+		if ok && (len(parts) == 1 || parts[1] == value) {
+			reasons = append(reasons, fmt.Sprintf("'%s=%s' matches keep label '%s'", parts[0], value, *keepLabel))
+		}
+	}
+
+	for _, key := range retainUntilLabels {
+		value, ok := md.Lookup(*key)
+		if !ok {
+			continue
+		}
+
+		until, err := parseRetainUntil(value)
+		switch {
+		case err != nil:
+			reasons = append(reasons, fmt.Sprintf("'%s' holds invalid date '%s'", *key, value))
+		case now.Before(until):
+			reasons = append(reasons, fmt.Sprintf("'%s' retains it until %s", *key, value))
+		}
+	}
+
+	return reasons
+}
+
+func parseRetainUntil(value string) (time.Time, error) {
+	if t, err := time.Parse(retainUntilDateLayout, value); err == nil {
+		return t.Add(24 * time.Hour), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// UnprotectedTags returns the tags of the given image that do not match any
+// of the filters.
+func UnprotectedTags(image *ecr.ImageDetail, filters []*string) []*string {
+	tags := []*string{}
+	regs := []*regexp.Regexp{}
+	for _, filter := range filters {
+		if reg, err := regexp.Compile(*filter); err == nil {
+			regs = append(regs, reg)
+		}
+	}
+
+tagsLoop:
+	for _, tag := range image.ImageTags {
+		for _, reg := range regs {
+			if reg.MatchString(*tag) {
+				continue tagsLoop
+			}
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
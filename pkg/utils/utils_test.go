@@ -1,9 +1,14 @@
 package utils
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
+	awssdk "github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/aws"
+	"github.com/danielfm/kube-ecr-cleanup-controller/pkg/policy"
 )
 
 func TestParseCommaSeparatedList(t *testing.T) {
@@ -118,3 +123,165 @@ func TestApplyKeepFilters(t *testing.T) {
 		}
 	}
 }
+
+func TestUnprotectedTags(t *testing.T) {
+	release, build, latest := "v1.4.2", "build-123", "latest"
+	releaseFilter, buildFilter := "^v", "^build-"
+
+	image := &ecr.ImageDetail{
+		ImageTags: []*string{&release, &build, &latest},
+	}
+
+	testCases := []struct {
+		filters  []*string
+		expected []string
+	}{
+		{[]*string{}, []string{release, build, latest}},
+		{[]*string{&releaseFilter}, []string{build, latest}},
+		{[]*string{&releaseFilter, &buildFilter}, []string{latest}},
+	}
+
+	for _, testCase := range testCases {
+		tags := []string{}
+		for _, tag := range UnprotectedTags(image, testCase.filters) {
+			tags = append(tags, *tag)
+		}
+
+		if !reflect.DeepEqual(tags, testCase.expected) {
+			t.Errorf("Expected unprotected tags to be %v, but got %v", testCase.expected, tags)
+		}
+	}
+}
+
+func TestApplySignatureFilter(t *testing.T) {
+	signedDigest, unsignedDigest := "sha256:a1", "sha256:a2"
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest: &signedDigest,
+		},
+		{
+			ImageDigest: &unsignedDigest,
+		},
+	}
+
+	testCases := []struct {
+		signed   map[string]bool
+		expected int
+	}{
+		{
+			signed:   map[string]bool{signedDigest: true},
+			expected: 1,
+		},
+		{
+			signed:   map[string]bool{signedDigest: false},
+			expected: 2,
+		},
+		{
+			signed:   nil,
+			expected: 2,
+		},
+	}
+
+	for _, testCase := range testCases {
+		filtered := ApplySignatureFilter(images, testCase.signed)
+
+		if len(filtered) != testCase.expected {
+			t.Errorf("Expected %d images after filtering by %v, but was %d", testCase.expected, testCase.signed, len(filtered))
+		}
+	}
+}
+
+func TestApplyPolicyFilter(t *testing.T) {
+	keptDigest, deletedDigest, otherDigest := "sha256:a1", "sha256:a2", "sha256:a3"
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest: &keptDigest,
+		},
+		{
+			ImageDigest: &deletedDigest,
+		},
+		{
+			ImageDigest: &otherDigest,
+		},
+	}
+
+	testCases := []struct {
+		decisions map[string]policy.Decision
+		expected  int
+	}{
+		{
+			decisions: map[string]policy.Decision{keptDigest: policy.Keep, deletedDigest: policy.Delete},
+			expected:  2,
+		},
+		{
+			decisions: map[string]policy.Decision{deletedDigest: policy.Delete},
+			expected:  3,
+		},
+		{
+			decisions: nil,
+			expected:  3,
+		},
+	}
+
+	for _, testCase := range testCases {
+		filtered := ApplyPolicyFilter(images, testCase.decisions)
+
+		if len(filtered) != testCase.expected {
+			t.Errorf("Expected %d images after filtering by %v, but was %d", testCase.expected, testCase.decisions, len(filtered))
+		}
+	}
+}
+
+func TestRetainingLabels(t *testing.T) {
+	now := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	keepLabels := []*string{awssdk.String("org.opencontainers.image.source"), awssdk.String("keep=true")}
+	retainUntilLabels := []*string{awssdk.String("retain-until")}
+
+	testCases := []struct {
+		md       *aws.ImageMetadata
+		expected int
+	}{
+		{&aws.ImageMetadata{Labels: map[string]string{"org.opencontainers.image.source": "https://example.com"}}, 1},
+		{&aws.ImageMetadata{Annotations: map[string]string{"keep": "true"}}, 1},
+		{&aws.ImageMetadata{Labels: map[string]string{"keep": "false"}}, 0},
+		{&aws.ImageMetadata{Labels: map[string]string{"retain-until": "2020-01-02"}}, 1},
+		{&aws.ImageMetadata{Labels: map[string]string{"retain-until": "2020-01-01"}}, 0},
+		{&aws.ImageMetadata{Labels: map[string]string{"retain-until": "2020-01-02T13:00:00Z"}}, 1},
+		{&aws.ImageMetadata{Labels: map[string]string{"retain-until": "2020-01-02T11:00:00Z"}}, 0},
+		{&aws.ImageMetadata{Labels: map[string]string{"retain-until": "someday"}}, 1},
+		{&aws.ImageMetadata{Labels: map[string]string{"keep": "true", "retain-until": "2021-01-01"}}, 2},
+		{nil, 0},
+	}
+
+	for _, testCase := range testCases {
+		reasons := RetainingLabels(testCase.md, keepLabels, retainUntilLabels, now)
+
+		if len(reasons) != testCase.expected {
+			t.Errorf("Expected %d reasons to retain %+v, but was %q", testCase.expected, testCase.md, reasons)
+		}
+	}
+}
+
+func TestApplyLabelFilters(t *testing.T) {
+	now := time.Now()
+	keptDigest, unlabeledDigest, removedDigest := "sha256:a1", "sha256:a2", "sha256:a3"
+
+	images := []*ecr.ImageDetail{
+		{ImageDigest: &keptDigest},
+		{ImageDigest: &unlabeledDigest},
+		{ImageDigest: &removedDigest},
+	}
+
+	metadata := map[string]*aws.ImageMetadata{
+		keptDigest:    {Labels: map[string]string{"keep": "true"}},
+		removedDigest: {Labels: map[string]string{"keep": "false"}},
+	}
+
+	filtered := ApplyLabelFilters(images, metadata, []*string{awssdk.String("keep=true")}, nil, now)
+
+	if len(filtered) != 2 || *filtered[0].ImageDigest != unlabeledDigest || *filtered[1].ImageDigest != removedDigest {
+		t.Errorf("Expected only %s to be retained, but was left with %v", keptDigest, filtered)
+	}
+}